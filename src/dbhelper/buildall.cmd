@@ -1,8 +1,13 @@
-go build dvdbaas.go 
+go build ocdbaas.go ocdbaasformat.go ocdbaascheck.go ocdbaasscram.go ocdbaasmongo.go dvnettls.go
 go build dvdescription.go
-go build dvnetwork.go
-go build dvenvironment.go
-go build m2mtoken.go
+go build dvnetwork.go dvnetassert.go dvnetreport.go dvnetextract.go dvnetload.go dvnetcurl.go dvnetbody.go dvnettls.go
+go build dvenvironment.go dvsecretcrypt.go
+go build m2mtoken.go m2mtokencache.go m2mtokeninspect.go dvnettls.go
 go build m2mcredentials.go
+go build dvoidc.go dvoidctoken.go dvoidcserver.go
+go build dvsecret.go dvsecretexport.go dvsecretrestore.go dvsecretcrypt.go
+go build gitinfo.go gitinforead.go gitinfostamp.go gitinfoartifact.go
+go build dvreaddcparams.go dvreaddcenv.go dvreaddcworkload.go dvreaddchelm.go dvreaddcoffline.go dvreaddcdrift.go
+go build sleep.go sleepcondition.go sleepcmd_windows.go dvnettls.go
 
 
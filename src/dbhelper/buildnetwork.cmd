@@ -1 +1 @@
-go build dvnetwork.go
+go build dvnetwork.go dvnetassert.go dvnetreport.go dvnetextract.go dvnetload.go dvnetcurl.go dvnetbody.go dvnettls.go
@@ -3,45 +3,726 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"github.com/Dobryvechir/dvserver/src/dvparser"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 )
 
 var copyright = "Copyright by Danyil Dobryvechir 2019"
 
-func main() {
-	args := dvparser.InitAndReadCommandLine()
+var helpDvEnvironment = copyright + "\ndvenvironment [options] newTextFileName oldTextFileName newTextFileName1 oldTextFileName1 ...\n" +
+	"dvenvironment --dir [options] sourceFolder destinationFolder\n" +
+	"options:\n" +
+	"  --strict           fail with the list of all unresolved placeholders before writing anything\n" +
+	"  --preview          show the difference between the existing and the rendered files without writing\n" +
+	"  --report[=file]    list the used properties, the unset ones and the unused keys of the properties file\n" +
+	"directory options:\n" +
+	"  --include=masks    comma-separated file masks to render (default - all files)\n" +
+	"  --exclude=masks    comma-separated file masks to skip\n" +
+	"  --overlay=name     per-folder properties overlay file name (default - " + defaultOverlayFileName + ")\n" +
+	"  --delete           delete destination files which are no longer present in the source\n" +
+	"secrets saved by dvsecret are referenced as {{{secret:<microservice>/<key>}}}, they are read from SECRET_PATH\n" +
+	"and <key>.enc files are decrypted by the private key SECRET_DECRYPT_KEY in DVSERVER_DVCRYPT_KEY_FOLDER"
+
+const (
+	diffContextLines        = 3
+	diffMaxEdits            = 1000
+	defaultRenderedFileMode = 0664
+	defaultOverlayFileName  = "dvenvironment.properties"
+	binaryProbeSize         = 8000
+	secretPrefix            = "secret:"
+	secretVariablePrefix    = "DVENVIRONMENT_SECRET_"
+	secretMask              = "******"
+)
+
+var secretPlaceholderRegexp = regexp.MustCompile(`\{\{\{\s*secret:([^{}\s]+)\s*\}\}\}`)
+
+var resolvedSecrets = make(map[string]string)
+
+type placeholderRef struct {
+	name     string
+	fileName string
+	line     int
+	resolved bool
+}
+
+type environmentOptions struct {
+	strict      bool
+	preview     bool
+	report      bool
+	reportFile  string
+	dir         bool
+	include     []string
+	exclude     []string
+	overlay     string
+	deleteStale bool
+}
+
+type renderJob struct {
+	src        string
+	dst        string
+	properties map[string]string
+	binary     bool
+	secrets    map[string]string
+	mode       os.FileMode
+	sourceMode bool
+}
+
+var usedPlaceholders = make(map[string][]*placeholderRef)
+
+func readEnvironmentOptions(args []string) (options *environmentOptions, rest []string) {
+	options = &environmentOptions{overlay: defaultOverlayFileName}
 	l := len(args)
-	if l < 1 {
-		fmt.Println(copyright)
-		fmt.Println("dvenvironment newTextFileName oldTextFileName newTextFileName1 oldTextFileName1 ...")
+	i := 0
+	for ; i < l && strings.HasPrefix(args[i], "--"); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--strict":
+			options.strict = true
+		case arg == "--preview":
+			options.preview = true
+		case arg == "--report":
+			options.report = true
+		case strings.HasPrefix(arg, "--report="):
+			options.report = true
+			options.reportFile = arg[len("--report="):]
+		case arg == "--dir":
+			options.dir = true
+		case strings.HasPrefix(arg, "--include="):
+			options.include = dvparser.ConvertToNonEmptyList(arg[len("--include="):])
+		case strings.HasPrefix(arg, "--exclude="):
+			options.exclude = dvparser.ConvertToNonEmptyList(arg[len("--exclude="):])
+		case strings.HasPrefix(arg, "--overlay="):
+			options.overlay = arg[len("--overlay="):]
+		case arg == "--delete":
+			options.deleteStale = true
+		default:
+			fmt.Printf("Unknown option %s\n", arg)
+			fmt.Println(helpDvEnvironment)
+			os.Exit(1)
+		}
+	}
+	rest = args[i:]
+	return
+}
+
+func isPropertyName(s string) bool {
+	n := len(s)
+	if n == 0 {
+		return false
+	}
+	for i := 0; i < n; i++ {
+		c := s[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c >= '0' && c <= '9' && i > 0 || c == '.' && i > 0) {
+			return false
+		}
+	}
+	return true
+}
+
+func collectPlaceholders(data []byte, fileName string) []*placeholderRef {
+	res := make([]*placeholderRef, 0, 16)
+	line := 1
+	l := len(data)
+	for i := 0; i < l; i++ {
+		c := data[i]
+		if c == 10 {
+			line++
+			continue
+		}
+		if c != '{' {
+			continue
+		}
+		start := i
+		for i < l && data[i] == '{' {
+			i++
+		}
+		sequence := i - start
+		if sequence < 3 {
+			i--
+			continue
+		}
+		end := bytes.Index(data[i:], bytes.Repeat([]byte{'}'}, sequence))
+		if end < 0 {
+			break
+		}
+		name := strings.TrimSpace(string(data[i : i+end]))
+		if isPropertyName(name) || strings.HasPrefix(name, secretPrefix) && len(name) > len(secretPrefix) {
+			res = append(res, &placeholderRef{name: name, fileName: fileName, line: line})
+		}
+		line += bytes.Count(data[i:i+end], []byte{10})
+		i += end + sequence - 1
+	}
+	return res
+}
+
+func registerPlaceholders(job *renderJob) []*placeholderRef {
+	data, err := ioutil.ReadFile(job.src)
+	if err != nil {
+		fmt.Printf("Error reading %s: %v\n", job.src, err)
+		os.Exit(1)
+	}
+	refs := collectPlaceholders(data, job.src)
+	unresolved := make([]*placeholderRef, 0, len(refs))
+	for _, ref := range refs {
+		if strings.HasPrefix(ref.name, secretPrefix) {
+			_, err = resolveSecret(ref.name[len(secretPrefix):])
+			ref.resolved = err == nil
+		} else {
+			_, ref.resolved = job.properties[ref.name]
+		}
+		if !ref.resolved {
+			unresolved = append(unresolved, ref)
+		}
+		usedPlaceholders[ref.name] = append(usedPlaceholders[ref.name], ref)
+	}
+	return unresolved
+}
+
+const (
+	secretPathProperty       = "SECRET_PATH"
+	secretDecryptKeyProperty = "SECRET_DECRYPT_KEY"
+)
+
+// resolveSecret reads <microservice>/<key> from the dvsecret folder layout, the value is never logged
+func resolveSecret(reference string) (string, error) {
+	if value, ok := resolvedSecrets[reference]; ok {
+		return value, nil
+	}
+	folder := dvparser.GlobalProperties[secretPathProperty]
+	if folder == "" {
+		return "", fmt.Errorf("%s is not defined for secret %s", secretPathProperty, reference)
+	}
+	p := strings.LastIndex(reference, "/")
+	if p <= 0 || p == len(reference)-1 || strings.Contains(reference, "..") {
+		return "", fmt.Errorf("secret %s must be specified as <microservice>/<key>", reference)
+	}
+	fileName := filepath.Join(folder, filepath.FromSlash(reference))
+	data, err := ioutil.ReadFile(fileName)
+	if err == nil {
+		resolvedSecrets[reference] = string(data)
+		return string(data), nil
+	}
+	if !os.IsNotExist(err) {
+		return "", fmt.Errorf("cannot read secret %s: %v", reference, err)
+	}
+	data, err = ioutil.ReadFile(fileName + encryptedSecretSuffix)
+	if err != nil {
+		return "", fmt.Errorf("secret %s is not found in %s", reference, folder)
+	}
+	key := dvparser.GlobalProperties[secretDecryptKeyProperty]
+	if key == "" {
+		return "", fmt.Errorf("secret %s is encrypted but %s is not defined", reference, secretDecryptKeyProperty)
+	}
+	decrypted, err := decryptSecretData(key, string(data))
+	if err != nil {
+		return "", fmt.Errorf("cannot decrypt secret %s: %v", reference, err)
+	}
+	value := string(decrypted)
+	resolvedSecrets[reference] = value
+	return value, nil
+}
+
+// substituteSecrets replaces secret placeholders by internal variables, so that the values never appear in the template
+func substituteSecrets(data []byte, properties map[string]string) ([]byte, map[string]string, error) {
+	secrets := make(map[string]string)
+	var err error
+	count := 0
+	data = secretPlaceholderRegexp.ReplaceAllFunc(data, func(placeholder []byte) []byte {
+		reference := string(secretPlaceholderRegexp.FindSubmatch(placeholder)[1])
+		value, err1 := resolveSecret(reference)
+		if err1 != nil {
+			if err == nil {
+				err = err1
+			}
+			return placeholder
+		}
+		count++
+		name := secretVariablePrefix + strconv.Itoa(count)
+		properties[name] = value
+		secrets[reference] = value
+		return []byte("{{{" + name + "}}}")
+	})
+	return data, secrets, err
+}
+
+func maskSecrets(data []byte, secrets map[string]string) []byte {
+	for reference, value := range secrets {
+		if value != "" {
+			data = bytes.Replace(data, []byte(value), []byte(secretMask+secretPrefix+reference+secretMask), -1)
+		}
+	}
+	return data
+}
+
+func readSimpleProperties(fileName string) (keys []string, values map[string]string, err error) {
+	file, err := os.Open(fileName)
+	if err != nil {
 		return
 	}
-	n := l / 2
-	if l&1 != 0 {
-		os.MkdirAll(args[l-1], os.ModePerm)
+	defer file.Close()
+	keys = make([]string, 0, 32)
+	values = make(map[string]string)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		s := strings.TrimSpace(scanner.Text())
+		if s == "" || s[0] == '#' || strings.Contains(s, "{{") {
+			continue
+		}
+		p := strings.Index(s, "=")
+		if p <= 0 {
+			continue
+		}
+		key := strings.TrimSpace(s[:p])
+		keys = append(keys, key)
+		values[key] = strings.TrimSpace(s[p+1:])
+	}
+	err = scanner.Err()
+	return
+}
+
+func isResolvedSomewhere(refs []*placeholderRef) bool {
+	for _, ref := range refs {
+		if ref.resolved {
+			return true
+		}
+	}
+	return false
+}
+
+func presentPropertyReport(reportFile string) {
+	names := make([]string, 0, len(usedPlaceholders))
+	for name := range usedPlaceholders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	buf.WriteString("Used properties:\n")
+	unset := ""
+	for _, name := range names {
+		refs := usedPlaceholders[name]
+		state := "set"
+		if !isResolvedSomewhere(refs) {
+			state = "UNSET"
+			unset += " " + name
+		}
+		buf.WriteString(fmt.Sprintf("  %s (%s, %d times, first at %s:%d)\n", name, state, len(refs), refs[0].fileName, refs[0].line))
+	}
+	if unset != "" {
+		buf.WriteString("Unset properties:" + unset + "\n")
+	}
+	propertiesFile := dvparser.DvServerPropertiesInCurrentFolderFileName
+	keys, _, _ := readSimpleProperties(propertiesFile)
+	unused := ""
+	for _, key := range keys {
+		if _, ok := usedPlaceholders[key]; !ok && key != secretPathProperty && key != secretDecryptKeyProperty {
+			unused += " " + key
+		}
+	}
+	if unused != "" {
+		buf.WriteString("Unused keys in " + propertiesFile + ":" + unused + "\n")
+	}
+	if reportFile == "" {
+		fmt.Print(buf.String())
+		return
+	}
+	err := ioutil.WriteFile(reportFile, buf.Bytes(), 0664)
+	if err != nil {
+		fmt.Printf("Cannot write report %s: %v\n", reportFile, err)
+		os.Exit(1)
+	}
+}
+
+func splitLines(data []byte) []string {
+	s := strings.Replace(string(data), "\r\n", "\n", -1)
+	if s == "" {
+		return nil
+	}
+	return strings.Split(strings.TrimSuffix(s, "\n"), "\n")
+}
+
+// diffLines returns the edit script between old and new lines as lines prefixed by ' ', '-' or '+',
+// the common beginning and end are trimmed and the rest is compared by the Myers algorithm
+func diffLines(oldLines []string, newLines []string) []string {
+	prefix := 0
+	for prefix < len(oldLines) && prefix < len(newLines) && oldLines[prefix] == newLines[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(oldLines)-prefix && suffix < len(newLines)-prefix && oldLines[len(oldLines)-1-suffix] == newLines[len(newLines)-1-suffix] {
+		suffix++
+	}
+	res := make([]string, 0, len(oldLines)+len(newLines))
+	for _, line := range oldLines[:prefix] {
+		res = append(res, " "+line)
+	}
+	res = appendMyersDiff(res, oldLines[prefix:len(oldLines)-suffix], newLines[prefix:len(newLines)-suffix])
+	for _, line := range oldLines[len(oldLines)-suffix:] {
+		res = append(res, " "+line)
+	}
+	return res
+}
+
+// appendMyersDiff keeps only the diagonals -d..d of every step, so the memory is the square of the number of edits;
+// beyond diffMaxEdits the lines are shown as replaced completely
+func appendMyersDiff(res []string, a []string, b []string) []string {
+	n, m := len(a), len(b)
+	trace := make([][]int, 0, 16)
+	for d := 0; d <= n+m && d <= diffMaxEdits; d++ {
+		v := make([]int, 2*d+1)
+		for k := -d; k <= d; k += 2 {
+			x := 0
+			if d > 0 {
+				prev := trace[d-1]
+				if k == -d || (k != d && prev[k-1+d-1] < prev[k+1+d-1]) {
+					x = prev[k+1+d-1]
+				} else {
+					x = prev[k-1+d-1] + 1
+				}
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[k+d] = x
+			if x >= n && y >= m {
+				return append(res, backtrackMyersDiff(append(trace, v), a, b)...)
+			}
+		}
+		trace = append(trace, v)
+	}
+	for _, line := range a {
+		res = append(res, "-"+line)
+	}
+	for _, line := range b {
+		res = append(res, "+"+line)
+	}
+	return res
+}
+
+func backtrackMyersDiff(trace [][]int, a []string, b []string) []string {
+	x, y := len(a), len(b)
+	script := make([]string, 0, x+y)
+	for d := len(trace) - 1; d > 0; d-- {
+		prev := trace[d-1]
+		k := x - y
+		prevK := k - 1
+		if k == -d || (k != d && prev[k-1+d-1] < prev[k+1+d-1]) {
+			prevK = k + 1
+		}
+		prevX := prev[prevK+d-1]
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			script = append(script, " "+a[x-1])
+			x--
+			y--
+		}
+		if x == prevX {
+			script = append(script, "+"+b[y-1])
+			y--
+		} else {
+			script = append(script, "-"+a[x-1])
+			x--
+		}
+	}
+	for x > 0 && y > 0 {
+		script = append(script, " "+a[x-1])
+		x--
+		y--
+	}
+	for i, j := 0, len(script)-1; i < j; i, j = i+1, j-1 {
+		script[i], script[j] = script[j], script[i]
+	}
+	return script
+}
+
+func presentDiff(dst string, src string, data []byte, secrets map[string]string) {
+	old, err := ioutil.ReadFile(dst)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Printf("Cannot read %s: %v\n", dst, err)
+		os.Exit(1)
+	}
+	script := diffLines(splitLines(maskSecrets(old, secrets)), splitLines(maskSecrets(data, secrets)))
+	n := len(script)
+	changed := make([]bool, n)
+	anyChange := false
+	for i := 0; i < n; i++ {
+		if script[i][0] != ' ' {
+			for k := i - diffContextLines; k <= i+diffContextLines; k++ {
+				if k >= 0 && k < n {
+					changed[k] = true
+				}
+			}
+			anyChange = true
+		}
+	}
+	if !anyChange {
+		fmt.Printf("No changes in %s\n", dst)
+		return
+	}
+	fmt.Printf("--- %s\n+++ %s (rendered)\n", dst, src)
+	for i := 0; i < n; i++ {
+		if changed[i] {
+			fmt.Println(script[i])
+		} else if i > 0 && changed[i-1] {
+			fmt.Println("@@")
+		}
+	}
+}
+
+func matchesAnyMask(relPath string, masks []string) bool {
+	base := filepath.Base(relPath)
+	for _, mask := range masks {
+		if ok, _ := filepath.Match(mask, base); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(mask, relPath); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func isSelectedByMasks(relPath string, options *environmentOptions) bool {
+	if len(options.include) > 0 && !matchesAnyMask(relPath, options.include) {
+		return false
+	}
+	return !matchesAnyMask(relPath, options.exclude)
+}
+
+func isBinaryFile(fileName string) bool {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	buf := make([]byte, binaryProbeSize)
+	n, _ := file.Read(buf)
+	return bytes.IndexByte(buf[:n], 0) >= 0
+}
+
+func mergeOverlay(folder string, properties map[string]string, overlay string) map[string]string {
+	if overlay == "" {
+		return properties
+	}
+	overlayFile := filepath.Join(folder, overlay)
+	keys, values, err := readSimpleProperties(overlayFile)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			fmt.Printf("Error reading overlay %s: %v\n", overlayFile, err)
+			os.Exit(1)
+		}
+		return properties
+	}
+	res := dvparser.CopyStringMap(properties)
+	for _, key := range keys {
+		res[key] = values[key]
+	}
+	return res
+}
+
+func collectDirectoryJobs(srcDir string, dstDir string, relDir string, properties map[string]string, options *environmentOptions, jobs []*renderJob) []*renderJob {
+	folder := filepath.Join(srcDir, relDir)
+	properties = mergeOverlay(folder, properties, options.overlay)
+	items, err := ioutil.ReadDir(folder)
+	if err != nil {
+		fmt.Printf("Error reading folder %s: %v\n", folder, err)
+		os.Exit(1)
+	}
+	for _, item := range items {
+		name := item.Name()
+		relPath := filepath.ToSlash(filepath.Join(relDir, name))
+		if item.IsDir() {
+			if !matchesAnyMask(relPath, options.exclude) {
+				jobs = collectDirectoryJobs(srcDir, dstDir, relPath, properties, options, jobs)
+			}
+			continue
+		}
+		if name == options.overlay || !isSelectedByMasks(relPath, options) {
+			continue
+		}
+		src := filepath.Join(srcDir, relPath)
+		jobs = append(jobs, &renderJob{
+			src:        src,
+			dst:        filepath.Join(dstDir, relPath),
+			properties: properties,
+			binary:     isBinaryFile(src),
+			mode:       item.Mode().Perm(),
+			sourceMode: true,
+		})
+	}
+	return jobs
+}
+
+func findStaleFiles(dstDir string, jobs []*renderJob, options *environmentOptions) []string {
+	expected := make(map[string]bool, len(jobs))
+	for _, job := range jobs {
+		expected[filepath.Clean(job.dst)] = true
+	}
+	stale := make([]string, 0, 16)
+	filepath.Walk(dstDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		relPath, err := filepath.Rel(dstDir, path)
+		if err != nil {
+			return nil
+		}
+		relPath = filepath.ToSlash(relPath)
+		if info.IsDir() {
+			// the excluded folders are not rendered, so their files are not stale
+			if relPath != "." && matchesAnyMask(relPath, options.exclude) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !expected[filepath.Clean(path)] && isSelectedByMasks(relPath, options) && filepath.Base(path) != options.overlay {
+			stale = append(stale, path)
+		}
+		return nil
+	})
+	return stale
+}
+
+func renderFile(job *renderJob) ([]byte, error) {
+	if job.binary {
+		return ioutil.ReadFile(job.src)
+	}
+	data, err := ioutil.ReadFile(job.src)
+	if err != nil {
+		return nil, err
+	}
+	properties := dvparser.CopyStringMap(job.properties)
+	data, job.secrets, err = substituteSecrets(data, properties)
+	if err != nil {
+		return nil, err
+	}
+	sourceName, err := filepath.Abs(job.src)
+	if err != nil {
+		sourceName = job.src
+	}
+	configInfo := &dvparser.ConfigInfo{
+		InputMap:         properties,
+		OutputMap:        make(map[string]string),
+		NumberOfBrackets: 3,
+		Options:          dvparser.CONFIG_IS_NOT_VARIABLES,
+		FilePaths:        dvparser.GeneralFilePaths,
+	}
+	dvparser.LinearSmartConfigParse(data, configInfo, sourceName)
+	if configInfo.Err != nil {
+		return nil, configInfo.Err
+	}
+	return bytes.Join(configInfo.OutputLines, []byte{10}), nil
+}
+
+// writeRenderedFile keeps the source mode in the directory mode, so that the rendered scripts keep the exec bit;
+// the mode of an existing file is not changed by WriteFile
+func writeRenderedFile(job *renderJob, data []byte) error {
+	err := ioutil.WriteFile(job.dst, data, job.mode)
+	if err == nil && job.sourceMode {
+		err = os.Chmod(job.dst, job.mode)
 	}
+	return err
+}
+
+func collectPairJobs(args []string) []*renderJob {
+	n := len(args) / 2
+	jobs := make([]*renderJob, n)
 	for i := 0; i < n; i++ {
 		src := args[i<<1]
 		dst := args[i<<1|1]
 		if src == "" || dst == "" {
-			panic("Pair " + strconv.Itoa(i+1) + " is not defined (" + src + "," + dst + ")")
+			fmt.Printf("Pair %d is not defined (%s,%s)\n", i+1, src, dst)
+			os.Exit(1)
+		}
+		jobs[i] = &renderJob{src: src, dst: dst, properties: dvparser.GlobalProperties, mode: defaultRenderedFileMode}
+	}
+	return jobs
+}
+
+func main() {
+	args := dvparser.InitAndReadCommandLine()
+	options, args := readEnvironmentOptions(args)
+	l := len(args)
+	if l < 1 || options.dir && l != 2 {
+		fmt.Println(helpDvEnvironment)
+		return
+	}
+	var jobs []*renderJob
+	if options.dir {
+		if info, err := os.Stat(args[0]); err != nil || !info.IsDir() {
+			fmt.Printf("Source folder %s does not exist\n", args[0])
+			os.Exit(1)
 		}
-		data, err := dvparser.ConvertFileByGlobalProperties(src)
+		jobs = collectDirectoryJobs(args[0], args[1], "", dvparser.GlobalProperties, options, nil)
+	} else {
+		jobs = collectPairJobs(args)
+	}
+	if options.strict || options.report {
+		unresolved := make([]*placeholderRef, 0, 16)
+		for _, job := range jobs {
+			if !job.binary {
+				unresolved = append(unresolved, registerPlaceholders(job)...)
+			}
+		}
+		if options.report {
+			presentPropertyReport(options.reportFile)
+		}
+		if options.strict && len(unresolved) > 0 {
+			fmt.Printf("%d unresolved placeholders:\n", len(unresolved))
+			for _, ref := range unresolved {
+				fmt.Printf("%s:%d: %s\n", ref.fileName, ref.line, ref.name)
+			}
+			os.Exit(1)
+		}
+	}
+	if !options.dir && l&1 != 0 && !options.preview {
+		os.MkdirAll(args[l-1], os.ModePerm)
+	}
+	for _, job := range jobs {
+		data, err := renderFile(job)
 		if err != nil {
-			panic("Error: " + err.Error())
+			fmt.Printf("Error in %s: %v\n", job.src, err)
+			os.Exit(1)
+		}
+		if options.preview {
+			if job.binary {
+				fmt.Printf("Binary file %s will be copied to %s\n", job.src, job.dst)
+			} else {
+				presentDiff(job.dst, job.src, data, job.secrets)
+			}
+			continue
 		}
-		dir := filepath.Dir(dst)
+		dir := filepath.Dir(job.dst)
 		if dir != "" && dir != "." {
 			os.MkdirAll(dir, os.ModePerm)
 		}
-		err = ioutil.WriteFile(dst, data, 0664)
-		if err != nil {
-			panic("Error: " + err.Error())
+		if err = writeRenderedFile(job, data); err != nil {
+			fmt.Printf("Error writing %s: %v\n", job.dst, err)
+			os.Exit(1)
+		}
+	}
+	if options.dir && options.deleteStale {
+		for _, stale := range findStaleFiles(args[1], jobs, options) {
+			if options.preview {
+				fmt.Printf("Stale file %s will be deleted\n", stale)
+				continue
+			}
+			err := os.Remove(stale)
+			if err != nil {
+				fmt.Printf("Cannot delete %s: %v\n", stale, err)
+				os.Exit(1)
+			}
+			fmt.Printf("Deleted %s\n", stale)
 		}
 	}
 }
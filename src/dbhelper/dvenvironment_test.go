@@ -0,0 +1,125 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/Dobryvechir/dvserver/src/dvparser"
+)
+
+// useTestSecretFolder points SECRET_PATH and SECRET_DECRYPT_KEY to a temporary folder and the private test key
+func useTestSecretFolder(t *testing.T) string {
+	useTestSecretKeys(t)
+	folder := t.TempDir()
+	saved := dvparser.GlobalProperties
+	dvparser.GlobalProperties = map[string]string{secretPathProperty: folder, secretDecryptKeyProperty: "private"}
+	resolvedSecrets = make(map[string]string)
+	t.Cleanup(func() {
+		dvparser.GlobalProperties = saved
+		resolvedSecrets = make(map[string]string)
+	})
+	return folder
+}
+
+// writeTestSecret saves the secret key as dvsecret --encrypt does
+func writeTestSecret(t *testing.T, folder string, reference string, value string) {
+	data, err := encryptSecretData("public", []byte(value))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fileName := filepath.Join(folder, filepath.FromSlash(reference)) + encryptedSecretSuffix
+	if err = os.MkdirAll(filepath.Dir(fileName), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(fileName, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResolveEncryptedSecret(t *testing.T) {
+	folder := useTestSecretFolder(t)
+	certificate := "-----BEGIN CERTIFICATE-----\n" + strings.Repeat("MIIDdzCCAl+gAwIBAgIEAgAAuTANBgkqhkiG9w0BAQUFADBaMQswCQYDVQQGEwJJ\n", 40) +
+		"-----END CERTIFICATE-----\n"
+	values := map[string]string{"payment-service/client_secret": "f2c1e9a4-77b0", "payment-service/ca.crt": certificate}
+	for reference, value := range values {
+		writeTestSecret(t, folder, reference, value)
+	}
+	for reference, expected := range values {
+		if value, err := resolveSecret(reference); err != nil || value != expected {
+			t.Errorf("%s is resolved as %q: %v", reference, value, err)
+		}
+	}
+	if _, err := resolveSecret("payment-service/missing"); err == nil {
+		t.Error("the missing secret is resolved")
+	}
+}
+
+func writeTestFiles(t *testing.T, folder string, names ...string) {
+	for _, name := range names {
+		fileName := filepath.Join(folder, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(fileName, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestFindStaleFilesSkipsExcludedFolders(t *testing.T) {
+	src := t.TempDir()
+	dst := t.TempDir()
+	writeTestFiles(t, src, "app.yaml", "config/db.yaml", "generated/keep.yaml")
+	writeTestFiles(t, dst, "app.yaml", "old.yaml", "config/db.yaml", "config/old.yaml", "generated/keep.yaml", "generated/other.yaml",
+		"config/generated/nested.yaml", defaultOverlayFileName)
+	options := &environmentOptions{exclude: []string{"generated"}, overlay: defaultOverlayFileName}
+	jobs := collectDirectoryJobs(src, dst, "", map[string]string{}, options, nil)
+	if len(jobs) != 2 {
+		t.Fatalf("%d files are rendered instead of 2", len(jobs))
+	}
+	stale := findStaleFiles(dst, jobs, options)
+	expected := []string{filepath.Join(dst, "config", "old.yaml"), filepath.Join(dst, "old.yaml")}
+	if !reflect.DeepEqual(stale, expected) {
+		t.Errorf("stale files %v instead of %v", stale, expected)
+	}
+}
+
+func TestWriteRenderedFileMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the exec bit is not kept on windows")
+	}
+	src := t.TempDir()
+	dst := t.TempDir()
+	writeTestFiles(t, src, "run.sh")
+	if err := os.Chmod(filepath.Join(src, "run.sh"), 0750); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFiles(t, dst, "run.sh", "pair.sh")
+	if err := os.Chmod(filepath.Join(dst, "pair.sh"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	jobs := collectDirectoryJobs(src, dst, "", map[string]string{}, &environmentOptions{}, nil)
+	jobs = append(jobs, collectPairJobs([]string{filepath.Join(src, "run.sh"), filepath.Join(dst, "pair.sh")})...)
+	for _, job := range jobs {
+		if err := writeRenderedFile(job, []byte("echo")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the directory mode takes the source mode, the pair mode keeps the mode of the existing file
+	for name, expected := range map[string]os.FileMode{"run.sh": 0750, "pair.sh": 0700} {
+		info, err := os.Stat(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != expected {
+			t.Errorf("%s has mode %v instead of %v", name, info.Mode().Perm(), expected)
+		}
+	}
+}
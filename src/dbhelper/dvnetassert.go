@@ -0,0 +1,255 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	assertSubjectStatus = "status"
+	assertSubjectTime   = "time"
+	assertSubjectBody   = "body"
+	assertSubjectHeader = "header:"
+	assertSubjectJson   = "json:"
+)
+
+// the longer operators go first, so that <= is not taken for <
+var netAssertionOperators = []string{"==", "!=", "<=", ">=", "!~", "~", "<", ">"}
+
+type netAssertion struct {
+	Source   string
+	Subject  string
+	Operator string
+	Expected string
+	regexp   *regexp.Regexp
+}
+
+func parseNetAssertion(source string) (*netAssertion, error) {
+	s := strings.TrimSpace(source)
+	a := &netAssertion{Source: s, Subject: s}
+	for i := 0; i < len(s) && a.Operator == ""; i++ {
+		for _, op := range netAssertionOperators {
+			if strings.HasPrefix(s[i:], op) {
+				a.Subject = strings.TrimSpace(s[:i])
+				a.Operator = op
+				a.Expected = strings.TrimSpace(s[i+len(op):])
+				break
+			}
+		}
+	}
+	if a.Subject == "" {
+		return nil, errors.New("subject is not specified")
+	}
+	switch {
+	case a.Subject == assertSubjectStatus, a.Subject == assertSubjectTime, a.Subject == assertSubjectBody:
+	case strings.HasPrefix(a.Subject, assertSubjectHeader) && len(a.Subject) > len(assertSubjectHeader):
+	case strings.HasPrefix(a.Subject, assertSubjectJson) && len(a.Subject) > len(assertSubjectJson):
+	default:
+		return nil, fmt.Errorf("unknown subject %s, it must be status, time, body, header:<name> or json:<path>", a.Subject)
+	}
+	if a.Operator == "~" || a.Operator == "!~" {
+		var err error
+		if a.regexp, err = regexp.Compile(a.Expected); err != nil {
+			return nil, err
+		}
+	}
+	return a, nil
+}
+
+func isStatusAsserted(assertions []*netAssertion, statusCode int) bool {
+	for _, a := range assertions {
+		if a.Subject == assertSubjectStatus && a.Operator != "" && a.Operator != "!=" && a.Operator != "!~" {
+			if a.check(strconv.Itoa(statusCode), true) == "" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func checkAssertions(assertions []*netAssertion, result *netResult) []string {
+	var failures []string
+	var document interface{}
+	var documentErr error
+	documentRead := false
+	for _, a := range assertions {
+		var actual string
+		present := true
+		switch {
+		case a.Subject == assertSubjectStatus:
+			actual = strconv.Itoa(result.StatusCode)
+		case a.Subject == assertSubjectTime:
+			actual = strconv.FormatInt(result.Duration.Milliseconds(), 10)
+		case a.Subject == assertSubjectBody:
+			actual = string(result.Body)
+		case strings.HasPrefix(a.Subject, assertSubjectHeader):
+			name := a.Subject[len(assertSubjectHeader):]
+			values := result.Headers.Values(name)
+			present = len(values) > 0
+			actual = strings.Join(values, ", ")
+		case strings.HasPrefix(a.Subject, assertSubjectJson):
+			if !documentRead {
+				documentRead = true
+				documentErr = json.Unmarshal(result.Body, &document)
+			}
+			if documentErr != nil {
+				failures = append(failures, a.Source+": response is not JSON: "+documentErr.Error())
+				continue
+			}
+			actual, present = evaluateJsonPathAsString(document, a.Subject[len(assertSubjectJson):])
+		}
+		if failure := a.check(actual, present); failure != "" {
+			failures = append(failures, failure)
+		}
+	}
+	return failures
+}
+
+func (a *netAssertion) check(actual string, present bool) string {
+	if !present {
+		return a.Source + ": not present"
+	}
+	ok := false
+	switch a.Operator {
+	case "":
+		ok = true
+	case "==":
+		ok = actual == a.Expected
+	case "!=":
+		ok = actual != a.Expected
+	case "~":
+		ok = a.regexp.MatchString(actual)
+	case "!~":
+		ok = !a.regexp.MatchString(actual)
+	default:
+		actualNumber, err1 := strconv.ParseFloat(actual, 64)
+		expectedNumber, err2 := strconv.ParseFloat(a.Expected, 64)
+		if err1 != nil || err2 != nil {
+			return a.Source + ": cannot compare non-numeric " + actual
+		}
+		switch a.Operator {
+		case "<":
+			ok = actualNumber < expectedNumber
+		case "<=":
+			ok = actualNumber <= expectedNumber
+		case ">":
+			ok = actualNumber > expectedNumber
+		case ">=":
+			ok = actualNumber >= expectedNumber
+		}
+	}
+	if ok {
+		return ""
+	}
+	if len(actual) > 200 {
+		actual = actual[:200] + "..."
+	}
+	return a.Source + ": actual " + actual
+}
+
+// splitJsonPath converts $.a.b[0]['c d'] into the list a b 0 c d
+func splitJsonPath(path string) ([]string, error) {
+	path = strings.TrimSpace(path)
+	if strings.HasPrefix(path, "$") {
+		path = path[1:]
+	}
+	parts := make([]string, 0, 8)
+	n := len(path)
+	for i := 0; i < n; {
+		switch path[i] {
+		case '.':
+			i++
+			j := i
+			for j < n && path[j] != '.' && path[j] != '[' {
+				j++
+			}
+			if j == i {
+				return nil, errors.New("empty name in JSONPath " + path)
+			}
+			parts = append(parts, path[i:j])
+			i = j
+		case '[':
+			j := strings.IndexByte(path[i:], ']')
+			if j < 0 {
+				return nil, errors.New("unclosed [ in JSONPath " + path)
+			}
+			key := strings.TrimSpace(path[i+1 : i+j])
+			if len(key) >= 2 && (key[0] == '\'' || key[0] == '"') && key[len(key)-1] == key[0] {
+				key = key[1 : len(key)-1]
+			}
+			parts = append(parts, key)
+			i += j + 1
+		default:
+			j := i
+			for j < n && path[j] != '.' && path[j] != '[' {
+				j++
+			}
+			parts = append(parts, path[i:j])
+			i = j
+		}
+	}
+	return parts, nil
+}
+
+func evaluateJsonPath(document interface{}, path string) (interface{}, bool) {
+	parts, err := splitJsonPath(path)
+	if err != nil {
+		return nil, false
+	}
+	current := document
+	for _, part := range parts {
+		switch v := current.(type) {
+		case map[string]interface{}:
+			next, ok := v[part]
+			if !ok {
+				return nil, false
+			}
+			current = next
+		case []interface{}:
+			index, err := strconv.Atoi(part)
+			if part == "length" && err != nil {
+				current = float64(len(v))
+				continue
+			}
+			if err != nil {
+				return nil, false
+			}
+			if index < 0 {
+				index += len(v)
+			}
+			if index < 0 || index >= len(v) {
+				return nil, false
+			}
+			current = v[index]
+		default:
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+func evaluateJsonPathAsString(document interface{}, path string) (string, bool) {
+	value, ok := evaluateJsonPath(document, path)
+	if !ok {
+		return "", false
+	}
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case nil:
+		return "null", true
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), true
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", false
+	}
+	return string(data), true
+}
@@ -0,0 +1,209 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	netFileBodyPrefix      = "@"
+	netOctetStream         = "application/octet-stream"
+	netDefaultDownloadName = "response"
+)
+
+var formQuoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+type netFormField struct {
+	Name        string
+	Value       string
+	File        string
+	ContentType string
+}
+
+// parseNetFormField reads the curl-like form field name=value or name=@path[;type=<content type>]
+func parseNetFormField(source string) (*netFormField, error) {
+	p := strings.Index(source, "=")
+	if p <= 0 {
+		return nil, errors.New("form field must be specified as name=value or name=@path[;type=<content type>]")
+	}
+	field := &netFormField{Name: source[:p], Value: source[p+1:]}
+	if !strings.HasPrefix(field.Value, netFileBodyPrefix) {
+		return field, nil
+	}
+	field.File = field.Value[1:]
+	field.Value = ""
+	if q := strings.Index(field.File, ";type="); q >= 0 {
+		field.ContentType = field.File[q+len(";type="):]
+		field.File = field.File[:q]
+	}
+	if field.File == "" {
+		return nil, errors.New("file name is empty in form field " + source)
+	}
+	return field, nil
+}
+
+func (field *netFormField) String() string {
+	if field.File == "" {
+		return field.Name + "=" + field.Value
+	}
+	res := field.Name + "=" + netFileBodyPrefix + field.File
+	if field.ContentType != "" {
+		res += ";type=" + field.ContentType
+	}
+	return res
+}
+
+func detectFileContentType(fileName string, data []byte) string {
+	if contentType := mime.TypeByExtension(filepath.Ext(fileName)); contentType != "" {
+		return contentType
+	}
+	return http.DetectContentType(data)
+}
+
+func createMultipartBody(fields []*netFormField) ([]byte, string, error) {
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+	for _, field := range fields {
+		if field.File == "" {
+			if err := writer.WriteField(field.Name, field.Value); err != nil {
+				return nil, "", err
+			}
+			continue
+		}
+		data, err := ioutil.ReadFile(field.File)
+		if err != nil {
+			return nil, "", err
+		}
+		contentType := field.ContentType
+		if contentType == "" {
+			contentType = detectFileContentType(field.File, data)
+		}
+		header := make(textproto.MIMEHeader)
+		header.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`,
+			formQuoteEscaper.Replace(field.Name), formQuoteEscaper.Replace(filepath.Base(field.File))))
+		header.Set(ContentType, contentType)
+		part, err := writer.CreatePart(header)
+		if err != nil {
+			return nil, "", err
+		}
+		if _, err = part.Write(data); err != nil {
+			return nil, "", err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), writer.FormDataContentType(), nil
+}
+
+// prepareNetBody reads the multipart form or the @file body once, so that repeats and the load mode do not read the files again
+func prepareNetBody(step *netStep) error {
+	switch {
+	case len(step.Form) > 0:
+		if step.Body != "" {
+			return errors.New("body and form fields cannot be combined in " + step.Name)
+		}
+		data, contentType, err := createMultipartBody(step.Form)
+		if err != nil {
+			return err
+		}
+		step.bodyData = data
+		for k := range step.Headers {
+			if strings.EqualFold(k, ContentType) {
+				delete(step.Headers, k)
+			}
+		}
+		step.Headers[ContentType] = contentType
+	case strings.HasPrefix(step.Body, netFileBodyPrefix):
+		fileName := step.Body[1:]
+		data, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return err
+		}
+		step.bodyData = data
+		if !hasHeader(step.Headers, ContentType) {
+			step.Headers[ContentType] = detectFileContentType(fileName, data)
+		}
+	default:
+		step.bodyData = []byte(step.Body)
+	}
+	return nil
+}
+
+func detectResponseContentType(result *netResult) string {
+	contentType := result.Headers.Get(ContentType)
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil && mediaType != netOctetStream {
+		return mediaType
+	}
+	if len(result.Body) == 0 {
+		return netOctetStream
+	}
+	mediaType, _, _ := mime.ParseMediaType(http.DetectContentType(result.Body))
+	return mediaType
+}
+
+func isTextContentType(contentType string) bool {
+	return strings.HasPrefix(contentType, "text/") || strings.HasSuffix(contentType, "json") ||
+		strings.HasSuffix(contentType, "xml") || strings.HasSuffix(contentType, "javascript") ||
+		contentType == "application/x-www-form-urlencoded" || contentType == "application/yaml"
+}
+
+// getDownloadFileName takes the name from Content-Disposition or the last segment of the url
+// and adds the extension by the content type if the name has none
+func getDownloadFileName(result *netResult, contentType string) string {
+	name := ""
+	if _, params, err := mime.ParseMediaType(result.Headers.Get("Content-Disposition")); err == nil {
+		name = filepath.Base(params["filename"])
+	}
+	if name == "" || name == "." || name == string(filepath.Separator) {
+		if u, err := url.Parse(result.Step.Url); err == nil {
+			name = path.Base(u.Path)
+		}
+	}
+	if name == "" || name == "." || name == "/" {
+		name = netDefaultDownloadName
+	}
+	if filepath.Ext(name) == "" {
+		if extensions, err := mime.ExtensionsByType(contentType); err == nil && len(extensions) > 0 {
+			name += extensions[0]
+		}
+	}
+	return name
+}
+
+// saveNetResponse writes the response body to the file or, if the save place is a folder, to the file named by the response
+func saveNetResponse(result *netResult) error {
+	fileName := result.Step.SaveFile
+	contentType := detectResponseContentType(result)
+	if strings.HasSuffix(fileName, "/") || strings.HasSuffix(fileName, "\\") {
+		if err := os.MkdirAll(fileName, 0755); err != nil {
+			return err
+		}
+	}
+	if info, err := os.Stat(fileName); err == nil && info.IsDir() {
+		fileName = filepath.Join(fileName, getDownloadFileName(result, contentType))
+	}
+	if err := ioutil.WriteFile(fileName, result.Body, 0644); err != nil {
+		return err
+	}
+	result.SavedFile = fileName
+	result.ContentType = contentType
+	return nil
+}
+
+func presentSavedResponse(result *netResult) {
+	fmt.Printf("Saved %d bytes of %s to %s\n", len(result.Body), result.ContentType, result.SavedFile)
+}
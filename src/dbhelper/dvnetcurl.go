@@ -0,0 +1,526 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// netImportedBodySuffix is the extension of the files with the imported bodies
+const netImportedBodySuffix = ".body"
+
+type harFile struct {
+	Log struct {
+		Entries []struct {
+			Request struct {
+				Method  string `json:"method"`
+				Url     string `json:"url"`
+				Headers []struct {
+					Name  string `json:"name"`
+					Value string `json:"value"`
+				} `json:"headers"`
+				PostData *struct {
+					MimeType string `json:"mimeType"`
+					Text     string `json:"text"`
+				} `json:"postData"`
+			} `json:"request"`
+		} `json:"entries"`
+	} `json:"log"`
+}
+
+type netImportOptions struct {
+	curlFile   string
+	harFile    string
+	harFilter  string
+	outputFile string
+	startStep  int
+	exportCurl bool
+}
+
+func readNetImportOption(options *netImportOptions, arg string) (bool, error) {
+	var err error
+	switch {
+	case strings.HasPrefix(arg, "--import-curl="):
+		options.curlFile = arg[len("--import-curl="):]
+	case strings.HasPrefix(arg, "--import-har="):
+		options.harFile = arg[len("--import-har="):]
+	case strings.HasPrefix(arg, "--har-filter="):
+		options.harFilter = arg[len("--har-filter="):]
+	case strings.HasPrefix(arg, "--output="):
+		options.outputFile = arg[len("--output="):]
+	case strings.HasPrefix(arg, "--step="):
+		options.startStep, err = strconv.Atoi(arg[len("--step="):])
+		if err == nil && options.startStep <= 0 {
+			err = errors.New("step must be positive")
+		}
+	case arg == "--export-curl":
+		options.exportCurl = true
+	default:
+		return false, nil
+	}
+	return true, err
+}
+
+// splitCommandLine splits a bash (or simple cmd) command line the way the shell does,
+// line continuations by \ or ^ are joined
+func splitCommandLine(s string) ([]string, error) {
+	var res []string
+	var current bytes.Buffer
+	inWord := false
+	n := len(s)
+	for i := 0; i < n; i++ {
+		c := s[i]
+		switch {
+		case (c == '\\' || c == '^') && i+1 < n && (s[i+1] == '\n' || s[i+1] == '\r'):
+			for i+1 < n && (s[i+1] == '\n' || s[i+1] == '\r') {
+				i++
+			}
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			if inWord {
+				res = append(res, current.String())
+				current.Reset()
+				inWord = false
+			}
+		case c == '\'':
+			inWord = true
+			j := strings.IndexByte(s[i+1:], '\'')
+			if j < 0 {
+				return nil, errors.New("unclosed single quote")
+			}
+			current.WriteString(s[i+1 : i+1+j])
+			i += j + 1
+		case c == '$' && i+1 < n && s[i+1] == '\'':
+			inWord = true
+			i += 2
+			for ; i < n && s[i] != '\''; i++ {
+				if s[i] == '\\' && i+1 < n {
+					i++
+					switch s[i] {
+					case 'n':
+						current.WriteByte('\n')
+					case 'r':
+						current.WriteByte('\r')
+					case 't':
+						current.WriteByte('\t')
+					default:
+						current.WriteByte(s[i])
+					}
+				} else {
+					current.WriteByte(s[i])
+				}
+			}
+			if i == n {
+				return nil, errors.New("unclosed $' quote")
+			}
+		case c == '"':
+			inWord = true
+			for i++; i < n && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < n && strings.IndexByte("\"\\$`\n", s[i+1]) >= 0 {
+					i++
+				}
+				current.WriteByte(s[i])
+			}
+			if i == n {
+				return nil, errors.New("unclosed double quote")
+			}
+		case c == '\\' && i+1 < n:
+			inWord = true
+			i++
+			current.WriteByte(s[i])
+		default:
+			inWord = true
+			current.WriteByte(c)
+		}
+	}
+	if inWord {
+		res = append(res, current.String())
+	}
+	return res, nil
+}
+
+// readCurlData reads the -d @file data the way curl does, the binary data files are kept as @file bodies
+func readCurlData(value string) (string, error) {
+	if !strings.HasPrefix(value, netFileBodyPrefix) {
+		return value, nil
+	}
+	data, err := ioutil.ReadFile(value[1:])
+	if err != nil {
+		return "", err
+	}
+	return strings.NewReplacer("\r", "", "\n", "").Replace(string(data)), nil
+}
+
+func encodeCurlDataUrlencode(value string) (string, error) {
+	name := ""
+	content := value
+	if p := strings.IndexAny(value, "=@"); p >= 0 {
+		name = value[:p]
+		content = value[p+1:]
+		if value[p] == '@' {
+			data, err := ioutil.ReadFile(content)
+			if err != nil {
+				return "", err
+			}
+			content = string(data)
+		}
+	}
+	if name == "" {
+		return url.QueryEscape(content), nil
+	}
+	return name + "=" + url.QueryEscape(content), nil
+}
+
+// parseCurlCommand converts the curl command line copied from the browser devtools into the request step
+func parseCurlCommand(command string) (*netStep, error) {
+	args, err := splitCommandLine(command)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 || args[0] != "curl" && !strings.HasSuffix(args[0], "/curl") && !strings.HasSuffix(args[0], "curl.exe") {
+		return nil, errors.New("command does not start with curl")
+	}
+	step := &netStep{Headers: make(map[string]string)}
+	var data []string
+	getData := false
+	n := len(args)
+	for i := 1; i < n; i++ {
+		arg := args[i]
+		value := ""
+		option := arg
+		if strings.HasPrefix(arg, "--") && strings.Contains(arg, "=") {
+			p := strings.Index(arg, "=")
+			option = arg[:p]
+			value = arg[p+1:]
+		} else if strings.HasPrefix(arg, "-") && len(arg) > 2 && arg[1] != '-' && strings.IndexByte("XHdbuAe", arg[1]) >= 0 {
+			option = arg[:2]
+			value = arg[2:]
+		} else if strings.HasPrefix(arg, "-") && curlOptionHasValue(arg) {
+			if i+1 >= n {
+				return nil, errors.New("missing value for " + arg)
+			}
+			i++
+			value = args[i]
+		}
+		switch option {
+		case "-X", "--request":
+			step.Method = strings.ToUpper(value)
+		case "-H", "--header":
+			k, v := splitHeader(value)
+			if k == "" {
+				return nil, errors.New("incorrect header " + value)
+			}
+			if !isRecalculatedHeader(k) {
+				step.Headers[k] = v
+			}
+		case "-d", "--data", "--data-ascii":
+			value, err = readCurlData(value)
+			data = append(data, value)
+		case "--data-binary", "--data-raw":
+			data = append(data, value)
+		case "--data-urlencode":
+			value, err = encodeCurlDataUrlencode(value)
+			data = append(data, value)
+		case "--json":
+			data = append(data, value)
+			step.Headers[ContentType] = "application/json"
+			step.Headers["Accept"] = "application/json"
+		case "-u", "--user":
+			step.Headers[Authorization] = "Basic " + base64.StdEncoding.EncodeToString([]byte(value))
+		case "-A", "--user-agent":
+			step.Headers["User-Agent"] = value
+		case "-b", "--cookie":
+			step.Headers["Cookie"] = value
+		case "-e", "--referer":
+			step.Headers["Referer"] = value
+		case "-G", "--get":
+			getData = true
+		case "--url":
+			step.Url = value
+		case "-F", "--form":
+			var field *netFormField
+			if field, err = parseNetFormField(value); err == nil {
+				step.Form = append(step.Form, field)
+			}
+		case "-o", "--output":
+			step.SaveFile = value
+		default:
+			if strings.HasPrefix(arg, "-") {
+				// output, verbosity, redirect and compression options do not change the request
+				continue
+			}
+			step.Url = arg
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if step.Url == "" {
+		return nil, errors.New("url is not specified")
+	}
+	body := strings.Join(data, "&")
+	if getData && body != "" {
+		if strings.Contains(step.Url, "?") {
+			step.Url += "&" + body
+		} else {
+			step.Url += "?" + body
+		}
+		body = ""
+	}
+	step.Body = body
+	if step.Method == "" {
+		step.Method = "GET"
+		if body != "" || len(step.Form) > 0 {
+			step.Method = "POST"
+		}
+	}
+	if body != "" && !hasHeader(step.Headers, ContentType) {
+		step.Headers[ContentType] = "application/x-www-form-urlencoded"
+	}
+	step.Name = step.Method + " " + step.Url
+	return step, nil
+}
+
+func curlOptionHasValue(option string) bool {
+	switch option {
+	case "-X", "--request", "-H", "--header", "-d", "--data", "--data-ascii", "--data-binary", "--data-raw",
+		"--data-urlencode", "--json", "-u", "--user", "-A", "--user-agent", "-b", "--cookie", "-e", "--referer",
+		"--url", "-F", "--form", "-o", "--output", "-w", "--write-out", "-m", "--max-time", "--connect-timeout",
+		"-x", "--proxy", "--cacert", "--cert", "--key", "-r", "--range", "--retry":
+		return true
+	}
+	return false
+}
+
+func splitHeader(header string) (string, string) {
+	p := strings.Index(header, ":")
+	if p <= 0 {
+		return "", ""
+	}
+	return strings.TrimSpace(header[:p]), strings.TrimSpace(header[p+1:])
+}
+
+func getSortedHeaderNames(headers map[string]string) []string {
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// formatNetStepBlock presents the step as the EXECUTE_NET property block;
+// the headers are separate properties because the header list is split by commas and spaces
+func formatNetStepBlock(prefix string, step *netStep) string {
+	var buf bytes.Buffer
+	buf.WriteString("# " + step.Name + "\n")
+	buf.WriteString(prefix + "_NAME=" + step.Name + "\n")
+	buf.WriteString(prefix + "_METHOD=" + step.Method + "\n")
+	buf.WriteString(prefix + "_URL=" + step.Url + "\n")
+	headerList := ""
+	for i, name := range getSortedHeaderNames(step.Headers) {
+		key := prefix + "_HEADER_" + strconv.Itoa(i+1)
+		buf.WriteString(key + "=" + name + ": " + step.Headers[name] + "\n")
+		if headerList != "" {
+			headerList += ","
+		}
+		headerList += key
+	}
+	if headerList != "" {
+		buf.WriteString(prefix + "_HEADERS=" + headerList + "\n")
+	}
+	if step.Body != "" {
+		buf.WriteString(prefix + "_BODY=" + step.Body + "\n")
+	}
+	for i, field := range step.Form {
+		buf.WriteString(prefix + "_FORM_" + strconv.Itoa(i+1) + "=" + field.String() + "\n")
+	}
+	if step.SaveFile != "" {
+		buf.WriteString(prefix + "_SAVE=" + step.SaveFile + "\n")
+	}
+	return buf.String()
+}
+
+func formatNetStepInvocation(prefix string, step *netStep) string {
+	// the command line takes the list of the header properties, it does not read the _HEADERS property
+	headers := make([]string, len(step.Headers))
+	for i := range headers {
+		headers[i] = prefix + "_HEADER_" + strconv.Itoa(i+1)
+	}
+	headerList := strings.Join(headers, ",")
+	if headerList == "" {
+		headerList = "\"\""
+	}
+	body := prefix + "_BODY"
+	if step.Body == "" {
+		body = "\"\""
+	}
+	options := ""
+	for _, field := range step.Form {
+		options += "--form=" + field.String() + " "
+	}
+	if step.SaveFile != "" {
+		options += "--save=" + step.SaveFile + " "
+	}
+	return "# dvnetwork " + options + prefix + "_URL " + step.Method + " " + headerList + " " + body + "\n"
+}
+
+func quoteForShell(s string) string {
+	return "'" + strings.Replace(s, "'", "'\\''", -1) + "'"
+}
+
+func formatCurlCommand(step *netStep) string {
+	res := "curl -X " + step.Method + " " + quoteForShell(step.Url)
+	for _, name := range getSortedHeaderNames(step.Headers) {
+		res += " \\\n  -H " + quoteForShell(name+": "+step.Headers[name])
+	}
+	for _, field := range step.Form {
+		res += " \\\n  -F " + quoteForShell(field.String())
+	}
+	if strings.HasPrefix(step.Body, netFileBodyPrefix) {
+		res += " \\\n  --data-binary " + quoteForShell(step.Body)
+	} else if step.Body != "" {
+		res += " \\\n  --data-raw " + quoteForShell(step.Body)
+	}
+	if step.SaveFile != "" {
+		res += " \\\n  -o " + quoteForShell(step.SaveFile)
+	}
+	return res
+}
+
+func readHarSteps(fileName string, filter string) ([]*netStep, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	har := &harFile{}
+	if err = json.Unmarshal(data, har); err != nil {
+		return nil, err
+	}
+	var filterRegexp *regexp.Regexp
+	if filter != "" {
+		if filterRegexp, err = regexp.Compile(filter); err != nil {
+			return nil, err
+		}
+	}
+	steps := make([]*netStep, 0, len(har.Log.Entries))
+	for _, entry := range har.Log.Entries {
+		request := entry.Request
+		if filterRegexp != nil && !filterRegexp.MatchString(request.Url) {
+			continue
+		}
+		step := &netStep{Name: request.Method + " " + request.Url, Method: request.Method, Url: request.Url, Headers: make(map[string]string)}
+		for _, header := range request.Headers {
+			if isRecalculatedHeader(header.Name) {
+				continue
+			}
+			step.Headers[header.Name] = header.Value
+		}
+		if request.PostData != nil {
+			step.Body = request.PostData.Text
+			if request.PostData.MimeType != "" && !hasHeader(step.Headers, ContentType) {
+				step.Headers[ContentType] = request.PostData.MimeType
+			}
+		}
+		steps = append(steps, step)
+	}
+	return steps, nil
+}
+
+// isRecalculatedHeader tells the imported headers set by the transport on replay: HTTP/2 pseudo-headers, the length
+// and Accept-Encoding, with which Go does not decompress the response and the assertions would see gzip or br
+func isRecalculatedHeader(name string) bool {
+	return strings.HasPrefix(name, ":") || strings.EqualFold(name, "Content-Length") || strings.EqualFold(name, "Accept-Encoding")
+}
+
+func hasHeader(headers map[string]string, name string) bool {
+	for k := range headers {
+		if strings.EqualFold(k, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// getImportedBodyFile is the file next to the output, such as steps-EXECUTE_NET_2.body for steps.properties
+func getImportedBodyFile(outputFile string, prefix string) string {
+	if outputFile == "" {
+		return prefix + netImportedBodySuffix
+	}
+	return strings.TrimSuffix(outputFile, filepath.Ext(outputFile)) + "-" + prefix + netImportedBodySuffix
+}
+
+// saveImportedBody keeps the body with line breaks, which a property cannot hold, in the file sent as _BODY=@<file>,
+// so that multipart, NDJSON and formatted bodies are replayed as they were captured
+func saveImportedBody(step *netStep, fileName string) error {
+	if !strings.ContainsAny(step.Body, "\r\n") {
+		return nil
+	}
+	if err := ioutil.WriteFile(fileName, []byte(step.Body), 0644); err != nil {
+		return err
+	}
+	step.Body = netFileBodyPrefix + fileName
+	return nil
+}
+
+func runNetImport(options *netImportOptions) bool {
+	var steps []*netStep
+	if options.curlFile != "" {
+		data, err := ioutil.ReadFile(options.curlFile)
+		if err != nil {
+			fmt.Printf("Cannot read %s: %v\n", options.curlFile, err)
+			return false
+		}
+		step, err := parseCurlCommand(string(data))
+		if err != nil {
+			fmt.Printf("Error in curl command %s: %v\n", options.curlFile, err)
+			return false
+		}
+		steps = append(steps, step)
+	}
+	if options.harFile != "" {
+		harSteps, err := readHarSteps(options.harFile, options.harFilter)
+		if err != nil {
+			fmt.Printf("Error in HAR file %s: %v\n", options.harFile, err)
+			return false
+		}
+		steps = append(steps, harSteps...)
+	}
+	start := options.startStep
+	if start <= 0 {
+		start = 1
+	}
+	var buf bytes.Buffer
+	for i, step := range steps {
+		prefix := netSequencePrefix + "_" + strconv.Itoa(start+i)
+		if err := saveImportedBody(step, getImportedBodyFile(options.outputFile, prefix)); err != nil {
+			fmt.Printf("Cannot save the body of %s: %v\n", step.Name, err)
+			return false
+		}
+		buf.WriteString(formatNetStepBlock(prefix, step))
+		if len(steps) == 1 {
+			buf.WriteString(formatNetStepInvocation(prefix, step))
+		}
+		buf.WriteString("\n")
+	}
+	if options.outputFile == "" {
+		fmt.Print(buf.String())
+		return true
+	}
+	if err := ioutil.WriteFile(options.outputFile, buf.Bytes(), 0644); err != nil {
+		fmt.Printf("Cannot write %s: %v\n", options.outputFile, err)
+		return false
+	}
+	fmt.Printf("%d requests are saved in %s\n", len(steps), options.outputFile)
+	return true
+}
@@ -0,0 +1,57 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestImportedMultilineBodyIsSavedInFile(t *testing.T) {
+	folder := t.TempDir()
+	ndjson := "{\"index\":{\"_id\":\"1\"}}\n{\"name\":\"a b\"}\n"
+	multipart := "--b\r\nContent-Disposition: form-data; name=\"f\"\r\n\r\n  text  \r\n--b--\r\n"
+	har := map[string]interface{}{"log": map[string]interface{}{"entries": []interface{}{
+		map[string]interface{}{"request": map[string]interface{}{"method": "POST", "url": "https://api.local/_bulk",
+			"headers":  []interface{}{map[string]string{"name": "Content-Length", "value": "40"}},
+			"postData": map[string]string{"mimeType": "application/x-ndjson", "text": ndjson}}},
+		map[string]interface{}{"request": map[string]interface{}{"method": "POST", "url": "https://api.local/upload",
+			"postData": map[string]string{"mimeType": "multipart/form-data; boundary=b", "text": multipart}}},
+		map[string]interface{}{"request": map[string]interface{}{"method": "POST", "url": "https://api.local/login",
+			"postData": map[string]string{"mimeType": "application/x-www-form-urlencoded", "text": "user=a&pass=b"}}},
+	}}}
+	data, err := json.Marshal(har)
+	if err != nil {
+		t.Fatal(err)
+	}
+	harFile := filepath.Join(folder, "capture.har")
+	if err = ioutil.WriteFile(harFile, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(folder, "steps.properties")
+	if !runNetImport(&netImportOptions{harFile: harFile, outputFile: output}) {
+		t.Fatal("the import failed")
+	}
+	data, err = ioutil.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	properties := string(data)
+	for i, expected := range []string{ndjson, multipart} {
+		prefix := netSequencePrefix + "_" + string(rune('1'+i))
+		bodyFile := filepath.Join(folder, "steps-"+prefix+netImportedBodySuffix)
+		if !strings.Contains(properties, prefix+"_BODY=@"+bodyFile+"\n") {
+			t.Errorf("%s has no body file:\n%s", prefix, properties)
+		}
+		step := &netStep{Name: prefix, Body: netFileBodyPrefix + bodyFile, Headers: map[string]string{ContentType: "text/plain"}}
+		if err = prepareNetBody(step); err != nil || string(step.bodyData) != expected {
+			t.Errorf("%s is replayed as %q: %v", prefix, step.bodyData, err)
+		}
+	}
+	if !strings.Contains(properties, netSequencePrefix+"_3_BODY=user=a&pass=b\n") {
+		t.Errorf("the single line body is not kept in the property:\n%s", properties)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Dobryvechir/microcore/pkg/dvparser"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	extractSourceJson   = "json:"
+	extractSourceRegex  = "regex:"
+	extractSourceHeader = "header:"
+)
+
+type netExtraction struct {
+	Source   string
+	Name     string
+	Kind     string
+	Argument string
+	regexp   *regexp.Regexp
+}
+
+// parseNetExtraction reads NAME=json:<JSONPath>, NAME=regex:<regular expression> or NAME=header:<name>
+func parseNetExtraction(source string) (*netExtraction, error) {
+	s := strings.TrimSpace(source)
+	p := strings.Index(s, "=")
+	if p <= 0 {
+		return nil, errors.New("extraction must be specified as NAME=json:<path>, NAME=regex:<expression> or NAME=header:<name>")
+	}
+	e := &netExtraction{Source: s, Name: strings.TrimSpace(s[:p])}
+	rule := strings.TrimSpace(s[p+1:])
+	for _, kind := range []string{extractSourceJson, extractSourceRegex, extractSourceHeader} {
+		if strings.HasPrefix(rule, kind) {
+			e.Kind = kind
+			e.Argument = rule[len(kind):]
+			break
+		}
+	}
+	if e.Kind == "" || e.Argument == "" {
+		return nil, fmt.Errorf("unknown extraction rule %s", rule)
+	}
+	if e.Kind == extractSourceRegex {
+		var err error
+		if e.regexp, err = regexp.Compile(e.Argument); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+func (e *netExtraction) extract(result *netResult, document interface{}, documentErr error) (string, error) {
+	switch e.Kind {
+	case extractSourceJson:
+		if documentErr != nil {
+			return "", errors.New("response is not JSON: " + documentErr.Error())
+		}
+		if value, ok := evaluateJsonPathAsString(document, e.Argument); ok {
+			return value, nil
+		}
+	case extractSourceRegex:
+		if match := e.regexp.FindSubmatch(result.Body); match != nil {
+			if len(match) > 1 {
+				return string(match[1]), nil
+			}
+			return string(match[0]), nil
+		}
+	case extractSourceHeader:
+		if values := result.Headers.Values(e.Argument); len(values) > 0 {
+			return values[0], nil
+		}
+	}
+	return "", errors.New("not found")
+}
+
+// applyExtractions stores the extracted values in the global properties, so that later steps can use {{{NAME}}}
+func applyExtractions(extractions []*netExtraction, result *netResult) (values map[string]string, failures []string) {
+	values = make(map[string]string)
+	var document interface{}
+	var documentErr error
+	documentRead := false
+	for _, e := range extractions {
+		if e.Kind == extractSourceJson && !documentRead {
+			documentRead = true
+			documentErr = json.Unmarshal(result.Body, &document)
+		}
+		value, err := e.extract(result, document, documentErr)
+		if err != nil {
+			failures = append(failures, "extract "+e.Source+": "+err.Error())
+			continue
+		}
+		dvparser.SetGlobalPropertiesValue(e.Name, value)
+		values[e.Name] = value
+	}
+	return
+}
+
+// saveExtractedProperties replaces the existing keys in the properties file and appends the new ones
+func saveExtractedProperties(fileName string, values map[string]string) error {
+	if fileName == "" || len(values) == 0 {
+		return nil
+	}
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	var lines []string
+	if len(data) > 0 {
+		lines = strings.Split(strings.TrimRight(strings.Replace(string(data), "\r\n", "\n", -1), "\n"), "\n")
+	}
+	saved := make(map[string]bool, len(values))
+	for i, line := range lines {
+		p := strings.Index(line, "=")
+		if p <= 0 {
+			continue
+		}
+		key := strings.TrimSpace(line[:p])
+		if value, ok := values[key]; ok && !strings.HasPrefix(strings.TrimSpace(line), "#") {
+			lines[i] = key + "=" + value
+			saved[key] = true
+		}
+	}
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		if !saved[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		lines = append(lines, key+"="+values[key])
+	}
+	return ioutil.WriteFile(fileName, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
@@ -0,0 +1,258 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	loadDefaultConcurrency = 10
+	loadDefaultDuration    = 10 * time.Second
+	loadHistogramWidth     = 50
+)
+
+// upper bounds of the latency histogram buckets in milliseconds, the last bucket is unbounded
+var loadHistogramBounds = []int64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000, 2000, 5000, 10000}
+
+type netLoadOptions struct {
+	enabled     bool
+	concurrency int
+	duration    time.Duration
+	requests    int64
+	rate        float64
+}
+
+type netLoadSummary struct {
+	Requests   int64            `json:"requests"`
+	Errors     int64            `json:"errors"`
+	ElapsedMs  int64            `json:"elapsedMs"`
+	Throughput float64          `json:"throughput"`
+	Outcomes   map[string]int64 `json:"outcomes"`
+	P50Ms      float64          `json:"p50Ms"`
+	P90Ms      float64          `json:"p90Ms"`
+	P99Ms      float64          `json:"p99Ms"`
+	MaxMs      float64          `json:"maxMs"`
+	Histogram  map[string]int64 `json:"histogram"`
+}
+
+type netLoadCollector struct {
+	sync.Mutex
+	latencies []time.Duration
+	outcomes  map[string]int64
+	errors    int64
+}
+
+func readNetLoadOption(load *netLoadOptions, arg string) (bool, error) {
+	var err error
+	switch {
+	case arg == "--load":
+		load.enabled = true
+	case strings.HasPrefix(arg, "--concurrency="):
+		load.enabled = true
+		load.concurrency, err = strconv.Atoi(arg[len("--concurrency="):])
+		if err == nil && load.concurrency <= 0 {
+			err = fmt.Errorf("concurrency must be positive")
+		}
+	case strings.HasPrefix(arg, "--duration="):
+		load.enabled = true
+		load.duration, err = time.ParseDuration(arg[len("--duration="):])
+		if err == nil && load.duration <= 0 {
+			err = fmt.Errorf("duration must be positive")
+		}
+	case strings.HasPrefix(arg, "--requests="):
+		load.enabled = true
+		load.requests, err = strconv.ParseInt(arg[len("--requests="):], 10, 64)
+		if err == nil && load.requests <= 0 {
+			err = fmt.Errorf("requests must be positive")
+		}
+	case strings.HasPrefix(arg, "--rate="):
+		load.enabled = true
+		load.rate, err = strconv.ParseFloat(arg[len("--rate="):], 64)
+		if err == nil && !(load.rate > 0) {
+			err = fmt.Errorf("rate must be positive")
+		}
+	default:
+		return false, nil
+	}
+	return true, err
+}
+
+func (c *netLoadCollector) add(result *netResult) {
+	outcome := ""
+	failed := false
+	switch {
+	case result.Err != nil:
+		outcome = "error: " + result.Err.Error()
+		if len(outcome) > 80 {
+			outcome = outcome[:80] + "..."
+		}
+		failed = true
+	case len(result.Failures) > 0:
+		outcome = "status " + strconv.Itoa(result.StatusCode) + " assertion failed"
+		failed = true
+	default:
+		outcome = "status " + strconv.Itoa(result.StatusCode)
+		// the error status expected by the assertions of the step is a success, as in a single run
+		failed = result.StatusCode >= 400 && (result.Step == nil || !isStatusAsserted(result.Step.Assertions, result.StatusCode))
+	}
+	c.Lock()
+	c.latencies = append(c.latencies, result.Duration)
+	c.outcomes[outcome]++
+	if failed {
+		c.errors++
+	}
+	c.Unlock()
+}
+
+func percentile(sorted []time.Duration, p float64) float64 {
+	n := len(sorted)
+	if n == 0 {
+		return 0
+	}
+	index := int(float64(n)*p+0.999999) - 1
+	if index < 0 {
+		index = 0
+	}
+	if index >= n {
+		index = n - 1
+	}
+	return float64(sorted[index].Microseconds()) / 1000
+}
+
+func histogramBucketName(i int) string {
+	if i == len(loadHistogramBounds) {
+		return ">" + strconv.FormatInt(loadHistogramBounds[i-1], 10) + "ms"
+	}
+	return "<=" + strconv.FormatInt(loadHistogramBounds[i], 10) + "ms"
+}
+
+func (c *netLoadCollector) summarize(elapsed time.Duration) *netLoadSummary {
+	sort.Slice(c.latencies, func(i, j int) bool { return c.latencies[i] < c.latencies[j] })
+	n := int64(len(c.latencies))
+	summary := &netLoadSummary{
+		Requests:  n,
+		Errors:    c.errors,
+		ElapsedMs: elapsed.Milliseconds(),
+		Outcomes:  c.outcomes,
+		P50Ms:     percentile(c.latencies, 0.5),
+		P90Ms:     percentile(c.latencies, 0.9),
+		P99Ms:     percentile(c.latencies, 0.99),
+		MaxMs:     percentile(c.latencies, 1),
+		Histogram: make(map[string]int64),
+	}
+	if elapsed > 0 {
+		summary.Throughput = float64(n) / elapsed.Seconds()
+	}
+	for _, latency := range c.latencies {
+		ms := latency.Milliseconds()
+		i := sort.Search(len(loadHistogramBounds), func(k int) bool { return ms <= loadHistogramBounds[k] })
+		summary.Histogram[histogramBucketName(i)]++
+	}
+	return summary
+}
+
+func presentNetLoadSummary(summary *netLoadSummary) {
+	fmt.Printf("Requests: %d, errors: %d, elapsed: %d ms, throughput: %.2f req/s\n", summary.Requests, summary.Errors, summary.ElapsedMs, summary.Throughput)
+	outcomes := make([]string, 0, len(summary.Outcomes))
+	for outcome := range summary.Outcomes {
+		outcomes = append(outcomes, outcome)
+	}
+	sort.Strings(outcomes)
+	for _, outcome := range outcomes {
+		fmt.Printf("  %-40s %d\n", outcome, summary.Outcomes[outcome])
+	}
+	fmt.Printf("Latency: p50 %.1f ms, p90 %.1f ms, p99 %.1f ms, max %.1f ms\n", summary.P50Ms, summary.P90Ms, summary.P99Ms, summary.MaxMs)
+	var maxCount int64
+	for _, count := range summary.Histogram {
+		if count > maxCount {
+			maxCount = count
+		}
+	}
+	for i := 0; i <= len(loadHistogramBounds); i++ {
+		name := histogramBucketName(i)
+		count := summary.Histogram[name]
+		bar := 0
+		if maxCount > 0 {
+			bar = int(count * loadHistogramWidth / maxCount)
+		}
+		fmt.Printf("  %9s %8d %s\n", name, count, strings.Repeat("#", bar))
+	}
+}
+
+func (load *netLoadOptions) clients() int {
+	if load.concurrency <= 0 {
+		return loadDefaultConcurrency
+	}
+	return load.concurrency
+}
+
+// runNetLoad issues the step concurrently without retries until the duration or the number of requests is exhausted
+func runNetLoad(step *netStep, load *netLoadOptions, jsonFile string) bool {
+	if err := resolveAuthorization(step.Headers); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return false
+	}
+	concurrency := load.clients()
+	duration := load.duration
+	if duration <= 0 && load.requests <= 0 {
+		duration = loadDefaultDuration
+	}
+	var deadline time.Time
+	if duration > 0 {
+		deadline = time.Now().Add(duration)
+	}
+	var ticker *time.Ticker
+	if load.rate > 0 {
+		ticker = time.NewTicker(time.Duration(float64(time.Second) / load.rate))
+		defer ticker.Stop()
+	}
+	collector := &netLoadCollector{outcomes: make(map[string]int64)}
+	var issued int64
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				if load.requests > 0 && atomic.AddInt64(&issued, 1) > load.requests {
+					return
+				}
+				if ticker != nil {
+					<-ticker.C
+				}
+				if !deadline.IsZero() && time.Now().After(deadline) {
+					return
+				}
+				result := executeNetRequest(step)
+				if result.Err == nil {
+					result.Failures = checkAssertions(step.Assertions, result)
+				}
+				collector.add(result)
+			}
+		}()
+	}
+	wg.Wait()
+	summary := collector.summarize(time.Since(start))
+	presentNetLoadSummary(summary)
+	if jsonFile != "" {
+		data, err := json.MarshalIndent(summary, "", "  ")
+		if err == nil {
+			err = ioutil.WriteFile(jsonFile, data, 0644)
+		}
+		if err != nil {
+			fmt.Printf("Cannot write report %s: %v\n", jsonFile, err)
+			return false
+		}
+	}
+	return summary.Errors == 0
+}
@@ -0,0 +1,46 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func createTestNetStep(t *testing.T, assertions ...string) *netStep {
+	step := &netStep{Name: "load", Method: "GET", Url: "http://localhost/", Headers: map[string]string{}}
+	for _, source := range assertions {
+		a, err := parseNetAssertion(source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		step.Assertions = append(step.Assertions, a)
+	}
+	return step
+}
+
+func TestNetLoadCollectorCountsErrors(t *testing.T) {
+	for _, test := range []struct {
+		assertions []string
+		status     int
+		failures   []string
+		err        error
+		expected   int64
+	}{
+		{nil, 200, nil, nil, 0},
+		{nil, 404, nil, nil, 1},
+		{[]string{"status == 404"}, 404, nil, nil, 0},
+		{[]string{"status ~ ^(404|409)$"}, 409, nil, nil, 0},
+		{[]string{"status != 404"}, 500, nil, nil, 1},
+		{[]string{"status == 404"}, 500, []string{"status 500 == 404"}, nil, 1},
+		{[]string{"status == 404"}, 0, nil, errors.New("connection refused"), 1},
+	} {
+		collector := &netLoadCollector{outcomes: make(map[string]int64)}
+		step := createTestNetStep(t, test.assertions...)
+		collector.add(&netResult{Step: step, StatusCode: test.status, Failures: test.failures, Err: test.err, Duration: time.Millisecond})
+		if collector.errors != test.expected {
+			t.Errorf("%v with status %d: %d errors instead of %d", test.assertions, test.status, collector.errors, test.expected)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Error     *junitFailure `xml:"error,omitempty"`
+}
+
+type junitTestSuite struct {
+	XMLName   xml.Name         `xml:"testsuite"`
+	Name      string           `xml:"name,attr"`
+	Tests     int              `xml:"tests,attr"`
+	Failures  int              `xml:"failures,attr"`
+	Errors    int              `xml:"errors,attr"`
+	Time      string           `xml:"time,attr"`
+	TestCases []*junitTestCase `xml:"testcase"`
+}
+
+type jsonNetResult struct {
+	Name       string   `json:"name"`
+	Method     string   `json:"method"`
+	Url        string   `json:"url"`
+	StatusCode int      `json:"status"`
+	TimeMs     int64    `json:"timeMs"`
+	Passed     bool     `json:"passed"`
+	Failures   []string `json:"failures,omitempty"`
+	Error      string   `json:"error,omitempty"`
+}
+
+func formatSeconds(ms int64) string {
+	return fmt.Sprintf("%.3f", float64(ms)/1000)
+}
+
+func createJUnitReport(results []*netResult) ([]byte, error) {
+	suite := &junitTestSuite{Name: "dvnetwork", Tests: len(results)}
+	var total int64
+	for _, result := range results {
+		ms := result.Duration.Milliseconds()
+		total += ms
+		testCase := &junitTestCase{
+			Name:      result.Step.Name,
+			ClassName: result.Step.Method + " " + result.Step.Url,
+			Time:      formatSeconds(ms),
+		}
+		if result.Err != nil {
+			suite.Errors++
+			testCase.Error = &junitFailure{Message: result.Err.Error()}
+		} else if len(result.Failures) > 0 {
+			suite.Failures++
+			testCase.Failure = &junitFailure{Message: result.Failures[0], Text: strings.Join(result.Failures, "\n")}
+		}
+		suite.TestCases = append(suite.TestCases, testCase)
+	}
+	suite.Time = formatSeconds(total)
+	data, err := xml.MarshalIndent(suite, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), data...), nil
+}
+
+func createJsonReport(results []*netResult) ([]byte, error) {
+	list := make([]*jsonNetResult, len(results))
+	for i, result := range results {
+		item := &jsonNetResult{
+			Name:       result.Step.Name,
+			Method:     result.Step.Method,
+			Url:        result.Step.Url,
+			StatusCode: result.StatusCode,
+			TimeMs:     result.Duration.Milliseconds(),
+			Passed:     result.Err == nil && len(result.Failures) == 0,
+			Failures:   result.Failures,
+		}
+		if result.Err != nil {
+			item.Error = result.Err.Error()
+		}
+		list[i] = item
+	}
+	return json.MarshalIndent(list, "", "  ")
+}
+
+func writeNetReport(fileName string, results []*netResult, creator func([]*netResult) ([]byte, error)) bool {
+	if fileName == "" {
+		return true
+	}
+	data, err := creator(results)
+	if err == nil {
+		err = ioutil.WriteFile(fileName, data, 0644)
+	}
+	if err != nil {
+		fmt.Printf("Cannot write report %s: %v\n", fileName, err)
+		return false
+	}
+	return true
+}
+
+func writeNetReports(results []*netResult, options *netOptions) bool {
+	ok := writeNetReport(options.junitFile, results, createJUnitReport)
+	return writeNetReport(options.jsonFile, results, createJsonReport) && ok
+}
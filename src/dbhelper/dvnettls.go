@@ -0,0 +1,212 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// the properties are used when the corresponding command line options are not specified
+const (
+	netTlsCertProperty     = "NET_TLS_CERT"
+	netTlsKeyProperty      = "NET_TLS_KEY"
+	netTlsCaProperty       = "NET_TLS_CA"
+	netTlsInsecureProperty = "NET_TLS_INSECURE"
+	netProxyProperty       = "NET_PROXY"
+	netNoProxyProperty     = "NET_NO_PROXY"
+)
+
+const (
+	netTransportTimeout          = 360 * time.Second
+	netTransportIdleTimeout      = 240 * time.Second
+	netTransportHandshakeTimeout = 10 * time.Second
+	netTransportMaxIdle          = 100
+)
+
+var helpNetTlsOptions = "" +
+	"  --cert=<file>         client certificate (PEM) for mutual TLS, property NET_TLS_CERT\n" +
+	"  --key=<file>          private key (PEM) of the client certificate, property NET_TLS_KEY (default - the --cert file)\n" +
+	"  --cacert=<file>       CA bundle (PEM) to verify the servers in addition to the system ones, property NET_TLS_CA\n" +
+	"  --proxy=<url>         HTTP(S) proxy, property NET_PROXY (default - HTTPS_PROXY/HTTP_PROXY environment)\n" +
+	"  --no-proxy=<list>     hosts, domains (.example.com), CIDRs or * to reach without proxy, property NET_NO_PROXY\n" +
+	"                        (default - NO_PROXY environment)\n" +
+	"  --insecure            skip the verification of the server certificates, property NET_TLS_INSECURE=true\n"
+
+type netTlsOptions struct {
+	certFile string
+	keyFile  string
+	caFile   string
+	proxy    string
+	noProxy  string
+	insecure bool
+}
+
+func readNetTlsOption(options *netTlsOptions, arg string) bool {
+	switch {
+	case strings.HasPrefix(arg, "--cert="):
+		options.certFile = arg[len("--cert="):]
+	case strings.HasPrefix(arg, "--key="):
+		options.keyFile = arg[len("--key="):]
+	case strings.HasPrefix(arg, "--cacert="):
+		options.caFile = arg[len("--cacert="):]
+	case strings.HasPrefix(arg, "--proxy="):
+		options.proxy = arg[len("--proxy="):]
+	case strings.HasPrefix(arg, "--no-proxy="):
+		options.noProxy = arg[len("--no-proxy="):]
+	case arg == "--insecure":
+		options.insecure = true
+	default:
+		return false
+	}
+	return true
+}
+
+func (options *netTlsOptions) applyProperties(params map[string]string) {
+	if options.certFile == "" {
+		options.certFile = params[netTlsCertProperty]
+	}
+	if options.keyFile == "" {
+		options.keyFile = params[netTlsKeyProperty]
+	}
+	if options.caFile == "" {
+		options.caFile = params[netTlsCaProperty]
+	}
+	if options.proxy == "" {
+		options.proxy = params[netProxyProperty]
+	}
+	if options.noProxy == "" {
+		options.noProxy = params[netNoProxyProperty]
+	}
+	if params[netTlsInsecureProperty] == "true" {
+		options.insecure = true
+	}
+}
+
+func createTlsConfig(options *netTlsOptions) (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: options.insecure}
+	if options.certFile != "" {
+		keyFile := options.keyFile
+		if keyFile == "" {
+			keyFile = options.certFile
+		}
+		cert, err := tls.LoadX509KeyPair(options.certFile, keyFile)
+		if err != nil {
+			return nil, errors.New("cannot load the client certificate: " + err.Error())
+		}
+		config.Certificates = []tls.Certificate{cert}
+	} else if options.keyFile != "" {
+		return nil, errors.New("the client key is specified without the certificate")
+	}
+	if options.caFile != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		data, err := ioutil.ReadFile(options.caFile)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("no certificates found in " + options.caFile)
+		}
+		config.RootCAs = pool
+	}
+	return config, nil
+}
+
+// isNoProxyHost checks the host against the list in the NO_PROXY style: exact hosts, domain suffixes, CIDRs and *
+func isNoProxyHost(noProxy []string, hostPort string) bool {
+	host, port, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		host = hostPort
+	}
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, item := range noProxy {
+		item = strings.ToLower(strings.TrimSpace(item))
+		switch {
+		case item == "":
+		case item == "*":
+			return true
+		case strings.Contains(item, "/"):
+			if _, network, err := net.ParseCIDR(item); err == nil && ip != nil && network.Contains(ip) {
+				return true
+			}
+		default:
+			itemHost, itemPort, err := net.SplitHostPort(item)
+			if err != nil {
+				itemHost, itemPort = item, ""
+			}
+			if itemPort != "" && itemPort != port {
+				continue
+			}
+			if host == strings.TrimPrefix(itemHost, ".") || strings.HasSuffix(host, "."+strings.TrimPrefix(itemHost, ".")) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func createProxyFunc(options *netTlsOptions) (func(*http.Request) (*url.URL, error), error) {
+	if options.proxy == "" && options.noProxy == "" {
+		return http.ProxyFromEnvironment, nil
+	}
+	var proxyUrl *url.URL
+	if options.proxy != "" {
+		var err error
+		if proxyUrl, err = url.Parse(options.proxy); err != nil || proxyUrl.Host == "" {
+			return nil, errors.New("incorrect proxy " + options.proxy)
+		}
+	}
+	noProxy := strings.Split(options.noProxy, ",")
+	return func(request *http.Request) (*url.URL, error) {
+		if isNoProxyHost(noProxy, request.URL.Host) {
+			return nil, nil
+		}
+		if proxyUrl == nil {
+			return http.ProxyFromEnvironment(request)
+		}
+		return proxyUrl, nil
+	}, nil
+}
+
+func createNetClient(options *netTlsOptions) (*http.Client, error) {
+	tlsConfig, err := createTlsConfig(options)
+	if err != nil {
+		return nil, err
+	}
+	proxy, err := createProxyFunc(options)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Timeout: netTransportTimeout,
+		Transport: &http.Transport{
+			Proxy:               proxy,
+			TLSClientConfig:     tlsConfig,
+			ForceAttemptHTTP2:   true,
+			MaxIdleConns:        netTransportMaxIdle,
+			IdleConnTimeout:     netTransportIdleTimeout,
+			TLSHandshakeTimeout: netTransportHandshakeTimeout,
+		},
+	}, nil
+}
+
+// setNetClientConnections keeps a connection per concurrent client, otherwise only 2 idle connections are kept per host
+func setNetClientConnections(client *http.Client, connections int) {
+	if transport, ok := client.Transport.(*http.Transport); ok {
+		transport.MaxIdleConnsPerHost = connections
+		if transport.MaxIdleConns < connections {
+			transport.MaxIdleConns = connections
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCertificates are the PEM files of a CA with the server certificate for 127.0.0.1 and a client certificate
+type testCertificates struct {
+	caFile     string
+	serverFile string
+	serverKey  string
+	clientFile string
+	clientKey  string
+	pool       *x509.CertPool
+	server     tls.Certificate
+}
+
+func writeTestPem(t *testing.T, fileName string, kind string, der []byte) {
+	if err := ioutil.WriteFile(fileName, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func issueTestCertificate(t *testing.T, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey, certFile string, keyFile string) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestPem(t, certFile, "CERTIFICATE", der)
+	if keyFile != "" {
+		writeTestPem(t, keyFile, "EC PRIVATE KEY", keyDer)
+	}
+	return cert, key
+}
+
+func createTestCertificates(t *testing.T) *testCertificates {
+	dir := t.TempDir()
+	certs := &testCertificates{
+		caFile:     filepath.Join(dir, "ca.pem"),
+		serverFile: filepath.Join(dir, "server.pem"),
+		serverKey:  filepath.Join(dir, "server.key"),
+		clientFile: filepath.Join(dir, "client.pem"),
+		clientKey:  filepath.Join(dir, "client.key"),
+	}
+	now := time.Now()
+	ca, caKey := issueTestCertificate(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil, nil, certs.caFile, "")
+	issueTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, ca, caKey, certs.serverFile, certs.serverKey)
+	issueTestCertificate(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    now.Add(-time.Hour),
+		NotAfter:     now.Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, caKey, certs.clientFile, certs.clientKey)
+	certs.pool = x509.NewCertPool()
+	certs.pool.AddCert(ca)
+	var err error
+	if certs.server, err = tls.LoadX509KeyPair(certs.serverFile, certs.serverKey); err != nil {
+		t.Fatal(err)
+	}
+	return certs
+}
+
+// startTestTlsServer serves the handler by the server certificate, the client certificate is required if mutual
+func startTestTlsServer(certs *testCertificates, mutual bool, handler http.Handler) *httptest.Server {
+	server := httptest.NewUnstartedServer(handler)
+	server.TLS = &tls.Config{Certificates: []tls.Certificate{certs.server}}
+	if mutual {
+		server.TLS.ClientAuth = tls.RequireAndVerifyClientCert
+		server.TLS.ClientCAs = certs.pool
+	}
+	server.StartTLS()
+	return server
+}
+
+func getTestUrl(options *netTlsOptions, u string) error {
+	client, err := createNetClient(options)
+	if err != nil {
+		return err
+	}
+	response, err := client.Get(u)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok"))
+})
+
+func TestNetClientVerifiesServer(t *testing.T) {
+	certs := createTestCertificates(t)
+	server := startTestTlsServer(certs, false, okHandler)
+	defer server.Close()
+	if err := getTestUrl(&netTlsOptions{}, server.URL); err == nil {
+		t.Fatal("the server with the untrusted certificate is accepted by default")
+	}
+	if err := getTestUrl(&netTlsOptions{caFile: certs.caFile}, server.URL); err != nil {
+		t.Fatalf("the server is not trusted by the CA bundle: %v", err)
+	}
+	if err := getTestUrl(&netTlsOptions{insecure: true}, server.URL); err != nil {
+		t.Fatalf("the server is not accepted by --insecure: %v", err)
+	}
+}
+
+func TestNetClientMutualTls(t *testing.T) {
+	certs := createTestCertificates(t)
+	server := startTestTlsServer(certs, true, okHandler)
+	defer server.Close()
+	if err := getTestUrl(&netTlsOptions{caFile: certs.caFile}, server.URL); err == nil {
+		t.Fatal("the server accepted the client without the certificate")
+	}
+	options := &netTlsOptions{caFile: certs.caFile, certFile: certs.clientFile, keyFile: certs.clientKey}
+	if err := getTestUrl(options, server.URL); err != nil {
+		t.Fatalf("the client certificate is not accepted: %v", err)
+	}
+}
+
+func TestNetClientOptions(t *testing.T) {
+	options := &netTlsOptions{}
+	for _, arg := range []string{"--cacert=ca.pem", "--cert=c.pem", "--key=c.key", "--insecure"} {
+		if !readNetTlsOption(options, arg) {
+			t.Fatalf("%s is not a TLS option", arg)
+		}
+	}
+	if readNetTlsOption(options, "--force") {
+		t.Fatal("--force is taken as a TLS option")
+	}
+	expected := netTlsOptions{caFile: "ca.pem", certFile: "c.pem", keyFile: "c.key", insecure: true}
+	if *options != expected {
+		t.Fatalf("options %+v instead of %+v", *options, expected)
+	}
+	if _, err := createNetClient(&netTlsOptions{keyFile: "c.key"}); err == nil {
+		t.Fatal("the key without the certificate is accepted")
+	}
+}
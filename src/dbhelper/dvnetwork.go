@@ -3,15 +3,20 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"github.com/Dobryvechir/microcore/pkg/dvaction"
 	"github.com/Dobryvechir/microcore/pkg/dvnet"
+	"github.com/Dobryvechir/microcore/pkg/dvoc"
 	"github.com/Dobryvechir/microcore/pkg/dvparser"
 	"github.com/Dobryvechir/microcore/pkg/dvtextutils"
 	"io/ioutil"
+	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var copyright = "Copyright by Danyil Dobryvechir 2019"
@@ -21,93 +26,521 @@ const (
 	ContentType   = "Content-Type"
 )
 
+const (
+	netSequencePrefix = "EXECUTE_NET"
+	netRepeatPause    = 5 * time.Second
+	netDefaultRepeats = 7
+)
+
+var helpDvNetwork = copyright + "\nSpecify property EXECUTE_NET_1 or provide the command line parameters as follows:\n" +
+	"dvnetwork [options] <url property> <method (default - GET)> <header,,,list> <body> <addMessage> <repeats>\n" +
+	"options:\n" +
+	"  --assert=<assertion>  check the response, can be repeated; assertions are\n" +
+	"                        status <op> 200, time <op> 500 (milliseconds), header:<name> <op> value,\n" +
+	"                        json:<JSONPath> <op> value, body <op> value\n" +
+	"                        where <op> is one of == != < <= > >= ~ (regex) !~ (not regex),\n" +
+	"                        an assertion without operator and value checks the presence only\n" +
+	"  --junit=<file>        write the results as JUnit XML\n" +
+	"  --json=<file>         write the results as JSON\n" +
+	"  --extract=<rule>      store a value of the response in the property, can be repeated; rules are\n" +
+	"                        NAME=json:<JSONPath>, NAME=regex:<expression> (the first group if any), NAME=header:<name>\n" +
+	"  --extract-file=<file> also save the extracted properties in the properties file\n" +
+	"  --form=<field>        send multipart/form-data, can be repeated; fields are name=value or\n" +
+	"                        name=@<file>[;type=<content type>] (the content type is detected if not set)\n" +
+	"  --save=<file>         save the response body to the file; if it is a folder (or ends with /), the name is taken\n" +
+	"                        from Content-Disposition or the url and the extension from the detected content type\n" +
+	"  --load                run the request concurrently and report throughput and latency percentiles\n" +
+	"  --concurrency=<n>     number of concurrent clients in the load mode (default 10)\n" +
+	"  --duration=<time>     duration of the load mode, such as 30s or 5m (default 10s if --requests is not set)\n" +
+	"  --requests=<n>        total number of requests in the load mode\n" +
+	"  --rate=<n>            maximum number of requests per second in the load mode\n" +
+	"  --import-curl=<file>  convert the curl command (such as copied from the browser) into the EXECUTE_NET block\n" +
+	"  --import-har=<file>   convert the requests of the HAR file into EXECUTE_NET blocks; the imported bodies with\n" +
+	"                        line breaks are saved in .body files next to the output and sent as _BODY=@<file>\n" +
+	"  --har-filter=<regex>  import only the HAR requests whose url matches the regular expression\n" +
+	"  --step=<n>            number of the first imported EXECUTE_NET block (default 1)\n" +
+	"  --output=<file>       save the imported blocks in the file instead of printing them\n" +
+	"  --export-curl         print the curl commands for the request or the EXECUTE_NET blocks instead of running them\n" +
+	helpNetTlsOptions +
+	"The body @<file> is sent from the file.\n" +
+	"The EXECUTE_NET_1 sequence of dvaction and the property requests do not verify the certificates and need --insecure.\n" +
+	"Requests in EXECUTE_NET sequences can be defined by property blocks EXECUTE_NET_<n>_URL, _METHOD, _HEADERS,\n" +
+	"_BODY, _FORM_1, _FORM_2, ..., _SAVE, _NAME, _REPEATS, the assertions _ASSERT_1, _ASSERT_2, ..., the extractions _EXTRACT_1, _EXTRACT_2, ...\n" +
+	"and _EXTRACT_FILE; the extracted values are available to the next steps as {{{NAME}}}"
+
+type netOptions struct {
+	assertions  []string
+	junitFile   string
+	jsonFile    string
+	extractions []string
+	extractFile string
+	forms       []string
+	saveFile    string
+	load        netLoadOptions
+	imports     netImportOptions
+	tls         netTlsOptions
+}
+
+type netStep struct {
+	Name        string
+	Method      string
+	Url         string
+	Headers     map[string]string
+	Body        string
+	AddMessage  string
+	Repeats     int
+	Assertions  []*netAssertion
+	Extractions []*netExtraction
+	ExtractFile string
+	Form        []*netFormField
+	SaveFile    string
+	bodyData    []byte
+}
+
+type netResult struct {
+	Step        *netStep
+	StatusCode  int
+	Headers     http.Header
+	Body        []byte
+	Duration    time.Duration
+	Err         error
+	Failures    []string
+	SavedFile   string
+	ContentType string
+}
+
+var netClient *http.Client
+
+func readNetOptions(args []string) (options *netOptions, rest []string) {
+	options = &netOptions{}
+	l := len(args)
+	i := 0
+	for ; i < l && strings.HasPrefix(args[i], "--"); i++ {
+		arg := args[i]
+		switch {
+		case strings.HasPrefix(arg, "--assert="):
+			options.assertions = append(options.assertions, arg[len("--assert="):])
+		case strings.HasPrefix(arg, "--junit="):
+			options.junitFile = arg[len("--junit="):]
+		case strings.HasPrefix(arg, "--json="):
+			options.jsonFile = arg[len("--json="):]
+		case strings.HasPrefix(arg, "--extract="):
+			options.extractions = append(options.extractions, arg[len("--extract="):])
+		case strings.HasPrefix(arg, "--extract-file="):
+			options.extractFile = arg[len("--extract-file="):]
+		case strings.HasPrefix(arg, "--form="):
+			options.forms = append(options.forms, arg[len("--form="):])
+		case strings.HasPrefix(arg, "--save="):
+			options.saveFile = arg[len("--save="):]
+		default:
+			ok, err := readNetLoadOption(&options.load, arg)
+			if !ok && err == nil {
+				ok, err = readNetImportOption(&options.imports, arg)
+			}
+			if !ok && err == nil {
+				ok = readNetTlsOption(&options.tls, arg)
+			}
+			if err != nil {
+				fmt.Printf("Incorrect option %s: %v\n", arg, err)
+				os.Exit(1)
+			}
+			if !ok {
+				fmt.Printf("Unknown option %s\n", arg)
+				fmt.Println(helpDvNetwork)
+				os.Exit(1)
+			}
+		}
+	}
+	rest = args[i:]
+	return
+}
+
+func resolveAuthorization(headers map[string]string) error {
+	if !strings.HasPrefix(headers[Authorization], "M2M_") {
+		return nil
+	}
+	microServiceName := headers[Authorization][4:]
+	token, ok := dvoc.GetM2MToken(microServiceName)
+	if !ok {
+		return errors.New("cannot get M2M token for " + microServiceName)
+	}
+	headers[Authorization] = token
+	return nil
+}
+
+func executeNetRequest(step *netStep) *netResult {
+	result := &netResult{Step: step}
+	headers := make(map[string]string, len(step.Headers))
+	for k, v := range step.Headers {
+		headers[k] = v
+	}
+	if result.Err = resolveAuthorization(headers); result.Err != nil {
+		return result
+	}
+	request, err := http.NewRequest(step.Method, step.Url, bytes.NewReader(step.bodyData))
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	for k, v := range headers {
+		request.Header.Set(k, v)
+	}
+	start := time.Now()
+	response, err := netClient.Do(request)
+	if err == nil {
+		result.Body, err = ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		result.StatusCode = response.StatusCode
+		result.Headers = response.Header
+	}
+	result.Duration = time.Since(start)
+	result.Err = err
+	return result
+}
+
+func runNetStep(step *netStep) *netResult {
+	repeats := step.Repeats
+	if repeats <= 0 {
+		repeats = 1
+		if step.Method != "POST" {
+			repeats = netDefaultRepeats
+		}
+	}
+	var result *netResult
+	for ; repeats > 0; repeats-- {
+		result = executeNetRequest(step)
+		if result.Err == nil && (result.StatusCode < 400 || isStatusAsserted(step.Assertions, result.StatusCode)) {
+			break
+		}
+		if repeats > 1 {
+			time.Sleep(netRepeatPause)
+		}
+	}
+	if result.Err == nil && result.StatusCode >= 400 && !isStatusAsserted(step.Assertions, result.StatusCode) {
+		result.Err = fmt.Errorf("status %d: %s", result.StatusCode, string(result.Body))
+	}
+	if result.Err == nil {
+		result.Failures = checkAssertions(step.Assertions, result)
+		values, failures := applyExtractions(step.Extractions, result)
+		result.Failures = append(result.Failures, failures...)
+		if err := saveExtractedProperties(step.ExtractFile, values); err != nil {
+			result.Failures = append(result.Failures, "cannot save "+step.ExtractFile+": "+err.Error())
+		}
+		if step.SaveFile != "" {
+			if err := saveNetResponse(result); err != nil {
+				result.Failures = append(result.Failures, "cannot save the response: "+err.Error())
+			}
+		}
+	}
+	return result
+}
+
+func presentResponse(addMessage string, data []byte) bool {
+	if addMessage == "" || addMessage[:1] != "@" {
+		fmt.Printf("%s%s\n", addMessage, string(data))
+		return true
+	}
+	dvparser.SetGlobalPropertiesValue("RESPONSE", string(data))
+	addMessage, err := dvparser.SmartReadFileAsString(addMessage[1:])
+	if err != nil {
+		fmt.Printf("Error: %s", err.Error())
+		return false
+	}
+	fileName := dvparser.GlobalProperties["SAVE_RESULT"]
+	if fileName == "" {
+		fmt.Printf("%s\n", addMessage)
+		return true
+	}
+	err = ioutil.WriteFile(fileName, []byte(addMessage), 0644)
+	if err != nil {
+		fmt.Printf("Cannot save results to %s: %v", fileName, err)
+		return false
+	}
+	return true
+}
+
+func presentNetResult(result *netResult) bool {
+	if result.Err != nil {
+		fmt.Printf("%s: ERROR %v\n", result.Step.Name, result.Err)
+		return false
+	}
+	if len(result.Failures) > 0 {
+		fmt.Printf("%s: FAILED (status %d, %d ms)\n", result.Step.Name, result.StatusCode, result.Duration.Milliseconds())
+		for _, failure := range result.Failures {
+			fmt.Printf("  %s\n", failure)
+		}
+		return false
+	}
+	fmt.Printf("%s: PASSED (status %d, %d ms)\n", result.Step.Name, result.StatusCode, result.Duration.Milliseconds())
+	if result.SavedFile != "" {
+		fmt.Print("  ")
+		presentSavedResponse(result)
+	}
+	return true
+}
+
+func convertStepValue(value string, place string) string {
+	if !strings.Contains(value, "{{") {
+		return value
+	}
+	res, err := dvparser.ConvertStringByGlobalProperties(value, place)
+	if err != nil {
+		fmt.Printf("Error in %s: %v\n", place, err)
+		os.Exit(1)
+	}
+	return res
+}
+
+func readStepUrl(url string) string {
+	if dvparser.GlobalProperties[url] != "" {
+		return dvparser.GlobalProperties[url]
+	}
+	return url
+}
+
+func readNetSequenceStep(prefix string) (*netStep, error) {
+	params := dvparser.GlobalProperties
+	step := &netStep{
+		Name:    params[prefix+"_NAME"],
+		Method:  convertStepValue(params[prefix+"_METHOD"], prefix+"_METHOD"),
+		Url:     readStepUrl(convertStepValue(params[prefix+"_URL"], prefix+"_URL")),
+		Headers: make(map[string]string),
+		Body:    convertStepValue(params[prefix+"_BODY"], prefix+"_BODY"),
+	}
+	if step.Name == "" {
+		step.Name = prefix
+	}
+	if step.Method == "" {
+		step.Method = "GET"
+	}
+	if headers := convertStepValue(params[prefix+"_HEADERS"], prefix+"_HEADERS"); headers != "" {
+		dvtextutils.PutDescribedAttributesToMapFromCommaSeparatedList(params, step.Headers, headers)
+	}
+	if repeats := params[prefix+"_REPEATS"]; repeats != "" {
+		n, err := strconv.Atoi(repeats)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("incorrect number of repeats in %s_REPEATS: %s", prefix, repeats)
+		}
+		step.Repeats = n
+	}
+	for i := 1; ; i++ {
+		key := prefix + "_ASSERT_" + strconv.Itoa(i)
+		assertion, ok := params[key]
+		if !ok {
+			break
+		}
+		a, err := parseNetAssertion(convertStepValue(assertion, key))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		step.Assertions = append(step.Assertions, a)
+	}
+	for i := 1; ; i++ {
+		key := prefix + "_EXTRACT_" + strconv.Itoa(i)
+		extraction, ok := params[key]
+		if !ok {
+			break
+		}
+		e, err := parseNetExtraction(extraction)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		step.Extractions = append(step.Extractions, e)
+	}
+	step.ExtractFile = convertStepValue(params[prefix+"_EXTRACT_FILE"], prefix+"_EXTRACT_FILE")
+	for i := 1; ; i++ {
+		key := prefix + "_FORM_" + strconv.Itoa(i)
+		field, ok := params[key]
+		if !ok {
+			break
+		}
+		f, err := parseNetFormField(convertStepValue(field, key))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		step.Form = append(step.Form, f)
+	}
+	step.SaveFile = convertStepValue(params[prefix+"_SAVE"], prefix+"_SAVE")
+	return step, nil
+}
+
+func runNetSequence(prefix string, options *netOptions) bool {
+	if options.imports.exportCurl {
+		return exportNetSequence(prefix)
+	}
+	results := make([]*netResult, 0, 16)
+	ok := true
+	for n := 1; ; n++ {
+		stepPrefix := prefix + "_" + strconv.Itoa(n)
+		if dvparser.GlobalProperties[stepPrefix+"_URL"] == "" {
+			break
+		}
+		step, err := readNetSequenceStep(stepPrefix)
+		if err == nil {
+			err = prepareNetBody(step)
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			ok = false
+			break
+		}
+		result := runNetStep(step)
+		results = append(results, result)
+		if !presentNetResult(result) {
+			ok = false
+		}
+	}
+	return writeNetReports(results, options) && ok
+}
+
+func exportNetSequence(prefix string) bool {
+	for n := 1; ; n++ {
+		stepPrefix := prefix + "_" + strconv.Itoa(n)
+		if dvparser.GlobalProperties[stepPrefix+"_URL"] == "" {
+			return true
+		}
+		step, err := readNetSequenceStep(stepPrefix)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return false
+		}
+		fmt.Printf("# %s\n%s\n\n", step.Name, formatCurlCommand(step))
+	}
+}
+
+// checkLegacyNetInsecure refuses the requests of the library, which does not verify the server certificates,
+// unless the verification is skipped explicitly
+func checkLegacyNetInsecure(options *netTlsOptions) {
+	if !options.insecure {
+		fmt.Println("Error: the EXECUTE_NET_1 sequence and the property requests do not verify the server certificates, use --insecure to run them")
+		os.Exit(1)
+	}
+}
+
 func main() {
 	args := dvparser.InitAndReadCommandLine()
+	options, args := readNetOptions(args)
 	params := dvparser.GlobalProperties
+	if options.imports.curlFile != "" || options.imports.harFile != "" {
+		if !runNetImport(&options.imports) {
+			os.Exit(1)
+		}
+		return
+	}
+	options.tls.applyProperties(params)
+	var err error
+	if netClient, err = createNetClient(&options.tls); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if options.load.enabled {
+		setNetClientConnections(netClient, options.load.clients())
+	}
 	l := len(args)
 	if l < 1 {
-		if params["EXECUTE_NET_1"] == "" {
-			fmt.Println(copyright)
-			fmt.Println("Specify property EXECUTE_NET_1 or provide the command line parameters as follows:")
-			fmt.Println("dvnetwork <url property> <method (default - GET)> <header,,,list> <body> <addMessage> <repeats>")
+		if params[netSequencePrefix+"_1_URL"] != "" {
+			if !runNetSequence(netSequencePrefix, options) {
+				os.Exit(1)
+			}
+		} else if params[netSequencePrefix+"_1"] == "" {
+			fmt.Println(helpDvNetwork)
 		} else {
-			dvaction.ExecuteSequence("EXECUTE_NET",nil,nil)
+			checkLegacyNetInsecure(&options.tls)
+			dvaction.ExecuteSequence(netSequencePrefix, nil, nil)
 		}
 		return
 	}
-	url := args[0]
-	if params[url] != "" {
-		url = params[url]
-	}
+	url := readStepUrl(args[0])
 	if strings.Index(url, "http") != 0 {
+		checkLegacyNetInsecure(&options.tls)
 		err := dvnet.UpdatePropertiesThruNetRequest(url)
 		if err != nil {
 			panic("Error: " + err.Error())
 		}
 		return
 	}
-	method := "GET"
+	step := &netStep{Name: url, Method: "GET", Url: url, Headers: make(map[string]string)}
 	if l > 1 {
-		method = args[1]
+		step.Method = args[1]
 	}
-	headers := make(map[string]string)
 	if l > 2 {
-		dvtextutils.PutDescribedAttributesToMapFromCommaSeparatedList(params, headers, args[2])
+		dvtextutils.PutDescribedAttributesToMapFromCommaSeparatedList(params, step.Headers, args[2])
 	}
-	body := ""
 	if l > 3 {
-		body = args[3]
-		if params[body] != "" {
-			body = params[body]
+		step.Body = args[3]
+		if params[step.Body] != "" {
+			step.Body = params[step.Body]
 		}
 	}
-	addMessage := ""
 	if l > 4 {
-		addMessage = args[4]
+		step.AddMessage = args[4]
 	}
-	repeats := 0
 	if l > 5 {
 		if nrepeats, err1 := strconv.Atoi(args[5]); err1 != nil || nrepeats < 0 {
 			fmt.Printf("Incorrect number of repeats: %s\n", args[5])
 		} else {
-			repeats = nrepeats
+			step.Repeats = nrepeats
 		}
 	}
-	options := map[string]interface{}{
-		"repeats": repeats,
+	for _, assertion := range options.assertions {
+		a, err := parseNetAssertion(assertion)
+		if err != nil {
+			fmt.Printf("Error in assertion %s: %v\n", assertion, err)
+			os.Exit(1)
+		}
+		step.Assertions = append(step.Assertions, a)
 	}
-	if strings.HasPrefix(headers[Authorization], "M2M_") {
-		microServiceName := headers[Authorization][4:]
-		options["M2M"] = microServiceName
+	for _, extraction := range options.extractions {
+		e, err := parseNetExtraction(extraction)
+		if err != nil {
+			fmt.Printf("Error in extraction %s: %v\n", extraction, err)
+			os.Exit(1)
+		}
+		step.Extractions = append(step.Extractions, e)
 	}
-	data, err, _, _ := dvnet.NewRequest(method, url, body, headers, options)
-	if err != nil {
-		fmt.Printf("Error: %s", err.Error())
-	} else {
-		if addMessage == "" || addMessage[:1] != "@" {
-			fmt.Printf("%s%s\n", addMessage, string(data))
-		} else {
-			properties := dvparser.CloneGlobalProperties()
-			properties["RESPONSE"] = string(data)
-			addMessage, err = dvparser.SmartReadFileAsString(addMessage[1:])
-			if err != nil {
-				fmt.Printf("Error: %s", err.Error())
-			} else {
-				fileName := properties["SAVE_RESULT"]
-				if fileName != "" {
-					err = ioutil.WriteFile(fileName, []byte(addMessage), 0644)
-					if err != nil {
-						fmt.Printf("Cannot save results to %s: %v", fileName, err)
-					} else {
-						return
-					}
-
-				} else {
-					fmt.Printf("%s\n", addMessage)
-					return
-				}
-			}
+	step.ExtractFile = options.extractFile
+	for _, field := range options.forms {
+		f, err := parseNetFormField(field)
+		if err != nil {
+			fmt.Printf("Error in form field %s: %v\n", field, err)
+			os.Exit(1)
+		}
+		step.Form = append(step.Form, f)
+	}
+	step.SaveFile = options.saveFile
+	if options.imports.exportCurl {
+		fmt.Println(formatCurlCommand(step))
+		return
+	}
+	if err := prepareNetBody(step); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if options.load.enabled {
+		if !runNetLoad(step, &options.load, options.jsonFile) {
+			os.Exit(1)
+		}
+		return
+	}
+	result := runNetStep(step)
+	reported := writeNetReports([]*netResult{result}, options)
+	if result.Err != nil {
+		fmt.Printf("Error: %s", result.Err.Error())
+		os.Exit(1)
+	}
+	if step.SaveFile != "" {
+		if len(result.Failures) == 0 {
+			presentSavedResponse(result)
 		}
+	} else if contentType := detectResponseContentType(result); !isTextContentType(contentType) && step.AddMessage == "" {
+		fmt.Printf("Binary response of %d bytes of %s, use --save=<file> to store it\n", len(result.Body), contentType)
+	} else if !presentResponse(step.AddMessage, result.Body) {
+		os.Exit(1)
+	}
+	if !reported {
+		os.Exit(1)
+	}
+	if len(step.Assertions)+len(step.Extractions) > 0 && !presentNetResult(result) {
+		os.Exit(1)
 	}
-	os.Exit(1)
 }
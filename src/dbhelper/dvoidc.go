@@ -0,0 +1,252 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Dobryvechir/dvserver/src/dvjson"
+	"github.com/Dobryvechir/dvserver/src/dvparser"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var copyright = "Copyright by Danyil Dobryvechir 2019"
+
+var help = copyright + "\ndvoidc [options] [realm file]\n" +
+	"local stand-in of a Keycloak realm: the openid-connect token, certs (JWKS) and userinfo endpoints and the discovery\n" +
+	"at http://<host>:<port>/realms/<realm>/..., the tokens are signed by RS256 with the local key;\n" +
+	"the grants are client_credentials, password, refresh_token and token exchange, the clients authenticate by\n" +
+	"client_secret_post or client_secret_basic;\n" +
+	"the realm file (json or yaml) is similar to the Keycloak realm export:\n" +
+	"  realm, accessTokenLifespan, refreshTokenLifespan (seconds),\n" +
+	"  clients: clientId, secret, realmRoles, clientRoles {client: [roles]} - the roles of the service account,\n" +
+	"  users: username, password (or credentials [{type: password, value}]), email, firstName, lastName,\n" +
+	"         realmRoles, clientRoles {client: [roles]}\n" +
+	"options:\n" +
+	"  --host=<host>         host to listen, property OIDC_HOST (default 127.0.0.1)\n" +
+	"  --port=<port>         port to listen, property OIDC_PORT (default 8180)\n" +
+	"  --realm=<realm>       realm name if the file has none, property OIDC_REALM (default local)\n" +
+	"  --key=<file>          RSA private key (PEM), generated and saved if it does not exist, property OIDC_KEY_FILE\n" +
+	"                        (default - a new key on every start)\n" +
+	"  --client-path=<path>  add the client from username and password of the secret path, as used by m2mtoken;\n" +
+	"                        may be repeated"
+
+const (
+	oidcHostProperty           = "OIDC_HOST"
+	oidcPortProperty           = "OIDC_PORT"
+	oidcRealmProperty          = "OIDC_REALM"
+	oidcKeyFileProperty        = "OIDC_KEY_FILE"
+	oidcDefaultHost            = "127.0.0.1"
+	oidcDefaultPort            = 8180
+	oidcDefaultRealm           = "local"
+	oidcDefaultAccessLifespan  = 300
+	oidcDefaultRefreshLifespan = 1800
+	oidcServiceAccountPrefix   = "service-account-"
+	oidcCredentialTypePassword = "password"
+	oidcDefaultClientAudience  = "account"
+	oidcClientPathUserFile     = "username"
+	oidcClientPathPasswordFile = "password"
+)
+
+type oidcCredential struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type oidcClient struct {
+	ClientId    string              `json:"clientId"`
+	Secret      string              `json:"secret"`
+	RealmRoles  []string            `json:"realmRoles"`
+	ClientRoles map[string][]string `json:"clientRoles"`
+}
+
+type oidcUser struct {
+	Username    string              `json:"username"`
+	Password    string              `json:"password"`
+	Credentials []oidcCredential    `json:"credentials"`
+	Email       string              `json:"email"`
+	FirstName   string              `json:"firstName"`
+	LastName    string              `json:"lastName"`
+	RealmRoles  []string            `json:"realmRoles"`
+	ClientRoles map[string][]string `json:"clientRoles"`
+}
+
+type oidcRealm struct {
+	Realm                string        `json:"realm"`
+	AccessTokenLifespan  int           `json:"accessTokenLifespan"`
+	RefreshTokenLifespan int           `json:"refreshTokenLifespan"`
+	Clients              []*oidcClient `json:"clients"`
+	Users                []*oidcUser   `json:"users"`
+}
+
+type oidcOptions struct {
+	host        string
+	port        int
+	realm       string
+	keyFile     string
+	realmFile   string
+	clientPaths []string
+}
+
+func (user *oidcUser) password() string {
+	for _, credential := range user.Credentials {
+		if credential.Type == oidcCredentialTypePassword || credential.Type == "" {
+			return credential.Value
+		}
+	}
+	return user.Password
+}
+
+func (realm *oidcRealm) findClient(clientId string) *oidcClient {
+	for _, client := range realm.Clients {
+		if client.ClientId == clientId {
+			return client
+		}
+	}
+	return nil
+}
+
+func (realm *oidcRealm) findUser(username string) *oidcUser {
+	for _, user := range realm.Users {
+		if strings.EqualFold(user.Username, username) {
+			return user
+		}
+	}
+	return nil
+}
+
+// readOidcRealm reads the realm from json or, converted to json, from yaml
+func readOidcRealm(fileName string) (*oidcRealm, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if !dvjson.IsCurrentFormatJson(data) {
+		item, err := dvjson.ReadYamlAsDvFieldInfo(data)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read %s: %v", fileName, err)
+		}
+		data = item.PrintToJson(0)
+	}
+	realm := &oidcRealm{}
+	if err = json.Unmarshal(data, realm); err != nil {
+		return nil, fmt.Errorf("cannot read %s: %v", fileName, err)
+	}
+	return realm, nil
+}
+
+func readOidcClientPath(path string) (*oidcClient, error) {
+	clientId, err := ioutil.ReadFile(filepath.Join(path, oidcClientPathUserFile))
+	if err != nil {
+		return nil, err
+	}
+	secret, err := ioutil.ReadFile(filepath.Join(path, oidcClientPathPasswordFile))
+	if err != nil {
+		return nil, err
+	}
+	return &oidcClient{ClientId: string(clientId), Secret: string(secret)}, nil
+}
+
+func readOidcOptions(args []string) (*oidcOptions, error) {
+	params := dvparser.GlobalProperties
+	options := &oidcOptions{host: params[oidcHostProperty], realm: params[oidcRealmProperty], keyFile: params[oidcKeyFileProperty], port: oidcDefaultPort}
+	if options.host == "" {
+		options.host = oidcDefaultHost
+	}
+	port := params[oidcPortProperty]
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "--host="):
+			options.host = arg[len("--host="):]
+		case strings.HasPrefix(arg, "--port="):
+			port = arg[len("--port="):]
+		case strings.HasPrefix(arg, "--realm="):
+			options.realm = arg[len("--realm="):]
+		case strings.HasPrefix(arg, "--key="):
+			options.keyFile = arg[len("--key="):]
+		case strings.HasPrefix(arg, "--client-path="):
+			options.clientPaths = append(options.clientPaths, arg[len("--client-path="):])
+		case strings.HasPrefix(arg, "--"):
+			return nil, errors.New("unknown option " + arg)
+		default:
+			if options.realmFile != "" {
+				return nil, errors.New("only one realm file is allowed")
+			}
+			options.realmFile = arg
+		}
+	}
+	if port != "" {
+		n, err := strconv.Atoi(port)
+		if err != nil || n <= 0 || n > 65535 {
+			return nil, errors.New("incorrect port " + port)
+		}
+		options.port = n
+	}
+	return options, nil
+}
+
+// createOidcRealm reads the realm file and adds the clients of the secret paths, the defaults are set
+func createOidcRealm(options *oidcOptions) (*oidcRealm, error) {
+	realm := &oidcRealm{}
+	if options.realmFile != "" {
+		var err error
+		if realm, err = readOidcRealm(options.realmFile); err != nil {
+			return nil, err
+		}
+	}
+	for _, path := range options.clientPaths {
+		client, err := readOidcClientPath(path)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read the client of %s: %v", path, err)
+		}
+		if realm.findClient(client.ClientId) == nil {
+			realm.Clients = append(realm.Clients, client)
+		}
+	}
+	if realm.Realm == "" {
+		realm.Realm = options.realm
+	}
+	if realm.Realm == "" {
+		realm.Realm = oidcDefaultRealm
+	}
+	if realm.AccessTokenLifespan <= 0 {
+		realm.AccessTokenLifespan = oidcDefaultAccessLifespan
+	}
+	if realm.RefreshTokenLifespan <= 0 {
+		realm.RefreshTokenLifespan = oidcDefaultRefreshLifespan
+	}
+	if len(realm.Clients) == 0 {
+		return nil, errors.New("no clients are defined, specify the realm file or --client-path")
+	}
+	return realm, nil
+}
+
+func main() {
+	args := dvparser.InitAndReadCommandLine()
+	options, err := readOidcOptions(args)
+	if err != nil {
+		fmt.Println(help)
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	realm, err := createOidcRealm(options)
+	if err != nil {
+		fmt.Println(help)
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	key, err := loadOidcKey(options.keyFile)
+	if err != nil {
+		fmt.Printf("Error: cannot load the key: %v\n", err)
+		os.Exit(1)
+	}
+	if err = runOidcServer(realm, key, options); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	oidcGrantClientCredentials = "client_credentials"
+	oidcGrantPassword          = "password"
+	oidcGrantRefreshToken      = "refresh_token"
+	oidcGrantTokenExchange     = "urn:ietf:params:oauth:grant-type:token-exchange"
+	oidcTokenTypeAccessToken   = "urn:ietf:params:oauth:token-type:access_token"
+	oidcConnectPath            = "/protocol/openid-connect"
+)
+
+// oidcError is the error response of the token endpoint as Keycloak returns it
+type oidcError struct {
+	status      int
+	code        string
+	description string
+}
+
+func (e *oidcError) Error() string {
+	return e.code + ": " + e.description
+}
+
+func logOidc(format string, args ...interface{}) {
+	fmt.Printf(time.Now().Format("15:04:05")+" "+format+"\n", args...)
+}
+
+func writeOidcJson(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeOidcError(w http.ResponseWriter, err *oidcError) {
+	if err.status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", "Basic realm=\"oidc\"")
+	}
+	writeOidcJson(w, err.status, map[string]string{"error": err.code, "error_description": err.description})
+}
+
+// authenticateClient takes the client from client_secret_basic or client_secret_post
+func (issuer *oidcIssuer) authenticateClient(r *http.Request) (*oidcClient, *oidcError) {
+	clientId, secret, basic := r.BasicAuth()
+	if basic {
+		// RFC 6749 2.3.1: the client id and secret are form-encoded before base64
+		if s, err := url.QueryUnescape(clientId); err == nil {
+			clientId = s
+		}
+		if s, err := url.QueryUnescape(secret); err == nil {
+			secret = s
+		}
+	} else {
+		clientId, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+	client := issuer.realm.findClient(clientId)
+	if client == nil || subtle.ConstantTimeCompare([]byte(client.Secret), []byte(secret)) != 1 {
+		return nil, &oidcError{http.StatusUnauthorized, "unauthorized_client", "Invalid client or Invalid client credentials"}
+	}
+	return client, nil
+}
+
+func (issuer *oidcIssuer) grantPassword(r *http.Request) (*oidcSubject, *oidcError) {
+	user := issuer.realm.findUser(r.PostForm.Get("username"))
+	if user == nil || subtle.ConstantTimeCompare([]byte(user.password()), []byte(r.PostForm.Get("password"))) != 1 {
+		return nil, &oidcError{http.StatusUnauthorized, "invalid_grant", "Invalid user credentials"}
+	}
+	return createUserSubject(user), nil
+}
+
+func (issuer *oidcIssuer) grantRefreshToken(r *http.Request, client *oidcClient) (*oidcSubject, string, *oidcError) {
+	claims, err := issuer.verify(r.PostForm.Get("refresh_token"), oidcTokenTypeRefresh)
+	if err != nil {
+		return nil, "", &oidcError{http.StatusBadRequest, "invalid_grant", "Invalid refresh token: " + err.Error()}
+	}
+	if claims["azp"] != client.ClientId {
+		return nil, "", &oidcError{http.StatusBadRequest, "invalid_grant", "Invalid refresh token. Token client and authorized client don't match"}
+	}
+	username, _ := claims["preferred_username"].(string)
+	subject := issuer.findSubject(username)
+	if subject == nil {
+		return nil, "", &oidcError{http.StatusBadRequest, "invalid_grant", "User not found"}
+	}
+	audience, _ := claims[oidcAudienceClaim].(string)
+	return subject, audience, nil
+}
+
+func (issuer *oidcIssuer) grantTokenExchange(r *http.Request) (*oidcSubject, string, *oidcError) {
+	if tokenType := r.PostForm.Get("subject_token_type"); tokenType != "" && tokenType != oidcTokenTypeAccessToken {
+		return nil, "", &oidcError{http.StatusBadRequest, "invalid_request", "Token type not supported: " + tokenType}
+	}
+	claims, err := issuer.verify(r.PostForm.Get("subject_token"), oidcTokenTypeBearer)
+	if err != nil {
+		return nil, "", &oidcError{http.StatusBadRequest, "access_denied", "Invalid token: " + err.Error()}
+	}
+	audience := r.PostForm.Get("audience")
+	if audience != "" && issuer.realm.findClient(audience) == nil {
+		return nil, "", &oidcError{http.StatusBadRequest, "invalid_client", "Audience not found"}
+	}
+	username, _ := claims["preferred_username"].(string)
+	subject := issuer.findSubject(username)
+	if subject == nil {
+		return nil, "", &oidcError{http.StatusBadRequest, "invalid_grant", "User not found"}
+	}
+	return subject, audience, nil
+}
+
+func (issuer *oidcIssuer) handleToken(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeOidcError(w, &oidcError{http.StatusMethodNotAllowed, "invalid_request", "POST is expected"})
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		writeOidcError(w, &oidcError{http.StatusBadRequest, "invalid_request", err.Error()})
+		return
+	}
+	grant := r.PostForm.Get("grant_type")
+	client, e := issuer.authenticateClient(r)
+	var subject *oidcSubject
+	audience := ""
+	if e == nil {
+		switch grant {
+		case oidcGrantClientCredentials:
+			subject = createServiceAccountSubject(client)
+		case oidcGrantPassword:
+			subject, e = issuer.grantPassword(r)
+		case oidcGrantRefreshToken:
+			subject, audience, e = issuer.grantRefreshToken(r, client)
+		case oidcGrantTokenExchange:
+			subject, audience, e = issuer.grantTokenExchange(r)
+		default:
+			e = &oidcError{http.StatusBadRequest, "unsupported_grant_type", "Unsupported grant_type " + grant}
+		}
+	}
+	if e != nil {
+		logOidc("token %s: %v", grant, e)
+		writeOidcError(w, e)
+		return
+	}
+	response, err := issuer.issueTokens(subject, client.ClientId, r.PostForm.Get("scope"), audience)
+	if err != nil {
+		logOidc("token %s: %v", grant, err)
+		writeOidcError(w, &oidcError{http.StatusInternalServerError, "server_error", err.Error()})
+		return
+	}
+	logOidc("token %s: %s for client %s", grant, subject.username, client.ClientId)
+	writeOidcJson(w, http.StatusOK, response)
+}
+
+func (issuer *oidcIssuer) handleUserInfo(w http.ResponseWriter, r *http.Request) {
+	token := r.Header.Get("Authorization")
+	if len(token) > 7 && strings.EqualFold(token[:7], "bearer ") {
+		token = token[7:]
+	} else {
+		r.ParseForm()
+		token = r.Form.Get("access_token")
+	}
+	claims, err := issuer.verify(strings.TrimSpace(token), oidcTokenTypeBearer)
+	if err != nil {
+		logOidc("userinfo: %v", err)
+		w.Header().Set("WWW-Authenticate", "Bearer error=\"invalid_token\", error_description=\""+err.Error()+"\"")
+		writeOidcJson(w, http.StatusUnauthorized, map[string]string{"error": "invalid_token", "error_description": err.Error()})
+		return
+	}
+	info := map[string]interface{}{"sub": claims["sub"]}
+	for _, name := range []string{"preferred_username", "email", "name", "given_name", "family_name"} {
+		if value, ok := claims[name]; ok {
+			info[name] = value
+		}
+	}
+	if _, ok := info["email"]; ok {
+		info["email_verified"] = true
+	}
+	writeOidcJson(w, http.StatusOK, info)
+}
+
+func (issuer *oidcIssuer) handleCerts(w http.ResponseWriter, r *http.Request) {
+	writeOidcJson(w, http.StatusOK, issuer.jwks())
+}
+
+func (issuer *oidcIssuer) handleDiscovery(w http.ResponseWriter, r *http.Request) {
+	endpoint := issuer.url + oidcConnectPath
+	writeOidcJson(w, http.StatusOK, map[string]interface{}{
+		"issuer":                                issuer.url,
+		"token_endpoint":                        endpoint + "/token",
+		"jwks_uri":                              endpoint + "/certs",
+		"userinfo_endpoint":                     endpoint + "/userinfo",
+		"grant_types_supported":                 []string{oidcGrantClientCredentials, oidcGrantPassword, oidcGrantRefreshToken, oidcGrantTokenExchange},
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post"},
+		"id_token_signing_alg_values_supported": []string{oidcAlgorithm},
+		"subject_types_supported":               []string{"public"},
+		"scopes_supported":                      []string{"openid", "profile", "email"},
+	})
+}
+
+// handleRealm returns the realm info of Keycloak with the public key
+func (issuer *oidcIssuer) handleRealm(w http.ResponseWriter, r *http.Request) {
+	writeOidcJson(w, http.StatusOK, map[string]interface{}{
+		"realm":             issuer.realm.Realm,
+		"public_key":        issuer.publicKeyBase64(),
+		"token-service":     issuer.url + oidcConnectPath,
+		"account-service":   issuer.url + "/account",
+		"tokens-not-before": 0,
+	})
+}
+
+// createHandler serves the endpoints of the realm at the paths of Keycloak
+func (issuer *oidcIssuer) createHandler(realmPath string) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc(realmPath, issuer.handleRealm)
+	mux.HandleFunc(realmPath+"/.well-known/openid-configuration", issuer.handleDiscovery)
+	mux.HandleFunc(realmPath+oidcConnectPath+"/token", issuer.handleToken)
+	mux.HandleFunc(realmPath+oidcConnectPath+"/certs", issuer.handleCerts)
+	mux.HandleFunc(realmPath+oidcConnectPath+"/userinfo", issuer.handleUserInfo)
+	return mux
+}
+
+func runOidcServer(realm *oidcRealm, key *rsa.PrivateKey, options *oidcOptions) error {
+	address := options.host + ":" + strconv.Itoa(options.port)
+	realmPath := "/realms/" + realm.Realm
+	issuer, err := createOidcIssuer(realm, key, "http://"+address+realmPath)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Realm %s with %d clients and %d users is served at %s\n", realm.Realm, len(realm.Clients), len(realm.Users), issuer.url)
+	fmt.Printf("M2MTOKEN_URL=%s%s/token\n", issuer.url, oidcConnectPath)
+	fmt.Printf("M2MTOKEN_JWKS_URL=%s%s/certs\n", issuer.url, oidcConnectPath)
+	return http.ListenAndServe(address, issuer.createHandler(realmPath))
+}
@@ -0,0 +1,257 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testOidcRealmPath = "/realms/test"
+
+// testOidcServer is the realm served by httptest with the issuer url of the test server
+type testOidcServer struct {
+	*httptest.Server
+	issuer *oidcIssuer
+}
+
+func startTestOidcServer(t *testing.T) *testOidcServer {
+	key, err := rsa.GenerateKey(rand.Reader, oidcKeySize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	realm := &oidcRealm{
+		Realm:                "test",
+		AccessTokenLifespan:  oidcDefaultAccessLifespan,
+		RefreshTokenLifespan: oidcDefaultRefreshLifespan,
+		Clients: []*oidcClient{
+			{ClientId: "payment-service", Secret: "s3cr3t", RealmRoles: []string{"m2m"}, ClientRoles: map[string][]string{"billing": {"read"}}},
+			{ClientId: "web", Secret: "a:b&c d%"},
+		},
+		Users: []*oidcUser{
+			{Username: "Alice", Credentials: []oidcCredential{{Type: "password", Value: "alice-pass"}}, Email: "alice@example.com",
+				FirstName: "Alice", LastName: "Smith", RealmRoles: []string{"user"}},
+		},
+	}
+	issuer, err := createOidcIssuer(realm, key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(issuer.createHandler(testOidcRealmPath))
+	t.Cleanup(server.Close)
+	issuer.url = server.URL + testOidcRealmPath
+	return &testOidcServer{Server: server, issuer: issuer}
+}
+
+// requestToken posts the form to the token endpoint, by client_secret_basic if the client id is given
+func (server *testOidcServer) requestToken(t *testing.T, form url.Values, clientId string, secret string) (int, map[string]interface{}) {
+	request, err := http.NewRequest(http.MethodPost, server.URL+testOidcRealmPath+oidcConnectPath+"/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if clientId != "" {
+		request.SetBasicAuth(url.QueryEscape(clientId), url.QueryEscape(secret))
+	}
+	return server.getJson(t, request)
+}
+
+func (server *testOidcServer) getJson(t *testing.T, request *http.Request) (int, map[string]interface{}) {
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	res := map[string]interface{}{}
+	if err = json.NewDecoder(response.Body).Decode(&res); err != nil {
+		t.Fatalf("the response %d is not json: %v", response.StatusCode, err)
+	}
+	return response.StatusCode, res
+}
+
+func (server *testOidcServer) getUserInfo(t *testing.T, token string) (int, map[string]interface{}) {
+	request, err := http.NewRequest(http.MethodGet, server.URL+testOidcRealmPath+oidcConnectPath+"/userinfo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+	return server.getJson(t, request)
+}
+
+// verifyByJwks checks the RS256 signature by the key of the served JWKS as a resource server does and returns the claims
+func (server *testOidcServer) verifyByJwks(t *testing.T, token string) map[string]interface{} {
+	response, err := http.Get(server.URL + testOidcRealmPath + oidcConnectPath + "/certs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	jwks := struct {
+		Keys []struct {
+			Kid string `json:"kid"`
+			Kty string `json:"kty"`
+			Alg string `json:"alg"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}{}
+	if err = json.NewDecoder(response.Body).Decode(&jwks); err != nil || len(jwks.Keys) != 1 {
+		t.Fatalf("jwks %+v: %v", jwks, err)
+	}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("malformed token %s", token)
+	}
+	header := map[string]string{}
+	data, _ := base64.RawURLEncoding.DecodeString(parts[0])
+	if err = json.Unmarshal(data, &header); err != nil || header["alg"] != "RS256" || header["kid"] != jwks.Keys[0].Kid {
+		t.Fatalf("header %v of the key %s: %v", header, jwks.Keys[0].Kid, err)
+	}
+	n, _ := base64.RawURLEncoding.DecodeString(jwks.Keys[0].N)
+	e, _ := base64.RawURLEncoding.DecodeString(jwks.Keys[0].E)
+	key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err = rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		t.Fatalf("the signature is not verified by the JWKS: %v", err)
+	}
+	claims := map[string]interface{}{}
+	data, _ = base64.RawURLEncoding.DecodeString(parts[1])
+	if err = json.Unmarshal(data, &claims); err != nil {
+		t.Fatal(err)
+	}
+	return claims
+}
+
+func TestOidcClientCredentials(t *testing.T) {
+	server := startTestOidcServer(t)
+	form := url.Values{"grant_type": {"client_credentials"}, "client_id": {"payment-service"}, "client_secret": {"s3cr3t"}}
+	status, res := server.requestToken(t, form, "", "")
+	if status != http.StatusOK || res["token_type"] != "Bearer" || res["expires_in"] != float64(oidcDefaultAccessLifespan) {
+		t.Fatalf("%d %v", status, res)
+	}
+	claims := server.verifyByJwks(t, res["access_token"].(string))
+	if claims["iss"] != server.issuer.url || claims["azp"] != "payment-service" || claims["preferred_username"] != "service-account-payment-service" ||
+		fmt.Sprint(claims["aud"]) != "[billing]" || claims["typ"] != "Bearer" {
+		t.Errorf("claims %v", claims)
+	}
+	if exp, _ := claims["exp"].(float64); int64(exp)-time.Now().Unix() > oidcDefaultAccessLifespan || int64(exp) <= time.Now().Unix() {
+		t.Errorf("exp %v", claims["exp"])
+	}
+}
+
+func TestOidcClientSecretBasic(t *testing.T) {
+	server := startTestOidcServer(t)
+	form := url.Values{"grant_type": {"client_credentials"}}
+	status, res := server.requestToken(t, form, "web", "a:b&c d%")
+	if status != http.StatusOK {
+		t.Fatalf("the form-encoded basic credentials are rejected: %d %v", status, res)
+	}
+	if claims := server.verifyByJwks(t, res["access_token"].(string)); claims["azp"] != "web" || claims["aud"] != oidcDefaultClientAudience {
+		t.Errorf("claims %v", claims)
+	}
+	for _, test := range []struct {
+		form     url.Values
+		clientId string
+		secret   string
+	}{
+		{form, "web", "wrong"},
+		{form, "unknown", "a:b&c d%"},
+		{url.Values{"grant_type": {"client_credentials"}, "client_id": {"payment-service"}, "client_secret": {"S3CR3T"}}, "", ""},
+		{url.Values{"grant_type": {"client_credentials"}, "client_id": {"payment-service"}}, "", ""},
+	} {
+		status, res = server.requestToken(t, test.form, test.clientId, test.secret)
+		if status != http.StatusUnauthorized || res["error"] != "unauthorized_client" || res["access_token"] != nil {
+			t.Errorf("%s %v: %d %v", test.clientId, test.form, status, res)
+		}
+	}
+}
+
+func TestOidcPasswordAndRefreshGrants(t *testing.T) {
+	server := startTestOidcServer(t)
+	form := url.Values{"grant_type": {"password"}, "username": {"alice"}, "password": {"alice-pass"}}
+	status, res := server.requestToken(t, form, "payment-service", "s3cr3t")
+	if status != http.StatusOK {
+		t.Fatalf("%d %v", status, res)
+	}
+	claims := server.verifyByJwks(t, res["access_token"].(string))
+	if claims["preferred_username"] != "alice" || claims["email"] != "alice@example.com" || claims["name"] != "Alice Smith" {
+		t.Errorf("claims %v", claims)
+	}
+	refreshToken := res["refresh_token"].(string)
+	if refresh := server.verifyByJwks(t, refreshToken); refresh["typ"] != "Refresh" || refresh["sub"] != claims["sub"] {
+		t.Errorf("refresh claims %v", refresh)
+	}
+	form.Set("password", "wrong")
+	if status, res = server.requestToken(t, form, "payment-service", "s3cr3t"); status != http.StatusUnauthorized || res["error"] != "invalid_grant" {
+		t.Errorf("the wrong password gives %d %v", status, res)
+	}
+
+	form = url.Values{"grant_type": {"refresh_token"}, "refresh_token": {refreshToken}}
+	status, res = server.requestToken(t, form, "payment-service", "s3cr3t")
+	if status != http.StatusOK {
+		t.Fatalf("refresh: %d %v", status, res)
+	}
+	accessToken := res["access_token"].(string)
+	if refreshed := server.verifyByJwks(t, accessToken); refreshed["preferred_username"] != "alice" || refreshed["sub"] != claims["sub"] {
+		t.Errorf("refreshed claims %v", refreshed)
+	}
+	if status, res = server.requestToken(t, form, "web", "a:b&c d%"); status != http.StatusBadRequest || res["error"] != "invalid_grant" {
+		t.Errorf("the refresh token of another client gives %d %v", status, res)
+	}
+	form.Set("refresh_token", accessToken)
+	if status, res = server.requestToken(t, form, "payment-service", "s3cr3t"); status != http.StatusBadRequest {
+		t.Errorf("the access token is taken as the refresh token: %d %v", status, res)
+	}
+}
+
+func TestOidcUserInfo(t *testing.T) {
+	server := startTestOidcServer(t)
+	form := url.Values{"grant_type": {"password"}, "username": {"alice"}, "password": {"alice-pass"}}
+	_, res := server.requestToken(t, form, "payment-service", "s3cr3t")
+	token, _ := res["access_token"].(string)
+	status, info := server.getUserInfo(t, token)
+	if status != http.StatusOK || info["preferred_username"] != "alice" || info["email"] != "alice@example.com" || info["email_verified"] != true {
+		t.Fatalf("%d %v", status, info)
+	}
+
+	claims := server.verifyByJwks(t, token)
+	claims["exp"] = time.Now().Add(-time.Minute).Unix()
+	expired, err := server.issuer.sign(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status, info = server.getUserInfo(t, expired); status != http.StatusUnauthorized || info["error"] != "invalid_token" ||
+		!strings.Contains(info["error_description"].(string), "expired") {
+		t.Errorf("the expired token gives %d %v", status, info)
+	}
+	tampered := token[:len(token)-4] + "AAAA"
+	if status, info = server.getUserInfo(t, tampered); status != http.StatusUnauthorized {
+		t.Errorf("the token with a wrong signature gives %d %v", status, info)
+	}
+}
+
+func TestOidcDiscovery(t *testing.T) {
+	server := startTestOidcServer(t)
+	request, err := http.NewRequest(http.MethodGet, server.URL+testOidcRealmPath+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, res := server.getJson(t, request)
+	endpoint := server.issuer.url + oidcConnectPath
+	if status != http.StatusOK || res["issuer"] != server.issuer.url || res["token_endpoint"] != endpoint+"/token" ||
+		res["jwks_uri"] != endpoint+"/certs" || res["userinfo_endpoint"] != endpoint+"/userinfo" {
+		t.Errorf("%d %v", status, res)
+	}
+}
@@ -0,0 +1,318 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	oidcKeySize           = 2048
+	oidcAlgorithm         = "RS256"
+	oidcTokenTypeBearer   = "Bearer"
+	oidcTokenTypeRefresh  = "Refresh"
+	oidcDefaultScope      = "profile email"
+	oidcAudienceClaim     = "requested_audience"
+	oidcKeyFilePermission = 0600
+)
+
+// oidcIssuer signs and verifies the tokens of the realm
+type oidcIssuer struct {
+	realm *oidcRealm
+	key   *rsa.PrivateKey
+	kid   string
+	url   string
+}
+
+// oidcSubject is the user or the service account of the client the token is issued for
+type oidcSubject struct {
+	username    string
+	email       string
+	firstName   string
+	lastName    string
+	clientId    string
+	realmRoles  []string
+	clientRoles map[string][]string
+}
+
+// loadOidcKey reads the PKCS1 or PKCS8 key, a missing key file is created with a new key
+func loadOidcKey(fileName string) (*rsa.PrivateKey, error) {
+	if fileName == "" {
+		return rsa.GenerateKey(rand.Reader, oidcKeySize)
+	}
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		key, err := rsa.GenerateKey(rand.Reader, oidcKeySize)
+		if err != nil {
+			return nil, err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			return nil, err
+		}
+		data = pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+		if err = ioutil.WriteFile(fileName, data, oidcKeyFilePermission); err != nil {
+			return nil, err
+		}
+		fmt.Printf("New key is saved in %s\n", fileName)
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block in " + fileName)
+	}
+	if block.Type == "RSA PRIVATE KEY" {
+		return x509.ParsePKCS1PrivateKey(block.Bytes)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("the key of " + fileName + " is not RSA")
+	}
+	return rsaKey, nil
+}
+
+func createOidcIssuer(realm *oidcRealm, key *rsa.PrivateKey, url string) (*oidcIssuer, error) {
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(der)
+	return &oidcIssuer{realm: realm, key: key, kid: base64.RawURLEncoding.EncodeToString(hash[:16]), url: url}, nil
+}
+
+func (issuer *oidcIssuer) publicKeyBase64() string {
+	der, _ := x509.MarshalPKIXPublicKey(&issuer.key.PublicKey)
+	return base64.StdEncoding.EncodeToString(der)
+}
+
+func (issuer *oidcIssuer) jwks() map[string]interface{} {
+	key := map[string]interface{}{
+		"kid": issuer.kid,
+		"kty": "RSA",
+		"alg": oidcAlgorithm,
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(issuer.key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(issuer.key.E)).Bytes()),
+	}
+	return map[string]interface{}{"keys": []interface{}{key}}
+}
+
+func (issuer *oidcIssuer) sign(claims map[string]interface{}) (string, error) {
+	header, err := json.Marshal(map[string]string{"alg": oidcAlgorithm, "typ": "JWT", "kid": issuer.kid})
+	if err != nil {
+		return "", err
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, issuer.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+// verify checks the signature, the issuer, the expiry and the type of the token issued by this realm
+func (issuer *oidcIssuer) verify(token string, tokenType string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	header := map[string]interface{}{}
+	data, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil || json.Unmarshal(data, &header) != nil || header["alg"] != oidcAlgorithm || header["kid"] != issuer.kid {
+		return nil, errors.New("token is not signed by this realm")
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err = rsa.VerifyPKCS1v15(&issuer.key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, errors.New("invalid token signature")
+	}
+	claims := map[string]interface{}{}
+	if data, err = base64.RawURLEncoding.DecodeString(parts[1]); err != nil || json.Unmarshal(data, &claims) != nil {
+		return nil, errors.New("malformed token claims")
+	}
+	if claims["iss"] != issuer.url {
+		return nil, errors.New("invalid token issuer")
+	}
+	if exp, ok := claims["exp"].(float64); !ok || int64(exp) <= time.Now().Unix() {
+		return nil, errors.New("token is expired")
+	}
+	if claims["typ"] != tokenType {
+		return nil, fmt.Errorf("token type is not %s", tokenType)
+	}
+	return claims, nil
+}
+
+// subjectId gives the same user id on every start as Keycloak keeps it
+func (issuer *oidcIssuer) subjectId(username string) string {
+	hash := sha256.Sum256([]byte(issuer.realm.Realm + "/" + strings.ToLower(username)))
+	s := hex.EncodeToString(hash[:16])
+	return s[:8] + "-" + s[8:12] + "-" + s[12:16] + "-" + s[16:20] + "-" + s[20:]
+}
+
+func createUserSubject(user *oidcUser) *oidcSubject {
+	return &oidcSubject{
+		username:    strings.ToLower(user.Username),
+		email:       user.Email,
+		firstName:   user.FirstName,
+		lastName:    user.LastName,
+		realmRoles:  user.RealmRoles,
+		clientRoles: user.ClientRoles,
+	}
+}
+
+func createServiceAccountSubject(client *oidcClient) *oidcSubject {
+	return &oidcSubject{
+		username:    oidcServiceAccountPrefix + strings.ToLower(client.ClientId),
+		clientId:    client.ClientId,
+		realmRoles:  client.RealmRoles,
+		clientRoles: client.ClientRoles,
+	}
+}
+
+// findSubject finds the user or the service account again, so that the refreshed token has the current roles
+func (issuer *oidcIssuer) findSubject(username string) *oidcSubject {
+	if strings.HasPrefix(username, oidcServiceAccountPrefix) {
+		for _, client := range issuer.realm.Clients {
+			if strings.EqualFold(client.ClientId, username[len(oidcServiceAccountPrefix):]) {
+				return createServiceAccountSubject(client)
+			}
+		}
+		return nil
+	}
+	if user := issuer.realm.findUser(username); user != nil {
+		return createUserSubject(user)
+	}
+	return nil
+}
+
+func createOidcTokenId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// getAudience is the requested audience or, as in Keycloak, the clients with roles of the subject
+func getAudience(subject *oidcSubject, azp string, audience string) interface{} {
+	if audience != "" {
+		return audience
+	}
+	clients := make([]string, 0, len(subject.clientRoles)+1)
+	for client := range subject.clientRoles {
+		if client != azp {
+			clients = append(clients, client)
+		}
+	}
+	if len(clients) == 0 {
+		return oidcDefaultClientAudience
+	}
+	sort.Strings(clients)
+	return clients
+}
+
+// issueTokens returns the token response with the access token and the refresh token
+func (issuer *oidcIssuer) issueTokens(subject *oidcSubject, azp string, scope string, audience string) (map[string]interface{}, error) {
+	now := time.Now().Unix()
+	if scope == "" {
+		scope = oidcDefaultScope
+	}
+	session := createOidcTokenId()
+	resourceAccess := map[string]interface{}{}
+	for client, roles := range subject.clientRoles {
+		resourceAccess[client] = map[string]interface{}{"roles": roles}
+	}
+	realmRoles := subject.realmRoles
+	if realmRoles == nil {
+		realmRoles = []string{}
+	}
+	access := map[string]interface{}{
+		"exp":                now + int64(issuer.realm.AccessTokenLifespan),
+		"iat":                now,
+		"jti":                createOidcTokenId(),
+		"iss":                issuer.url,
+		"aud":                getAudience(subject, azp, audience),
+		"sub":                issuer.subjectId(subject.username),
+		"typ":                oidcTokenTypeBearer,
+		"azp":                azp,
+		"session_state":      session,
+		"scope":              scope,
+		"realm_access":       map[string]interface{}{"roles": realmRoles},
+		"resource_access":    resourceAccess,
+		"preferred_username": subject.username,
+	}
+	if subject.clientId != "" {
+		access["clientId"] = subject.clientId
+	}
+	if subject.email != "" {
+		access["email"] = subject.email
+	}
+	if name := strings.TrimSpace(subject.firstName + " " + subject.lastName); name != "" {
+		access["name"] = name
+		access["given_name"] = subject.firstName
+		access["family_name"] = subject.lastName
+	}
+	refresh := map[string]interface{}{
+		"exp":                now + int64(issuer.realm.RefreshTokenLifespan),
+		"iat":                now,
+		"jti":                createOidcTokenId(),
+		"iss":                issuer.url,
+		"aud":                issuer.url,
+		"sub":                access["sub"],
+		"typ":                oidcTokenTypeRefresh,
+		"azp":                azp,
+		"session_state":      session,
+		"scope":              scope,
+		"preferred_username": subject.username,
+	}
+	if audience != "" {
+		refresh[oidcAudienceClaim] = audience
+	}
+	accessToken, err := issuer.sign(access)
+	if err != nil {
+		return nil, err
+	}
+	refreshToken, err := issuer.sign(refresh)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]interface{}{
+		"access_token":       accessToken,
+		"expires_in":         issuer.realm.AccessTokenLifespan,
+		"refresh_expires_in": issuer.realm.RefreshTokenLifespan,
+		"refresh_token":      refreshToken,
+		"token_type":         oidcTokenTypeBearer,
+		"not-before-policy":  0,
+		"session_state":      session,
+		"scope":              scope,
+	}, nil
+}
@@ -0,0 +1,147 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	driftFormatTable     = "table"
+	driftFormatJson      = "json"
+	driftReportTableFile = "driftReport.txt"
+	driftReportJsonFile  = "driftReport.json"
+	driftColumnMaxWidth  = 40
+)
+
+// driftEntry compares the template default of a parameter with the value discovered in the live objects
+type driftEntry struct {
+	Parameter  string `json:"parameter"`
+	Default    string `json:"default"`
+	Live       string `json:"live"`
+	Discovered bool   `json:"discovered"`
+	Differs    bool   `json:"differs"`
+	Dubious    bool   `json:"dubious"`
+	ObjectType string `json:"objectType,omitempty"`
+	Path       string `json:"path,omitempty"`
+}
+
+func (entry *driftEntry) status() string {
+	status := "same"
+	if !entry.Discovered {
+		status = "not found"
+	} else if entry.Differs {
+		status = "DRIFT"
+	}
+	if entry.Dubious {
+		status += ", DUBIOUS"
+	}
+	return status
+}
+
+func (entry *driftEntry) source() string {
+	if entry.ObjectType == "" {
+		return entry.Path
+	}
+	return entry.ObjectType + ": " + entry.Path
+}
+
+// createDriftEntries takes the parameters sorted by name, the Helm helper expressions are not real parameters
+func createDriftEntries(ocMap map[string]*ocTemplateParameter, paramMap map[string]string) []*driftEntry {
+	keys := make([]string, 0, len(ocMap))
+	for k := range ocMap {
+		if !strings.HasPrefix(k, helmExpressionPrefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	entries := make([]*driftEntry, 0, len(keys))
+	for _, k := range keys {
+		p := ocMap[k]
+		entry := &driftEntry{
+			Parameter:  k,
+			Default:    p.defaultValue,
+			Discovered: p.provided,
+			Dubious:    p.doubt,
+			ObjectType: p.openShiftObjectType,
+			Path:       strings.TrimPrefix(p.path, "."),
+		}
+		if p.provided {
+			entry.Live = paramMap[k]
+			entry.Differs = entry.Live != entry.Default
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func shortenDriftValue(value string) string {
+	value = strings.NewReplacer("\r", "\\r", "\n", "\\n", "\t", "\\t").Replace(value)
+	if utf8.RuneCountInString(value) <= driftColumnMaxWidth {
+		return value
+	}
+	return string([]rune(value)[:driftColumnMaxWidth-3]) + "..."
+}
+
+func formatDriftTable(entries []*driftEntry) string {
+	rows := [][]string{{"PARAMETER", "DEFAULT", "LIVE", "STATUS", "SOURCE"}}
+	drifts := 0
+	for _, entry := range entries {
+		rows = append(rows, []string{entry.Parameter, shortenDriftValue(entry.Default), shortenDriftValue(entry.Live), entry.status(), entry.source()})
+		if entry.Differs {
+			drifts++
+		}
+	}
+	widths := make([]int, len(rows[0]))
+	for _, row := range rows {
+		for i, cell := range row {
+			if n := utf8.RuneCountInString(cell); n > widths[i] {
+				widths[i] = n
+			}
+		}
+	}
+	var buf bytes.Buffer
+	for _, row := range rows {
+		for i, cell := range row {
+			if i == len(row)-1 {
+				buf.WriteString(cell)
+			} else {
+				buf.WriteString(cell + strings.Repeat(" ", widths[i]-utf8.RuneCountInString(cell)+2))
+			}
+		}
+		buf.WriteString("\n")
+	}
+	buf.WriteString(fmt.Sprintf("%d parameters, %d differ from the template defaults\n", len(entries), drifts))
+	return buf.String()
+}
+
+// writeDriftReport presents the drift as a table or json, the table is also shown on the screen
+func writeDriftReport(options *dcParamsOptions, ocMap map[string]*ocTemplateParameter, paramMap map[string]string) {
+	entries := createDriftEntries(ocMap, paramMap)
+	fileName := options.driftFile
+	var data string
+	if options.drift == driftFormatJson {
+		if fileName == "" {
+			fileName = driftReportJsonFile
+		}
+		b, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			fmt.Printf("Cannot present the drift report: %v\n", err)
+			commonReadDcOk = false
+			return
+		}
+		data = string(b) + "\n"
+	} else {
+		if fileName == "" {
+			fileName = driftReportTableFile
+		}
+		data = formatDriftTable(entries)
+		fmt.Print(data)
+	}
+	writeFile(fileName, data)
+}
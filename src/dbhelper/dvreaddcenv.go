@@ -0,0 +1,154 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	paramsSetSh           = "launchRun.sh"
+	paramsSetPowerShell   = "launchRun.ps1"
+	paramsDockerEnvFile   = "launchRun.docker.env"
+	paramsIntelliJEnvFile = "launchRun.intellij.env"
+)
+
+// envScriptFormat describes how the pod environment is presented for a specific target
+type envScriptFormat struct {
+	fileName   string
+	header     string
+	lineEnd    string
+	permission os.FileMode
+	comment    func(text string) string
+	assign     func(key string, value string) (string, bool)
+}
+
+var envScriptFormats = []*envScriptFormat{
+	{
+		fileName:   paramsSetSh,
+		header:     "#!/bin/sh",
+		lineEnd:    "\n",
+		permission: 0755,
+		comment:    hashComment,
+		assign: func(key string, value string) (string, bool) {
+			// kubernetes allows . and - in the names, sh does not
+			if !isShellVariableName(key) {
+				return "", false
+			}
+			return "export " + key + "='" + strings.Replace(value, "'", "'\\''", -1) + "'", true
+		},
+	},
+	{
+		fileName:   paramsSetPowerShell,
+		lineEnd:    "\r\n",
+		permission: 0644,
+		comment:    hashComment,
+		assign: func(key string, value string) (string, bool) {
+			variable := "$env:" + key
+			if !isShellVariableName(key) {
+				// $env:A.B is the property B of $env:A
+				variable = "${env:" + key + "}"
+			}
+			return variable + " = '" + strings.Replace(value, "'", "''", -1) + "'", true
+		},
+	},
+	{
+		fileName:   paramsDockerEnvFile,
+		lineEnd:    "\n",
+		permission: 0644,
+		comment:    hashComment,
+		assign: func(key string, value string) (string, bool) {
+			// docker takes the rest of the line literally, so multi-line values cannot be passed
+			if strings.ContainsAny(value, "\r\n") {
+				return "", false
+			}
+			return key + "=" + value, true
+		},
+	},
+	{
+		fileName:   paramsIntelliJEnvFile,
+		lineEnd:    "\n",
+		permission: 0644,
+		comment:    hashComment,
+		assign: func(key string, value string) (string, bool) {
+			if value == "" || strings.IndexAny(value, " \t\r\n\"'#\\$=") < 0 {
+				return key + "=" + value, true
+			}
+			escaped := strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\r", "\\r", "\n", "\\n", "$", "\\$").Replace(value)
+			return key + "=\"" + escaped + "\"", true
+		},
+	},
+}
+
+func hashComment(text string) string {
+	return "# " + text
+}
+
+func isShellVariableName(name string) bool {
+	for i, c := range name {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return name != ""
+}
+
+// splitExtraEnvironmentLine takes KEY=VALUE from the extra pod properties, other lines are comments
+func splitExtraEnvironmentLine(line string) (key string, value string, ok bool) {
+	s := strings.TrimSpace(line)
+	if s == "" || s[0] == '#' {
+		return
+	}
+	p := strings.Index(s, "=")
+	if p <= 0 {
+		return
+	}
+	return strings.TrimSpace(s[:p]), s[p+1:], true
+}
+
+func writeEnvironmentScript(format *envScriptFormat, params map[string]string, extra []string) {
+	var buf bytes.Buffer
+	if format.header != "" {
+		buf.WriteString(format.header + format.lineEnd)
+	}
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	writeAssignment := func(k string, v string) {
+		line, ok := format.assign(k, v)
+		if !ok {
+			line = format.comment(k + " is skipped because its name or value cannot be presented in this format")
+		}
+		buf.WriteString(line + format.lineEnd)
+	}
+	for _, k := range keys {
+		writeAssignment(k, params[k])
+	}
+	for _, line := range extra {
+		if k, v, ok := splitExtraEnvironmentLine(line); ok {
+			writeAssignment(k, v)
+		} else if strings.TrimSpace(line) == "" {
+			buf.WriteString(format.lineEnd)
+		} else {
+			buf.WriteString(format.comment(strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(line), "#"))) + format.lineEnd)
+		}
+	}
+	err := ioutil.WriteFile(format.fileName, buf.Bytes(), format.permission)
+	if err != nil {
+		fmt.Printf("Error writing to %s: %v\n", format.fileName, err)
+		commonReadDcOk = false
+	}
+}
+
+func writeEnvironmentScripts(params map[string]string, extra []string) {
+	for _, format := range envScriptFormats {
+		writeEnvironmentScript(format, params, extra)
+	}
+}
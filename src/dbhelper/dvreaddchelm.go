@@ -0,0 +1,260 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"fmt"
+	"github.com/Dobryvechir/dvserver/src/dvjson"
+	"github.com/Dobryvechir/dvserver/src/dvparser"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	helmValuesFile       = "values.discovered.yaml"
+	helmValuesPrefix     = "Values."
+	helmReleaseName      = "Release.Name"
+	helmExpressionPrefix = "Helm.expression."
+)
+
+var helmCommentRegexp = regexp.MustCompile(`\{\{-?\s*/\*.*?\*/\s*-?\}\}`)
+var helmActionRegexp = regexp.MustCompile(`\{\{-?\s*(.*?)\s*-?\}\}`)
+var helmReferenceRegexp = regexp.MustCompile(`\.((?:Values|Release|Chart)(?:\.[A-Za-z0-9_-]+)+)`)
+
+// isHelmNameParameter tells whether the parameter is the release name or a helper, such as the full name, that cannot be matched
+func isHelmNameParameter(name string) bool {
+	return name == helmReleaseName || strings.HasPrefix(name, helmExpressionPrefix)
+}
+
+// convertHelmAction turns {{ .Values.a.b | quote }} or {{ default "x" .Values.a.b }} into ${Values.a.b};
+// the other actions become placeholders that match anything
+func convertHelmAction(action string, counter *int) string {
+	expr := strings.TrimSpace(helmActionRegexp.FindStringSubmatch(action)[1])
+	refs := helmReferenceRegexp.FindAllStringSubmatchIndex(expr, -1)
+	if len(refs) > 0 {
+		if refs[0][0] == 0 {
+			return "${" + expr[refs[0][2]:refs[0][3]] + "}"
+		}
+		if strings.HasPrefix(expr, "default ") || strings.HasPrefix(expr, "quote ") || strings.HasPrefix(expr, "squote ") {
+			last := refs[len(refs)-1]
+			return "${" + expr[last[2]:last[3]] + "}"
+		}
+	}
+	*counter++
+	return "${" + helmExpressionPrefix + strconv.Itoa(*counter) + "}"
+}
+
+// convertHelmTemplate converts a chart template into the parametrized yaml documents,
+// the lines with control actions only (if, range, with, end, include of blocks) are dropped
+func convertHelmTemplate(data string, counter *int) []string {
+	lines := strings.Split(strings.Replace(data, "\r\n", "\n", -1), "\n")
+	docs := make([]string, 0, 2)
+	current := make([]string, 0, len(lines))
+	for _, line := range lines {
+		line = helmCommentRegexp.ReplaceAllString(line, "")
+		if strings.TrimSpace(line) == "---" {
+			docs = append(docs, strings.Join(current, "\n"))
+			current = current[:0]
+			continue
+		}
+		if strings.Contains(line, "{{") {
+			if strings.TrimSpace(helmActionRegexp.ReplaceAllString(line, "")) == "" {
+				continue
+			}
+			line = helmActionRegexp.ReplaceAllStringFunc(line, func(action string) string {
+				return convertHelmAction(action, counter)
+			})
+		}
+		current = append(current, line)
+	}
+	return append(docs, strings.Join(current, "\n"))
+}
+
+func readHelmChartObjects(chartFolder string) ([]*dvjson.DvFieldInfo, error) {
+	files, err := ioutil.ReadDir(filepath.Join(chartFolder, "templates"))
+	if err != nil {
+		return nil, err
+	}
+	objects := make([]*dvjson.DvFieldInfo, 0, len(files))
+	counter := 0
+	for _, file := range files {
+		name := file.Name()
+		ext := strings.ToLower(filepath.Ext(name))
+		if file.IsDir() || strings.HasPrefix(name, "_") || ext != ".yaml" && ext != ".yml" {
+			continue
+		}
+		fileName := filepath.Join(chartFolder, "templates", name)
+		data, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range convertHelmTemplate(string(data), &counter) {
+			if strings.TrimSpace(doc) == "" {
+				continue
+			}
+			item, err := dvjson.ReadYamlAsDvFieldInfo([]byte(doc))
+			if err != nil || item == nil || item.ReadSimpleChildValue("kind") == "" {
+				fmt.Printf("Skipped a part of %s that cannot be read without rendering: %v\n", fileName, err)
+				continue
+			}
+			objects = append(objects, item)
+		}
+	}
+	return objects, nil
+}
+
+func readHelmValues(chartFolder string) (*dvjson.DvFieldInfo, error) {
+	data, err := ioutil.ReadFile(filepath.Join(chartFolder, "values.yaml"))
+	if os.IsNotExist(err) {
+		return dvjson.CreateDvFieldInfoObject(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	values, err := dvjson.ReadYamlAsDvFieldInfo(data)
+	if err != nil {
+		return nil, err
+	}
+	if values == nil || values.Kind != dvjson.FIELD_OBJECT {
+		values = dvjson.CreateDvFieldInfoObject()
+	}
+	return values, nil
+}
+
+// addHelmValueDefaults presents the scalar values as the parameters Values.a.b with their defaults
+func addHelmValueDefaults(node *dvjson.DvFieldInfo, path string, res map[string]*ocTemplateParameter) {
+	for _, field := range node.Fields {
+		if field == nil {
+			continue
+		}
+		key := path + "." + string(field.Name)
+		switch field.Kind {
+		case dvjson.FIELD_OBJECT:
+			addHelmValueDefaults(field, key, res)
+		case dvjson.FIELD_ARRAY:
+		default:
+			value := dvparser.GetUnquotedString(field.GetStringValue())
+			res[key] = &ocTemplateParameter{value: value, defaultValue: value}
+		}
+	}
+}
+
+func isHelmValueOfKind(value string, kind int) bool {
+	switch kind {
+	case dvjson.FIELD_NUMBER:
+		_, err := strconv.ParseFloat(value, 64)
+		return err == nil
+	case dvjson.FIELD_BOOLEAN:
+		return value == "true" || value == "false"
+	}
+	return false
+}
+
+// setHelmValue puts the discovered value in the values tree, the numbers and booleans keep their kind
+func setHelmValue(root *dvjson.DvFieldInfo, path []string, value string) {
+	node := root
+	n := len(path)
+	for i := 0; i < n; i++ {
+		var child *dvjson.DvFieldInfo
+		for _, field := range node.Fields {
+			if field != nil && string(field.Name) == path[i] {
+				child = field
+				break
+			}
+		}
+		if i == n-1 {
+			if child == nil {
+				node.AddStringField(path[i], value)
+				return
+			}
+			if !isHelmValueOfKind(value, child.Kind) {
+				child.Kind = dvjson.FIELD_STRING
+			}
+			child.Value = []byte(value)
+			child.Fields = nil
+			return
+		}
+		if child == nil || child.Kind != dvjson.FIELD_OBJECT {
+			if child == nil {
+				child = dvjson.CreateDvFieldInfoObject()
+				child.Name = []byte(path[i])
+				node.AddField(child)
+			} else {
+				child.Kind = dvjson.FIELD_OBJECT
+				child.Value = nil
+				child.Fields = nil
+			}
+		}
+		node = child
+	}
+}
+
+// runHelmDiscovery reverse-engineers the values of the chart from the live objects of the microservice
+func runHelmDiscovery(args []string, options *dcParamsOptions) bool {
+	microServiceName := ""
+	if len(args) > 0 {
+		microServiceName = args[0]
+	} else {
+		var err error
+		if microServiceName, err = tryLearnMicroServiceNameFromCurrentFolderPath(); err != nil {
+			fmt.Println("Failure. Please specify the microservice name")
+			fmt.Println(helpDvReadDcParams)
+			return false
+		}
+	}
+	values, err := readHelmValues(options.helm)
+	if err != nil {
+		fmt.Printf("Error in values of %s: %v\n", options.helm, err)
+		return false
+	}
+	objects, err := readHelmChartObjects(options.helm)
+	if err != nil {
+		fmt.Printf("Error in templates of %s: %v\n", options.helm, err)
+		return false
+	}
+	kind, ok, err := findWorkloadKind(microServiceName, options.kind)
+	if !ok {
+		fmt.Printf("Microservice %s does not exist %v\n", microServiceName, err)
+		return false
+	}
+	envMap, workload := presentMicroServiceInfo(microServiceName, kind)
+	context := createTemplateProcessingContext(microServiceName, kind, workload)
+	res := make(map[string]*ocTemplateParameter)
+	addHelmValueDefaults(values, strings.TrimSuffix(helmValuesPrefix, "."), res)
+	objects = orderTemplateObjects(objects)
+	if err = collectObjectParameters(objects, envMap, res, context); err != nil {
+		fmt.Printf("error: %v\n", err)
+	}
+	if p := res[helmReleaseName]; p != nil && p.provided {
+		fmt.Printf("Release name: %s\n", p.value)
+	}
+	for k := range res {
+		if !strings.HasPrefix(k, helmValuesPrefix) {
+			delete(res, k)
+		}
+	}
+	paramMap := createSimpleMapFromOcTemplateParameters(res)
+	if options.drift != "" {
+		writeDriftReport(options, res, paramMap)
+	}
+	keys := make([]string, 0, len(res))
+	for k, v := range res {
+		if v.provided {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		setHelmValue(values, strings.Split(k[len(helmValuesPrefix):], "."), paramMap[k])
+	}
+	writeFile(helmValuesFile, string(values.PrintToYaml(2)))
+	if commonReadDcOk {
+		fmt.Printf("Successfully saved %d discovered values in %s\n", len(keys), helmValuesFile)
+	}
+	return commonReadDcOk
+}
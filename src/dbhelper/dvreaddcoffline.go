@@ -0,0 +1,168 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/Dobryvechir/dvserver/src/dvjson"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// offlineObjectStore keeps the objects of `oc get -o json/yaml` dumps by the lower case kind and name
+type offlineObjectStore struct {
+	folder  string
+	objects map[string]map[string]*dvjson.DvFieldInfo
+}
+
+// offlineStore is set in the offline mode, then no cluster requests are made
+var offlineStore *offlineObjectStore
+
+func splitYamlDocuments(data []byte) [][]byte {
+	lines := strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n")
+	docs := make([][]byte, 0, 1)
+	start := 0
+	for i, line := range lines {
+		if strings.TrimRight(line, " \t") == "---" {
+			docs = append(docs, []byte(strings.Join(lines[start:i], "\n")))
+			start = i + 1
+		}
+	}
+	return append(docs, []byte(strings.Join(lines[start:], "\n")))
+}
+
+// add registers the object or, for lists, all its items
+func (store *offlineObjectStore) add(item *dvjson.DvFieldInfo) {
+	if item == nil || item.Kind != dvjson.FIELD_OBJECT {
+		return
+	}
+	kind := strings.ToLower(item.ReadSimpleChildValue("kind"))
+	if kind == "list" || strings.HasSuffix(kind, "list") && item.ReadSimpleChild("items") != nil {
+		if items := item.ReadSimpleChild("items"); items != nil {
+			for _, child := range items.Fields {
+				store.add(child)
+			}
+		}
+		return
+	}
+	name := item.ReadChildStringValue("metadata.name")
+	if kind == "" || name == "" {
+		return
+	}
+	if store.objects[kind] == nil {
+		store.objects[kind] = make(map[string]*dvjson.DvFieldInfo)
+	}
+	store.objects[kind][name] = item
+}
+
+func loadOfflineObjects(folder string) (*offlineObjectStore, error) {
+	files, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return nil, err
+	}
+	store := &offlineObjectStore{folder: folder, objects: make(map[string]map[string]*dvjson.DvFieldInfo)}
+	for _, file := range files {
+		ext := strings.ToLower(filepath.Ext(file.Name()))
+		if file.IsDir() || ext != ".json" && ext != ".yaml" && ext != ".yml" {
+			continue
+		}
+		fileName := filepath.Join(folder, file.Name())
+		data, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return nil, err
+		}
+		if dvjson.IsCurrentFormatJson(data) {
+			item, err := dvjson.ReadJsonAsDvFieldInfo(data)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", fileName, err)
+			}
+			store.add(item)
+			continue
+		}
+		for _, doc := range splitYamlDocuments(data) {
+			if strings.TrimSpace(string(doc)) == "" {
+				continue
+			}
+			item, err := dvjson.ReadYamlAsDvFieldInfo(doc)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", fileName, err)
+			}
+			store.add(item)
+		}
+	}
+	return store, nil
+}
+
+func (store *offlineObjectStore) list(kind string) []string {
+	objects := store.objects[strings.ToLower(kind)]
+	names := make([]string, 0, len(objects))
+	for name := range objects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (store *offlineObjectStore) get(kind string, name string) (*dvjson.DvFieldInfo, error) {
+	kind = strings.ToLower(kind)
+	if item := store.objects[kind][name]; item != nil {
+		return item, nil
+	}
+	return nil, fmt.Errorf("%s %s is not found in %s", kind, name, store.folder)
+}
+
+// getSingle returns the object of the kind named as the microservice or, failing that, the only object of the kind
+func (store *offlineObjectStore) getSingle(microServiceName string, kind string) (*dvjson.DvFieldInfo, error) {
+	if item, err := store.get(kind, microServiceName); err == nil {
+		return item, nil
+	}
+	if names := store.list(kind); len(names) == 1 {
+		return store.get(kind, names[0])
+	}
+	return nil, fmt.Errorf("cannot choose %s for %s in %s", kind, microServiceName, store.folder)
+}
+
+// readSectionValue reads data.<key> without the path syntax, because the keys may contain dots
+func readSectionValue(item *dvjson.DvFieldInfo, section string, key string) (string, bool) {
+	data := item.ReadSimpleChild(section)
+	if data == nil || data.ReadSimpleChild(key) == nil {
+		return "", false
+	}
+	return data.ReadSimpleChildValue(key), true
+}
+
+// resolveValueFrom takes the environment value from the dumped config maps and secrets
+func (store *offlineObjectStore) resolveValueFrom(valueFrom *dvjson.DvFieldInfo) (string, error) {
+	if ref := valueFrom.ReadSimpleChild("configMapKeyRef"); ref != nil {
+		configMap, err := store.get("configmap", ref.ReadSimpleChildValue("name"))
+		if err != nil {
+			return "", err
+		}
+		value, ok := readSectionValue(configMap, "data", ref.ReadSimpleChildValue("key"))
+		if !ok {
+			return "", errors.New("no " + ref.ReadSimpleChildValue("key") + " in config map " + ref.ReadSimpleChildValue("name"))
+		}
+		return value, nil
+	}
+	if ref := valueFrom.ReadSimpleChild("secretKeyRef"); ref != nil {
+		secret, err := store.get("secret", ref.ReadSimpleChildValue("name"))
+		if err != nil {
+			return "", err
+		}
+		key := ref.ReadSimpleChildValue("key")
+		if value, ok := readSectionValue(secret, "stringData", key); ok {
+			return value, nil
+		}
+		value, ok := readSectionValue(secret, "data", key)
+		if !ok {
+			return "", errors.New("no " + key + " in secret " + ref.ReadSimpleChildValue("name"))
+		}
+		data, err := base64.StdEncoding.DecodeString(value)
+		return string(data), err
+	}
+	return "", errors.New("only configMapKeyRef and secretKeyRef can be resolved offline")
+}
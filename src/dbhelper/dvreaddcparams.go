@@ -16,7 +16,25 @@ import (
 
 var copyrightDvReadDcParams = "Copyright by Danyil Dobryvechir 2019"
 
-var helpDvReadDcParams = copyrightDvReadDcParams + "\ndvreaddcparams <microservice name> [<original template>]"
+var helpDvReadDcParams = copyrightDvReadDcParams + "\ndvreaddcparams [options] <microservice name> [<original template>]\n" +
+	"options:\n" +
+	"  --kind=<kind>         kind of the microservice workload: DeploymentConfig, Deployment or StatefulSet\n" +
+	"                        (default - the first kind that has the object named as the microservice)\n" +
+	"  --helm=<chart folder> discover the Helm values of the chart from the live objects and save them in " + helmValuesFile + "\n" +
+	"  --offline=<folder>    read the objects from the `oc get -o json` or `-o yaml` dumps (single objects, lists\n" +
+	"                        or multi-document yaml) in the folder instead of the cluster; the environment values\n" +
+	"                        from config maps and secrets are taken from the dumped ones\n" +
+	"  --drift[=table|json]  report per parameter the template default, the live value, whether they differ, the object\n" +
+	"                        and path of the value and the dubious matches (default format - table)\n" +
+	"  --drift-file=<file>   file of the drift report (default - " + driftReportTableFile + " or " + driftReportJsonFile + ")"
+
+type dcParamsOptions struct {
+	kind      string
+	helm      string
+	offline   string
+	drift     string
+	driftFile string
+}
 
 var commonReadDcOk = true
 
@@ -25,7 +43,6 @@ const (
 	paramsMapFile             = "paramsMap.properties"
 	paramsSetCmd              = "launchRun.cmd"
 	templatePropertiesFile    = "template.properties"
-	templateEnvPath           = "objects.find({\"kind\":\"DeploymentConfig\"}).spec.template.spec.containers[0].env"
 	serviceUpFile             = "serviceUp.cmd"
 	serviceUpFileContent      = "@oc new-app -f dvtemplate.json\n"
 	serviceDownFile           = "serviceDown.cmd"
@@ -37,9 +54,11 @@ const (
 
 type ocTemplateParameter struct {
 	value               string
+	defaultValue        string
 	path                string
 	openShiftObjectType string
 	provided            bool
+	doubt               bool
 }
 
 type OcTemplateProcessingContext struct {
@@ -155,8 +174,8 @@ func isRealMicroService(name string) bool {
 	if len(name) == 0 {
 		return false
 	}
-	ok, err := dvoc.IsMicroServicePresent(name)
-	if err != nil {
+	_, ok, err := findWorkloadKind(name, "")
+	if err != nil && !ok {
 		fmt.Printf("Error %v", err)
 		return false
 	}
@@ -190,11 +209,63 @@ func tryLearnMicroServiceNameFromCurrentFolderPath() (string, error) {
 	return "", errors.New("failed to determine the microService name from your path")
 }
 
+func readDcParamsOptions(args []string) (options *dcParamsOptions, rest []string) {
+	options = &dcParamsOptions{}
+	i := 0
+	for ; i < len(args) && strings.HasPrefix(args[i], "--") && args[i] != "--help" && args[i] != "--version"; i++ {
+		arg := args[i]
+		switch {
+		case strings.HasPrefix(arg, "--kind="):
+			options.kind = strings.ToLower(arg[len("--kind="):])
+			if !isWorkloadKind(options.kind) {
+				fmt.Printf("Unsupported kind %s\n", options.kind)
+				os.Exit(1)
+			}
+		case strings.HasPrefix(arg, "--helm="):
+			options.helm = arg[len("--helm="):]
+		case strings.HasPrefix(arg, "--offline="):
+			options.offline = arg[len("--offline="):]
+		case arg == "--drift":
+			options.drift = driftFormatTable
+		case strings.HasPrefix(arg, "--drift="):
+			options.drift = strings.ToLower(arg[len("--drift="):])
+			if options.drift != driftFormatTable && options.drift != driftFormatJson {
+				fmt.Printf("Unsupported drift report format %s\n", options.drift)
+				os.Exit(1)
+			}
+		case strings.HasPrefix(arg, "--drift-file="):
+			options.driftFile = arg[len("--drift-file="):]
+			if options.drift == "" {
+				options.drift = driftFormatTable
+			}
+		default:
+			fmt.Printf("Unknown option %s\n", arg)
+			fmt.Println(helpDvReadDcParams)
+			os.Exit(1)
+		}
+	}
+	return options, args[i:]
+}
+
 func main() {
 	//if mainTest() {
 	//	return
 	//}
 	args := dvparser.InitAndReadCommandLine()
+	options, args := readDcParamsOptions(args)
+	if options.offline != "" {
+		var err error
+		if offlineStore, err = loadOfflineObjects(options.offline); err != nil {
+			fmt.Printf("Cannot read the dumps: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if options.helm != "" {
+		if !runHelmDiscovery(args, options) {
+			os.Exit(1)
+		}
+		return
+	}
 	l := len(args)
 	microServiceName := ""
 	data, err := ioutil.ReadFile("template.json")
@@ -221,13 +292,16 @@ func main() {
 				os.Exit(1)
 			}
 		} else {
-			isPresent, err = dvoc.IsMicroServicePresent(microServiceName)
+			options.kind, isPresent, err = findWorkloadKind(microServiceName, options.kind)
+			if isPresent {
+				err = nil
+			}
 		}
 		if l > 1 {
 			if !isPresent {
 				data, err = ioutil.ReadFile(args[1])
 				if err != nil || len(data) == 0 {
-					fmt.Printf("%s is neither microservice name nor template file name")
+					fmt.Printf("%s is neither microservice name nor template file name", args[1])
 					os.Exit(1)
 				} else {
 					isPresent = true
@@ -247,7 +321,7 @@ func main() {
 	}
 
 	if len(data) == 0 {
-		presentMicroServiceInfo(microServiceName)
+		presentMicroServiceInfo(microServiceName, options.kind)
 		return
 	}
 	templateOrig, err := dvjson.ReadJsonAsDvFieldInfo(data)
@@ -263,10 +337,13 @@ func main() {
 			os.Exit(1)
 		}
 	}
-	envMap, dc := presentMicroServiceInfo(microServiceName)
-	smartDiscoveryOfOpenShiftParameters(microServiceName, envMap, templateOrig, dc)
+	if options.kind == "" {
+		options.kind, _, _ = findWorkloadKind(microServiceName, "")
+	}
+	envMap, dc := presentMicroServiceInfo(microServiceName, options.kind)
+	smartDiscoveryOfOpenShiftParameters(microServiceName, options, envMap, templateOrig, dc)
 	if commonReadDcOk {
-		fmt.Printf("Successfully saved in %s %s", paramsMapFile, paramsSetCmd)
+		fmt.Printf("Successfully saved in %s %s %s %s %s %s", paramsMapFile, paramsSetCmd, paramsSetSh, paramsSetPowerShell, paramsDockerEnvFile, paramsIntelliJEnvFile)
 	} else {
 		os.Exit(1)
 	}
@@ -282,8 +359,8 @@ func setObjectNameByType(context *OcTemplateProcessingContext, kind string, name
 			}
 			return "", false
 		})
-		if len(rest) == 1 && rest[0] == "OPENSHIFT_SERVICE_NAME" {
-			if objectName, ok := dvoc.ResolveMostSimilarObjectByMicroserviceNameAndObjectType(context.MicroServiceName, kind); ok {
+		if len(rest) == 1 && (rest[0] == "OPENSHIFT_SERVICE_NAME" || isHelmNameParameter(rest[0])) {
+			if objectName, ok := resolveMostSimilarObject(context.MicroServiceName, kind); ok {
 				rest = nil
 				name = objectName
 			}
@@ -313,13 +390,13 @@ func readExtraPodFile() []string {
 	return res
 }
 
-func presentMicroServiceInfo(microServiceName string) (map[string]string, *dvjson.DvFieldInfo) {
+func presentMicroServiceInfo(microServiceName string, kind string) (map[string]string, *dvjson.DvFieldInfo) {
 	if microServiceName == "" {
 		fmt.Printf("Error in command line! Please, specify microservice name ")
 		os.Exit(1)
 	}
 	dvparser.SetGlobalPropertiesValue("MICROSERVICE_NAME", microServiceName)
-	envMap, dc, err := dvoc.ReadPodReadyEnvironment(microServiceName)
+	envMap, dc, err := readWorkloadEnvironment(microServiceName, kind)
 	if err != nil {
 		fmt.Printf("Cannot read pod environment: %v", err)
 		os.Exit(1)
@@ -328,6 +405,7 @@ func presentMicroServiceInfo(microServiceName string) (map[string]string, *dvjso
 	writeEnvironment(paramsMapPureFile, envMap, "", nil)
 	writeEnvironment(paramsMapFile, envMap, "", extra)
 	writeEnvironment(paramsSetCmd, envMap, "SET ", extra)
+	writeEnvironmentScripts(envMap, extra)
 	return envMap, dc
 }
 
@@ -350,10 +428,19 @@ func createSimpleMapFromOcTemplateParameters(ocMap map[string]*ocTemplateParamet
 	return res
 }
 
-func smartDiscoveryOfOpenShiftParameters(microServiceName string, envMap map[string]string, template *dvjson.DvFieldInfo, dc *dvjson.DvFieldInfo) error {
+func createTemplateProcessingContext(microServiceName string, kind string, workload *dvjson.DvFieldInfo) *OcTemplateProcessingContext {
 	fieldByObjectType := make(map[string]*dvjson.DvFieldInfo)
-	fieldByObjectType["DeploymentConfig"] = dc
-	context := &OcTemplateProcessingContext{FieldByObjectType: fieldByObjectType, MicroServiceName: microServiceName, ObjectNameByType: make(map[string]string)}
+	if kind == "" {
+		kind = kindDeploymentConfig
+	}
+	if workload != nil {
+		fieldByObjectType[kind] = workload
+	}
+	return &OcTemplateProcessingContext{FieldByObjectType: fieldByObjectType, MicroServiceName: microServiceName, ObjectNameByType: make(map[string]string)}
+}
+
+func smartDiscoveryOfOpenShiftParameters(microServiceName string, options *dcParamsOptions, envMap map[string]string, template *dvjson.DvFieldInfo, dc *dvjson.DvFieldInfo) error {
+	context := createTemplateProcessingContext(microServiceName, options.kind, dc)
 	ocMap, err := collectAllTemplateParameters(template, envMap, context)
 	if err != nil {
 		fmt.Printf("error: %v\n", err)
@@ -361,6 +448,9 @@ func smartDiscoveryOfOpenShiftParameters(microServiceName string, envMap map[str
 		return err
 	}
 	paramMap := createSimpleMapFromOcTemplateParameters(ocMap)
+	if options.drift != "" {
+		writeDriftReport(options, ocMap, paramMap)
+	}
 	writeEnvironment(templatePropertiesFile, paramMap, "", nil)
 	writeFile(serviceUpFile, serviceUpFileContent)
 	writeFile(serviceDownFile, getMicroServiceDownInfo(context, template, paramMap))
@@ -369,30 +459,32 @@ func smartDiscoveryOfOpenShiftParameters(microServiceName string, envMap map[str
 	return nil
 }
 
-func addSingleVariableParam(res map[string]*ocTemplateParameter, k string, v string) {
-	if res[k] != nil {
-		res[k].value = v
-		res[k].provided = true
-	} else {
-		res[k] = &ocTemplateParameter{value: v, provided: true}
-	}
+func addSingleVariableParam(res map[string]*ocTemplateParameter, k string, v string, objectType string, path string, doubt bool) {
+	if res[k] == nil {
+		res[k] = &ocTemplateParameter{}
+	}
+	res[k].value = v
+	res[k].provided = true
+	res[k].openShiftObjectType = objectType
+	res[k].path = path
+	res[k].doubt = doubt
 }
 
-func addVariableParams(res map[string]*ocTemplateParameter, params map[string]string) {
+func addVariableParams(res map[string]*ocTemplateParameter, params map[string]string, objectType string, path string, doubt bool) {
 	if params != nil {
 		for k, v := range params {
-			addSingleVariableParam(res, k, v)
+			addSingleVariableParam(res, k, v, objectType, path, doubt)
 		}
 	}
 }
 
-func setVariablesBy(model string, pattern string, res map[string]*ocTemplateParameter) {
+func setVariablesBy(model string, pattern string, res map[string]*ocTemplateParameter, objectType string, path string) {
 	hintOccurrence, hintStrict := getHintForPattern(pattern)
 	if params, doubt, ok := dvparser.SubstitutionMatchModelByPattern(model, pattern, hintOccurrence, hintStrict); ok {
 		if doubt {
 			fmt.Printf("Dubious match in %s by %s", model, pattern)
 		}
-		addVariableParams(res, params)
+		addVariableParams(res, params, objectType, path, doubt)
 	}
 }
 
@@ -426,13 +518,31 @@ func collectAllTemplateParameters(template *dvjson.DvFieldInfo, envMap map[strin
 		if v != nil {
 			value = string(v.Value)
 		}
-		res[key] = &ocTemplateParameter{value: value}
+		res[key] = &ocTemplateParameter{value: value, defaultValue: value}
 	}
-	envField, err := template.ReadChild(templateEnvPath, nil)
-	if err != nil || envField == nil {
+	objects := template.ReadSimpleChild("objects")
+	if objects == nil {
+		err = errors.New("objects is not present in the template")
 		return
 	}
-	n = len(envField.Fields)
+	objects.Fields = orderTemplateObjects(objects.Fields)
+	err = collectObjectParameters(objects.Fields, envMap, res, context)
+	return
+}
+
+// collectObjectParameters matches the parametrized objects with the live ones: the workload environment first, then all fields;
+// the objects must be ordered by dependencies
+func collectObjectParameters(objects []*dvjson.DvFieldInfo, envMap map[string]string, res map[string]*ocTemplateParameter, context *OcTemplateProcessingContext) (err error) {
+	var envField *dvjson.DvFieldInfo
+	workloadKind := ""
+	if workload := findWorkloadObject(objects); workload != nil {
+		envField, _ = workload.ReadChild(workloadEnvPath, nil)
+		workloadKind = strings.ToLower(workload.ReadSimpleChildValue("kind"))
+	}
+	n := 0
+	if envField != nil {
+		n = len(envField.Fields)
+	}
 	for i := 0; i < n; i++ {
 		k := envField.Fields[i].ReadSimpleChild("name")
 		v := envField.Fields[i].ReadSimpleChild("value")
@@ -449,28 +559,23 @@ func collectAllTemplateParameters(template *dvjson.DvFieldInfo, envMap map[strin
 						}
 						if found != "" {
 							fmt.Printf("Not unique environment variable: both %s and %s match %s", lk, found, key)
+							doubt = true
 						}
 						found = lk
-						addVariableParams(res, params)
-						setVariablesBy(liveValue, value, res)
+						addVariableParams(res, params, workloadKind, workloadEnvPath+"."+lk+" (name)", doubt)
+						setVariablesBy(liveValue, value, res, workloadKind, workloadEnvPath+"."+lk)
 					}
 				}
 			} else {
 				if liveValue, ok := envMap[key]; ok {
-					setVariablesBy(liveValue, value, res)
+					setVariablesBy(liveValue, value, res, workloadKind, workloadEnvPath+"."+key)
 				}
 			}
 		}
 	}
-	objects := template.ReadSimpleChild("objects")
-	if objects == nil {
-		err = errors.New("objects is not present in the template")
-		return
-	}
-	objects.Fields, _ = dvoc.OrderTemplateObjectsByDependencies(objects.Fields, true)
-	n = len(objects.Fields)
+	n = len(objects)
 	for i := 0; i < n; i++ {
-		item := objects.Fields[i]
+		item := objects[i]
 		if item == nil {
 			continue
 		}
@@ -543,7 +648,7 @@ func provideObjectParameters(item *dvjson.DvFieldInfo, objectType string, path s
 			if doubt {
 				fmt.Printf("Dubious match in %s by %s\n", model, string(item.Value))
 			}
-			addVariableParams(res, params)
+			addVariableParams(res, params, objectType, path, doubt)
 		} else {
 			fmt.Printf("Missing values for %v (%s, %v)\n", list, model, rest)
 			for _, v := range list {
@@ -560,7 +665,11 @@ func getLiveSimpleValueByObjectType(objectType string, path string, context *OcT
 	if !ok {
 		objectName, ok := context.ObjectNameByType[objectType]
 		if ok {
-			fieldInfo, err = dvoc.GetConfigurationByOpenShiftObjectTypeAndName(objectName, objectType)
+			fieldInfo, err = getLiveObjectConfiguration(objectName, objectType)
+		} else if isWorkloadKind(objectType) {
+			fieldInfo, err = getLiveObjectConfiguration(context.MicroServiceName, objectType)
+		} else if offlineStore != nil {
+			fieldInfo, err = offlineStore.getSingle(context.MicroServiceName, objectType)
 		} else {
 			fieldInfo, err = dvoc.GetConfigurationByOpenShiftObjectType(context.MicroServiceName, objectType)
 		}
@@ -586,7 +695,7 @@ func getMicroServiceDownInfo(context *OcTemplateProcessingContext, template *dvj
 			o := objects.Fields[i]
 			kind := o.ReadSimpleChildValue("kind")
 			name := o.ReadChildStringValue("metadata.name")
-			objType, err := dvoc.GetShortOpenShiftNameForObjectType(kind)
+			objType, err := getShortObjectType(kind)
 			if err != nil {
 				fmt.Printf("delete %s problem: %v", kind, err)
 			} else {
@@ -0,0 +1,179 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/Dobryvechir/dvserver/src/dvjson"
+)
+
+const deploymentTemplate = `{
+  "kind": "Template",
+  "parameters": [
+    {"name": "SERVICE_NAME", "value": "app"},
+    {"name": "IMAGE_TAG", "value": "latest"},
+    {"name": "DB_HOST", "value": "localhost"},
+    {"name": "LOG_LEVEL", "value": "INFO"}
+  ],
+  "objects": [
+    {"kind": "Service", "metadata": {"name": "${SERVICE_NAME}"}, "spec": {"ports": [{"port": 8080}]}},
+    {"kind": "Deployment", "metadata": {"name": "${SERVICE_NAME}"}, "spec": {"template": {"spec": {"containers": [{
+      "name": "app",
+      "image": "registry.local/app:${IMAGE_TAG}",
+      "env": [
+        {"name": "DB_HOST", "value": "${DB_HOST}"},
+        {"name": "LOG_LEVEL", "value": "${LOG_LEVEL}"}
+      ]
+    }]}}}}
+  ]
+}`
+
+const liveDeployment = `{"kind": "Deployment", "metadata": {"name": "app"}, "spec": {"template": {"spec": {"containers": [{
+  "name": "app",
+  "image": "registry.local/app:1.4.2",
+  "env": [
+    {"name": "DB_HOST", "value": "db.prod"},
+    {"name": "LOG_LEVEL", "value": "DEBUG"}
+  ]
+}]}}}}`
+
+func readTestJson(t *testing.T, data string) *dvjson.DvFieldInfo {
+	item, err := dvjson.ReadJsonAsDvFieldInfo([]byte(data))
+	if err != nil || item == nil {
+		t.Fatalf("cannot read %s: %v", data, err)
+	}
+	return item
+}
+
+func useTestOfflineStore(t *testing.T, store *offlineObjectStore) {
+	saved := offlineStore
+	offlineStore = store
+	t.Cleanup(func() { offlineStore = saved })
+}
+
+func TestOrderTemplateObjectsKeepsWorkloads(t *testing.T) {
+	var objects []*dvjson.DvFieldInfo
+	for _, kind := range []string{"Secret", "Service", "StatefulSet", "HorizontalPodAutoscaler", "Deployment", "ConfigMap"} {
+		objects = append(objects, readTestJson(t, `{"kind": "`+kind+`", "metadata": {"name": "app"}}`))
+	}
+	ordered := orderTemplateObjects(objects)
+	kinds := make([]string, len(ordered))
+	for i, item := range ordered {
+		kinds[i] = item.ReadSimpleChildValue("kind")
+	}
+	if got := strings.Join(kinds, ","); got != "StatefulSet,Deployment,Service,ConfigMap,Secret" {
+		t.Fatalf("ordered kinds %s", got)
+	}
+}
+
+func TestDeploymentTemplateParameters(t *testing.T) {
+	store := &offlineObjectStore{folder: "test", objects: make(map[string]map[string]*dvjson.DvFieldInfo)}
+	store.add(readTestJson(t, liveDeployment))
+	store.add(readTestJson(t, `{"kind": "Service", "metadata": {"name": "app"}, "spec": {"ports": [{"port": 8080}]}}`))
+	useTestOfflineStore(t, store)
+	envMap, workload, err := readWorkloadEnvironment("app", kindDeployment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	context := createTemplateProcessingContext("app", kindDeployment, workload)
+	res, err := collectAllTemplateParameters(readTestJson(t, deploymentTemplate), envMap, context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{"IMAGE_TAG": "1.4.2", "DB_HOST": "db.prod", "LOG_LEVEL": "DEBUG", "SERVICE_NAME": "app"} {
+		if res[k] == nil || res[k].value != v {
+			t.Errorf("%s is %+v instead of %s", k, res[k], v)
+		}
+	}
+}
+
+const offlineFixtures = "testdata/dvreaddcparams"
+
+func TestLoadOfflineObjects(t *testing.T) {
+	store, err := loadOfflineObjects(offlineFixtures + "/dumps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for kind, names := range map[string]string{
+		"deployment": "app",
+		"configmap":  "app-config,other-config",
+		"secret":     "app-secret",
+		"service":    "app",
+		"route":      "app",
+	} {
+		if got := strings.Join(store.list(kind), ","); got != names {
+			t.Errorf("%s objects %s instead of %s", kind, got, names)
+		}
+	}
+	if len(store.objects) != 5 {
+		t.Errorf("%d kinds are loaded instead of 5", len(store.objects))
+	}
+	if _, err = store.getSingle("other", "deployment"); err != nil {
+		t.Errorf("the only deployment is not chosen: %v", err)
+	}
+}
+
+func TestResolveValueFromOffline(t *testing.T) {
+	store, err := loadOfflineObjects(offlineFixtures + "/dumps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for ref, expected := range map[string]string{
+		`{"configMapKeyRef": {"name": "app-config", "key": "feature.flags"}}`: "search,export",
+		`{"secretKeyRef": {"name": "app-secret", "key": "password"}}`:         "s3cr3t!pass",
+		`{"secretKeyRef": {"name": "app-secret", "key": "username"}}`:         "app",
+	} {
+		value, err := store.resolveValueFrom(readTestJson(t, ref))
+		if err != nil || value != expected {
+			t.Errorf("%s is resolved to %q, %v instead of %q", ref, value, err, expected)
+		}
+	}
+	for _, ref := range []string{
+		`{"secretKeyRef": {"name": "app-secret", "key": "token"}}`,
+		`{"configMapKeyRef": {"name": "missing", "key": "mode"}}`,
+		`{"fieldRef": {"fieldPath": "metadata.name"}}`,
+	} {
+		if value, err := store.resolveValueFrom(readTestJson(t, ref)); err == nil {
+			t.Errorf("%s is resolved to %q", ref, value)
+		}
+	}
+}
+
+func TestOfflineParameterDiscovery(t *testing.T) {
+	store, err := loadOfflineObjects(offlineFixtures + "/dumps")
+	if err != nil {
+		t.Fatal(err)
+	}
+	useTestOfflineStore(t, store)
+	data, err := ioutil.ReadFile(offlineFixtures + "/template.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	envMap, workload, err := readWorkloadEnvironment("app", kindDeployment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if envMap["DB_PASSWORD"] != "s3cr3t!pass" || envMap["FEATURE_FLAGS"] != "search,export" {
+		t.Fatalf("valueFrom is not resolved in %v", envMap)
+	}
+	context := createTemplateProcessingContext("app", kindDeployment, workload)
+	res, err := collectAllTemplateParameters(readTestJson(t, string(data)), envMap, context)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{
+		"SERVICE_NAME": "app",
+		"IMAGE_TAG":    "1.4.2",
+		"LOG_LEVEL":    "DEBUG",
+		"DB_HOST":      "db.prod",
+		"FEATURES":     "search,export",
+		"ROUTE_HOST":   "app.prod.example.com",
+	} {
+		if res[k] == nil || res[k].value != v {
+			t.Errorf("%s is %+v instead of %s", k, res[k], v)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/Dobryvechir/dvserver/src/dvjson"
+	"github.com/Dobryvechir/dvserver/src/dvoc"
+	"github.com/Dobryvechir/dvserver/src/dvparser"
+	"sort"
+	"strings"
+)
+
+const (
+	kindDeploymentConfig = "deploymentconfig"
+	kindDeployment       = "deployment"
+	kindStatefulSet      = "statefulset"
+	workloadEnvPath      = "spec.template.spec.containers[0].env"
+)
+
+// workloadKinds are tried in this order when the kind of the microservice is not specified
+var workloadKinds = []string{kindDeploymentConfig, kindDeployment, kindStatefulSet}
+
+// orderTemplateObjects orders the objects by dependencies as dvoc.OrderTemplateObjectsByDependencies does, which drops
+// the kinds it does not know; the Deployments and StatefulSets take the place of the DeploymentConfig instead
+func orderTemplateObjects(objects []*dvjson.DvFieldInfo) []*dvjson.DvFieldInfo {
+	res := make([]*dvjson.DvFieldInfo, 0, len(objects))
+	for _, item := range objects {
+		if item == nil {
+			continue
+		}
+		kind := strings.ToLower(item.ReadSimpleChildValue("kind"))
+		priority, ok := dvoc.TemplateObjectPriority[kind]
+		if !ok && isWorkloadKind(kind) {
+			priority, ok = dvoc.TemplateObjectPriority[kindDeploymentConfig], true
+		}
+		if !ok {
+			fmt.Printf("Unknown object type %s is skipped\n", kind)
+			continue
+		}
+		item.FieldStatus = priority
+		res = append(res, item)
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].FieldStatus < res[j].FieldStatus
+	})
+	return res
+}
+
+func isWorkloadKind(kind string) bool {
+	kind = strings.ToLower(kind)
+	for _, k := range workloadKinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// getShortObjectType extends the OpenShift short names by the Kubernetes workloads
+func getShortObjectType(kind string) (string, error) {
+	switch strings.ToLower(kind) {
+	case kindDeployment:
+		return "deployment", nil
+	case kindStatefulSet:
+		return "statefulset", nil
+	}
+	return dvoc.GetShortOpenShiftNameForObjectType(kind)
+}
+
+func getObjectListByType(kind string) ([]string, error) {
+	if offlineStore != nil {
+		return offlineStore.list(kind), nil
+	}
+	shortName, err := getShortObjectType(kind)
+	if err != nil {
+		return nil, err
+	}
+	return dvoc.GetObjectFullList(shortName)
+}
+
+// findWorkloadKind returns the kind of the workload named as the microservice, checking only the specified kind if any
+func findWorkloadKind(name string, kind string) (string, bool, error) {
+	kinds := workloadKinds
+	if kind != "" {
+		kinds = []string{strings.ToLower(kind)}
+	}
+	var lastErr error
+	for _, k := range kinds {
+		list, err := getObjectListByType(k)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		for _, s := range list {
+			if s == name {
+				return k, true, nil
+			}
+		}
+	}
+	return "", false, lastErr
+}
+
+func resolveMostSimilarObject(microServiceName string, kind string) (string, bool) {
+	if !isWorkloadKind(kind) && offlineStore == nil {
+		return dvoc.ResolveMostSimilarObjectByMicroserviceNameAndObjectType(microServiceName, kind)
+	}
+	list, err := getObjectListByType(kind)
+	if err != nil {
+		return "", false
+	}
+	choice := ""
+	choiceRate := 0
+	for _, s := range list {
+		if s == microServiceName {
+			return s, true
+		}
+		rate := dvparser.EvaluateDifferenceRate(s, microServiceName)
+		if rate > choiceRate {
+			choiceRate = rate
+			choice = s
+		}
+	}
+	return choice, choiceRate > 50
+}
+
+func getLiveObjectConfiguration(objectName string, kind string) (*dvjson.DvFieldInfo, error) {
+	if offlineStore != nil {
+		return offlineStore.get(kind, objectName)
+	}
+	shortName, err := getShortObjectType(kind)
+	if err != nil {
+		return nil, err
+	}
+	return dvoc.GetLiveConfiguration("edit " + shortName + " " + objectName)
+}
+
+// readWorkloadEnvironment reads the environment of the first container, the values from config maps and secrets
+// are taken from the pod or, in the offline mode, from the dumped config maps and secrets
+func readWorkloadEnvironment(microServiceName string, kind string) (map[string]string, *dvjson.DvFieldInfo, error) {
+	if kind == "" {
+		kind = kindDeploymentConfig
+	}
+	if kind == kindDeploymentConfig && offlineStore == nil {
+		return dvoc.ReadPodReadyEnvironment(microServiceName)
+	}
+	workload, err := getLiveObjectConfiguration(microServiceName, kind)
+	if err != nil {
+		return nil, nil, err
+	}
+	if workload == nil {
+		return nil, nil, errors.New("empty configuration of " + kind + " " + microServiceName)
+	}
+	env := make(map[string]string)
+	data, err := workload.ReadChild(workloadEnvPath, nil)
+	if err != nil || data == nil {
+		return env, workload, nil
+	}
+	for _, item := range data.Fields {
+		if item == nil {
+			continue
+		}
+		key := item.ReadSimpleChildValue("name")
+		if key == "" {
+			continue
+		}
+		if valueFrom := item.ReadSimpleChild("valueFrom"); valueFrom == nil {
+			env[key] = item.ReadSimpleChildValue("value")
+		} else if offlineStore != nil {
+			if env[key], err = offlineStore.resolveValueFrom(valueFrom); err != nil {
+				fmt.Printf("Cannot resolve %s offline: %v\n", key, err)
+			}
+		} else {
+			value, err := dvoc.GetSpecificVariableAtServer(microServiceName, key)
+			if err != nil {
+				return nil, nil, fmt.Errorf("cannot read %s at the pod: %v", key, err)
+			}
+			env[key] = strings.TrimRight(value, "\r\n")
+		}
+	}
+	return env, workload, nil
+}
+
+// findWorkloadObject finds the first DeploymentConfig, Deployment or StatefulSet among the objects
+func findWorkloadObject(objects []*dvjson.DvFieldInfo) *dvjson.DvFieldInfo {
+	for _, item := range objects {
+		if item != nil && isWorkloadKind(item.ReadSimpleChildValue("kind")) {
+			return item
+		}
+	}
+	return nil
+}
@@ -7,26 +7,102 @@ import (
 	"github.com/Dobryvechir/dvserver/src/dvoc"
 	"github.com/Dobryvechir/dvserver/src/dvparser"
 	"os"
+	"strconv"
 	"strings"
 )
 
 var copyrightDvSecret = "Copyright by Danyil Dobryvechir 2019"
 
-var help = copyrightDvSecret + "\ndvsecret [folder for all microservices in project, defaults to SECRET_PATH environment variable] [microservice name or * for all, default=*]"
+var help = copyrightDvSecret + "\ndvsecret [options] [save | restore | diff, default=save] [folder for all microservices in project, defaults to SECRET_PATH environment variable] [microservice name or * for all, default=*]\n" +
+	"  save                  save the live secrets and their types (" + secretTypeFile + ") in the folder\n" +
+	"  restore               build the Secret manifests from the saved secrets and apply them (or write them by --output)\n" +
+	"  diff                  compare the saved secrets with the live ones, only the key names and whether the values\n" +
+	"                        changed are reported\n" +
+	"options:\n" +
+	"  --format=<list>       comma-separated formats of the saved secrets (default - files):\n" +
+	"                        files - a file per key, env - " + secretEnvFile + ", properties - " + secretPropertiesFile + ",\n" +
+	"                        json - " + secretJsonFile + "; the values are decoded from base64, the files are readable by the owner only\n" +
+	"  --encrypt=<key name>  encrypt every saved file by a random AES-GCM key encrypted by the public key (the file gets\n" +
+	"                        the " + encryptedSecretSuffix + " suffix), the key folder is DVSERVER_DVCRYPT_KEY_FOLDER, the files are read by --decrypt\n" +
+	"  --secret=<name>       name of the secret, %1 is replaced by the microservice name (default - " + defaultSecretName + ")\n" +
+	"  --decrypt=<key name>  private key to read the encrypted saved secrets, property " + secretDecryptProperty + "\n" +
+	"  --output=<folder>     restore: write the manifests for `oc apply -f` in the folder instead of applying them\n" +
+	"  --parallel=<n>        number of microservices processed at once for * (default - " + strconv.Itoa(secretDefaultParallel) + ")\n" +
+	"for * the secrets are saved for all microservices of the project, restored and compared for all saved ones"
+
+const defaultSecretName = "%1-client-credentials"
+
+type secretOptions struct {
+	formats    []string
+	encryptKey string
+	decryptKey string
+	secretName string
+	output     string
+	parallel   int
+}
 
 var commonOk = true
 
-func createSingleSecret(folder string, microservice string) {
-	if !dvoc.SaveOpenshiftSecret(folder+microservice, microservice) {
-		fmt.Printf("Failed to save secrets for %s", microservice)
-		commonOk = false
+func readSecretOptions(args []string) (options *secretOptions, rest []string) {
+	options = &secretOptions{formats: []string{secretFormatFiles}, secretName: defaultSecretName, parallel: secretDefaultParallel}
+	i := 0
+	for ; i < len(args) && strings.HasPrefix(args[i], "--") && args[i] != "--help" && args[i] != "--version"; i++ {
+		arg := args[i]
+		switch {
+		case strings.HasPrefix(arg, "--format="):
+			options.formats = options.formats[:0]
+			for _, format := range strings.Split(strings.ToLower(arg[len("--format="):]), ",") {
+				format = strings.TrimSpace(format)
+				if !isSecretFormat(format) {
+					fmt.Printf("Unsupported format %s\n", format)
+					os.Exit(1)
+				}
+				options.formats = append(options.formats, format)
+			}
+		case strings.HasPrefix(arg, "--encrypt="):
+			options.encryptKey = arg[len("--encrypt="):]
+		case strings.HasPrefix(arg, "--secret="):
+			options.secretName = arg[len("--secret="):]
+		case strings.HasPrefix(arg, "--decrypt="):
+			options.decryptKey = arg[len("--decrypt="):]
+		case strings.HasPrefix(arg, "--output="):
+			options.output = arg[len("--output="):]
+		case strings.HasPrefix(arg, "--parallel="):
+			options.parallel = readSecretParallel(arg[len("--parallel="):])
+		default:
+			fmt.Printf("Unknown option %s\n", arg)
+			fmt.Println(help)
+			os.Exit(1)
+		}
 	}
+	return options, args[i:]
+}
+
+func getSecretName(options *secretOptions, microservice string) string {
+	return strings.Replace(options.secretName, "%1", microservice, -1)
+}
+
+func saveSingleSecret(folder string, microservice string, options *secretOptions) (string, error) {
+	values, secretType, err := readLiveSecret(getSecretName(options, microservice))
+	if err == nil {
+		err = exportSecret(folder+microservice, values, secretType, options.formats, options.encryptKey)
+	}
+	return "", err
 }
 
 func main() {
 	args := dvparser.InitAndReadCommandLine()
+	options, args := readSecretOptions(args)
 	params := dvparser.GlobalProperties
 	folder := params["SECRET_PATH"]
+	if options.decryptKey == "" {
+		options.decryptKey = params[secretDecryptProperty]
+	}
+	mode := secretModeSave
+	if len(args) >= 1 && (args[0] == secretModeSave || args[0] == secretModeRestore || args[0] == secretModeDiff) {
+		mode = args[0]
+		args = args[1:]
+	}
 	l := len(args)
 	if l >= 1 && (args[0] == "--help" || args[0] == "version" || args[0] == "-version" || args[0] == "--version") {
 		fmt.Println(help)
@@ -51,23 +127,48 @@ func main() {
 	if c != '\\' && c != '/' {
 		folder += "/"
 	}
+	task := saveSingleSecret
+	switch mode {
+	case secretModeRestore:
+		task = restoreSingleSecret
+	case secretModeDiff:
+		task = diffSingleSecret
+	}
+	list := []string{microservice}
 	if strings.Index(microservice, "*") >= 0 {
-		list, err := dvoc.GetMicroServiceFullList()
+		var err error
+		if mode == secretModeSave {
+			list, err = dvoc.GetMicroServiceFullList()
+		} else {
+			list, err = listSavedMicroServices(folder)
+		}
 		if err != nil {
 			commonOk = false
 			fmt.Printf("Failed to get the list of microservices")
 			os.Exit(1)
 			return
 		}
-		for _, microservice = range list {
-			createSingleSecret(folder, microservice)
+	}
+	if (mode == secretModeDiff || mode == secretModeRestore && options.output == "") && !dvoc.OcLogin() {
+		fmt.Println("Failed to login to the cluster")
+		os.Exit(1)
+	}
+	if options.output != "" {
+		if err := os.MkdirAll(options.output, secretFolderPermission); err != nil {
+			fmt.Printf("Cannot create %s: %v\n", options.output, err)
+			os.Exit(1)
 		}
-	} else {
-		createSingleSecret(folder, microservice)
 	}
-	if commonOk {
-		fmt.Printf("Successfully saved in %s", folder)
-	} else {
+	commonOk = runSecretTasks(list, options.parallel, func(microservice string) (string, error) {
+		return task(folder, microservice, options)
+	})
+	if !commonOk {
 		os.Exit(1)
 	}
+	switch mode {
+	case secretModeSave:
+		fmt.Printf("Successfully saved in %s", folder)
+	case secretModeRestore:
+		fmt.Printf("Successfully restored from %s", folder)
+	}
 }
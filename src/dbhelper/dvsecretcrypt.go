@@ -0,0 +1,77 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"github.com/Dobryvechir/dvserver/src/dvcrypt"
+	"strings"
+)
+
+// the encrypted secret files are written by dvsecret and read by dvsecret and dvenvironment
+const (
+	encryptedSecretSuffix = ".enc"
+	secretDataKeySize     = 32
+)
+
+func newSecretCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptSecretData encrypts the data by a random AES-GCM key and only the key by the RSA public key, because
+// RSA alone cannot encrypt more than its key size; the result is the line of the key and the line of the data
+func encryptSecretData(encryptKey string, data []byte) ([]byte, error) {
+	key := make([]byte, secretDataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	encryptedKey, err := dvcrypt.EncryptString(encryptKey, string(key), true)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newSecretCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := gcm.Seal(nonce, nonce, data, nil)
+	return []byte(encryptedKey + "\n" + string(dvcrypt.EncodeByteLine(sealed)) + "\n"), nil
+}
+
+// decryptSecretData is the reverse of encryptSecretData, a single line is the short file encrypted by RSA alone
+func decryptSecretData(decryptKey string, s string) ([]byte, error) {
+	lines := strings.Fields(s)
+	if len(lines) == 1 {
+		value, err := dvcrypt.DecryptString(decryptKey, lines[0], true)
+		return []byte(value), err
+	}
+	if len(lines) != 2 {
+		return nil, errors.New("the encrypted key and data are expected")
+	}
+	key, err := dvcrypt.DecryptString(decryptKey, lines[0], true)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newSecretCipher([]byte(key))
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := dvcrypt.DecodeByteLine([]byte(lines[1]))
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("the encrypted data is too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+}
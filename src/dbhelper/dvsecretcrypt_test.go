@@ -0,0 +1,54 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"path/filepath"
+	"testing"
+
+	"github.com/Dobryvechir/dvserver/src/dvcrypt"
+)
+
+// useTestSecretKeys saves the dvcrypt key pair as "public" and "private" in a temporary key folder
+func useTestSecretKeys(t *testing.T) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	privateDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	folder := t.TempDir()
+	if err = dvcrypt.SaveEncodedData(filepath.Join(folder, "public"), x509.MarshalPKCS1PublicKey(&key.PublicKey)); err != nil {
+		t.Fatal(err)
+	}
+	if err = dvcrypt.SaveEncodedData(filepath.Join(folder, "private"), privateDer); err != nil {
+		t.Fatal(err)
+	}
+	dvcrypt.SetKeyFolder(folder)
+	return key
+}
+
+func TestDecryptSecretEncryptedByRsaAlone(t *testing.T) {
+	useTestSecretKeys(t)
+	data, err := dvcrypt.EncryptString("public", "short value", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value, err := decryptSecretData("private", data)
+	if err != nil || string(value) != "short value" {
+		t.Fatalf("the file encrypted by RSA alone is read as %q: %v", value, err)
+	}
+	encrypted, err := encryptSecretData("public", []byte("value"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted[len(encrypted)-3] ^= 1
+	if _, err = decryptSecretData("private", string(encrypted)); err == nil {
+		t.Fatal("the modified data is decrypted")
+	}
+}
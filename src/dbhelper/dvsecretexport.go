@@ -0,0 +1,213 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Dobryvechir/dvserver/src/dvjson"
+	"github.com/Dobryvechir/dvserver/src/dvoc"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	secretFormatFiles      = "files"
+	secretFormatEnv        = "env"
+	secretFormatProperties = "properties"
+	secretFormatJson       = "json"
+	secretEnvFile          = "secret.env"
+	secretPropertiesFile   = "secret.properties"
+	secretJsonFile         = "secret.json"
+	secretTypeFile         = "secret.type"
+	secretDefaultType      = "Opaque"
+	secretFilePermission   = 0600
+	secretFolderPermission = 0700
+)
+
+var secretFormats = []string{secretFormatFiles, secretFormatEnv, secretFormatProperties, secretFormatJson}
+
+func isSecretFormat(format string) bool {
+	for _, f := range secretFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+func getSortedSecretKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// getSecretFieldValue takes the string without the quotes which GetStringValue adds
+func getSecretFieldValue(field *dvjson.DvFieldInfo) string {
+	if field.Kind == dvjson.FIELD_STRING {
+		return string(field.Value)
+	}
+	return field.GetStringValue()
+}
+
+// readLiveSecret reads all keys of the secret with the values of data already decoded from base64 and the type of the secret
+func readLiveSecret(secretName string) (map[string]string, string, error) {
+	info, ok := dvoc.RunOCCommand("get secret " + secretName + " -o json")
+	if !ok {
+		return nil, "", errors.New("cannot read secret " + secretName)
+	}
+	return parseLiveSecret(secretName, []byte(info))
+}
+
+func parseLiveSecret(secretName string, info []byte) (map[string]string, string, error) {
+	secret, err := dvjson.ReadJsonAsDvFieldInfo(info)
+	if err != nil || secret == nil {
+		return nil, "", fmt.Errorf("incorrect secret %s: %v", secretName, err)
+	}
+	values := make(map[string]string)
+	if data := secret.ReadSimpleChild("data"); data != nil {
+		for _, field := range data.Fields {
+			if field == nil {
+				continue
+			}
+			value, err := base64.StdEncoding.DecodeString(getSecretFieldValue(field))
+			if err != nil {
+				return nil, "", fmt.Errorf("incorrect value of %s in secret %s: %v", string(field.Name), secretName, err)
+			}
+			values[string(field.Name)] = string(value)
+		}
+	}
+	if data := secret.ReadSimpleChild("stringData"); data != nil {
+		for _, field := range data.Fields {
+			if field != nil {
+				values[string(field.Name)] = getSecretFieldValue(field)
+			}
+		}
+	}
+	return values, secret.ReadSimpleChildValue("type"), nil
+}
+
+func formatSecretEnv(values map[string]string) []byte {
+	var buf bytes.Buffer
+	for _, k := range getSortedSecretKeys(values) {
+		v := values[k]
+		if v != "" && strings.IndexAny(v, " \t\r\n\"'#\\$=") >= 0 {
+			v = "\"" + strings.NewReplacer("\\", "\\\\", "\"", "\\\"", "\r", "\\r", "\n", "\\n", "$", "\\$").Replace(v) + "\""
+		}
+		buf.WriteString(k + "=" + v + "\n")
+	}
+	return buf.Bytes()
+}
+
+func escapeSecretProperty(s string, isKey bool) string {
+	var buf bytes.Buffer
+	for i, c := range s {
+		switch c {
+		case '\\':
+			buf.WriteString("\\\\")
+		case '\n':
+			buf.WriteString("\\n")
+		case '\r':
+			buf.WriteString("\\r")
+		case '\t':
+			buf.WriteString("\\t")
+		case '=', ':', '#', '!':
+			buf.WriteString("\\" + string(c))
+		case ' ':
+			if isKey || i == 0 {
+				buf.WriteString("\\ ")
+			} else {
+				buf.WriteRune(c)
+			}
+		default:
+			buf.WriteRune(c)
+		}
+	}
+	return buf.String()
+}
+
+func formatSecretProperties(values map[string]string) []byte {
+	var buf bytes.Buffer
+	for _, k := range getSortedSecretKeys(values) {
+		buf.WriteString(escapeSecretProperty(k, true) + "=" + escapeSecretProperty(values[k], false) + "\n")
+	}
+	return buf.Bytes()
+}
+
+func formatSecretJson(values map[string]string) ([]byte, error) {
+	data, err := json.MarshalIndent(values, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// writeSecretFile writes the file readable by the owner only, encrypted by the public key if it is specified;
+// the plain text version of an encrypted file is removed
+func writeSecretFile(fileName string, data []byte, encryptKey string) error {
+	if encryptKey != "" {
+		res, err := encryptSecretData(encryptKey, data)
+		if err != nil {
+			return fmt.Errorf("cannot encrypt %s by %s: %v", fileName, encryptKey, err)
+		}
+		if err = os.Remove(fileName); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		fileName += encryptedSecretSuffix
+		data = res
+	}
+	if err := ioutil.WriteFile(fileName, data, secretFilePermission); err != nil {
+		return err
+	}
+	// the permissions of an existing file are not changed by WriteFile
+	return os.Chmod(fileName, secretFilePermission)
+}
+
+// exportSecret saves the values in the formats and the type of the secret in secret.type, the type is not encrypted
+func exportSecret(folder string, values map[string]string, secretType string, formats []string, encryptKey string) error {
+	if err := os.MkdirAll(folder, secretFolderPermission); err != nil {
+		return err
+	}
+	if secretType != "" {
+		if err := writeSecretFile(filepath.Join(folder, secretTypeFile), []byte(secretType+"\n"), ""); err != nil {
+			return err
+		}
+	}
+	for _, format := range formats {
+		var err error
+		switch format {
+		case secretFormatFiles:
+			for _, k := range getSortedSecretKeys(values) {
+				if k == "" || k == "." || k == ".." || strings.ContainsAny(k, "/\\") {
+					fmt.Printf("Key %s cannot be saved as a file\n", k)
+					continue
+				}
+				if err = writeSecretFile(filepath.Join(folder, k), []byte(values[k]), encryptKey); err != nil {
+					break
+				}
+			}
+		case secretFormatEnv:
+			err = writeSecretFile(filepath.Join(folder, secretEnvFile), formatSecretEnv(values), encryptKey)
+		case secretFormatProperties:
+			err = writeSecretFile(filepath.Join(folder, secretPropertiesFile), formatSecretProperties(values), encryptKey)
+		case secretFormatJson:
+			var data []byte
+			if data, err = formatSecretJson(values); err == nil {
+				err = writeSecretFile(filepath.Join(folder, secretJsonFile), data, encryptKey)
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
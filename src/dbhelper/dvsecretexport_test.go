@@ -0,0 +1,64 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// createTestSecretValues looks like a client credentials secret with the TLS files, several kilobytes in total
+func createTestSecretValues(t *testing.T, key *rsa.PrivateKey) map[string]string {
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return map[string]string{
+		"client_id":     "payment-service",
+		"client_secret": "f2c1e9a4-77b0-4d3e-9c55-0b8f3a1d6e42",
+		"password":      "p@ss w=rd#1 \"quoted\" $HOME",
+		"tls.key":       string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDer})),
+		"ca.crt":        strings.Repeat("MIIDdzCCAl+gAwIBAgIEAgAAuTANBgkqhkiG9w0BAQUFADBaMQswCQYDVQQGEwJJ\n", 20),
+		"application.yaml": "spring:\n  datasource:\n    url: jdbc:postgresql://db:5432/payments\n" +
+			"    username: payments\n    password: s3cr3t\n",
+	}
+}
+
+func TestExportEncryptedSecret(t *testing.T) {
+	key := useTestSecretKeys(t)
+	values := createTestSecretValues(t, key)
+	for _, format := range secretFormats {
+		folder := filepath.Join(t.TempDir(), "payment-service")
+		if err := exportSecret(folder, values, "", []string{format}, "public"); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		files, err := filepath.Glob(filepath.Join(folder, "*"))
+		if err != nil || len(files) == 0 {
+			t.Fatalf("%s: no files are saved: %v", format, err)
+		}
+		for _, fileName := range files {
+			if !strings.HasSuffix(fileName, encryptedSecretSuffix) {
+				t.Errorf("%s: %s is not encrypted", format, fileName)
+			}
+			if info, err := os.Stat(fileName); err == nil && info.Mode().Perm() != secretFilePermission {
+				t.Errorf("%s: %s has mode %v", format, fileName, info.Mode().Perm())
+			}
+		}
+		if _, err = loadSavedSecret(folder, ""); err == nil {
+			t.Errorf("%s: the encrypted secret is read without the key", format)
+		}
+		saved, err := loadSavedSecret(folder, "private")
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if !reflect.DeepEqual(saved, values) {
+			t.Errorf("%s: the secret is read back as %v", format, saved)
+		}
+	}
+}
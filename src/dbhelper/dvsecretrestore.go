@@ -0,0 +1,382 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Dobryvechir/dvserver/src/dvoc"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	secretModeSave         = "save"
+	secretModeRestore      = "restore"
+	secretModeDiff         = "diff"
+	secretDefaultParallel  = 4
+	secretManifestSuffix   = "-secret.json"
+	secretDecryptProperty  = "SECRET_DECRYPT_KEY"
+	secretManifestTempName = "dvsecret*.json"
+)
+
+type secretManifestMetadata struct {
+	Name string `json:"name"`
+}
+
+type secretManifest struct {
+	ApiVersion string                 `json:"apiVersion"`
+	Kind       string                 `json:"kind"`
+	Metadata   secretManifestMetadata `json:"metadata"`
+	Type       string                 `json:"type"`
+	Data       map[string]string      `json:"data"`
+}
+
+// readSavedSecretFile reads the plain file or, if only the encrypted one exists, decrypts it by the private key
+func readSavedSecretFile(fileName string, decryptKey string) ([]byte, bool, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err == nil {
+		return data, true, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, false, err
+	}
+	data, err = ioutil.ReadFile(fileName + encryptedSecretSuffix)
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if decryptKey == "" {
+		return nil, false, fmt.Errorf("%s is encrypted but neither --decrypt nor %s is specified", fileName, secretDecryptProperty)
+	}
+	if data, err = decryptSecretData(decryptKey, string(data)); err != nil {
+		return nil, false, fmt.Errorf("cannot decrypt %s: %v", fileName, err)
+	}
+	return data, true, nil
+}
+
+func unquoteSecretEnvValue(v string) string {
+	if len(v) < 2 || v[0] != '"' || v[len(v)-1] != '"' {
+		return v
+	}
+	var buf bytes.Buffer
+	v = v[1 : len(v)-1]
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if c == '\\' && i+1 < len(v) {
+			i++
+			switch v[i] {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			default:
+				c = v[i]
+			}
+		}
+		buf.WriteByte(c)
+	}
+	return buf.String()
+}
+
+func parseSecretEnv(data []byte) map[string]string {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		p := strings.Index(line, "=")
+		if p <= 0 || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		values[line[:p]] = unquoteSecretEnvValue(line[p+1:])
+	}
+	return values
+}
+
+// unescapeSecretProperty is the reverse of escapeSecretProperty, it returns the rest after the unescaped separator
+func unescapeSecretProperty(s string, isKey bool) (string, string) {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == '\\' && i+1 < len(s) {
+			i++
+			switch s[i] {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			default:
+				c = s[i]
+			}
+		} else if isKey && c == '=' {
+			return buf.String(), s[i+1:]
+		}
+		buf.WriteByte(c)
+	}
+	return buf.String(), ""
+}
+
+func parseSecretProperties(data []byte) map[string]string {
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		key, rest := unescapeSecretProperty(line, true)
+		values[key], _ = unescapeSecretProperty(rest, false)
+	}
+	return values
+}
+
+// loadSavedSecret reads the saved secret from json, properties, env or, failing that, from the files per key
+func loadSavedSecret(folder string, decryptKey string) (map[string]string, error) {
+	data, ok, err := readSavedSecretFile(filepath.Join(folder, secretJsonFile), decryptKey)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		values := make(map[string]string)
+		if err = json.Unmarshal(data, &values); err != nil {
+			return nil, fmt.Errorf("incorrect %s: %v", secretJsonFile, err)
+		}
+		return values, nil
+	}
+	if data, ok, err = readSavedSecretFile(filepath.Join(folder, secretPropertiesFile), decryptKey); ok || err != nil {
+		return parseSecretProperties(data), err
+	}
+	if data, ok, err = readSavedSecretFile(filepath.Join(folder, secretEnvFile), decryptKey); ok || err != nil {
+		return parseSecretEnv(data), err
+	}
+	files, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string)
+	for _, file := range files {
+		key := strings.TrimSuffix(file.Name(), encryptedSecretSuffix)
+		if file.IsDir() || key == secretTypeFile || strings.HasSuffix(key, secretManifestSuffix) {
+			continue
+		}
+		if _, present := values[key]; present {
+			continue
+		}
+		if data, _, err = readSavedSecretFile(filepath.Join(folder, key), decryptKey); err != nil {
+			return nil, err
+		}
+		values[key] = string(data)
+	}
+	if len(values) == 0 {
+		return nil, errors.New("no saved secret in " + folder)
+	}
+	return values, nil
+}
+
+// loadSavedSecretType reads secret.type, the secrets saved before it was written are Opaque
+func loadSavedSecretType(folder string) (string, error) {
+	data, err := ioutil.ReadFile(filepath.Join(folder, secretTypeFile))
+	if os.IsNotExist(err) {
+		return secretDefaultType, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if secretType := strings.TrimSpace(string(data)); secretType != "" {
+		return secretType, nil
+	}
+	return secretDefaultType, nil
+}
+
+func createSecretManifest(secretName string, secretType string, values map[string]string) ([]byte, error) {
+	manifest := &secretManifest{
+		ApiVersion: "v1",
+		Kind:       "Secret",
+		Metadata:   secretManifestMetadata{Name: secretName},
+		Type:       secretType,
+		Data:       make(map[string]string),
+	}
+	for k, v := range values {
+		manifest.Data[k] = base64.StdEncoding.EncodeToString([]byte(v))
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(data, '\n'), nil
+}
+
+// applySecretManifest applies the manifest through a temporary file, which is removed at once
+func applySecretManifest(data []byte) error {
+	file, err := ioutil.TempFile("", secretManifestTempName)
+	if err != nil {
+		return err
+	}
+	fileName := file.Name()
+	defer os.Remove(fileName)
+	_, err = file.Write(data)
+	if err1 := file.Close(); err == nil {
+		err = err1
+	}
+	if err != nil {
+		return err
+	}
+	info, ok := dvoc.RunOCCommand("apply -f " + fileName)
+	if !ok {
+		return errors.New("oc apply failed: " + strings.TrimSpace(info))
+	}
+	return nil
+}
+
+func restoreSingleSecret(folder string, microservice string, options *secretOptions) (string, error) {
+	values, err := loadSavedSecret(folder+microservice, options.decryptKey)
+	if err != nil {
+		return "", err
+	}
+	secretType, err := loadSavedSecretType(folder + microservice)
+	if err != nil {
+		return "", err
+	}
+	secretName := getSecretName(options, microservice)
+	data, err := createSecretManifest(secretName, secretType, values)
+	if err != nil {
+		return "", err
+	}
+	if options.output != "" {
+		fileName := filepath.Join(options.output, secretName+secretManifestSuffix)
+		if err = writeSecretFile(fileName, data, ""); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s: %d keys written to %s", secretName, len(values), fileName), nil
+	}
+	if err = applySecretManifest(data); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s: %d keys applied", secretName, len(values)), nil
+}
+
+func diffSingleSecret(folder string, microservice string, options *secretOptions) (string, error) {
+	saved, err := loadSavedSecret(folder+microservice, options.decryptKey)
+	if err != nil {
+		return "", err
+	}
+	savedType, err := loadSavedSecretType(folder + microservice)
+	if err != nil {
+		return "", err
+	}
+	secretName := getSecretName(options, microservice)
+	live, liveType, err := readLiveSecret(secretName)
+	if err != nil {
+		return "", err
+	}
+	if liveType == "" {
+		liveType = secretDefaultType
+	}
+	return diffSecretValues(secretName, savedType, saved, liveType, live), nil
+}
+
+// diffSecretValues reports only the key names and whether the values changed, never the values themselves
+func diffSecretValues(secretName string, savedType string, saved map[string]string, liveType string, live map[string]string) string {
+	keys := getSortedSecretKeys(saved)
+	for k := range live {
+		if _, ok := saved[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var buf bytes.Buffer
+	differ := 0
+	for _, k := range keys {
+		savedValue, inSaved := saved[k]
+		liveValue, inLive := live[k]
+		status := "same"
+		switch {
+		case !inLive:
+			status = "only saved"
+		case !inSaved:
+			status = "only live"
+		case savedValue != liveValue:
+			status = "changed"
+		}
+		if status != "same" {
+			differ++
+		}
+		buf.WriteString("  " + k + ": " + status + "\n")
+	}
+	if savedType != liveType {
+		buf.WriteString("  type " + savedType + " is saved, " + liveType + " is live\n")
+	}
+	return fmt.Sprintf("%s: %d of %d keys differ\n%s", secretName, differ, len(keys), strings.TrimRight(buf.String(), "\n"))
+}
+
+// listSavedMicroServices lists the microservice folders of the saved secrets
+func listSavedMicroServices(folder string) ([]string, error) {
+	files, err := ioutil.ReadDir(folder)
+	if err != nil {
+		return nil, err
+	}
+	list := make([]string, 0, len(files))
+	for _, file := range files {
+		if file.IsDir() {
+			list = append(list, file.Name())
+		}
+	}
+	return list, nil
+}
+
+// runSecretTasks runs the task for the microservices in parallel, the reports are printed in the order of the list
+func runSecretTasks(list []string, parallel int, task func(microservice string) (string, error)) bool {
+	reports := make([]string, len(list))
+	errs := make([]error, len(list))
+	indices := make(chan int)
+	if parallel <= 0 {
+		parallel = 1
+	}
+	var wg sync.WaitGroup
+	for w := 0; w < parallel; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				reports[i], errs[i] = task(list[i])
+			}
+		}()
+	}
+	for i := range list {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+	ok := true
+	for i, microservice := range list {
+		if errs[i] != nil {
+			fmt.Printf("Failed for %s: %v\n", microservice, errs[i])
+			ok = false
+		} else if reports[i] != "" {
+			fmt.Println(reports[i])
+		}
+	}
+	return ok
+}
+
+func readSecretParallel(value string) int {
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		fmt.Printf("Incorrect parallelism %s\n", value)
+		os.Exit(1)
+	}
+	return n
+}
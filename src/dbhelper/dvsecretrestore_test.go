@@ -0,0 +1,111 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testSecretTlsType = "kubernetes.io/tls"
+
+// restoreTestSecret restores the saved secret of payment-service into a manifest file and reads it
+func restoreTestSecret(t *testing.T, root string, options *secretOptions) *secretManifest {
+	options.output = t.TempDir()
+	if _, err := restoreSingleSecret(root+"/", "payment-service", options); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(options.output, "payment-service-client-credentials"+secretManifestSuffix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifest := &secretManifest{}
+	if err = json.Unmarshal(data, manifest); err != nil {
+		t.Fatalf("the manifest %s is not json: %v", data, err)
+	}
+	return manifest
+}
+
+func TestRestoreSecretKeepsType(t *testing.T) {
+	key := useTestSecretKeys(t)
+	values := createTestSecretValues(t, key)
+	for _, format := range secretFormats {
+		root := t.TempDir()
+		if err := exportSecret(filepath.Join(root, "payment-service"), values, testSecretTlsType, []string{format}, "public"); err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		manifest := restoreTestSecret(t, root, &secretOptions{secretName: defaultSecretName, decryptKey: "private"})
+		if manifest.Kind != "Secret" || manifest.Type != testSecretTlsType || manifest.Metadata.Name != "payment-service-client-credentials" {
+			t.Errorf("%s: the manifest is %s %s of type %s", format, manifest.Kind, manifest.Metadata.Name, manifest.Type)
+		}
+		restored := make(map[string]string)
+		for k, v := range manifest.Data {
+			data, err := base64.StdEncoding.DecodeString(v)
+			if err != nil {
+				t.Fatalf("%s: %s is not base64: %v", format, k, err)
+			}
+			restored[k] = string(data)
+		}
+		if !reflect.DeepEqual(restored, values) {
+			t.Errorf("%s: the secret is restored as %v", format, restored)
+		}
+	}
+}
+
+func TestRestoreSecretSavedWithoutType(t *testing.T) {
+	root := t.TempDir()
+	folder := filepath.Join(root, "payment-service")
+	if err := exportSecret(folder, map[string]string{"client_id": "payment-service"}, "", []string{secretFormatFiles}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(folder, secretTypeFile)); !os.IsNotExist(err) {
+		t.Errorf("%s is written without the type: %v", secretTypeFile, err)
+	}
+	manifest := restoreTestSecret(t, root, &secretOptions{secretName: defaultSecretName})
+	if manifest.Type != secretDefaultType || len(manifest.Data) != 1 {
+		t.Errorf("the manifest is %+v", manifest)
+	}
+}
+
+func TestParseLiveSecret(t *testing.T) {
+	info := `{"apiVersion":"v1","kind":"Secret","type":"kubernetes.io/tls","metadata":{"name":"app"},` +
+		`"data":{"tls.crt":"` + base64.StdEncoding.EncodeToString([]byte("certificate")) + `"},"stringData":{"mode":"strict"}}`
+	values, secretType, err := parseLiveSecret("app", []byte(info))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secretType != testSecretTlsType || !reflect.DeepEqual(values, map[string]string{"tls.crt": "certificate", "mode": "strict"}) {
+		t.Errorf("the secret of type %s is read as %v", secretType, values)
+	}
+	if _, _, err = parseLiveSecret("app", []byte(`{"data":{"key":"%%%"}}`)); err == nil {
+		t.Error("the value which is not base64 is accepted")
+	}
+}
+
+func TestDiffSecretValuesHidesValues(t *testing.T) {
+	saved := map[string]string{"client_id": "payment-service", "client_secret": "old-s3cr3t", "saved_only": "saved-value"}
+	live := map[string]string{"client_id": "payment-service", "client_secret": "new-s3cr3t", "live_only": "live-value"}
+	report := diffSecretValues("app", secretDefaultType, saved, testSecretTlsType, live)
+	expected := "app: 3 of 4 keys differ\n  client_id: same\n  client_secret: changed\n  live_only: only live\n  saved_only: only saved\n" +
+		"  type Opaque is saved, kubernetes.io/tls is live"
+	if report != expected {
+		t.Errorf("the report is\n%s\ninstead of\n%s", report, expected)
+	}
+	for _, values := range []map[string]string{saved, live} {
+		for k, v := range values {
+			if k != "client_id" && strings.Contains(report, v) {
+				t.Errorf("the report contains the value of %s", k)
+			}
+		}
+	}
+	if report = diffSecretValues("app", secretDefaultType, saved, secretDefaultType, saved); report != "app: 0 of 3 keys differ\n"+
+		"  client_id: same\n  client_secret: same\n  saved_only: same" {
+		t.Errorf("the same secret is reported as\n%s", report)
+	}
+}
@@ -3,69 +3,283 @@
 package main
 
 import (
-	"bufio"
-	"encoding/base64"
+	"bytes"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/Dobryvechir/dvserver/src/dvlog"
 	"github.com/Dobryvechir/dvserver/src/dvparser"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
+	"time"
 )
 
 var copyright = "Copyright by Danyil Dobryvechir 2019"
 
+var help = copyright + "\ngitinfo [options] <actions: R - read info C - update in the cloud A - open artifactory in the browser> [folder]\n" +
+	"the repository is searched from the folder (default - the current one) up to the root, then by the properties\n" +
+	"GIT_FOLDER and GIT_FOLDERS (separated by ; or ,); the git binary is not needed\n" +
+	"options:\n" +
+	"  --format=<format>     properties (default), json, sh, cmd or ps1\n" +
+	"  --output=<file>       save the information in the file instead of printing it\n" +
+	"C stamps the DeploymentConfig, Deployment or StatefulSet of the microservice by the labels and annotations\n" +
+	"git.branch, git.commit, git.commit-time and git.author:\n" +
+	"  --microservice=<name> microservice to stamp (default - MICROSERVICE_NAME property or the repository folder name)\n" +
+	"  --kind=<kind>         dc, deployment or statefulset (default - the first kind having the microservice)\n" +
+	"  --script=<file>       write the oc patch command in the file (.cmd or sh) instead of patching the cluster\n" +
+	"  --template=<file>     set GIT_BRANCH, GIT_LATEST, GIT_LATEST_TIME and GIT_LATEST_AUTHOR as env of the containers\n" +
+	"                        in the rendered template (json or yaml) instead of patching the cluster, with --script the\n" +
+	"                        command is written too; the cluster is patched only if neither --template nor --script is given\n" +
+	helpGitArtifactory
+
+const (
+	gitFolderProperty  = "GIT_FOLDER"
+	gitFoldersProperty = "GIT_FOLDERS"
+)
+
+const (
+	gitFormatProperties = "properties"
+	gitFormatJson       = "json"
+	gitFormatSh         = "sh"
+	gitFormatCmd        = "cmd"
+	gitFormatPowerShell = "ps1"
+)
+
 type GitInfo struct {
-	ServiceName string
-	Branch      string
-	Artifactory string
-	Latest      string
-	LatestTime  string
-	GitFolder   string
+	ServiceName     string
+	Branch          string
+	Artifactory     string
+	ArtifactVersion string
+	Latest          string
+	LatestTime      string
+	LatestAuthor    string
+	Detached        bool
+	GitFolder       string
 }
 
-func tryFolder(string folder) (gitInfo *GitInfo, ok bool) {
-	data, err := ioutil.ReadFile(folder + "/.git/HEAD")
+type gitInfoOptions struct {
+	actions      string
+	folder       string
+	format       string
+	output       string
+	microservice string
+	kind         string
+	script       string
+	template     string
+	browse       bool
+}
+
+type gitProperty struct {
+	name  string
+	value string
+}
+
+func tryFolder(folder string) (gitInfo *GitInfo, ok bool, err error) {
+	repo, ok := findGitRepository(folder)
+	if !ok {
+		return nil, false, nil
+	}
+	branch, hash, detached, err := repo.readHead()
 	if err != nil {
-		return nil, false
+		return nil, true, err
 	}
-	s := string(data)
-	search := "heads/"
-	r := strings.Index(s, search)
-	if r < 0 {
-		return nil, false
+	gitInfo = &GitInfo{
+		ServiceName: filepath.Base(repo.workTree),
+		Branch:      branch,
+		Latest:      hash,
+		Detached:    detached,
+		GitFolder:   repo.workTree,
 	}
-	branch := strings.TrimSpace(s[r+len(search):])
-	gitInfo := &GitInfo{Branch: branch, GitFolder: folder}
-	ok := true
-	return
+	commit, err := repo.readCommit(hash)
+	if err != nil {
+		return gitInfo, true, err
+	}
+	gitInfo.LatestTime = commit.Time.Format(time.RFC3339)
+	gitInfo.LatestAuthor = commit.AuthorName
+	if commit.AuthorEmail != "" {
+		gitInfo.LatestAuthor += " <" + commit.AuthorEmail + ">"
+	}
+	return gitInfo, true, nil
 }
 
-func tryFolders() *GitInfo {
-
+func tryFolders(folder string) (*GitInfo, error) {
+	folders := []string{folder}
+	if s := strings.TrimSpace(dvparser.GlobalProperties[gitFolderProperty]); s != "" {
+		folders = append(folders, s)
+	}
+	for _, s := range strings.FieldsFunc(dvparser.GlobalProperties[gitFoldersProperty], func(c rune) bool { return c == ';' || c == ',' }) {
+		if s = strings.TrimSpace(s); s != "" {
+			folders = append(folders, s)
+		}
+	}
+	for _, f := range folders {
+		gitInfo, ok, err := tryFolder(f)
+		if ok {
+			return gitInfo, err
+		}
+	}
+	return nil, nil
 }
 
-func readGitInfo() (gitInfo *GitInfo, err error) {
-	gitInfo := tryFolders()
-	if gitInfo == nil {
+func readGitInfo(folder string) (gitInfo *GitInfo, err error) {
+	gitInfo, err = tryFolders(folder)
+	if gitInfo == nil && err == nil {
 		err = errors.New("No git folder found neither in the current folder nor by the global variables")
-		return
 	}
 	return
 }
 
+func (gitInfo *GitInfo) properties() []gitProperty {
+	props := []gitProperty{
+		{"GIT_BRANCH", gitInfo.Branch},
+		{"GIT_LATEST", gitInfo.Latest},
+		{"GIT_LATEST_TIME", gitInfo.LatestTime},
+		{"GIT_LATEST_AUTHOR", gitInfo.LatestAuthor},
+	}
+	if gitInfo.Artifactory != "" {
+		props = append(props, gitProperty{"GIT_ARTIFACTORY", gitInfo.Artifactory}, gitProperty{"GIT_ARTIFACT_VERSION", gitInfo.ArtifactVersion})
+	}
+	return props
+}
+
+func formatGitInfo(gitInfo *GitInfo, format string) ([]byte, error) {
+	var buf bytes.Buffer
+	props := gitInfo.properties()
+	switch format {
+	case gitFormatJson:
+		values := make(map[string]string)
+		for _, p := range props {
+			values[p.name] = p.value
+		}
+		encoder := json.NewEncoder(&buf)
+		encoder.SetEscapeHTML(false)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(values); err != nil {
+			return nil, err
+		}
+	case gitFormatSh:
+		for _, p := range props {
+			buf.WriteString("export " + p.name + "='" + strings.Replace(p.value, "'", "'\\''", -1) + "'\n")
+		}
+	case gitFormatCmd:
+		// the quotes keep < > & | as they are, % is doubled in the batch files
+		for _, p := range props {
+			buf.WriteString("SET \"" + p.name + "=" + strings.Replace(p.value, "%", "%%", -1) + "\"\r\n")
+		}
+	case gitFormatPowerShell:
+		for _, p := range props {
+			buf.WriteString("$env:" + p.name + " = '" + strings.Replace(p.value, "'", "''", -1) + "'\r\n")
+		}
+	default:
+		for _, p := range props {
+			buf.WriteString(p.name + "=" + p.value + "\n")
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func readGitInfoOptions(args []string) (*gitInfoOptions, error) {
+	options := &gitInfoOptions{folder: ".", format: gitFormatProperties}
+	rest := make([]string, 0, 2)
+	for _, arg := range args {
+		switch {
+		case strings.HasPrefix(arg, "--format="):
+			options.format = strings.ToLower(arg[len("--format="):])
+			switch options.format {
+			case gitFormatProperties, gitFormatJson, gitFormatSh, gitFormatCmd, gitFormatPowerShell:
+			default:
+				return nil, errors.New("unsupported format " + options.format)
+			}
+		case strings.HasPrefix(arg, "--output="):
+			options.output = arg[len("--output="):]
+		case strings.HasPrefix(arg, "--microservice="):
+			options.microservice = arg[len("--microservice="):]
+		case strings.HasPrefix(arg, "--kind="):
+			switch strings.ToLower(arg[len("--kind="):]) {
+			case "dc", "deploymentconfig":
+				options.kind = "dc"
+			case "deployment":
+				options.kind = "deployment"
+			case "statefulset":
+				options.kind = "statefulset"
+			default:
+				return nil, errors.New("unsupported kind " + arg[len("--kind="):])
+			}
+		case strings.HasPrefix(arg, "--script="):
+			options.script = arg[len("--script="):]
+		case strings.HasPrefix(arg, "--template="):
+			options.template = arg[len("--template="):]
+		case arg == "--browse":
+			options.browse = true
+		case strings.HasPrefix(arg, "--"):
+			return nil, errors.New("unknown option " + arg)
+		default:
+			rest = append(rest, arg)
+		}
+	}
+	if len(rest) == 0 {
+		return nil, errors.New("no actions specified")
+	}
+	options.actions = strings.ToUpper(rest[0])
+	if strings.Contains(options.actions, "A") {
+		// the artifact is found first to be presented by R
+		options.actions = "A" + strings.Replace(options.actions, "A", "", -1)
+	}
+	if len(rest) > 1 {
+		options.folder = rest[1]
+	}
+	return options, nil
+}
+
+func presentGitInfo(gitInfo *GitInfo, options *gitInfoOptions) error {
+	data, err := formatGitInfo(gitInfo, options.format)
+	if err != nil {
+		return err
+	}
+	if options.output == "" {
+		fmt.Print(string(data))
+		return nil
+	}
+	return ioutil.WriteFile(options.output, data, 0644)
+}
+
 func main() {
 	args := dvparser.InitAndReadCommandLine()
-	l := len(args)
-	if l < 1 {
-		fmt.Println(copyright)
-		fmt.Println("gitinfo <options: R - read info C - update in the cloud A - open artifactory in the browser>")
+	options, err := readGitInfoOptions(args)
+	if err != nil {
+		fmt.Println(help)
+		if len(args) > 0 {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
 		return
 	}
-	//options := args[0]
-	gitInfo, err := readGitInfo()
+	gitInfo, err := readGitInfo(options.folder)
 	if err != nil {
-		panic("Git error: " + err.Error())
+		fmt.Printf("Git error: %v\n", err)
+		os.Exit(1)
+	}
+	if options.microservice == "" {
+		options.microservice = dvparser.GlobalProperties["MICROSERVICE_NAME"]
+	}
+	if options.microservice == "" {
+		options.microservice = gitInfo.ServiceName
+	}
+	for _, action := range options.actions {
+		switch action {
+		case 'R':
+			err = presentGitInfo(gitInfo, options)
+		case 'C':
+			err = stampGitInfo(gitInfo, options)
+		case 'A':
+			err = presentArtifact(gitInfo, options)
+		default:
+			err = fmt.Errorf("unknown action %c", action)
+		}
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
 	}
-	fmt.Printf("GIT_BRANCH=%s\nGIT_ARTIFACTORY=%s\nGIT_LATEST=%s\n", gitInfo.Branch, gitInfo.Artifactory, gitInfo.Latest)
 }
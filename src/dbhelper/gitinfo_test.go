@@ -0,0 +1,62 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFormatGitInfo(t *testing.T) {
+	gitInfo := &GitInfo{Branch: "feature/a&b", Latest: "0c1d2e3f", LatestTime: "2024-01-02T03:04:05Z", LatestAuthor: "agent <agent@local> 100% | it's"}
+	for format, expected := range map[string]string{
+		gitFormatCmd:        "SET \"GIT_LATEST_AUTHOR=agent <agent@local> 100%% | it's\"\r\n",
+		gitFormatSh:         "export GIT_LATEST_AUTHOR='agent <agent@local> 100% | it'\\''s'\n",
+		gitFormatPowerShell: "$env:GIT_LATEST_AUTHOR = 'agent <agent@local> 100% | it''s'\r\n",
+		gitFormatProperties: "GIT_LATEST_AUTHOR=agent <agent@local> 100% | it's\n",
+	} {
+		data, err := formatGitInfo(gitInfo, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), expected) {
+			t.Errorf("%s: %q has no %q", format, data, expected)
+		}
+	}
+	if data, _ := formatGitInfo(gitInfo, gitFormatCmd); !strings.HasPrefix(string(data), "SET \"GIT_BRANCH=feature/a&b\"\r\n") {
+		t.Errorf("the branch is written as %q", data)
+	}
+}
+
+func TestReadGitInfoOptionsErrors(t *testing.T) {
+	for _, args := range [][]string{{}, {"--unknown", "R"}, {"--format=xml", "R"}, {"--kind=pod", "C"}} {
+		if _, err := readGitInfoOptions(args); err == nil {
+			t.Errorf("%v is accepted", args)
+		}
+	}
+	options, err := readGitInfoOptions([]string{"--format=CMD", "ra", "repo"})
+	if err != nil || options.format != gitFormatCmd || options.actions != "AR" || options.folder != "repo" {
+		t.Fatalf("%+v %v", options, err)
+	}
+}
+
+func TestWriteGitStampCmdScript(t *testing.T) {
+	gitInfo := &GitInfo{Branch: "master", Latest: "0c1d2e3f", LatestAuthor: "agent <agent@local> 100% | ^"}
+	options := &gitInfoOptions{microservice: "app", kind: "dc", script: filepath.Join(t.TempDir(), "stamp.cmd")}
+	if err := writeGitStampScript(gitInfo, options); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(options.script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := string(data)
+	if !strings.HasPrefix(script, "@oc patch dc app --type=merge -p \"{") || strings.ContainsAny(script, "<>&|^%") {
+		t.Errorf("the script %q is not safe for cmd", script)
+	}
+	if !strings.Contains(script, `agent \u003cagent@local\u003e 100\u0025 \u007c \u005e`) {
+		t.Errorf("the author is written as %q", script)
+	}
+}
@@ -0,0 +1,343 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/Dobryvechir/dvserver/src/dvparser"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	artifactoryUrlProperty        = "ARTIFACTORY_URL"
+	artifactoryTypeProperty       = "ARTIFACTORY_TYPE"
+	artifactoryRepositoryProperty = "ARTIFACTORY_REPOSITORY"
+	artifactoryGroupProperty      = "ARTIFACTORY_GROUP"
+	artifactoryArtifactProperty   = "ARTIFACTORY_ARTIFACT"
+	artifactoryImageProperty      = "ARTIFACTORY_IMAGE"
+	artifactoryUserProperty       = "ARTIFACTORY_USER"
+	artifactoryPasswordProperty   = "ARTIFACTORY_PASSWORD"
+	artifactoryTokenProperty      = "ARTIFACTORY_TOKEN"
+	artifactoryTypeMaven          = "maven"
+	artifactoryTypeDocker         = "docker"
+	artifactoryTimeout            = 30 * time.Second
+	artifactoryShortCommit        = 7
+	artifactoryMaxPages           = 100
+)
+
+// plainVersionRegexp matches the versions without a branch, such as 1.10.2 or 1.10.2-1a2b3c4
+var plainVersionRegexp = regexp.MustCompile(`^v?[0-9]+([.-][0-9]+)*(-[0-9a-f]{7,40})?$`)
+
+var helpGitArtifactory = "" +
+	"A finds the newest Maven version or Docker tag built from the branch (the tag with the latest commit is preferred)\n" +
+	"and prints its URL as GIT_ARTIFACTORY, the properties are:\n" +
+	"  ARTIFACTORY_URL        base URL of the repository manager or the Docker registry\n" +
+	"  ARTIFACTORY_TYPE       maven or docker (default - docker if ARTIFACTORY_IMAGE is set, otherwise maven)\n" +
+	"  ARTIFACTORY_REPOSITORY Maven repository name, such as libs-release\n" +
+	"  ARTIFACTORY_GROUP      Maven group id; ARTIFACTORY_ARTIFACT - artifact id (default - the repository folder name)\n" +
+	"  ARTIFACTORY_IMAGE      Docker image, such as project/app\n" +
+	"  ARTIFACTORY_USER, ARTIFACTORY_PASSWORD or ARTIFACTORY_TOKEN for the basic or bearer authorization\n" +
+	"  --browse              open the found URL in the browser"
+
+type mavenMetadata struct {
+	Versions []string `xml:"versioning>versions>version"`
+}
+
+type dockerTagList struct {
+	Name string   `json:"name"`
+	Tags []string `json:"tags"`
+}
+
+func splitNaturalParts(s string) []string {
+	parts := make([]string, 0, 8)
+	start := 0
+	for i := 1; i <= len(s); i++ {
+		if i == len(s) || (s[i] >= '0' && s[i] <= '9') != (s[i-1] >= '0' && s[i-1] <= '9') {
+			parts = append(parts, s[start:i])
+			start = i
+		}
+	}
+	return parts
+}
+
+// naturalLess compares the numbers inside the versions by value, so that 1.10 is after 1.9
+func naturalLess(a string, b string) bool {
+	pa, pb := splitNaturalParts(a), splitNaturalParts(b)
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		if pa[i] == pb[i] {
+			continue
+		}
+		if pa[i][0] >= '0' && pa[i][0] <= '9' && pb[i][0] >= '0' && pb[i][0] <= '9' {
+			na, nb := strings.TrimLeft(pa[i], "0"), strings.TrimLeft(pb[i], "0")
+			if len(na) != len(nb) {
+				return len(na) < len(nb)
+			}
+			if na != nb {
+				return na < nb
+			}
+			continue
+		}
+		return pa[i] < pb[i]
+	}
+	return len(pa) < len(pb)
+}
+
+// getBranchTokens returns the forms of the branch that may appear in the versions: feature/ABC-1 gives
+// feature/abc-1, feature-abc-1, feature_abc-1 and abc-1
+func getBranchTokens(branch string) []string {
+	branch = strings.ToLower(branch)
+	tokens := []string{branch, strings.Replace(branch, "/", "-", -1), strings.Replace(branch, "/", "_", -1)}
+	if p := strings.LastIndex(branch, "/"); p >= 0 && p < len(branch)-1 {
+		tokens = append(tokens, branch[p+1:])
+	}
+	return tokens
+}
+
+// isVersionSeparator tells the characters that separate the branch and the commit from the rest of a version
+func isVersionSeparator(c byte) bool {
+	return c == '-' || c == '_' || c == '.'
+}
+
+// containsVersionToken finds the token between the separators, so that abc-1 is not found in abc-12;
+// the commit may be followed by more hex digits of the full hash
+func containsVersionToken(version string, token string, isCommit bool) bool {
+	for start := 0; token != ""; {
+		p := strings.Index(version[start:], token)
+		if p < 0 {
+			return false
+		}
+		p += start
+		end := p + len(token)
+		if (p == 0 || isVersionSeparator(version[p-1])) && (end == len(version) || isVersionSeparator(version[end]) ||
+			isCommit && strings.IndexByte("0123456789abcdef", version[end]) >= 0) {
+			return true
+		}
+		start = p + 1
+	}
+	return false
+}
+
+// chooseArtifactVersion prefers the versions with the latest commit, then the newest version of the branch;
+// for master and main, the newest version without a branch is taken if none mentions the branch
+func chooseArtifactVersion(versions []string, gitInfo *GitInfo) (string, bool) {
+	if len(gitInfo.Latest) >= artifactoryShortCommit {
+		commit := strings.ToLower(gitInfo.Latest[:artifactoryShortCommit])
+		if v, ok := chooseNewestVersion(versions, func(v string) bool { return containsVersionToken(v, commit, true) }); ok {
+			return v, true
+		}
+	}
+	tokens := getBranchTokens(gitInfo.Branch)
+	if v, ok := chooseNewestVersion(versions, func(v string) bool {
+		for _, token := range tokens {
+			if containsVersionToken(v, token, false) {
+				return true
+			}
+		}
+		return false
+	}); ok {
+		return v, true
+	}
+	if gitInfo.Branch == "master" || gitInfo.Branch == "main" {
+		return chooseNewestVersion(versions, plainVersionRegexp.MatchString)
+	}
+	return "", false
+}
+
+// chooseNewestVersion takes the naturally greatest of the versions accepted by match, which gets them in lower case
+func chooseNewestVersion(versions []string, match func(string) bool) (string, bool) {
+	candidates := make([]string, 0, len(versions))
+	for _, v := range versions {
+		if match(strings.ToLower(v)) {
+			candidates = append(candidates, v)
+		}
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+	sort.SliceStable(candidates, func(i, j int) bool { return naturalLess(candidates[i], candidates[j]) })
+	return candidates[len(candidates)-1], true
+}
+
+func readArtifactoryResource(url string, params map[string]string) ([]byte, http.Header, error) {
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if token := params[artifactoryTokenProperty]; token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	} else if user := params[artifactoryUserProperty]; user != "" {
+		request.SetBasicAuth(user, params[artifactoryPasswordProperty])
+	}
+	client := &http.Client{Timeout: artifactoryTimeout}
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("%s returned %d", url, response.StatusCode)
+	}
+	return data, response.Header, nil
+}
+
+// getNextPageUrl finds rel="next" in the Link header, such as </v2/app/tags/list?n=100&last=1.2>; rel="next",
+// and resolves it against the current URL; it returns "" on the last page
+func getNextPageUrl(current string, link string) (string, error) {
+	for _, part := range strings.Split(link, ",") {
+		params := strings.Split(part, ";")
+		ref := strings.TrimSpace(params[0])
+		if len(ref) < 2 || ref[0] != '<' || ref[len(ref)-1] != '>' {
+			continue
+		}
+		for _, param := range params[1:] {
+			if strings.Replace(strings.ToLower(strings.TrimSpace(param)), "\"", "", -1) != "rel=next" {
+				continue
+			}
+			base, err := url.Parse(current)
+			if err != nil {
+				return "", err
+			}
+			next, err := base.Parse(ref[1 : len(ref)-1])
+			if err != nil {
+				return "", err
+			}
+			return next.String(), nil
+		}
+	}
+	return "", nil
+}
+
+func findMavenArtifact(baseUrl string, gitInfo *GitInfo, params map[string]string) (string, string, error) {
+	group := params[artifactoryGroupProperty]
+	if group == "" {
+		return "", "", errors.New(artifactoryGroupProperty + " is not defined")
+	}
+	artifact := params[artifactoryArtifactProperty]
+	if artifact == "" {
+		artifact = gitInfo.ServiceName
+	}
+	folder := baseUrl
+	if repository := params[artifactoryRepositoryProperty]; repository != "" {
+		folder += "/" + repository
+	}
+	folder += "/" + strings.Replace(group, ".", "/", -1) + "/" + artifact
+	data, _, err := readArtifactoryResource(folder+"/maven-metadata.xml", params)
+	if err != nil {
+		return "", "", err
+	}
+	metadata := &mavenMetadata{}
+	if err = xml.Unmarshal(data, metadata); err != nil {
+		return "", "", fmt.Errorf("incorrect maven-metadata.xml of %s: %v", artifact, err)
+	}
+	version, ok := chooseArtifactVersion(metadata.Versions, gitInfo)
+	if !ok {
+		return "", "", fmt.Errorf("no version of %s is built from %s", artifact, gitInfo.Branch)
+	}
+	return folder + "/" + version + "/", version, nil
+}
+
+// readDockerTags reads all pages of the tag list, the registries return up to 100 or 1000 tags per page
+func readDockerTags(pageUrl string, params map[string]string) ([]string, error) {
+	var res []string
+	for page := 1; pageUrl != ""; page++ {
+		if page > artifactoryMaxPages {
+			return nil, fmt.Errorf("more than %d pages", artifactoryMaxPages)
+		}
+		data, header, err := readArtifactoryResource(pageUrl, params)
+		if err != nil {
+			return nil, err
+		}
+		tags := &dockerTagList{}
+		if err = json.Unmarshal(data, tags); err != nil {
+			return nil, fmt.Errorf("incorrect tag list at %s: %v", pageUrl, err)
+		}
+		res = append(res, tags.Tags...)
+		if pageUrl, err = getNextPageUrl(pageUrl, header.Get("Link")); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func findDockerTag(baseUrl string, gitInfo *GitInfo, params map[string]string) (string, string, error) {
+	image := params[artifactoryImageProperty]
+	if image == "" {
+		image = gitInfo.ServiceName
+	}
+	tags, err := readDockerTags(baseUrl+"/v2/"+image+"/tags/list", params)
+	if err != nil {
+		return "", "", fmt.Errorf("cannot read the tags of %s: %v", image, err)
+	}
+	tag, ok := chooseArtifactVersion(tags, gitInfo)
+	if !ok {
+		return "", "", fmt.Errorf("no tag of %s is built from %s", image, gitInfo.Branch)
+	}
+	return baseUrl + "/v2/" + image + "/manifests/" + tag, tag, nil
+}
+
+// findArtifact sets the URL and the version of the newest artifact of the branch in the git info
+func findArtifact(gitInfo *GitInfo) error {
+	params := dvparser.GlobalProperties
+	baseUrl := strings.TrimRight(params[artifactoryUrlProperty], "/")
+	if baseUrl == "" {
+		return errors.New(artifactoryUrlProperty + " is not defined")
+	}
+	kind := strings.ToLower(params[artifactoryTypeProperty])
+	if kind == "" {
+		kind = artifactoryTypeMaven
+		if params[artifactoryImageProperty] != "" {
+			kind = artifactoryTypeDocker
+		}
+	}
+	var err error
+	switch kind {
+	case artifactoryTypeMaven:
+		gitInfo.Artifactory, gitInfo.ArtifactVersion, err = findMavenArtifact(baseUrl, gitInfo, params)
+	case artifactoryTypeDocker:
+		gitInfo.Artifactory, gitInfo.ArtifactVersion, err = findDockerTag(baseUrl, gitInfo, params)
+	default:
+		err = errors.New("unsupported " + artifactoryTypeProperty + " " + kind)
+	}
+	return err
+}
+
+func openInBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	case "darwin":
+		cmd = exec.Command("open", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	return cmd.Start()
+}
+
+func presentArtifact(gitInfo *GitInfo, options *gitInfoOptions) error {
+	if err := findArtifact(gitInfo); err != nil {
+		return err
+	}
+	if options.browse {
+		return openInBrowser(gitInfo.Artifactory)
+	}
+	if !strings.Contains(options.actions, "R") {
+		fmt.Printf("GIT_ARTIFACTORY=%s\nGIT_ARTIFACT_VERSION=%s\n", gitInfo.Artifactory, gitInfo.ArtifactVersion)
+	}
+	return nil
+}
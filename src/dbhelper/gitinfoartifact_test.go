@@ -0,0 +1,172 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const testMavenMetadata = `<?xml version="1.0" encoding="UTF-8"?>
+<metadata>
+  <groupId>com.example</groupId>
+  <artifactId>app</artifactId>
+  <versioning>
+    <latest>1.10.0-master-1a2b3c4</latest>
+    <versions>
+      <version>1.9.0-master-9f8e7d6</version>
+      <version>1.10.0-feature-abc-12-0c1d2e3</version>
+      <version>1.10.0-master-1a2b3c4</version>
+      <version>1.9.5-feature-abc-12-5a6b7c8</version>
+    </versions>
+  </versioning>
+</metadata>`
+
+func TestChooseArtifactVersion(t *testing.T) {
+	versions := []string{"1.9-master", "1.10-master", "1.2-feature-abc-12", "1.11-feature-abc-12-0c1d2e3", "1.3-release_2.0", "1.1-feature-abc-1"}
+	for _, test := range []struct {
+		branch   string
+		commit   string
+		expected string
+	}{
+		{"feature/ABC-12", "0C1D2E3F4A5B", "1.11-feature-abc-12-0c1d2e3"},
+		{"feature/ABC-12", "ffffffffffff", "1.11-feature-abc-12-0c1d2e3"},
+		{"feature/abc-12", "", "1.11-feature-abc-12-0c1d2e3"},
+		{"release/2.0", "", "1.3-release_2.0"},
+		{"master", "aaaaaaaaaaaa", "1.10-master"},
+		{"feature/ABC-1", "", "1.1-feature-abc-1"},
+		{"main", "", ""},
+		{"develop", "", ""},
+	} {
+		version, ok := chooseArtifactVersion(versions, &GitInfo{Branch: test.branch, Latest: test.commit})
+		if version != test.expected || ok != (test.expected != "") {
+			t.Errorf("%s %s: %s %v instead of %s", test.branch, test.commit, version, ok, test.expected)
+		}
+	}
+	if version, _ := chooseArtifactVersion([]string{"1.10", "1.9", "1.9.1"}, &GitInfo{Branch: "master"}); version != "1.10" {
+		t.Errorf("%s is chosen instead of 1.10", version)
+	}
+	if version, _ := chooseArtifactVersion(append(versions, "1.8.2", "1.8.10-0c1d2e3f", "2.0-SNAPSHOT"), &GitInfo{Branch: "main"}); version != "1.8.10-0c1d2e3f" {
+		t.Errorf("%s is chosen for main instead of the newest version without a branch", version)
+	}
+	if version, _ := chooseArtifactVersion([]string{"1.4.2-1a2b3c4", "1.4.10"}, &GitInfo{Branch: "master", Latest: "1a2b3c4d"}); version != "1.4.2-1a2b3c4" {
+		t.Errorf("%s is chosen instead of the commit version", version)
+	}
+}
+
+func TestFindMavenArtifact(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, _ := r.BasicAuth(); user != "reader" || password != "pass" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path != "/libs-release/com/example/app/maven-metadata.xml" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(testMavenMetadata))
+	}))
+	defer server.Close()
+	params := map[string]string{
+		artifactoryRepositoryProperty: "libs-release",
+		artifactoryGroupProperty:      "com.example",
+		artifactoryUserProperty:       "reader",
+		artifactoryPasswordProperty:   "pass",
+	}
+	gitInfo := &GitInfo{ServiceName: "app", Branch: "feature/ABC-12", Latest: "5a6b7c8d9e"}
+	u, version, err := findMavenArtifact(server.URL, gitInfo, params)
+	if err != nil || version != "1.9.5-feature-abc-12-5a6b7c8" || u != server.URL+"/libs-release/com/example/app/1.9.5-feature-abc-12-5a6b7c8/" {
+		t.Fatalf("%s %s %v", u, version, err)
+	}
+	gitInfo = &GitInfo{ServiceName: "app", Branch: "master"}
+	if _, version, err = findMavenArtifact(server.URL, gitInfo, params); err != nil || version != "1.10.0-master-1a2b3c4" {
+		t.Fatalf("%s %v", version, err)
+	}
+	params[artifactoryPasswordProperty] = "wrong"
+	if _, _, err = findMavenArtifact(server.URL, gitInfo, params); err == nil {
+		t.Fatal("the rejected credentials are not reported")
+	}
+}
+
+// startTestRegistry serves the tags by pages of two, the next page is given by the Link header as the registries do
+func startTestRegistry(t *testing.T, tags []string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v2/project/app/tags/list" || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		start := 0
+		if last := r.URL.Query().Get("last"); last != "" {
+			for start < len(tags) && tags[start] != last {
+				start++
+			}
+			start++
+		}
+		end := start + 2
+		if end < len(tags) {
+			w.Header().Set("Link", `</v2/project/app/tags/list?n=2&last=`+tags[end-1]+`>; rel="next"`)
+		} else {
+			end = len(tags)
+		}
+		data, _ := json.Marshal(&dockerTagList{Name: "project/app", Tags: tags[start:end]})
+		w.Write(data)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestFindDockerTagReadsAllPages(t *testing.T) {
+	server := startTestRegistry(t, []string{"1.0-master", "1.1-master", "1.2-develop", "1.9-master", "1.10-master", "2.0-develop", "1.10.1-develop"})
+	params := map[string]string{artifactoryImageProperty: "project/app", artifactoryTokenProperty: "token"}
+	for branch, expected := range map[string]string{"master": "1.10-master", "develop": "2.0-develop"} {
+		u, tag, err := findDockerTag(server.URL, &GitInfo{Branch: branch}, params)
+		if err != nil || tag != expected || u != server.URL+"/v2/project/app/manifests/"+expected {
+			t.Errorf("%s: %s %s %v instead of %s", branch, u, tag, err, expected)
+		}
+	}
+	if _, _, err := findDockerTag(server.URL, &GitInfo{Branch: "feature/x"}, params); err == nil || !strings.Contains(err.Error(), "feature/x") {
+		t.Errorf("the missing branch is reported as %v", err)
+	}
+}
+
+func TestContainsVersionToken(t *testing.T) {
+	for _, test := range []struct {
+		version  string
+		token    string
+		isCommit bool
+		expected bool
+	}{
+		{"1.11-feature-abc-12-0c1d2e3", "feature-abc-12", false, true},
+		{"1.11-feature-abc-12-0c1d2e3", "feature-abc-1", false, false},
+		{"1.11-feature-abc-12-0c1d2e3", "abc-1", false, false},
+		{"1.11-xabc-1", "abc-1", false, false},
+		{"1.11-abc-1", "abc-1", false, true},
+		{"1.3-release_2.0", "release_2.0", false, true},
+		{"1.3-release_2.0.1", "release_2.0", false, true},
+		{"1.4-0c1d2e3f4a", "0c1d2e3", true, true},
+		{"1.4-0c1d2e3x", "0c1d2e3", true, false},
+		{"1.4-10c1d2e3", "0c1d2e3", true, false},
+	} {
+		if containsVersionToken(test.version, test.token, test.isCommit) != test.expected {
+			t.Errorf("%s in %s is not %v", test.token, test.version, test.expected)
+		}
+	}
+}
+
+func TestGetNextPageUrl(t *testing.T) {
+	current := "https://registry.local/v2/app/tags/list"
+	for link, expected := range map[string]string{
+		"":                                       "",
+		`</v2/app/tags/list?last=b>; rel="next"`: "https://registry.local/v2/app/tags/list?last=b",
+		`<https://cdn.local/p2>; rel=next`:       "https://cdn.local/p2",
+		`</p1>; rel="prev", </p3>; rel="next"`:   "https://registry.local/p3",
+		`</p1>; rel="prev"`:                      "",
+	} {
+		if next, err := getNextPageUrl(current, link); err != nil || next != expected {
+			t.Errorf("%s: %s %v instead of %s", link, next, err, expected)
+		}
+	}
+}
@@ -0,0 +1,587 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	gitHashLength     = 20
+	gitMaxSymbolicRef = 10
+	gitMaxDeltaDepth  = 50
+)
+
+const (
+	gitObjectCommit   = 1
+	gitObjectTree     = 2
+	gitObjectBlob     = 3
+	gitObjectTag      = 4
+	gitObjectOfsDelta = 6
+	gitObjectRefDelta = 7
+)
+
+// gitRepository keeps the folders of a repository: the work tree, the git folder with HEAD
+// and the common folder with refs and objects, which differs from the git folder for worktrees
+type gitRepository struct {
+	workTree  string
+	gitDir    string
+	commonDir string
+	packs     []*gitPack
+}
+
+type gitPack struct {
+	packFile string
+	hashes   [][]byte
+	offsets  []int64
+}
+
+type gitCommit struct {
+	Hash        string
+	AuthorName  string
+	AuthorEmail string
+	Time        time.Time
+}
+
+// openGitRepository checks whether the folder has .git as a folder or as a file with gitdir: (worktrees and submodules)
+func openGitRepository(folder string) (*gitRepository, bool) {
+	dotGit := filepath.Join(folder, ".git")
+	info, err := os.Stat(dotGit)
+	if err != nil {
+		return nil, false
+	}
+	gitDir := dotGit
+	if !info.IsDir() {
+		data, err := ioutil.ReadFile(dotGit)
+		s := strings.TrimSpace(string(data))
+		if err != nil || !strings.HasPrefix(s, "gitdir:") {
+			return nil, false
+		}
+		gitDir = strings.TrimSpace(s[len("gitdir:"):])
+		if !filepath.IsAbs(gitDir) {
+			gitDir = filepath.Join(folder, gitDir)
+		}
+	}
+	if _, err = os.Stat(filepath.Join(gitDir, "HEAD")); err != nil {
+		return nil, false
+	}
+	commonDir := gitDir
+	if data, err := ioutil.ReadFile(filepath.Join(gitDir, "commondir")); err == nil {
+		commonDir = strings.TrimSpace(string(data))
+		if !filepath.IsAbs(commonDir) {
+			commonDir = filepath.Join(gitDir, commonDir)
+		}
+	}
+	return &gitRepository{workTree: folder, gitDir: gitDir, commonDir: commonDir}, true
+}
+
+// findGitRepository walks up from the folder to the root looking for the repository
+func findGitRepository(folder string) (*gitRepository, bool) {
+	folder, err := filepath.Abs(folder)
+	if err != nil {
+		return nil, false
+	}
+	for {
+		if repo, ok := openGitRepository(folder); ok {
+			return repo, true
+		}
+		parent := filepath.Dir(folder)
+		if parent == folder {
+			return nil, false
+		}
+		folder = parent
+	}
+}
+
+func isGitHash(s string) bool {
+	if len(s) != gitHashLength*2 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// readPackedRefs reads packed-refs, the peeled lines (^) of annotated tags are skipped
+func (repo *gitRepository) readPackedRefs() map[string]string {
+	refs := make(map[string]string)
+	data, err := ioutil.ReadFile(filepath.Join(repo.commonDir, "packed-refs"))
+	if err != nil {
+		return refs
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == '^' {
+			continue
+		}
+		parts := strings.SplitN(line, " ", 2)
+		if len(parts) == 2 && isGitHash(parts[0]) {
+			refs[strings.TrimSpace(parts[1])] = parts[0]
+		}
+	}
+	return refs
+}
+
+func (repo *gitRepository) readLooseRef(name string) (string, bool) {
+	for _, dir := range []string{repo.gitDir, repo.commonDir} {
+		data, err := ioutil.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+		if err == nil {
+			return strings.TrimSpace(string(data)), true
+		}
+	}
+	return "", false
+}
+
+// resolveRef follows the symbolic refs to the hash, loose refs take precedence over packed-refs
+func (repo *gitRepository) resolveRef(name string) (string, error) {
+	var packed map[string]string
+	for i := 0; i < gitMaxSymbolicRef; i++ {
+		value, ok := repo.readLooseRef(name)
+		if !ok {
+			if packed == nil {
+				packed = repo.readPackedRefs()
+			}
+			if value, ok = packed[name]; !ok {
+				return "", errors.New("reference " + name + " is not found")
+			}
+		}
+		if !strings.HasPrefix(value, "ref:") {
+			if !isGitHash(value) {
+				return "", errors.New("incorrect reference " + name + ": " + value)
+			}
+			return value, nil
+		}
+		name = strings.TrimSpace(value[len("ref:"):])
+	}
+	return "", errors.New("too deep symbolic reference " + name)
+}
+
+// listRefs lists the loose and packed refs with the prefix, such as refs/heads/
+func (repo *gitRepository) listRefs(prefix string) map[string]string {
+	refs := make(map[string]string)
+	for name, hash := range repo.readPackedRefs() {
+		if strings.HasPrefix(name, prefix) {
+			refs[name] = hash
+		}
+	}
+	root := filepath.Join(repo.commonDir, filepath.FromSlash(prefix))
+	filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(repo.commonDir, path)
+		if err != nil {
+			return nil
+		}
+		data, err := ioutil.ReadFile(path)
+		if value := strings.TrimSpace(string(data)); err == nil && isGitHash(value) {
+			refs[filepath.ToSlash(rel)] = value
+		}
+		return nil
+	})
+	return refs
+}
+
+// readHead returns the branch and the commit hash of HEAD; for a detached HEAD the branch
+// is taken from a local or remote branch pointing to the same commit, or it is HEAD
+func (repo *gitRepository) readHead() (branch string, hash string, detached bool, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(repo.gitDir, "HEAD"))
+	if err != nil {
+		return
+	}
+	s := strings.TrimSpace(string(data))
+	if strings.HasPrefix(s, "ref:") {
+		ref := strings.TrimSpace(s[len("ref:"):])
+		branch = strings.TrimPrefix(ref, "refs/heads/")
+		hash, err = repo.resolveRef(ref)
+		return
+	}
+	if !isGitHash(s) {
+		err = errors.New("incorrect HEAD: " + s)
+		return
+	}
+	hash = s
+	detached = true
+	branch = "HEAD"
+	for _, prefix := range []string{"refs/heads/", "refs/remotes/"} {
+		refs := repo.listRefs(prefix)
+		names := make([]string, 0, len(refs))
+		for name, h := range refs {
+			if h == hash && !strings.HasSuffix(name, "/HEAD") {
+				names = append(names, name)
+			}
+		}
+		if len(names) > 0 {
+			sort.Strings(names)
+			branch = strings.TrimPrefix(names[0], prefix)
+			if prefix == "refs/remotes/" {
+				if p := strings.Index(branch, "/"); p > 0 {
+					branch = branch[p+1:]
+				}
+			}
+			return
+		}
+	}
+	return
+}
+
+func inflateGitData(r io.Reader) ([]byte, error) {
+	z, err := zlib.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer z.Close()
+	return ioutil.ReadAll(z)
+}
+
+func (repo *gitRepository) readLooseObject(hash string) (int, []byte, bool, error) {
+	data, err := ioutil.ReadFile(filepath.Join(repo.commonDir, "objects", hash[:2], hash[2:]))
+	if os.IsNotExist(err) {
+		return 0, nil, false, nil
+	}
+	if err != nil {
+		return 0, nil, false, err
+	}
+	data, err = inflateGitData(bytes.NewReader(data))
+	if err != nil {
+		return 0, nil, false, fmt.Errorf("object %s: %v", hash, err)
+	}
+	p := bytes.IndexByte(data, 0)
+	if p < 0 {
+		return 0, nil, false, errors.New("incorrect object " + hash)
+	}
+	kind := 0
+	switch strings.SplitN(string(data[:p]), " ", 2)[0] {
+	case "commit":
+		kind = gitObjectCommit
+	case "tree":
+		kind = gitObjectTree
+	case "blob":
+		kind = gitObjectBlob
+	case "tag":
+		kind = gitObjectTag
+	}
+	return kind, data[p+1:], true, nil
+}
+
+// readPackIndex reads the pack index of version 2 or the older version 1
+func readPackIndex(idxFile string) (*gitPack, error) {
+	data, err := ioutil.ReadFile(idxFile)
+	if err != nil {
+		return nil, err
+	}
+	pack := &gitPack{packFile: strings.TrimSuffix(idxFile, ".idx") + ".pack"}
+	if len(data) >= 8 && bytes.Equal(data[:4], []byte{0xff, 't', 'O', 'c'}) {
+		if binary.BigEndian.Uint32(data[4:8]) != 2 {
+			return nil, errors.New("unsupported version of " + idxFile)
+		}
+		if len(data) < 8+256*4 {
+			return nil, errors.New("incorrect " + idxFile)
+		}
+		n := int(binary.BigEndian.Uint32(data[8+255*4:]))
+		hashStart := 8 + 256*4
+		offsetStart := hashStart + n*gitHashLength + n*4
+		largeStart := offsetStart + n*4
+		if len(data) < largeStart {
+			return nil, errors.New("incorrect " + idxFile)
+		}
+		pack.hashes = make([][]byte, n)
+		pack.offsets = make([]int64, n)
+		for i := 0; i < n; i++ {
+			pack.hashes[i] = data[hashStart+i*gitHashLength : hashStart+(i+1)*gitHashLength]
+			offset := binary.BigEndian.Uint32(data[offsetStart+i*4:])
+			if offset&0x80000000 != 0 {
+				pos := largeStart + int(offset&0x7fffffff)*8
+				if len(data) < pos+8 {
+					return nil, errors.New("incorrect " + idxFile)
+				}
+				pack.offsets[i] = int64(binary.BigEndian.Uint64(data[pos:]))
+			} else {
+				pack.offsets[i] = int64(offset)
+			}
+		}
+		return pack, nil
+	}
+	if len(data) < 256*4 {
+		return nil, errors.New("incorrect " + idxFile)
+	}
+	n := int(binary.BigEndian.Uint32(data[255*4:]))
+	if len(data) < 256*4+n*(4+gitHashLength) {
+		return nil, errors.New("incorrect " + idxFile)
+	}
+	pack.hashes = make([][]byte, n)
+	pack.offsets = make([]int64, n)
+	for i := 0; i < n; i++ {
+		pos := 256*4 + i*(4+gitHashLength)
+		pack.offsets[i] = int64(binary.BigEndian.Uint32(data[pos:]))
+		pack.hashes[i] = data[pos+4 : pos+4+gitHashLength]
+	}
+	return pack, nil
+}
+
+func (repo *gitRepository) loadPacks() error {
+	if repo.packs != nil {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(repo.commonDir, "objects", "pack", "*.idx"))
+	if err != nil {
+		return err
+	}
+	repo.packs = make([]*gitPack, 0, len(files))
+	for _, file := range files {
+		pack, err := readPackIndex(file)
+		if err != nil {
+			return err
+		}
+		repo.packs = append(repo.packs, pack)
+	}
+	return nil
+}
+
+func (pack *gitPack) find(hash []byte) (int64, bool) {
+	i := sort.Search(len(pack.hashes), func(i int) bool {
+		return bytes.Compare(pack.hashes[i], hash) >= 0
+	})
+	if i < len(pack.hashes) && bytes.Equal(pack.hashes[i], hash) {
+		return pack.offsets[i], true
+	}
+	return 0, false
+}
+
+// applyGitDelta builds the object from the base by the copy and insert instructions of the delta
+func applyGitDelta(base []byte, delta []byte) ([]byte, error) {
+	pos := 0
+	readSize := func() int {
+		size, shift := 0, uint(0)
+		for pos < len(delta) {
+			c := delta[pos]
+			pos++
+			size |= int(c&0x7f) << shift
+			shift += 7
+			if c&0x80 == 0 {
+				break
+			}
+		}
+		return size
+	}
+	if readSize() != len(base) {
+		return nil, errors.New("delta base size mismatch")
+	}
+	size := readSize()
+	res := make([]byte, 0, size)
+	for pos < len(delta) {
+		c := delta[pos]
+		pos++
+		if c&0x80 == 0 {
+			if c == 0 || pos+int(c) > len(delta) {
+				return nil, errors.New("incorrect delta")
+			}
+			res = append(res, delta[pos:pos+int(c)]...)
+			pos += int(c)
+			continue
+		}
+		offset, length := 0, 0
+		for i := uint(0); i < 7; i++ {
+			if c&(1<<i) == 0 {
+				continue
+			}
+			if pos >= len(delta) {
+				return nil, errors.New("incorrect delta")
+			}
+			if i < 4 {
+				offset |= int(delta[pos]) << (8 * i)
+			} else {
+				length |= int(delta[pos]) << (8 * (i - 4))
+			}
+			pos++
+		}
+		if length == 0 {
+			length = 0x10000
+		}
+		if offset+length > len(base) {
+			return nil, errors.New("incorrect delta copy")
+		}
+		res = append(res, base[offset:offset+length]...)
+	}
+	if len(res) != size {
+		return nil, errors.New("delta result size mismatch")
+	}
+	return res, nil
+}
+
+// readPackObject reads the object at the offset of the pack resolving the deltas
+func (repo *gitRepository) readPackObject(file *os.File, offset int64, depth int) (int, []byte, error) {
+	if depth > gitMaxDeltaDepth {
+		return 0, nil, errors.New("too deep delta chain")
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return 0, nil, err
+	}
+	r := bufio.NewReader(file)
+	c, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	kind := int(c>>4) & 7
+	for c&0x80 != 0 {
+		if c, err = r.ReadByte(); err != nil {
+			return 0, nil, err
+		}
+	}
+	switch kind {
+	case gitObjectOfsDelta:
+		c, err = r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		distance := int64(c & 0x7f)
+		for c&0x80 != 0 {
+			if c, err = r.ReadByte(); err != nil {
+				return 0, nil, err
+			}
+			distance = (distance+1)<<7 | int64(c&0x7f)
+		}
+		delta, err := inflateGitData(r)
+		if err != nil {
+			return 0, nil, err
+		}
+		baseKind, base, err := repo.readPackObject(file, offset-distance, depth+1)
+		if err != nil {
+			return 0, nil, err
+		}
+		data, err := applyGitDelta(base, delta)
+		return baseKind, data, err
+	case gitObjectRefDelta:
+		baseHash := make([]byte, gitHashLength)
+		if _, err = io.ReadFull(r, baseHash); err != nil {
+			return 0, nil, err
+		}
+		delta, err := inflateGitData(r)
+		if err != nil {
+			return 0, nil, err
+		}
+		baseKind, base, err := repo.readObjectDepth(hex.EncodeToString(baseHash), depth+1)
+		if err != nil {
+			return 0, nil, err
+		}
+		data, err := applyGitDelta(base, delta)
+		return baseKind, data, err
+	}
+	data, err := inflateGitData(r)
+	return kind, data, err
+}
+
+func (repo *gitRepository) readObjectDepth(hash string, depth int) (int, []byte, error) {
+	kind, data, ok, err := repo.readLooseObject(hash)
+	if ok || err != nil {
+		return kind, data, err
+	}
+	if err = repo.loadPacks(); err != nil {
+		return 0, nil, err
+	}
+	raw, err := hex.DecodeString(hash)
+	if err != nil {
+		return 0, nil, err
+	}
+	for _, pack := range repo.packs {
+		offset, ok := pack.find(raw)
+		if !ok {
+			continue
+		}
+		file, err := os.Open(pack.packFile)
+		if err != nil {
+			return 0, nil, err
+		}
+		kind, data, err = repo.readPackObject(file, offset, depth)
+		file.Close()
+		return kind, data, err
+	}
+	return 0, nil, errors.New("object " + hash + " is not found")
+}
+
+// readObject reads the loose or packed object by the hash
+func (repo *gitRepository) readObject(hash string) (int, []byte, error) {
+	return repo.readObjectDepth(hash, 0)
+}
+
+// parseGitSignature parses "Name <email> 1577836800 +0200" of the author and committer lines
+func parseGitSignature(s string) (name string, email string, when time.Time) {
+	start := strings.Index(s, "<")
+	end := strings.LastIndex(s, ">")
+	if start < 0 || end < start {
+		return strings.TrimSpace(s), "", when
+	}
+	name = strings.TrimSpace(s[:start])
+	email = s[start+1 : end]
+	parts := strings.Fields(s[end+1:])
+	if len(parts) == 0 {
+		return
+	}
+	seconds, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return
+	}
+	when = time.Unix(seconds, 0)
+	if len(parts) > 1 && len(parts[1]) == 5 {
+		hours, err1 := strconv.Atoi(parts[1][1:3])
+		minutes, err2 := strconv.Atoi(parts[1][3:])
+		if err1 == nil && err2 == nil {
+			offset := hours*3600 + minutes*60
+			if parts[1][0] == '-' {
+				offset = -offset
+			}
+			when = when.In(time.FixedZone(parts[1], offset))
+		}
+	}
+	return
+}
+
+// readCommit reads the author and the commit time, an annotated tag is followed to its commit
+func (repo *gitRepository) readCommit(hash string) (*gitCommit, error) {
+	for i := 0; i < gitMaxSymbolicRef; i++ {
+		kind, data, err := repo.readObject(hash)
+		if err != nil {
+			return nil, err
+		}
+		headers := string(data)
+		if p := strings.Index(headers, "\n\n"); p >= 0 {
+			headers = headers[:p]
+		}
+		lines := strings.Split(headers, "\n")
+		if kind == gitObjectTag {
+			for _, line := range lines {
+				if strings.HasPrefix(line, "object ") {
+					hash = strings.TrimSpace(line[len("object "):])
+				}
+			}
+			continue
+		}
+		if kind != gitObjectCommit {
+			return nil, errors.New(hash + " is not a commit")
+		}
+		commit := &gitCommit{Hash: hash}
+		for _, line := range lines {
+			if strings.HasPrefix(line, "author ") {
+				commit.AuthorName, commit.AuthorEmail, _ = parseGitSignature(line[len("author "):])
+			} else if strings.HasPrefix(line, "committer ") {
+				_, _, commit.Time = parseGitSignature(line[len("committer "):])
+			}
+		}
+		return commit, nil
+	}
+	return nil, errors.New("too deep tag chain at " + hash)
+}
@@ -0,0 +1,343 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+// testGitRepo writes a repository as git does: loose objects, a pack with an index of version 2 and the refs
+type testGitRepo struct {
+	t      *testing.T
+	gitDir string
+}
+
+// testGitPackEntry is an object of the pack, delta entries refer to the base by the index or by the hash
+type testGitPackEntry struct {
+	kind    int
+	data    []byte
+	hash    string
+	base    int
+	baseRef string
+}
+
+func createTestGitRepo(t *testing.T, folder string) *testGitRepo {
+	repo := &testGitRepo{t: t, gitDir: filepath.Join(folder, ".git")}
+	repo.write("HEAD", "ref: refs/heads/main\n")
+	return repo
+}
+
+func (repo *testGitRepo) write(name string, content string) {
+	fileName := filepath.Join(repo.gitDir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(fileName), 0755); err != nil {
+		repo.t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fileName, []byte(content), 0644); err != nil {
+		repo.t.Fatal(err)
+	}
+}
+
+func deflateTestGitData(data []byte) []byte {
+	var buf bytes.Buffer
+	z := zlib.NewWriter(&buf)
+	z.Write(data)
+	z.Close()
+	return buf.Bytes()
+}
+
+func hashTestGitObject(kind string, data []byte) string {
+	sum := sha1.Sum(append([]byte(fmt.Sprintf("%s %d\x00", kind, len(data))), data...))
+	return hex.EncodeToString(sum[:])
+}
+
+func (repo *testGitRepo) writeLooseObject(kind string, data []byte) string {
+	hash := hashTestGitObject(kind, data)
+	content := deflateTestGitData(append([]byte(fmt.Sprintf("%s %d\x00", kind, len(data))), data...))
+	repo.write("objects/"+hash[:2]+"/"+hash[2:], string(content))
+	return hash
+}
+
+func createTestGitCommit(tree string, parent string, author string, seconds int64, message string) []byte {
+	s := "tree " + tree + "\n"
+	if parent != "" {
+		s += "parent " + parent + "\n"
+	}
+	s += fmt.Sprintf("author %s %d +0200\ncommitter Build Bot <bot@local> %d +0200\n\n%s\n", author, seconds, seconds, message)
+	return []byte(s)
+}
+
+// createTestGitDelta copies the common prefix of the base and inserts the rest of the target
+func createTestGitDelta(base []byte, target []byte) []byte {
+	writeSize := func(buf *bytes.Buffer, size int) {
+		for size >= 0x80 {
+			buf.WriteByte(byte(size&0x7f) | 0x80)
+			size >>= 7
+		}
+		buf.WriteByte(byte(size))
+	}
+	var buf bytes.Buffer
+	writeSize(&buf, len(base))
+	writeSize(&buf, len(target))
+	common := 0
+	for common < len(base) && common < len(target) && base[common] == target[common] {
+		common++
+	}
+	// the copy of the offset 0 has no offset bytes, the length has two bytes
+	buf.Write([]byte{0x80 | 0x10 | 0x20, byte(common), byte(common >> 8)})
+	for rest := target[common:]; len(rest) > 0; {
+		n := len(rest)
+		if n > 0x7f {
+			n = 0x7f
+		}
+		buf.WriteByte(byte(n))
+		buf.Write(rest[:n])
+		rest = rest[n:]
+	}
+	return buf.Bytes()
+}
+
+// writePack writes the pack and its index, the hashes of the entries are set by the caller
+func (repo *testGitRepo) writePack(entries []*testGitPackEntry) {
+	var pack bytes.Buffer
+	pack.WriteString("PACK")
+	binary.Write(&pack, binary.BigEndian, uint32(2))
+	binary.Write(&pack, binary.BigEndian, uint32(len(entries)))
+	offsets := make([]int64, len(entries))
+	crcs := make([]uint32, len(entries))
+	for i, entry := range entries {
+		offsets[i] = int64(pack.Len())
+		var buf bytes.Buffer
+		size := len(entry.data)
+		c := byte(entry.kind<<4) | byte(size&0x0f)
+		for size >>= 4; size > 0; size >>= 7 {
+			buf.WriteByte(c | 0x80)
+			c = byte(size & 0x7f)
+		}
+		buf.WriteByte(c)
+		switch entry.kind {
+		case gitObjectOfsDelta:
+			distance := offsets[i] - offsets[entry.base]
+			encoded := []byte{byte(distance & 0x7f)}
+			for distance >>= 7; distance > 0; distance >>= 7 {
+				distance--
+				encoded = append([]byte{byte(distance&0x7f) | 0x80}, encoded...)
+			}
+			buf.Write(encoded)
+		case gitObjectRefDelta:
+			raw, _ := hex.DecodeString(entry.baseRef)
+			buf.Write(raw)
+		}
+		buf.Write(deflateTestGitData(entry.data))
+		crcs[i] = crc32.ChecksumIEEE(buf.Bytes())
+		pack.Write(buf.Bytes())
+	}
+	packSum := sha1.Sum(pack.Bytes())
+	pack.Write(packSum[:])
+
+	order := make([]int, len(entries))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return entries[order[i]].hash < entries[order[j]].hash })
+	var idx bytes.Buffer
+	idx.Write([]byte{0xff, 't', 'O', 'c'})
+	binary.Write(&idx, binary.BigEndian, uint32(2))
+	for b := 0; b < 256; b++ {
+		count := 0
+		for _, entry := range entries {
+			if first, _ := hex.DecodeString(entry.hash[:2]); int(first[0]) <= b {
+				count++
+			}
+		}
+		binary.Write(&idx, binary.BigEndian, uint32(count))
+	}
+	for _, i := range order {
+		raw, _ := hex.DecodeString(entries[i].hash)
+		idx.Write(raw)
+	}
+	for _, i := range order {
+		binary.Write(&idx, binary.BigEndian, crcs[i])
+	}
+	for _, i := range order {
+		binary.Write(&idx, binary.BigEndian, uint32(offsets[i]))
+	}
+	idx.Write(packSum[:])
+	idxSum := sha1.Sum(idx.Bytes())
+	idx.Write(idxSum[:])
+
+	name := "objects/pack/pack-" + hex.EncodeToString(packSum[:])
+	repo.write(name+".pack", pack.String())
+	repo.write(name+".idx", idx.String())
+}
+
+// testGitHistory is the history of three commits: the first is packed as it is, the second as the ofs delta
+// of the first and the third as the ref delta of the second; the annotated tag of the third is loose
+type testGitHistory struct {
+	commits []string
+	tag     string
+}
+
+func (repo *testGitRepo) writeHistory() *testGitHistory {
+	tree := repo.writeLooseObject("tree", nil)
+	history := &testGitHistory{}
+	var entries []*testGitPackEntry
+	var previous []byte
+	for i, author := range []string{"Alice Smith <alice@local>", "Bob Stone <bob@local>", "Carol White <carol@local>"} {
+		parent := ""
+		if i > 0 {
+			parent = history.commits[i-1]
+		}
+		data := createTestGitCommit(tree, parent, author, 1577836800+int64(i)*3600, fmt.Sprintf("change %d", i+1))
+		hash := hashTestGitObject("commit", data)
+		entry := &testGitPackEntry{kind: gitObjectCommit, data: data, hash: hash}
+		switch i {
+		case 1:
+			entry = &testGitPackEntry{kind: gitObjectOfsDelta, data: createTestGitDelta(previous, data), hash: hash, base: 0}
+		case 2:
+			entry = &testGitPackEntry{kind: gitObjectRefDelta, data: createTestGitDelta(previous, data), hash: hash, baseRef: history.commits[1]}
+		}
+		entries = append(entries, entry)
+		history.commits = append(history.commits, hash)
+		previous = data
+	}
+	repo.writePack(entries)
+	history.tag = repo.writeLooseObject("tag", []byte("object "+history.commits[2]+"\ntype commit\ntag v1.0\n"+
+		"tagger Build Bot <bot@local> 1577851200 +0200\n\nrelease 1.0\n"))
+	return history
+}
+
+func readTestGitInfo(t *testing.T, folder string) *GitInfo {
+	gitInfo, ok, err := tryFolder(folder)
+	if !ok || err != nil {
+		t.Fatalf("%s is read as %v: %v", folder, ok, err)
+	}
+	return gitInfo
+}
+
+func TestReadGitPackedObjects(t *testing.T) {
+	repo := createTestGitRepo(t, t.TempDir())
+	history := repo.writeHistory()
+	r, ok := openGitRepository(filepath.Dir(repo.gitDir))
+	if !ok {
+		t.Fatal("the repository is not found")
+	}
+	for i, expected := range []string{"Alice Smith", "Bob Stone", "Carol White"} {
+		commit, err := r.readCommit(history.commits[i])
+		if err != nil {
+			t.Fatalf("commit %d: %v", i+1, err)
+		}
+		if commit.AuthorName != expected || commit.Time.Unix() != 1577836800+int64(i)*3600 {
+			t.Errorf("commit %d is read as %+v", i+1, commit)
+		}
+	}
+	commit, err := r.readCommit(history.tag)
+	if err != nil || commit.Hash != history.commits[2] || commit.AuthorEmail != "carol@local" {
+		t.Errorf("the tag is followed to %+v: %v", commit, err)
+	}
+	if _, err = r.readCommit(hashTestGitObject("commit", []byte("absent"))); err == nil {
+		t.Error("no error for an absent object")
+	}
+}
+
+func TestReadGitHeadFromPackedRefs(t *testing.T) {
+	folder := filepath.Join(t.TempDir(), "payment-service")
+	repo := createTestGitRepo(t, folder)
+	history := repo.writeHistory()
+	repo.write("packed-refs", "# pack-refs with: peeled fully-peeled sorted \n"+
+		history.commits[2]+" refs/heads/main\n"+
+		history.commits[0]+" refs/heads/feature/ABC-1\n"+
+		history.tag+" refs/tags/v1.0\n^"+history.commits[2]+"\n")
+	gitInfo := readTestGitInfo(t, filepath.Join(folder, "src", "main"))
+	if gitInfo.Branch != "main" || gitInfo.Latest != history.commits[2] || gitInfo.Detached || gitInfo.ServiceName != "payment-service" {
+		t.Errorf("the packed main is read as %+v", gitInfo)
+	}
+	if gitInfo.LatestAuthor != "Carol White <carol@local>" || gitInfo.LatestTime != "2020-01-01T04:00:00+02:00" {
+		t.Errorf("the latest commit is %s at %s", gitInfo.LatestAuthor, gitInfo.LatestTime)
+	}
+
+	// the loose ref takes precedence over packed-refs
+	repo.write("refs/heads/feature/ABC-1", history.commits[1]+"\n")
+	repo.write("HEAD", "ref: refs/heads/feature/ABC-1\n")
+	if gitInfo = readTestGitInfo(t, folder); gitInfo.Branch != "feature/ABC-1" || gitInfo.Latest != history.commits[1] {
+		t.Errorf("the loose feature branch is read as %+v", gitInfo)
+	}
+	repo.write("HEAD", "ref: refs/heads/absent\n")
+	if _, _, err := tryFolder(folder); err == nil {
+		t.Error("no error for the absent branch")
+	}
+}
+
+func TestReadGitDetachedHead(t *testing.T) {
+	folder := t.TempDir()
+	repo := createTestGitRepo(t, folder)
+	history := repo.writeHistory()
+	repo.write("packed-refs", history.commits[2]+" refs/heads/main\n"+
+		history.commits[1]+" refs/remotes/origin/HEAD\n"+
+		history.commits[1]+" refs/remotes/origin/release/1.2\n")
+	repo.write("HEAD", history.commits[1]+"\n")
+	gitInfo := readTestGitInfo(t, folder)
+	if !gitInfo.Detached || gitInfo.Branch != "release/1.2" || gitInfo.Latest != history.commits[1] || gitInfo.LatestAuthor != "Bob Stone <bob@local>" {
+		t.Errorf("HEAD at the remote branch is read as %+v", gitInfo)
+	}
+	// the local branch is preferred to the remote one
+	repo.write("refs/heads/hotfix", history.commits[1]+"\n")
+	if gitInfo = readTestGitInfo(t, folder); gitInfo.Branch != "hotfix" {
+		t.Errorf("HEAD at the local branch is read as %+v", gitInfo)
+	}
+	repo.write("HEAD", history.commits[0]+"\n")
+	if gitInfo = readTestGitInfo(t, folder); !gitInfo.Detached || gitInfo.Branch != "HEAD" || gitInfo.LatestAuthor != "Alice Smith <alice@local>" {
+		t.Errorf("HEAD without a branch is read as %+v", gitInfo)
+	}
+}
+
+func TestReadGitWorktree(t *testing.T) {
+	root := t.TempDir()
+	repo := createTestGitRepo(t, filepath.Join(root, "main"))
+	history := repo.writeHistory()
+	repo.write("packed-refs", history.commits[2]+" refs/heads/main\n")
+	repo.write("refs/heads/feature", history.commits[0]+"\n")
+	// git worktree add ../feature-tree feature
+	repo.write("worktrees/feature-tree/HEAD", "ref: refs/heads/feature\n")
+	repo.write("worktrees/feature-tree/commondir", "../..\n")
+	worktree := filepath.Join(root, "feature-tree")
+	if err := os.MkdirAll(filepath.Join(worktree, "docs"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(worktree, ".git"), []byte("gitdir: ../main/.git/worktrees/feature-tree\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gitInfo := readTestGitInfo(t, filepath.Join(worktree, "docs"))
+	if gitInfo.Branch != "feature" || gitInfo.Latest != history.commits[0] || gitInfo.ServiceName != "feature-tree" ||
+		gitInfo.LatestAuthor != "Alice Smith <alice@local>" {
+		t.Errorf("the worktree is read as %+v", gitInfo)
+	}
+	if gitInfo = readTestGitInfo(t, filepath.Join(root, "main")); gitInfo.Branch != "main" || gitInfo.Latest != history.commits[2] {
+		t.Errorf("the main work tree is read as %+v", gitInfo)
+	}
+}
+
+func TestApplyGitDeltaErrors(t *testing.T) {
+	base := []byte("tree 1\nauthor a\n")
+	target := []byte("tree 1\nauthor b\n")
+	delta := createTestGitDelta(base, target)
+	if data, err := applyGitDelta(base, delta); err != nil || !bytes.Equal(data, target) {
+		t.Fatalf("the delta gives %q: %v", data, err)
+	}
+	if _, err := applyGitDelta(base[1:], delta); err == nil {
+		t.Error("no error for the base of another size")
+	}
+	if _, err := applyGitDelta(base, delta[:len(delta)-1]); err == nil {
+		t.Error("no error for the truncated delta")
+	}
+}
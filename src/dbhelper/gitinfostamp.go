@@ -0,0 +1,285 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Dobryvechir/dvserver/src/dvjson"
+	"github.com/Dobryvechir/dvserver/src/dvoc"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	gitStampBranch     = "git.branch"
+	gitStampCommit     = "git.commit"
+	gitStampCommitTime = "git.commit-time"
+	gitStampAuthor     = "git.author"
+	gitLabelMaxLength  = 63
+)
+
+// gitWorkloadKinds are checked in this order when the kind of the microservice is not specified
+var gitWorkloadKinds = []string{"dc", "deployment", "statefulset"}
+
+// sanitizeGitLabelValue keeps the label value within 63 letters, digits, '-', '_' and '.', starting and ending with an alphanumeric
+func sanitizeGitLabelValue(s string) string {
+	b := []byte(s)
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			b[i] = '_'
+		}
+	}
+	if len(b) > gitLabelMaxLength {
+		b = b[:gitLabelMaxLength]
+	}
+	return strings.Trim(string(b), "-_.")
+}
+
+func createGitStampPatch(gitInfo *GitInfo) ([]byte, error) {
+	labels := map[string]string{
+		gitStampBranch: sanitizeGitLabelValue(gitInfo.Branch),
+		gitStampCommit: gitInfo.Latest,
+	}
+	annotations := map[string]string{
+		gitStampBranch:     gitInfo.Branch,
+		gitStampCommit:     gitInfo.Latest,
+		gitStampCommitTime: gitInfo.LatestTime,
+		gitStampAuthor:     gitInfo.LatestAuthor,
+	}
+	patch := map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"labels":      labels,
+			"annotations": annotations,
+		},
+	}
+	return json.Marshal(patch)
+}
+
+func findGitWorkloadKind(microServiceName string) (string, error) {
+	for _, kind := range gitWorkloadKinds {
+		list, err := dvoc.GetObjectFullList(kind)
+		if err != nil {
+			continue
+		}
+		for _, name := range list {
+			if name == microServiceName {
+				return kind, nil
+			}
+		}
+	}
+	return "", errors.New("no DeploymentConfig, Deployment or StatefulSet " + microServiceName)
+}
+
+// stampGitInfoInCluster patches the labels and annotations of the workload, the spaces are escaped
+// in json because the oc command line is split by spaces
+func stampGitInfoInCluster(gitInfo *GitInfo, options *gitInfoOptions) error {
+	patch, err := createGitStampPatch(gitInfo)
+	if err != nil {
+		return err
+	}
+	kind := options.kind
+	if kind == "" {
+		if kind, err = findGitWorkloadKind(options.microservice); err != nil {
+			return err
+		}
+	}
+	cmdLine := "patch " + kind + " " + options.microservice + " --type=merge -p " + strings.Replace(string(patch), " ", "\\u0020", -1)
+	info, ok := dvoc.RunOCCommand(cmdLine)
+	if !ok {
+		return errors.New("oc patch failed: " + strings.TrimSpace(info))
+	}
+	fmt.Printf("%s %s is stamped by %s %s\n", kind, options.microservice, gitInfo.Branch, gitInfo.Latest)
+	return nil
+}
+
+// writeGitStampScript writes the oc patch command for cmd or, for other extensions, for sh
+func writeGitStampScript(gitInfo *GitInfo, options *gitInfoOptions) error {
+	patch, err := createGitStampPatch(gitInfo)
+	if err != nil {
+		return err
+	}
+	kind := options.kind
+	if kind == "" {
+		kind = gitWorkloadKinds[0]
+	}
+	command := "oc patch " + kind + " " + options.microservice + " --type=merge -p "
+	var data string
+	if strings.ToLower(filepath.Ext(options.script)) == ".cmd" {
+		// json.Marshal already writes < > & as \u escapes, the other characters special to cmd are escaped the same way
+		escaped := strings.NewReplacer("\"", "\\\"", "|", "\\u007c", "^", "\\u005e", "%", "\\u0025").Replace(string(patch))
+		data = "@" + command + "\"" + escaped + "\"\r\n"
+	} else {
+		data = "#!/bin/sh\n" + command + "'" + strings.Replace(string(patch), "'", "'\\''", -1) + "'\n"
+	}
+	if err = ioutil.WriteFile(options.script, []byte(data), 0755); err != nil {
+		return err
+	}
+	fmt.Printf("The stamp of %s is saved in %s\n", options.microservice, options.script)
+	return nil
+}
+
+func setContainerEnv(container *dvjson.DvFieldInfo, name string, value string) {
+	env := container.ReadSimpleChild("env")
+	if env == nil {
+		env = &dvjson.DvFieldInfo{Kind: dvjson.FIELD_ARRAY, Name: []byte("env")}
+		container.AddField(env)
+	}
+	for _, item := range env.Fields {
+		if item == nil || item.ReadSimpleChildValue("name") != name {
+			continue
+		}
+		fields := make([]*dvjson.DvFieldInfo, 0, 2)
+		for _, field := range item.Fields {
+			if field != nil && string(field.Name) != "value" && string(field.Name) != "valueFrom" {
+				fields = append(fields, field)
+			}
+		}
+		item.Fields = fields
+		item.AddStringField("value", value)
+		return
+	}
+	item := dvjson.CreateDvFieldInfoObject()
+	item.AddStringField("name", name)
+	item.AddStringField("value", value)
+	env.AddField(item)
+}
+
+// injectGitInfoInObject sets the git properties as env of all containers of the workloads, the lists and templates included
+func injectGitInfoInObject(item *dvjson.DvFieldInfo, props []gitProperty) int {
+	if item == nil || item.Kind != dvjson.FIELD_OBJECT {
+		return 0
+	}
+	count := 0
+	for _, group := range []string{"objects", "items"} {
+		if children := item.ReadSimpleChild(group); children != nil && children.Kind == dvjson.FIELD_ARRAY {
+			for _, child := range children.Fields {
+				count += injectGitInfoInObject(child, props)
+			}
+		}
+	}
+	switch strings.ToLower(item.ReadSimpleChildValue("kind")) {
+	case "deploymentconfig", "deployment", "statefulset":
+	default:
+		return count
+	}
+	containers, err := item.ReadChild("spec.template.spec.containers", nil)
+	if err != nil || containers == nil {
+		return count
+	}
+	for _, container := range containers.Fields {
+		if container == nil {
+			continue
+		}
+		for _, p := range props {
+			setContainerEnv(container, p.name, p.value)
+		}
+		count++
+	}
+	return count
+}
+
+func splitTemplateDocuments(data []byte) []string {
+	lines := strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n")
+	docs := make([]string, 0, 1)
+	start := 0
+	for i, line := range lines {
+		if strings.TrimRight(line, " \t") == "---" {
+			docs = append(docs, strings.Join(lines[start:i], "\n"))
+			start = i + 1
+		}
+	}
+	return append(docs, strings.Join(lines[start:], "\n"))
+}
+
+// getLeadingYamlComments keeps the comments such as # Source: of helm template, which are lost when the yaml is printed
+func getLeadingYamlComments(doc string) string {
+	end := 0
+	for end < len(doc) {
+		p := strings.IndexByte(doc[end:], '\n')
+		line := doc[end:]
+		if p >= 0 {
+			line = doc[end : end+p+1]
+		}
+		if trimmed := strings.TrimSpace(line); trimmed != "" && trimmed[0] != '#' {
+			break
+		}
+		end += len(line)
+	}
+	return doc[:end]
+}
+
+// injectGitInfoInYaml stamps every document of the yaml (as helm template writes them), the documents
+// without workloads are written back as they are
+func injectGitInfoInYaml(data []byte, props []gitProperty) ([]byte, int, error) {
+	docs := splitTemplateDocuments(data)
+	count := 0
+	for i, doc := range docs {
+		if strings.TrimSpace(getLeadingYamlComments(doc)) == strings.TrimSpace(doc) {
+			continue
+		}
+		template, err := dvjson.ReadYamlAsDvFieldInfo([]byte(doc))
+		if err != nil || template == nil {
+			return nil, 0, fmt.Errorf("document %d: %v", i+1, err)
+		}
+		n := injectGitInfoInObject(template, props)
+		if n > 0 {
+			docs[i] = getLeadingYamlComments(doc) + strings.TrimRight(string(template.PrintToYaml(2)), "\n")
+			count += n
+		}
+	}
+	res := strings.Join(docs, "\n---\n")
+	if !strings.HasSuffix(res, "\n") {
+		res += "\n"
+	}
+	return []byte(res), count, nil
+}
+
+// injectGitInfoInTemplate rewrites the rendered template (json or yaml) with the git properties in the container env
+func injectGitInfoInTemplate(gitInfo *GitInfo, fileName string) error {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	count := 0
+	if dvjson.IsCurrentFormatJson(data) {
+		template, err := dvjson.ReadJsonAsDvFieldInfo(data)
+		if err != nil || template == nil {
+			return fmt.Errorf("cannot read %s: %v", fileName, err)
+		}
+		count = injectGitInfoInObject(template, gitInfo.properties())
+		data = template.PrintToJson(2)
+	} else if data, count, err = injectGitInfoInYaml(data, gitInfo.properties()); err != nil {
+		return fmt.Errorf("cannot read %s: %v", fileName, err)
+	}
+	if count == 0 {
+		return errors.New("no containers of DeploymentConfig, Deployment or StatefulSet in " + fileName)
+	}
+	if err = ioutil.WriteFile(fileName, data, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("Git properties are set in %d containers of %s\n", count, fileName)
+	return nil
+}
+
+// stampGitInfo stamps the template if it is specified, writes the script if it is specified,
+// and patches the live workload if neither is specified
+func stampGitInfo(gitInfo *GitInfo, options *gitInfoOptions) error {
+	if options.template != "" {
+		if err := injectGitInfoInTemplate(gitInfo, options.template); err != nil {
+			return err
+		}
+	}
+	if options.template != "" && options.script == "" {
+		return nil
+	}
+	if options.microservice == "" {
+		return errors.New("the microservice name is not known, specify --microservice")
+	}
+	if options.script != "" {
+		return writeGitStampScript(gitInfo, options)
+	}
+	return stampGitInfoInCluster(gitInfo, options)
+}
@@ -0,0 +1,118 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Dobryvechir/dvserver/src/dvjson"
+)
+
+// testHelmTemplate is the output of helm template with a Service, a Deployment and a StatefulSet
+const testHelmTemplate = `---
+# Source: app/templates/service.yaml
+apiVersion: v1
+kind: Service
+metadata:
+  name: app
+spec:
+  ports:
+  - port: 8080
+---
+# Source: app/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+spec:
+  template:
+    spec:
+      containers:
+      - name: app
+        image: registry.local/app:1.10
+        env:
+        - name: GIT_BRANCH
+          value: old
+      - name: proxy
+        image: registry.local/proxy:2.0
+---
+# Source: app/templates/statefulset.yaml
+apiVersion: apps/v1
+kind: StatefulSet
+metadata:
+  name: cache
+spec:
+  template:
+    spec:
+      containers:
+      - name: cache
+        image: registry.local/cache:7
+`
+
+func TestInjectGitInfoInMultiDocumentYaml(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "rendered.yaml")
+	if err := ioutil.WriteFile(fileName, []byte(testHelmTemplate), 0644); err != nil {
+		t.Fatal(err)
+	}
+	gitInfo := &GitInfo{Branch: "feature/ABC-12", Latest: "0c1d2e3f", LatestTime: "2024-01-02T03:04:05Z", LatestAuthor: "agent <agent@local>"}
+	if err := injectGitInfoInTemplate(gitInfo, fileName); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	docs := splitTemplateDocuments(data)
+	if len(docs) != 4 || docs[0] != "" {
+		t.Fatalf("%d documents are written:\n%s", len(docs), data)
+	}
+	if !strings.HasPrefix(docs[1], "# Source: app/templates/service.yaml\n") || !strings.Contains(testHelmTemplate, docs[1]) {
+		t.Errorf("the service is changed:\n%s", docs[1])
+	}
+	containers := 0
+	for i, kind := range []string{"Deployment", "StatefulSet"} {
+		doc := docs[i+2]
+		if !strings.HasPrefix(doc, "# Source: ") {
+			t.Errorf("the comment of the %s is lost:\n%s", kind, doc)
+		}
+		item, err := dvjson.ReadYamlAsDvFieldInfo([]byte(doc))
+		if err != nil || item.ReadSimpleChildValue("kind") != kind {
+			t.Fatalf("%s is written as %v:\n%s", kind, err, doc)
+		}
+		list, err := item.ReadChild("spec.template.spec.containers", nil)
+		if err != nil || list == nil {
+			t.Fatalf("no containers in the %s: %v", kind, err)
+		}
+		for _, container := range list.Fields {
+			containers++
+			values := make(map[string]string)
+			for _, env := range container.ReadSimpleChild("env").Fields {
+				values[env.ReadSimpleChildValue("name")] = env.ReadSimpleChildValue("value")
+			}
+			for _, p := range gitInfo.properties() {
+				if values[p.name] != p.value {
+					t.Errorf("%s of %s is %q", p.name, container.ReadSimpleChildValue("name"), values[p.name])
+				}
+			}
+			if len(values) != len(gitInfo.properties()) {
+				t.Errorf("env of %s is %v", container.ReadSimpleChildValue("name"), values)
+			}
+		}
+	}
+	if containers != 3 {
+		t.Errorf("%d containers are stamped instead of 3", containers)
+	}
+}
+
+func TestInjectGitInfoWithoutWorkloads(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "rendered.yaml")
+	if err := ioutil.WriteFile(fileName, []byte("kind: Service\nmetadata:\n  name: app\n---\nkind: ConfigMap\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := injectGitInfoInTemplate(&GitInfo{Branch: "master"}, fileName); err == nil {
+		t.Fatal("no error if the template has no workloads")
+	}
+}
@@ -3,75 +3,237 @@
 package main
 
 import (
-	"bufio"
 	"encoding/base64"
+	"errors"
 	"fmt"
-	"github.com/Dobryvechir/dvserver/src/dvlog"
+	"github.com/Dobryvechir/dvserver/src/dvjson"
 	"github.com/Dobryvechir/dvserver/src/dvparser"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 )
 
 var copyright = "Copyright by Danyil Dobryvechir 2019"
 
-func readCredentials(fileName string, pathName string) (user string, ps string) {
-	file, err := os.Open(fileName)
-	if err != nil {
-		panic("File " + fileName + " not found")
-	}
-	scanner := bufio.NewScanner(file)
-	passFileName := pathName + "/password"
-	_ = dvlog.EnsureDirForFileExists(passFileName)
-	var str []byte
-	for scanner.Scan() {
-		s := strings.Split(strings.TrimSpace(scanner.Text()), " ")
-		if len(s) == 2 {
-			switch s[0] {
-			case "password:":
-				str, err = base64.StdEncoding.DecodeString(s[1])
-				if err != nil {
-					fmt.Println("error: %v", err)
-					panic("Fatal error")
-				}
-				ps = string(str)
-				err = ioutil.WriteFile(passFileName, []byte(ps), 0644)
-				if err != nil {
-					fmt.Printf("Cannot write password file " + err.Error())
-				}
-				if user != "" {
-					return
-				}
-			case "username:":
-				str, err = base64.StdEncoding.DecodeString(s[1])
-				if err != nil {
-					fmt.Println("error: %v", err)
-					panic("Fatal error")
-				}
-				user = string(str)
-				err = ioutil.WriteFile(pathName+"/username", []byte(user), 0644)
-				if err != nil {
-					fmt.Printf("Cannot write user file " + err.Error())
-				}
-				if ps != "" {
-					return
-				}
+var help = copyright + "\nm2mcredentials [options] <credential file> <secret-path>\n" +
+	"the credential file is the output of `oc get secret -o yaml` or `-o json`, a list of secrets or several yaml documents;\n" +
+	"the user and the password are saved in <secret-path> as username and password readable by the owner only,\n" +
+	"for several secrets in <secret-path>/<secret name>; the secrets without the keys are skipped\n" +
+	"options:\n" +
+	"  --keys=<user key>,<password key> keys of the user and the password in the secret, property M2M_CREDENTIAL_KEYS\n" +
+	"                                   (default - username,password or, if they are absent, client_id,client_secret)"
+
+const (
+	credentialKeysProperty   = "M2M_CREDENTIAL_KEYS"
+	credentialUserFile       = "username"
+	credentialPasswordFile   = "password"
+	credentialFilePermission = 0600
+)
+
+var defaultCredentialKeys = [][]string{{"username", "password"}, {"client_id", "client_secret"}}
+
+type credential struct {
+	secretName string
+	user       string
+	password   string
+}
+
+func splitCredentialDocuments(data []byte) [][]byte {
+	lines := strings.Split(strings.Replace(string(data), "\r\n", "\n", -1), "\n")
+	docs := make([][]byte, 0, 1)
+	start := 0
+	for i, line := range lines {
+		if strings.TrimRight(line, " \t") == "---" {
+			docs = append(docs, []byte(strings.Join(lines[start:i], "\n")))
+			start = i + 1
+		}
+	}
+	return append(docs, []byte(strings.Join(lines[start:], "\n")))
+}
+
+// readSecretObjects reads the secrets from json or yaml, the lists are expanded into their items
+func readSecretObjects(data []byte) ([]*dvjson.DvFieldInfo, error) {
+	var docs []*dvjson.DvFieldInfo
+	if dvjson.IsCurrentFormatJson(data) {
+		item, err := dvjson.ReadJsonAsDvFieldInfo(data)
+		if err != nil {
+			return nil, err
+		}
+		docs = append(docs, item)
+	} else {
+		for _, doc := range splitCredentialDocuments(data) {
+			if strings.TrimSpace(string(doc)) == "" {
+				continue
 			}
+			item, err := dvjson.ReadYamlAsDvFieldInfo(doc)
+			if err != nil {
+				return nil, err
+			}
+			docs = append(docs, item)
+		}
+	}
+	secrets := make([]*dvjson.DvFieldInfo, 0, len(docs))
+	for len(docs) > 0 {
+		item := docs[0]
+		docs = docs[1:]
+		if item == nil || item.Kind != dvjson.FIELD_OBJECT {
+			continue
+		}
+		if items := item.ReadSimpleChild("items"); items != nil && items.Kind == dvjson.FIELD_ARRAY {
+			docs = append(docs, items.Fields...)
+			continue
 		}
+		secrets = append(secrets, item)
 	}
-	panic("Credential file " + fileName + " is wrong")
-	return
+	return secrets, nil
+}
+
+// readSecretValue takes the key from data decoding base64 or from stringData as is
+func readSecretValue(secret *dvjson.DvFieldInfo, key string) (string, bool, error) {
+	if data := secret.ReadSimpleChild("stringData"); data != nil && data.ReadSimpleChild(key) != nil {
+		return data.ReadSimpleChildValue(key), true, nil
+	}
+	data := secret.ReadSimpleChild("data")
+	if data == nil || data.ReadSimpleChild(key) == nil {
+		return "", false, nil
+	}
+	value, err := base64.StdEncoding.DecodeString(data.ReadSimpleChildValue(key))
+	if err != nil {
+		return "", true, fmt.Errorf("incorrect base64 of %s: %v", key, err)
+	}
+	return string(value), true, nil
+}
+
+// readCredential returns nil without an error if the secret has none of the key pairs
+func readCredential(secret *dvjson.DvFieldInfo, keySets [][]string) (*credential, error) {
+	name := secret.ReadChildStringValue("metadata.name")
+	for _, keys := range keySets {
+		user, userOk, err := readSecretValue(secret, keys[0])
+		if err != nil {
+			return nil, fmt.Errorf("secret %s: %v", name, err)
+		}
+		password, passwordOk, err := readSecretValue(secret, keys[1])
+		if err != nil {
+			return nil, fmt.Errorf("secret %s: %v", name, err)
+		}
+		if userOk && passwordOk {
+			return &credential{secretName: name, user: user, password: password}, nil
+		}
+	}
+	return nil, nil
+}
+
+func formatCredentialKeys(keySets [][]string) string {
+	list := make([]string, len(keySets))
+	for i, keys := range keySets {
+		list[i] = keys[0] + " and " + keys[1]
+	}
+	return strings.Join(list, " or ")
+}
+
+// readCredentials skips the secrets without the keys, such as the service account and registry secrets of
+// `oc get secret -o yaml`, and fails only if no secret has them
+func readCredentials(fileName string, keySets [][]string) ([]*credential, error) {
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	secrets, err := readSecretObjects(data)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read %s: %v", fileName, err)
+	}
+	if len(secrets) == 0 {
+		return nil, errors.New("no secrets in " + fileName)
+	}
+	credentials := make([]*credential, 0, len(secrets))
+	for _, secret := range secrets {
+		c, err := readCredential(secret, keySets)
+		if err != nil {
+			return nil, err
+		}
+		if c == nil {
+			fmt.Printf("# secret %s is skipped, it has no %s\n", secret.ReadChildStringValue("metadata.name"), formatCredentialKeys(keySets))
+			continue
+		}
+		credentials = append(credentials, c)
+	}
+	if len(credentials) == 0 {
+		return nil, fmt.Errorf("no secret in %s has %s", fileName, formatCredentialKeys(keySets))
+	}
+	return credentials, nil
+}
+
+func writeCredentialFile(fileName string, data string) error {
+	if err := ioutil.WriteFile(fileName, []byte(data), credentialFilePermission); err != nil {
+		return err
+	}
+	// the permissions of an existing file are not changed by WriteFile
+	return os.Chmod(fileName, credentialFilePermission)
+}
+
+func saveCredential(c *credential, pathName string) error {
+	if err := os.MkdirAll(pathName, 0700); err != nil {
+		return err
+	}
+	if err := writeCredentialFile(filepath.Join(pathName, credentialUserFile), c.user); err != nil {
+		return fmt.Errorf("cannot write user file: %v", err)
+	}
+	if err := writeCredentialFile(filepath.Join(pathName, credentialPasswordFile), c.password); err != nil {
+		return fmt.Errorf("cannot write password file: %v", err)
+	}
+	return nil
+}
+
+func readCredentialKeys(value string) ([][]string, error) {
+	keys := strings.Split(value, ",")
+	if len(keys) != 2 || strings.TrimSpace(keys[0]) == "" || strings.TrimSpace(keys[1]) == "" {
+		return nil, errors.New("keys must be specified as <user key>,<password key>: " + value)
+	}
+	return [][]string{{strings.TrimSpace(keys[0]), strings.TrimSpace(keys[1])}}, nil
 }
 
 func main() {
 	args := dvparser.InitAndReadCommandLine()
+	keySets := defaultCredentialKeys
+	var err error
+	if value := dvparser.GlobalProperties[credentialKeysProperty]; value != "" {
+		keySets, err = readCredentialKeys(value)
+	}
+	for err == nil && len(args) > 0 && strings.HasPrefix(args[0], "--keys=") {
+		keySets, err = readCredentialKeys(args[0][len("--keys="):])
+		args = args[1:]
+	}
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
 	l := len(args)
 	if l < 2 {
-		fmt.Println(copyright)
-		fmt.Println("m2mcredentials <credential file> <secret-path>")
+		fmt.Println(help)
 		return
 	}
 	m2mPath := args[1]
-	username, passwrd := readCredentials(args[0], m2mPath)
-	fmt.Printf("MICROSERVICE_USER=%s\nMICROSERVICE_PASS=%s\nMICROSERVICE_PATH=%s\n", username, passwrd, m2mPath)
+	credentials, err := readCredentials(args[0], keySets)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	for i, c := range credentials {
+		path := m2mPath
+		if len(credentials) > 1 {
+			name := c.secretName
+			if name == "" {
+				name = "secret" + strconv.Itoa(i+1)
+			}
+			path = filepath.Join(m2mPath, name)
+			fmt.Printf("# %s\n", name)
+		}
+		if err = saveCredential(c, path); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("MICROSERVICE_USER=%s\nMICROSERVICE_PASS=%s\nMICROSERVICE_PATH=%s\n", c.user, c.password, path)
+	}
 }
@@ -0,0 +1,74 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+// testSecretList is `oc get secret -o yaml` of a project, only app-credentials has the keys
+const testSecretList = `apiVersion: v1
+kind: List
+items:
+- apiVersion: v1
+  kind: Secret
+  metadata:
+    name: builder-token-x7k2p
+    annotations:
+      kubernetes.io/service-account.name: builder
+  type: kubernetes.io/service-account-token
+  data:
+    token: ZXlKaGJHY2lPaUpTVXpJMU5pSjkuZXlK
+    namespace: cHJvZA==
+- apiVersion: v1
+  kind: Secret
+  metadata:
+    name: default-dockercfg-9qz4w
+  type: kubernetes.io/dockercfg
+  data:
+    .dockercfg: e30=
+- apiVersion: v1
+  kind: Secret
+  metadata:
+    name: app-credentials
+  type: Opaque
+  data:
+    client_id: YXBw
+    client_secret: czNjcjN0
+metadata:
+  resourceVersion: ""
+`
+
+func writeTestCredentialFile(t *testing.T, data string) string {
+	fileName := filepath.Join(t.TempDir(), "secrets.yaml")
+	if err := ioutil.WriteFile(fileName, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return fileName
+}
+
+func TestReadCredentialsSkipsSecretsWithoutKeys(t *testing.T) {
+	credentials, err := readCredentials(writeTestCredentialFile(t, testSecretList), defaultCredentialKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(credentials) != 1 {
+		t.Fatalf("%d credentials are read instead of 1", len(credentials))
+	}
+	if c := credentials[0]; c.secretName != "app-credentials" || c.user != "app" || c.password != "s3cr3t" {
+		t.Fatalf("credential %+v", c)
+	}
+}
+
+func TestReadCredentialsFailsWithoutKeys(t *testing.T) {
+	fileName := writeTestCredentialFile(t, testSecretList)
+	if _, err := readCredentials(fileName, [][]string{{"user", "pass"}}); err == nil {
+		t.Fatal("no error if no secret has the keys")
+	}
+	fileName = writeTestCredentialFile(t, "kind: Secret\nmetadata:\n  name: broken\ndata:\n  username: YXBw\n  password: '%%%'\n")
+	if _, err := readCredentials(fileName, defaultCredentialKeys); err == nil {
+		t.Fatal("the incorrect base64 is not reported")
+	}
+}
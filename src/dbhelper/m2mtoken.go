@@ -3,15 +3,68 @@
 package main
 
 import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
-	"github.com/Dobryvechir/dvserver/src/dvnet"
 	"github.com/Dobryvechir/dvserver/src/dvparser"
 )
 
 var copyright = "Copyright by Danyil Dobryvechir 2019"
 
+var tlsOptions = &netTlsOptions{}
+
+const (
+	m2mGrantProperty      = "M2MTOKEN_GRANT"
+	m2mClientAuthProperty = "M2MTOKEN_CLIENT_AUTH"
+	m2mScopeProperty      = "M2MTOKEN_SCOPE"
+	m2mUserPathProperty   = "M2MTOKEN_USER_PATH"
+	m2mUsernameProperty   = "M2MTOKEN_USERNAME"
+	m2mPasswordProperty   = "M2MTOKEN_PASSWORD"
+	m2mJwksUrlProperty    = "M2MTOKEN_JWKS_URL"
+)
+
+const (
+	m2mGrantClientCredentials = "client_credentials"
+	m2mGrantPassword          = "password"
+	m2mGrantTokenExchange     = "token-exchange"
+	m2mGrantTypeTokenExchange = "urn:ietf:params:oauth:grant-type:token-exchange"
+	m2mTokenTypeAccessToken   = "urn:ietf:params:oauth:token-type:access_token"
+	m2mAuthPost               = "post"
+	m2mAuthBasic              = "basic"
+	m2mModeInspect            = "inspect"
+)
+
+// m2mTokenOutputFiles are the files in the secret path for the tokens of the grants
+var m2mTokenOutputFiles = map[string]string{
+	m2mGrantClientCredentials: "m2mtoken",
+	m2mGrantPassword:          "usertoken",
+	m2mGrantTokenExchange:     "exchangetoken",
+}
+
+type m2mTokenOptions struct {
+	grant        string
+	auth         string
+	scope        string
+	userPath     string
+	subjectToken string
+	audience     string
+	output       string
+	force        bool
+	verify       bool
+}
+
 type AccessToken struct {
 	AccessToken      string `json:"access_token"`
 	TokenType        string `json:"token_type"`
@@ -35,33 +88,325 @@ func readCredentials(secretPath string) (user string, pass string, err error) {
 	return
 }
 
-func writeToken(secretPath string, m2mToken string) error {
-	return ioutil.WriteFile(secretPath+"/m2mtoken", []byte(m2mToken), 0664)
+func writeToken(fileName string, m2mToken string) error {
+	return ioutil.WriteFile(fileName, []byte(m2mToken), 0600)
 }
 
-func getM2MToken(m2mTokenUrl string, username string, passwrd string) (string, error) {
-	body := map[string]string{"grant_type": "client_credentials",
-		"client_secret": passwrd,
-		"client_id":     username}
+// the token endpoint is asked persistently while the pods start, the refresh is tried once and then the grant is used
+const (
+	m2mTokenRepeats        = 50
+	m2mTokenRefreshRepeats = 1
+	m2mTokenRepeatPause    = 5 * time.Second
+)
+
+// tokenClient is the client of the token endpoint, it authenticates by client_secret_post or client_secret_basic
+type tokenClient struct {
+	url          string
+	clientId     string
+	clientSecret string
+	auth         string
+	scope        string
+}
+
+// requestAccessToken posts the grant by the client of the TLS options, so the server certificate is verified
+// unless --insecure is given; the connection errors and 5xx are repeated, the rejected grant is not
+func (client *tokenClient) requestAccessToken(body map[string]string, repeats int) (*AccessToken, error) {
 	headers := map[string]string{"cache-control": "no-cache", "Content-Type": "application/x-www-form-urlencoded"}
-	var accessToken AccessToken = AccessToken{}
-	err := dvnet.LoadStructFormUrlEncoded("POST", m2mTokenUrl, body, headers, &accessToken, dvnet.AveragePersistentOptions)
+	if client.auth == m2mAuthBasic {
+		// RFC 6749 2.3.1: the client id and secret are form-encoded before base64
+		credentials := url.QueryEscape(client.clientId) + ":" + url.QueryEscape(client.clientSecret)
+		headers["Authorization"] = "Basic " + base64.StdEncoding.EncodeToString([]byte(credentials))
+	} else {
+		body["client_id"] = client.clientId
+		body["client_secret"] = client.clientSecret
+	}
+	if client.scope != "" && body["grant_type"] != "refresh_token" {
+		body["scope"] = client.scope
+	}
+	for attempt := 1; ; attempt++ {
+		accessToken, retry, err := getM2MTokenThruNetClient(client.url, body, headers)
+		if err == nil || !retry || attempt >= repeats {
+			return accessToken, err
+		}
+		fmt.Printf("Attempt %d of %d to get the token failed: %v\n", attempt, repeats, err)
+		time.Sleep(m2mTokenRepeatPause)
+	}
+}
+
+func (client *tokenClient) getClientCredentialsToken() (*AccessToken, error) {
+	body := map[string]string{"grant_type": "client_credentials"}
+	return client.requestAccessToken(body, m2mTokenRepeats)
+}
+
+func (client *tokenClient) getPasswordToken(username string, passwrd string) (*AccessToken, error) {
+	body := map[string]string{"grant_type": "password",
+		"username": username,
+		"password": passwrd}
+	return client.requestAccessToken(body, m2mTokenRepeats)
+}
+
+// exchangeToken exchanges the subject token for the token of the audience (RFC 8693, as supported by Keycloak)
+func (client *tokenClient) exchangeToken(subjectToken string, audience string) (*AccessToken, error) {
+	body := map[string]string{"grant_type": m2mGrantTypeTokenExchange,
+		"subject_token":        subjectToken,
+		"subject_token_type":   m2mTokenTypeAccessToken,
+		"requested_token_type": m2mTokenTypeAccessToken}
+	if audience != "" {
+		body["audience"] = audience
+	}
+	return client.requestAccessToken(body, m2mTokenRepeats)
+}
+
+// refreshToken is tried once, a rejected refresh token falls back to the grant at once
+func (client *tokenClient) refreshToken(refreshToken string) (*AccessToken, error) {
+	body := map[string]string{"grant_type": "refresh_token",
+		"refresh_token": refreshToken}
+	return client.requestAccessToken(body, m2mTokenRefreshRepeats)
+}
+
+// getM2MTokenThruNetClient requests the token with the client certificate, CA bundle and proxy settings
+// getM2MTokenThruNetClient tells whether the error may pass if the request is repeated
+func getM2MTokenThruNetClient(m2mTokenUrl string, body map[string]string, headers map[string]string) (*AccessToken, bool, error) {
+	client, err := createNetClient(tlsOptions)
+	if err != nil {
+		return nil, false, err
+	}
+	form := url.Values{}
+	for k, v := range body {
+		form.Set(k, v)
+	}
+	request, err := http.NewRequest("POST", m2mTokenUrl, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, false, err
+	}
+	for k, v := range headers {
+		request.Header.Set(k, v)
+	}
+	response, err := client.Do(request)
+	if err != nil {
+		// the certificate will not become trusted by repeating
+		var unknownAuthority x509.UnknownAuthorityError
+		var hostnameErr x509.HostnameError
+		var invalidErr x509.CertificateInvalidError
+		if errors.As(err, &unknownAuthority) || errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) {
+			return nil, false, err
+		}
+		return nil, true, err
+	}
+	data, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return nil, true, err
+	}
+	if response.StatusCode >= 400 {
+		return nil, response.StatusCode >= 500, fmt.Errorf("status %d: %s", response.StatusCode, string(data))
+	}
+	accessToken := &AccessToken{}
+	if err = json.Unmarshal(data, accessToken); err != nil {
+		return nil, false, err
+	}
 	if accessToken.TokenType == "" || accessToken.AccessToken == "" {
-		dvnet.DvNetLog = true
-		err = dvnet.LoadStructFormUrlEncoded("POST", m2mTokenUrl, body, headers, &accessToken, dvnet.AveragePersistentOptions)
-		if accessToken.TokenType == "" || accessToken.AccessToken == "" {
-			panic("Fatal error")
+		return nil, false, fmt.Errorf("no token in the response: %s", string(data))
+	}
+	return accessToken, false, nil
+}
+
+func readM2MTokenOptions(args []string) (*m2mTokenOptions, []string, error) {
+	params := dvparser.GlobalProperties
+	options := &m2mTokenOptions{grant: m2mGrantClientCredentials, auth: m2mAuthPost}
+	if grant := params[m2mGrantProperty]; grant != "" {
+		options.grant = grant
+	}
+	if auth := params[m2mClientAuthProperty]; auth != "" {
+		options.auth = auth
+	}
+	options.scope = params[m2mScopeProperty]
+	rest := make([]string, 0, 2)
+	for _, arg := range args {
+		switch {
+		case readNetTlsOption(tlsOptions, arg):
+		case arg == "--force":
+			options.force = true
+		case arg == "--verify":
+			options.verify = true
+		case strings.HasPrefix(arg, "--grant="):
+			options.grant = arg[len("--grant="):]
+		case strings.HasPrefix(arg, "--auth="):
+			options.auth = arg[len("--auth="):]
+		case strings.HasPrefix(arg, "--scope="):
+			options.scope = arg[len("--scope="):]
+		case strings.HasPrefix(arg, "--user-path="):
+			options.userPath = arg[len("--user-path="):]
+		case strings.HasPrefix(arg, "--subject-token="):
+			options.subjectToken = arg[len("--subject-token="):]
+		case strings.HasPrefix(arg, "--audience="):
+			options.audience = arg[len("--audience="):]
+		case strings.HasPrefix(arg, "--output="):
+			options.output = arg[len("--output="):]
+		case strings.HasPrefix(arg, "--"):
+			return nil, nil, errors.New("unknown option " + arg)
+		default:
+			rest = append(rest, arg)
+		}
+	}
+	if _, ok := m2mTokenOutputFiles[options.grant]; !ok {
+		return nil, nil, errors.New("unsupported grant " + options.grant)
+	}
+	if options.auth != m2mAuthPost && options.auth != m2mAuthBasic {
+		return nil, nil, errors.New("unsupported client authentication " + options.auth)
+	}
+	return options, rest, nil
+}
+
+func getTokenOutputFile(secretPath string, options *m2mTokenOptions) string {
+	if options.output != "" {
+		return options.output
+	}
+	return filepath.Join(secretPath, m2mTokenOutputFiles[options.grant])
+}
+
+// readTokenValue takes the token as is, from @file or from the file of the secret path, the token type is removed
+func readTokenValue(source string, options *m2mTokenOptions) (string, error) {
+	fileName := ""
+	if strings.HasPrefix(source, "@") {
+		fileName = source[1:]
+	} else if info, err := os.Stat(source); err == nil && info.IsDir() {
+		fileName = getTokenOutputFile(source, options)
+	}
+	if fileName != "" {
+		data, err := ioutil.ReadFile(fileName)
+		if err != nil {
+			return "", err
+		}
+		source = string(data)
+	}
+	source = strings.TrimSpace(source)
+	if p := strings.LastIndex(source, " "); p >= 0 {
+		source = source[p+1:]
+	}
+	if source == "" {
+		return "", errors.New("the token is empty")
+	}
+	return source, nil
+}
+
+func readUserCredentials(options *m2mTokenOptions, params map[string]string) (string, string, error) {
+	userPath := options.userPath
+	if userPath == "" {
+		userPath = params[m2mUserPathProperty]
+	}
+	if userPath != "" {
+		return readCredentials(userPath)
+	}
+	if params[m2mUsernameProperty] == "" {
+		return "", "", errors.New("the user is defined neither by --user-path nor by " + m2mUserPathProperty + " or " + m2mUsernameProperty)
+	}
+	return params[m2mUsernameProperty], params[m2mPasswordProperty], nil
+}
+
+// shortTokenHash identifies the subject token in the cache without keeping it
+func shortTokenHash(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:8])
+}
+
+// obtainGrantToken gets the token of the grant from the cache, by the refresh token or by the grant itself;
+// the token exchange takes the client credentials token as the subject if --subject-token is not given
+func obtainGrantToken(client *tokenClient, secretPath string, options *m2mTokenOptions, params map[string]string) (*cachedToken, error) {
+	margin := getTokenExpiryMargin(params)
+	request := ""
+	if options.scope != "" {
+		request = "scope=" + options.scope
+	}
+	var grant func() (*AccessToken, error)
+	switch options.grant {
+	case m2mGrantClientCredentials:
+		grant = client.getClientCredentialsToken
+	case m2mGrantPassword:
+		username, passwrd, err := readUserCredentials(options, params)
+		if err != nil {
+			return nil, err
+		}
+		request += " user=" + username
+		grant = func() (*AccessToken, error) {
+			return client.getPasswordToken(username, passwrd)
+		}
+	case m2mGrantTokenExchange:
+		var subjectToken string
+		if options.subjectToken != "" {
+			token, err := readTokenValue(options.subjectToken, options)
+			if err != nil {
+				return nil, fmt.Errorf("cannot read the subject token: %v", err)
+			}
+			subjectToken = token
+		} else {
+			token, err := obtainCachedToken(createTokenCache(secretPath, m2mGrantClientCredentials, ""), false, margin,
+				client.refreshToken, client.getClientCredentialsToken)
+			if err != nil {
+				return nil, fmt.Errorf("cannot get the subject token: %v", err)
+			}
+			subjectToken = token.AccessToken.AccessToken
+		}
+		request += " audience=" + options.audience + " subject=" + shortTokenHash(subjectToken)
+		grant = func() (*AccessToken, error) {
+			return client.exchangeToken(subjectToken, options.audience)
 		}
 	}
-	return accessToken.TokenType + " " + accessToken.AccessToken, err
+	cache := createTokenCache(secretPath, options.grant, strings.TrimSpace(request))
+	return obtainCachedToken(cache, options.force, margin, client.refreshToken, grant)
+}
+
+func printM2MTokenHelp() {
+	fmt.Println(copyright)
+	fmt.Println("m2mtoken [options] <specific secret path>")
+	fmt.Println("m2mtoken [options] inspect <token | @file | specific secret path>")
+	fmt.Println("the client id and secret are read from username and password of the secret path, the token is requested from")
+	fmt.Println("M2MTOKEN_URL and saved in m2mtoken (usertoken for the password grant, exchangetoken for the token exchange);")
+	fmt.Println("the token is cached in <specific secret path>/token with its expiry and reused while it is valid, then it is")
+	fmt.Println("refreshed by refresh_token or requested anew; the cache is shared with dvoc.GetM2MToken (and so with the M2M_")
+	fmt.Println("authorization of dvnetwork) when the secret path is M2MTOKEN_PATH/<microservice>, the other grants are")
+	fmt.Println("cached in token-password and token-exchange;")
+	fmt.Println("M2MTOKEN_EXPIRY_MARGIN is the number of seconds before the expiry when the token is no longer used (default 30)")
+	fmt.Println("inspect prints the header and the claims of the JWT, its expiry in local time, the roles and the scopes")
+	fmt.Print("options:\n" + helpNetTlsOptions)
+	fmt.Println("  --force               request a new token ignoring the cache")
+	fmt.Println("  --grant=<grant>       client_credentials (default), password or token-exchange, property M2MTOKEN_GRANT")
+	fmt.Println("  --auth=<auth>         post (client_secret_post, default) or basic (client_secret_basic),")
+	fmt.Println("                        property M2MTOKEN_CLIENT_AUTH")
+	fmt.Println("  --scope=<scopes>      scopes separated by spaces, property M2MTOKEN_SCOPE")
+	fmt.Println("  --user-path=<folder>  username and password of the user for the password grant, property M2MTOKEN_USER_PATH")
+	fmt.Println("                        (default - properties M2MTOKEN_USERNAME and M2MTOKEN_PASSWORD)")
+	fmt.Println("  --subject-token=<token or @file> token to exchange (default - the client credentials token of the client)")
+	fmt.Println("  --audience=<client>   client the token is exchanged for")
+	fmt.Println("  --output=<file>       file for the token instead of m2mtoken, usertoken or exchangetoken")
+	fmt.Println("  --verify              inspect verifies the signature by the JWKS of the realm, property M2MTOKEN_JWKS_URL")
+	fmt.Println("                        (default - the certs endpoint next to M2MTOKEN_URL, the token issuer is not trusted)")
 }
 
 func main() {
 	args := dvparser.InitAndReadCommandLine()
+	options, args, err := readM2MTokenOptions(args)
+	if err != nil {
+		printM2MTokenHelp()
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	params := dvparser.GlobalProperties
+	tlsOptions.applyProperties(params)
+	if len(args) >= 1 && args[0] == m2mModeInspect {
+		if len(args) < 2 {
+			printM2MTokenHelp()
+			os.Exit(1)
+		}
+		if err = inspectToken(args[1], options, params); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
 	l := len(args)
 	if l < 1 {
-		fmt.Println(copyright)
-		fmt.Println("m2mtoken <specific secret path>")
+		printM2MTokenHelp()
 		return
 	}
 	secretPath := args[0]
@@ -69,16 +414,16 @@ func main() {
 	if err1 != nil {
 		panic("Secret path problems: " + secretPath + " : " + err1.Error())
 	}
-	params := dvparser.GlobalProperties
 	m2mTokenUrl := params["M2MTOKEN_URL"]
 	if m2mTokenUrl == "" {
 		panic("Parameter M2MTOKEN_URL is not defined in the properties")
 	}
-	m2mToken, err := getM2MToken(m2mTokenUrl, username, passwrd)
+	client := &tokenClient{url: m2mTokenUrl, clientId: username, clientSecret: passwrd, auth: options.auth, scope: options.scope}
+	token, err := obtainGrantToken(client, secretPath, options, params)
 	if err != nil {
 		panic("Fatal error: cannot get M2MToken: " + err.Error())
 	}
-	err = writeToken(secretPath, m2mToken)
+	err = writeToken(getTokenOutputFile(secretPath, options), token.authorization())
 	if err != nil {
 		panic("Fatal error: cannot write M2MToken: " + err.Error())
 	}
@@ -0,0 +1,116 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startTestTokenServer issues the token to the client id and secret by client_secret_post and counts the requests
+func startTestTokenServer(t *testing.T, certs *testCertificates, mutual bool, requests *int32) string {
+	server := startTestTlsServer(certs, mutual, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(requests, 1)
+		r.ParseForm()
+		if r.PostForm.Get("client_id") != "client" || r.PostForm.Get("client_secret") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"unauthorized_client"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"access_token":"token-` + r.PostForm.Get("grant_type") + `","token_type":"Bearer","expires_in":300}`))
+	}))
+	t.Cleanup(server.Close)
+	return server.URL + "/token"
+}
+
+func useTestTlsOptions(t *testing.T, options *netTlsOptions) {
+	saved := tlsOptions
+	tlsOptions = options
+	t.Cleanup(func() { tlsOptions = saved })
+}
+
+func TestTokenRequestVerifiesServer(t *testing.T) {
+	certs := createTestCertificates(t)
+	var requests int32
+	client := &tokenClient{url: startTestTokenServer(t, certs, false, &requests), clientId: "client", clientSecret: "secret", auth: m2mAuthPost}
+
+	useTestTlsOptions(t, &netTlsOptions{})
+	start := time.Now()
+	if _, err := client.getClientCredentialsToken(); err == nil {
+		t.Fatal("the token is requested from the server with the untrusted certificate")
+	}
+	if requests != 0 {
+		t.Fatal("the client secret is sent to the untrusted server")
+	}
+	if time.Since(start) >= m2mTokenRepeatPause {
+		t.Fatal("the untrusted certificate is repeated")
+	}
+
+	useTestTlsOptions(t, &netTlsOptions{caFile: certs.caFile})
+	token, err := client.getClientCredentialsToken()
+	if err != nil || token.AccessToken != "token-client_credentials" {
+		t.Fatalf("token %+v, error %v", token, err)
+	}
+
+	useTestTlsOptions(t, &netTlsOptions{insecure: true})
+	if _, err = client.getClientCredentialsToken(); err != nil {
+		t.Fatalf("--insecure does not skip the verification: %v", err)
+	}
+}
+
+func TestTokenRequestMutualTls(t *testing.T) {
+	certs := createTestCertificates(t)
+	var requests int32
+	client := &tokenClient{url: startTestTokenServer(t, certs, true, &requests), clientId: "client", clientSecret: "secret", auth: m2mAuthPost}
+	useTestTlsOptions(t, &netTlsOptions{caFile: certs.caFile, certFile: certs.clientFile, keyFile: certs.clientKey})
+	token, err := client.getPasswordToken("user", "pass")
+	if err != nil || token.AccessToken != "token-password" {
+		t.Fatalf("token %+v, error %v", token, err)
+	}
+}
+
+func TestTokenRequestRejectedGrantIsNotRepeated(t *testing.T) {
+	certs := createTestCertificates(t)
+	var requests int32
+	client := &tokenClient{url: startTestTokenServer(t, certs, false, &requests), clientId: "client", clientSecret: "wrong", auth: m2mAuthPost}
+	useTestTlsOptions(t, &netTlsOptions{caFile: certs.caFile})
+	if _, err := client.getClientCredentialsToken(); err == nil {
+		t.Fatal("the wrong secret is accepted")
+	}
+	if requests != 1 {
+		t.Fatalf("the rejected grant is sent %d times", requests)
+	}
+}
+
+func TestJwksUrlIsNotTakenFromIssuer(t *testing.T) {
+	var requests int32
+	issuer := startTestTlsServer(createTestCertificates(t), false, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer issuer.Close()
+	useTestTlsOptions(t, &netTlsOptions{insecure: true})
+	encode := base64.RawURLEncoding.EncodeToString
+	jwt, err := decodeJwt(encode([]byte(`{"alg":"RS256","kid":"k1"}`)) + "." + encode([]byte(`{"iss":"`+issuer.URL+`/realms/x"}`)) + ".c2ln")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = verifyJwt(jwt, map[string]string{}); err == nil || !strings.Contains(err.Error(), "cannot verify") {
+		t.Fatalf("the token without the configured JWKS is reported as %v", err)
+	}
+	if requests != 0 {
+		t.Fatal("the keys are requested from the issuer of the token")
+	}
+	params := map[string]string{"M2MTOKEN_URL": "https://sso/realms/x/protocol/openid-connect/token"}
+	if u, err := getJwksUrl(params); err != nil || u != "https://sso/realms/x/protocol/openid-connect/certs" {
+		t.Errorf("the certs endpoint next to the token one is %s %v", u, err)
+	}
+	params[m2mJwksUrlProperty] = "https://sso/certs"
+	if u, err := getJwksUrl(params); err != nil || u != "https://sso/certs" {
+		t.Errorf("%s is taken instead of %s: %v", u, m2mJwksUrlProperty, err)
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+const (
+	// tokenCacheFile is the file of dvoc.GetM2MToken when the secret path is M2MTOKEN_PATH/<microservice>
+	tokenCacheFile            = "token"
+	tokenExpiryMarginProperty = "M2MTOKEN_EXPIRY_MARGIN"
+	tokenDefaultExpiryMargin  = 30 * time.Second
+)
+
+// cachedToken keeps the token response with the time it was obtained, the other tools read only the token fields;
+// request identifies the user, the audience and the scope the token was obtained for
+type cachedToken struct {
+	AccessToken
+	ObtainedAt int64  `json:"obtained_at"`
+	Request    string `json:"request,omitempty"`
+}
+
+// tokenCache is the cache file of one grant, the token of another request is not reused
+type tokenCache struct {
+	fileName string
+	request  string
+}
+
+// tokenCacheFiles are the cache files of the grants in the secret path
+var tokenCacheFiles = map[string]string{
+	m2mGrantClientCredentials: tokenCacheFile,
+	m2mGrantPassword:          "token-password",
+	m2mGrantTokenExchange:     "token-exchange",
+}
+
+func createTokenCache(secretPath string, grant string, request string) *tokenCache {
+	return &tokenCache{fileName: filepath.Join(secretPath, tokenCacheFiles[grant]), request: request}
+}
+
+func getTokenExpiryMargin(params map[string]string) time.Duration {
+	if seconds, err := strconv.Atoi(params[tokenExpiryMarginProperty]); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	return tokenDefaultExpiryMargin
+}
+
+func (token *cachedToken) obtained() time.Time {
+	return time.Unix(token.ObtainedAt, 0)
+}
+
+func (token *cachedToken) isValid(margin time.Duration) bool {
+	if token.AccessToken.AccessToken == "" || token.ExpiresIn <= 0 {
+		return false
+	}
+	return time.Now().Add(margin).Before(token.obtained().Add(time.Duration(token.ExpiresIn) * time.Second))
+}
+
+// canRefresh tells whether the refresh token is still valid, refresh_expires_in of 0 means no known expiry
+func (token *cachedToken) canRefresh(margin time.Duration) bool {
+	if token.RefreshToken == "" {
+		return false
+	}
+	if token.RefreshExpiresIn <= 0 {
+		return true
+	}
+	return time.Now().Add(margin).Before(token.obtained().Add(time.Duration(token.RefreshExpiresIn) * time.Second))
+}
+
+func (token *cachedToken) authorization() string {
+	return token.TokenType + " " + token.AccessToken.AccessToken
+}
+
+// readCachedToken reads the cached token, the tokens cached by dvoc have no obtained_at, so the file time is taken
+func readCachedToken(cache *tokenCache) *cachedToken {
+	fileName := cache.fileName
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return nil
+	}
+	data, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil
+	}
+	token := &cachedToken{}
+	if err = json.Unmarshal(data, token); err != nil || token.AccessToken.AccessToken == "" || token.Request != cache.request {
+		return nil
+	}
+	if token.ObtainedAt == 0 {
+		token.ObtainedAt = info.ModTime().Unix()
+	}
+	return token
+}
+
+func saveCachedToken(cache *tokenCache, accessToken *AccessToken, obtained time.Time) (*cachedToken, error) {
+	token := &cachedToken{AccessToken: *accessToken, ObtainedAt: obtained.Unix(), Request: cache.request}
+	data, err := json.Marshal(token)
+	if err != nil {
+		return nil, err
+	}
+	fileName := cache.fileName
+	if err = ioutil.WriteFile(fileName, data, 0600); err != nil {
+		return nil, err
+	}
+	return token, os.Chmod(fileName, 0600)
+}
+
+// obtainCachedToken returns the cached token while it is valid, otherwise it is refreshed or, failing that,
+// requested anew by the grant
+func obtainCachedToken(cache *tokenCache, force bool, margin time.Duration, refresh func(refreshToken string) (*AccessToken, error), grant func() (*AccessToken, error)) (*cachedToken, error) {
+	cached := readCachedToken(cache)
+	if cached != nil && !force {
+		if cached.isValid(margin) {
+			return cached, nil
+		}
+		if cached.canRefresh(margin) {
+			obtained := time.Now()
+			accessToken, err := refresh(cached.RefreshToken)
+			if err == nil {
+				return saveCachedToken(cache, accessToken, obtained)
+			}
+			fmt.Printf("Refresh token is not accepted, a new token is requested: %v\n", err)
+		}
+	}
+	obtained := time.Now()
+	accessToken, err := grant()
+	if err != nil {
+		return nil, err
+	}
+	return saveCachedToken(cache, accessToken, obtained)
+}
@@ -0,0 +1,164 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// testTokenSource counts the grant and refresh requests of obtainCachedToken
+type testTokenSource struct {
+	grants        int
+	refreshes     int
+	refreshTokens []string
+	refreshErr    error
+}
+
+func (source *testTokenSource) grant() (*AccessToken, error) {
+	source.grants++
+	return &AccessToken{AccessToken: "granted", TokenType: "Bearer", ExpiresIn: 300, RefreshToken: "refresh-2", RefreshExpiresIn: 1800}, nil
+}
+
+func (source *testTokenSource) refresh(refreshToken string) (*AccessToken, error) {
+	source.refreshes++
+	source.refreshTokens = append(source.refreshTokens, refreshToken)
+	if source.refreshErr != nil {
+		return nil, source.refreshErr
+	}
+	return &AccessToken{AccessToken: "refreshed", TokenType: "Bearer", ExpiresIn: 300, RefreshToken: "refresh-3", RefreshExpiresIn: 1800}, nil
+}
+
+func (source *testTokenSource) obtain(t *testing.T, cache *tokenCache, force bool, margin time.Duration) string {
+	token, err := obtainCachedToken(cache, force, margin, source.refresh, source.grant)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token.AccessToken.AccessToken
+}
+
+// writeTestCachedToken caches the token obtained the given time ago
+func writeTestCachedToken(t *testing.T, cache *tokenCache, token *AccessToken, age time.Duration) {
+	if _, err := saveCachedToken(cache, token, time.Now().Add(-age)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCachedTokenIsReused(t *testing.T) {
+	cache := createTokenCache(t.TempDir(), m2mGrantClientCredentials, "")
+	source := &testTokenSource{}
+	if token := source.obtain(t, cache, false, tokenDefaultExpiryMargin); token != "granted" || source.grants != 1 {
+		t.Fatalf("%s after %d grants", token, source.grants)
+	}
+	if token := source.obtain(t, cache, false, tokenDefaultExpiryMargin); token != "granted" || source.grants != 1 || source.refreshes != 0 {
+		t.Errorf("the valid token is not reused: %s after %d grants and %d refreshes", token, source.grants, source.refreshes)
+	}
+	if source.obtain(t, cache, true, tokenDefaultExpiryMargin); source.grants != 2 || source.refreshes != 0 {
+		t.Errorf("--force gives %d grants and %d refreshes", source.grants, source.refreshes)
+	}
+	info, err := os.Stat(cache.fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+		t.Errorf("the cache file has mode %v", info.Mode().Perm())
+	}
+}
+
+func TestCachedTokenExpiryMargin(t *testing.T) {
+	cache := createTokenCache(t.TempDir(), m2mGrantClientCredentials, "")
+	// 50 seconds of the token are left
+	writeTestCachedToken(t, cache, &AccessToken{AccessToken: "cached", TokenType: "Bearer", ExpiresIn: 300}, 250*time.Second)
+	source := &testTokenSource{}
+	if token := source.obtain(t, cache, false, 30*time.Second); token != "cached" || source.grants != 0 {
+		t.Errorf("the token is not reused within the margin of 30s: %s", token)
+	}
+	if token := source.obtain(t, cache, false, 60*time.Second); token != "granted" || source.grants != 1 {
+		t.Errorf("the token is reused within the margin of 60s: %s", token)
+	}
+	for value, expected := range map[string]time.Duration{"": tokenDefaultExpiryMargin, "0": 0, "90": 90 * time.Second, "-5": tokenDefaultExpiryMargin, "x": tokenDefaultExpiryMargin} {
+		if margin := getTokenExpiryMargin(map[string]string{tokenExpiryMarginProperty: value}); margin != expected {
+			t.Errorf("%s=%q gives %s instead of %s", tokenExpiryMarginProperty, value, margin, expected)
+		}
+	}
+}
+
+func TestCachedTokenIsRefreshedBeforeGrant(t *testing.T) {
+	cache := createTokenCache(t.TempDir(), m2mGrantPassword, "user=alice")
+	expired := &AccessToken{AccessToken: "expired", TokenType: "Bearer", ExpiresIn: 300, RefreshToken: "refresh-1", RefreshExpiresIn: 1800}
+	writeTestCachedToken(t, cache, expired, 400*time.Second)
+	source := &testTokenSource{}
+	if token := source.obtain(t, cache, false, tokenDefaultExpiryMargin); token != "refreshed" || source.grants != 0 || source.refreshes != 1 ||
+		source.refreshTokens[0] != "refresh-1" {
+		t.Fatalf("%s after %d grants and refreshes by %v", token, source.grants, source.refreshTokens)
+	}
+	if cached := readCachedToken(cache); cached == nil || cached.RefreshToken != "refresh-3" || cached.Request != "user=alice" {
+		t.Errorf("the refreshed token is cached as %+v", cached)
+	}
+
+	writeTestCachedToken(t, cache, expired, 400*time.Second)
+	source = &testTokenSource{refreshErr: errors.New("invalid_grant")}
+	if token := source.obtain(t, cache, false, tokenDefaultExpiryMargin); token != "granted" || source.refreshes != 1 || source.grants != 1 {
+		t.Errorf("the rejected refresh gives %s after %d refreshes and %d grants", token, source.refreshes, source.grants)
+	}
+
+	// the refresh token has expired too
+	writeTestCachedToken(t, cache, expired, 2000*time.Second)
+	source = &testTokenSource{}
+	if token := source.obtain(t, cache, false, tokenDefaultExpiryMargin); token != "granted" || source.refreshes != 0 {
+		t.Errorf("the expired refresh token is used: %s after %d refreshes", token, source.refreshes)
+	}
+}
+
+func TestCachedTokenOfAnotherRequestIsIgnored(t *testing.T) {
+	folder := t.TempDir()
+	writeTestCachedToken(t, createTokenCache(folder, m2mGrantPassword, "user=alice"),
+		&AccessToken{AccessToken: "alice", TokenType: "Bearer", ExpiresIn: 300, RefreshToken: "refresh-alice"}, 0)
+	cache := createTokenCache(folder, m2mGrantPassword, "user=bob")
+	if cached := readCachedToken(cache); cached != nil {
+		t.Fatalf("the token of alice is read for bob: %+v", cached)
+	}
+	source := &testTokenSource{}
+	if token := source.obtain(t, cache, false, tokenDefaultExpiryMargin); token != "granted" || source.refreshes != 0 {
+		t.Errorf("%s after refreshes by %v", token, source.refreshTokens)
+	}
+	if cached := readCachedToken(createTokenCache(folder, m2mGrantClientCredentials, "user=bob")); cached != nil {
+		t.Error("the password grant token is read from the client credentials cache")
+	}
+}
+
+func TestCachedTokenOfDvoc(t *testing.T) {
+	cache := createTokenCache(t.TempDir(), m2mGrantClientCredentials, "")
+	// dvoc.GetM2MToken saves the token response as it is
+	data := `{"access_token":"dvoc","expires_in":300,"refresh_expires_in":0,"token_type":"Bearer","not-before-policy":0,"scope":"profile"}`
+	if err := ioutil.WriteFile(cache.fileName, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	modified := time.Now().Add(-100 * time.Second)
+	if err := os.Chtimes(cache.fileName, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	cached := readCachedToken(cache)
+	if cached == nil || cached.ObtainedAt != modified.Unix() || !cached.isValid(tokenDefaultExpiryMargin) || cached.authorization() != "Bearer dvoc" {
+		t.Fatalf("the token of dvoc is read as %+v", cached)
+	}
+	source := &testTokenSource{}
+	if token := source.obtain(t, cache, false, tokenDefaultExpiryMargin); token != "dvoc" || source.grants != 0 {
+		t.Errorf("the token of dvoc is not reused: %s", token)
+	}
+
+	modified = time.Now().Add(-400 * time.Second)
+	if err := ioutil.WriteFile(cache.fileName, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(cache.fileName, modified, modified); err != nil {
+		t.Fatal(err)
+	}
+	if token := source.obtain(t, cache, false, tokenDefaultExpiryMargin); token != "granted" || source.grants != 1 || source.refreshes != 0 {
+		t.Errorf("the expired token of dvoc gives %s after %d grants and %d refreshes", token, source.grants, source.refreshes)
+	}
+}
@@ -0,0 +1,371 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"sort"
+	"strings"
+	"time"
+)
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jsonWebKeySet struct {
+	Keys []*jsonWebKey `json:"keys"`
+}
+
+// jwtToken is the decoded token, the signature is verified over signed
+type jwtToken struct {
+	header    *jwtHeader
+	rawHeader []byte
+	claims    map[string]interface{}
+	rawClaims []byte
+	signed    string
+	signature []byte
+}
+
+func decodeJwtPart(part string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(part, "="))
+}
+
+func decodeJwt(token string) (*jwtToken, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("JWT must have 3 parts, but it has %d", len(parts))
+	}
+	jwt := &jwtToken{header: &jwtHeader{}, signed: parts[0] + "." + parts[1]}
+	var err error
+	if jwt.rawHeader, err = decodeJwtPart(parts[0]); err != nil {
+		return nil, fmt.Errorf("incorrect JWT header: %v", err)
+	}
+	if err = json.Unmarshal(jwt.rawHeader, jwt.header); err != nil {
+		return nil, fmt.Errorf("incorrect JWT header: %v", err)
+	}
+	if jwt.rawClaims, err = decodeJwtPart(parts[1]); err != nil {
+		return nil, fmt.Errorf("incorrect JWT claims: %v", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(jwt.rawClaims))
+	decoder.UseNumber()
+	if err = decoder.Decode(&jwt.claims); err != nil {
+		return nil, fmt.Errorf("incorrect JWT claims: %v", err)
+	}
+	if jwt.signature, err = decodeJwtPart(parts[2]); err != nil {
+		return nil, fmt.Errorf("incorrect JWT signature: %v", err)
+	}
+	return jwt, nil
+}
+
+func (jwt *jwtToken) claimString(name string) string {
+	if s, ok := jwt.claims[name].(string); ok {
+		return s
+	}
+	return ""
+}
+
+// claimStrings reads the claim that is either a string or an array of strings
+func claimStrings(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		list := make([]string, 0, len(v))
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				list = append(list, s)
+			}
+		}
+		return list
+	}
+	return nil
+}
+
+func (jwt *jwtToken) claimTime(name string) (time.Time, bool) {
+	if n, ok := jwt.claims[name].(json.Number); ok {
+		if seconds, err := n.Int64(); err == nil {
+			return time.Unix(seconds, 0), true
+		}
+		if seconds, err := n.Float64(); err == nil {
+			return time.Unix(int64(seconds), 0), true
+		}
+	}
+	return time.Time{}, false
+}
+
+func formatJwtJson(data []byte) string {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, data, "", "  "); err != nil {
+		return string(data)
+	}
+	return buf.String()
+}
+
+func describeExpiry(expiry time.Time) string {
+	left := time.Until(expiry).Round(time.Second)
+	if left <= 0 {
+		return "expired " + (-left).String() + " ago"
+	}
+	return "valid for " + left.String()
+}
+
+// printJwt prints the header, the claims and the summary used to debug the authorization failures
+func printJwt(jwt *jwtToken) {
+	fmt.Printf("Header:\n%s\n", formatJwtJson(jwt.rawHeader))
+	fmt.Printf("Claims:\n%s\n", formatJwtJson(jwt.rawClaims))
+	for _, claim := range []string{"iss", "sub", "azp", "preferred_username"} {
+		if s := jwt.claimString(claim); s != "" {
+			fmt.Printf("%-19s %s\n", claim+":", s)
+		}
+	}
+	if audience := claimStrings(jwt.claims["aud"]); len(audience) > 0 {
+		fmt.Printf("%-19s %s\n", "aud:", strings.Join(audience, ", "))
+	}
+	now := time.Now()
+	if t, ok := jwt.claimTime("iat"); ok {
+		fmt.Printf("%-19s %s\n", "issued at:", t.Local().Format(time.RFC3339))
+	}
+	if t, ok := jwt.claimTime("nbf"); ok && t.After(now) {
+		fmt.Printf("%-19s %s (not valid yet)\n", "not before:", t.Local().Format(time.RFC3339))
+	}
+	if t, ok := jwt.claimTime("exp"); ok {
+		fmt.Printf("%-19s %s (%s)\n", "expires at:", t.Local().Format(time.RFC3339), describeExpiry(t))
+	} else {
+		fmt.Printf("%-19s never\n", "expires at:")
+	}
+	if realm, ok := jwt.claims["realm_access"].(map[string]interface{}); ok {
+		fmt.Printf("%-19s %s\n", "realm roles:", strings.Join(claimStrings(realm["roles"]), ", "))
+	}
+	if resources, ok := jwt.claims["resource_access"].(map[string]interface{}); ok {
+		clients := make([]string, 0, len(resources))
+		for client := range resources {
+			clients = append(clients, client)
+		}
+		sort.Strings(clients)
+		for _, client := range clients {
+			if access, ok := resources[client].(map[string]interface{}); ok {
+				fmt.Printf("%-19s %s\n", "roles of "+client+":", strings.Join(claimStrings(access["roles"]), ", "))
+			}
+		}
+	}
+	scopes := jwt.claimString("scope")
+	if scopes == "" {
+		scopes = strings.Join(claimStrings(jwt.claims["scp"]), " ")
+	}
+	if scopes != "" {
+		fmt.Printf("%-19s %s\n", "scopes:", strings.Join(strings.Fields(scopes), ", "))
+	}
+}
+
+// getJwksUrl takes M2MTOKEN_JWKS_URL or the Keycloak certs endpoint next to M2MTOKEN_URL; the issuer of the token
+// is never used, because a forged token would name the issuer with the keys it is signed by
+func getJwksUrl(params map[string]string) (string, error) {
+	if jwksUrl := params[m2mJwksUrlProperty]; jwksUrl != "" {
+		return jwksUrl, nil
+	}
+	if tokenUrl := strings.TrimRight(params["M2MTOKEN_URL"], "/"); strings.HasSuffix(tokenUrl, "/token") {
+		return tokenUrl[:len(tokenUrl)-len("token")] + "certs", nil
+	}
+	return "", errors.New("cannot verify the signature: " + m2mJwksUrlProperty + " is not defined and M2MTOKEN_URL is not a token endpoint")
+}
+
+func readJsonWebKeySet(jwksUrl string) (*jsonWebKeySet, error) {
+	client, err := createNetClient(tlsOptions)
+	if err != nil {
+		return nil, err
+	}
+	response, err := client.Get(jwksUrl)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode >= 400 {
+		return nil, fmt.Errorf("%s returned %d", jwksUrl, response.StatusCode)
+	}
+	keySet := &jsonWebKeySet{}
+	if err = json.Unmarshal(data, keySet); err != nil {
+		return nil, fmt.Errorf("incorrect JWKS of %s: %v", jwksUrl, err)
+	}
+	return keySet, nil
+}
+
+func decodeJwkNumber(s string) (*big.Int, error) {
+	data, err := decodeJwtPart(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(data), nil
+}
+
+func (key *jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch key.Kty {
+	case "RSA":
+		n, err := decodeJwkNumber(key.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeJwkNumber(key.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch key.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, errors.New("unsupported curve " + key.Crv)
+		}
+		x, err := decodeJwkNumber(key.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeJwkNumber(key.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, errors.New("unsupported key type " + key.Kty)
+}
+
+func getJwtHash(alg string) (crypto.Hash, error) {
+	if len(alg) == 5 {
+		switch alg[2:] {
+		case "256":
+			return crypto.SHA256, nil
+		case "384":
+			return crypto.SHA384, nil
+		case "512":
+			return crypto.SHA512, nil
+		}
+	}
+	return 0, errors.New("unsupported algorithm " + alg)
+}
+
+func verifyJwtSignature(jwt *jwtToken, key crypto.PublicKey) error {
+	alg := jwt.header.Alg
+	hash, err := getJwtHash(alg)
+	if err != nil {
+		return err
+	}
+	h := hash.New()
+	h.Write([]byte(jwt.signed))
+	digest := h.Sum(nil)
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			return rsa.VerifyPKCS1v15(pub, hash, digest, jwt.signature)
+		case "PS":
+			return rsa.VerifyPSS(pub, hash, digest, jwt.signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		}
+	case *ecdsa.PublicKey:
+		if alg[:2] == "ES" {
+			size := (pub.Curve.Params().BitSize + 7) / 8
+			if len(jwt.signature) != 2*size {
+				return errors.New("incorrect length of the ECDSA signature")
+			}
+			r := new(big.Int).SetBytes(jwt.signature[:size])
+			s := new(big.Int).SetBytes(jwt.signature[size:])
+			if !ecdsa.Verify(pub, digest, r, s) {
+				return errors.New("ECDSA verification failed")
+			}
+			return nil
+		}
+	}
+	return errors.New("the key does not match the algorithm " + alg)
+}
+
+// verifyJwt checks the signature by the key of the same kid or, without kid, by any key of the type
+func verifyJwt(jwt *jwtToken, params map[string]string) (string, error) {
+	if jwt.header.Alg == "" || jwt.header.Alg == "none" || strings.HasPrefix(jwt.header.Alg, "HS") {
+		return "", errors.New("the signature " + jwt.header.Alg + " cannot be verified by JWKS")
+	}
+	jwksUrl, err := getJwksUrl(params)
+	if err != nil {
+		return "", err
+	}
+	keySet, err := readJsonWebKeySet(jwksUrl)
+	if err != nil {
+		return "", err
+	}
+	tried := 0
+	var lastErr error
+	for _, key := range keySet.Keys {
+		if key == nil || key.Use == "enc" || jwt.header.Kid != "" && key.Kid != jwt.header.Kid {
+			continue
+		}
+		pub, err := key.publicKey()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		tried++
+		if lastErr = verifyJwtSignature(jwt, pub); lastErr == nil {
+			return key.Kid, nil
+		}
+	}
+	if tried == 0 {
+		return "", fmt.Errorf("no key %s in %s", jwt.header.Kid, jwksUrl)
+	}
+	return "", fmt.Errorf("the signature is not valid: %v", lastErr)
+}
+
+func inspectToken(source string, options *m2mTokenOptions, params map[string]string) error {
+	token, err := readTokenValue(source, options)
+	if err != nil {
+		return err
+	}
+	jwt, err := decodeJwt(token)
+	if err != nil {
+		return err
+	}
+	printJwt(jwt)
+	if !options.verify {
+		return nil
+	}
+	kid, err := verifyJwt(jwt, params)
+	if err != nil {
+		fmt.Printf("%-19s NOT VERIFIED\n", "signature:")
+		return err
+	}
+	fmt.Printf("%-19s verified by %s key %s\n", "signature:", jwt.header.Alg, kid)
+	return nil
+}
@@ -7,29 +7,34 @@ import (
 	"github.com/Dobryvechir/dvserver/src/dvoc"
 	"github.com/Dobryvechir/dvserver/src/dvparser"
 	"io/ioutil"
+	"os"
+	"strings"
 )
 
 const (
 	ocDbaaSCopyRight = "Copyright by Danyil Dobryvechir 2019"
-	ocDbaaSHelp      = "ocdbaas <microservice name> <tenant or - if none> <p = postgres or m=mongodb (default)> <output file>"
+	ocDbaaSHelp      = "ocdbaas [--format=<format>] [--check] [TLS options] <microservice name> <tenant or - if none> <database type, mongodb by default> <output file>"
 )
 
-func presentDbProperties(microServiceName string, m2mToken string, tenantId string, database string, output string) {
+// tlsOptions verify the database servers of --check, the proxy options apply only to ClickHouse and OpenSearch over HTTP
+var tlsOptions = &netTlsOptions{}
+
+func presentDbProperties(microServiceName string, m2mToken string, tenantId string, database string, format string, output string) *dbEndpoint {
 	dbaasInfo, err := dvoc.GetDbaasProperties(microServiceName, m2mToken, database, tenantId)
 	if err != nil {
 		fmt.Printf("Fatal error: %v", err)
-		return
+		return nil
+	}
+	endpoint := createDbEndpoint(&dbaasInfo.ConnectionProperties, database, microServiceName)
+	info, err := formatDbEndpoint(endpoint, format)
+	if err != nil {
+		fmt.Printf("Fatal error: %v", err)
+		return nil
 	}
-	info := fmt.Sprintf("HOST=%s\nPORT=%d\nURL=%s\nDB=%s\nUSERNAME=%s\nPASSWORD=%s\n",
-		dbaasInfo.ConnectionProperties.Host,
-		dbaasInfo.ConnectionProperties.Port,
-		dbaasInfo.ConnectionProperties.Url,
-		dbaasInfo.ConnectionProperties.DbName,
-		dbaasInfo.ConnectionProperties.UserName,
-		dbaasInfo.ConnectionProperties.Password)
 
 	if output != "" {
-		err = ioutil.WriteFile(output, []byte(info), 0644)
+		// the connection has the password, .pgpass is also ignored by libpq if others can read it
+		err = ioutil.WriteFile(output, []byte(info), 0600)
 		if err != nil {
 			fmt.Println(info)
 			fmt.Printf("Error in %s saving: %v", output, err)
@@ -37,15 +42,52 @@ func presentDbProperties(microServiceName string, m2mToken string, tenantId stri
 	} else {
 		fmt.Println(info)
 	}
+	return endpoint
+}
+
+// checkDbConnection exits with 1 if the database cannot be reached with the credentials of DBaaS
+func checkDbConnection(endpoint *dbEndpoint) {
+	fmt.Printf("Connection check of %s at %s:%d ", endpoint.database, endpoint.host, endpoint.port)
+	info, err := checkDbEndpoint(endpoint)
+	if err != nil {
+		fmt.Printf("failed: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("OK: %s\n", info)
 }
 
 func main() {
 	args := dvparser.InitAndReadCommandLine()
 	dvoc.OpenShiftAddRoutesTOBeExposed("dbaas-agent")
+	format := dbFormatEnv
+	check := false
+	for len(args) > 0 && strings.HasPrefix(args[0], "--") {
+		if args[0] == "--check" {
+			check = true
+		} else if strings.HasPrefix(args[0], "--format=") {
+			format = strings.ToLower(args[0][len("--format="):])
+		} else if !readNetTlsOption(tlsOptions, args[0]) {
+			fmt.Printf("Unknown option %s", args[0])
+			return
+		}
+		args = args[1:]
+	}
 	l := len(args)
 	if l < 2 {
 		fmt.Println(ocDbaaSCopyRight)
 		fmt.Println(ocDbaaSHelp)
+		fmt.Println("Database types: " + listDbTypes())
+		fmt.Println(ocDbaaSFormatHelp)
+		fmt.Println("--check connects to the database and authenticates, the exit code is 1 if it fails; TLS is used as sslmode")
+		fmt.Println("        of the url says (require, verify-ca and verify-full need it, prefer and allow use it if the server has it),")
+		fmt.Println("        for tls=true or ssl=true, rediss:// and the ClickHouse port 9440, the certificates are verified unless --insecure")
+		fmt.Println("TLS options:")
+		fmt.Print(helpNetTlsOptions)
+		return
+	}
+	tlsOptions.applyProperties(dvparser.GlobalProperties)
+	if _, ok := dbFormatters[format]; !ok {
+		fmt.Printf("Unknown format %s, the formats are %s", format, listDbFormats())
 		return
 	}
 	microServiceName := args[0]
@@ -55,15 +97,12 @@ func main() {
 	}
 	database := dvoc.OcMongoDb
 	if l > 2 {
-		s := args[2]
-		switch s[0] {
-		case 'p':
-			database = dvoc.OcPostgreSql
-		case 'm':
-		default:
-			fmt.Printf("3rd parameter must be either p (postgresql) or m (mongodb) but not %s", s)
+		t := findDbType(args[2])
+		if t == nil {
+			fmt.Printf("3rd parameter must be one of %s but not %s", listDbTypes(), args[2])
 			return
 		}
+		database = t.name
 	}
 	output := ""
 	if l > 3 {
@@ -76,8 +115,18 @@ func main() {
 		tenantId, err = dvoc.ResolveTenantIdByTenant(tenant)
 		if err != nil {
 			fmt.Printf("Fatal error: cannot get tenant id for tenant %s: %v", tenant, err)
+			if check {
+				os.Exit(1)
+			}
 			return
 		}
 	}
-	presentDbProperties(microServiceName, m2mToken, tenantId, database, output)
+	endpoint := presentDbProperties(microServiceName, m2mToken, tenantId, database, format, output)
+	if check {
+		// the check fails if the connection properties cannot be read from DBaaS at all
+		if endpoint == nil {
+			os.Exit(1)
+		}
+		checkDbConnection(endpoint)
+	}
 }
@@ -0,0 +1,555 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Dobryvechir/dvserver/src/dvoc"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	dbCheckTimeout        = 10 * time.Second
+	dbCheckApplication    = "ocdbaas"
+	pgProtocolVersion     = 196608
+	cqlProtocolVersion    = 4
+	clickHouseRevision    = 54213
+	clickHouseSecurePort  = 9440
+	clickHouseHelloPacket = 0
+	clickHouseErrorPacket = 2
+	pgSslRequestCode      = 80877103
+)
+
+// sslmode of PostgreSQL, the other values (require, verify-ca, verify-full) need TLS
+const (
+	dbSslDisable = "disable"
+	dbSslAllow   = "allow"
+	dbSslPrefer  = "prefer"
+	dbSslRequire = "require"
+)
+
+type dbChecker func(endpoint *dbEndpoint) (string, error)
+
+var dbCheckers = map[string]dbChecker{
+	dvoc.OcPostgreSql: checkPostgres,
+	dvoc.OcMongoDb:    checkMongo,
+	dbTypeCassandra:   checkCassandra,
+	dbTypeRedis:       checkRedis,
+	dbTypeClickHouse:  checkClickHouse,
+	dbTypeOpenSearch:  checkOpenSearch,
+}
+
+// checkDbEndpoint connects to the database and authenticates by its own protocol, the result describes the server
+func checkDbEndpoint(endpoint *dbEndpoint) (string, error) {
+	checker, ok := dbCheckers[endpoint.database]
+	if !ok {
+		return "", errors.New("the check is not supported for " + endpoint.database)
+	}
+	if endpoint.host == "" {
+		return "", errors.New("the host is not known")
+	}
+	return checker(endpoint)
+}
+
+// requiresTls is true if sslmode of the url needs TLS or the url has tls=true or ssl=true
+func (endpoint *dbEndpoint) requiresTls() bool {
+	switch endpoint.sslMode {
+	case "", dbSslDisable, dbSslAllow, dbSslPrefer:
+		return false
+	}
+	return true
+}
+
+// startDbTls verifies the server by the system CAs and --cacert unless --insecure is given
+func startDbTls(conn net.Conn, endpoint *dbEndpoint) (net.Conn, error) {
+	config, err := createTlsConfig(tlsOptions)
+	if err != nil {
+		return nil, err
+	}
+	config.ServerName = endpoint.host
+	tlsConn := tls.Client(conn, config)
+	if err = tlsConn.Handshake(); err != nil {
+		return nil, fmt.Errorf("TLS: %v (--cacert adds the CA of the database, --insecure skips the verification)", err)
+	}
+	return tlsConn, nil
+}
+
+func dialDbEndpoint(endpoint *dbEndpoint, secure bool) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: dbCheckTimeout}
+	conn, err := dialer.Dial("tcp", endpoint.hostPort())
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(dbCheckTimeout))
+	if !secure {
+		return conn, nil
+	}
+	tlsConn, err := startDbTls(conn, endpoint)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// startPgTls asks the server for TLS by SSLRequest as sslmode says: prefer and allow continue without TLS
+// if the server has none, disable and no sslmode do not ask
+func startPgTls(conn net.Conn, endpoint *dbEndpoint) (net.Conn, bool, error) {
+	if endpoint.sslMode == "" || endpoint.sslMode == dbSslDisable {
+		return conn, false, nil
+	}
+	request := make([]byte, 4)
+	binary.BigEndian.PutUint32(request, pgSslRequestCode)
+	if err := writePgMessage(conn, 0, request); err != nil {
+		return nil, false, err
+	}
+	answer := make([]byte, 1)
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		return nil, false, err
+	}
+	switch answer[0] {
+	case 'S':
+		tlsConn, err := startDbTls(conn, endpoint)
+		return tlsConn, err == nil, err
+	case 'N':
+		if endpoint.requiresTls() {
+			return nil, false, errors.New("the server does not support SSL, but sslmode is " + endpoint.sslMode)
+		}
+		return conn, false, nil
+	}
+	return nil, false, fmt.Errorf("unexpected answer %q to SSLRequest", answer[0])
+}
+
+func writePgMessage(w io.Writer, kind byte, data []byte) error {
+	message := make([]byte, 0, len(data)+5)
+	if kind != 0 {
+		message = append(message, kind)
+	}
+	message = append(message, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(message[len(message)-4:], uint32(len(data)+4))
+	_, err := w.Write(append(message, data...))
+	return err
+}
+
+func readPgMessage(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	size := int(binary.BigEndian.Uint32(header[1:]))
+	if size < 4 || size > 1<<24 {
+		return 0, nil, fmt.Errorf("incorrect message length %d", size)
+	}
+	data := make([]byte, size-4)
+	_, err := io.ReadFull(r, data)
+	return header[0], data, err
+}
+
+// readPgError takes the severity, the code and the message of ErrorResponse
+func readPgError(data []byte) error {
+	fields := make(map[byte]string)
+	for _, field := range bytes.Split(data, []byte{0}) {
+		if len(field) > 1 {
+			fields[field[0]] = string(field[1:])
+		}
+	}
+	return fmt.Errorf("%s %s %s", fields['S'], fields['C'], fields['M'])
+}
+
+func md5Hex(s string) string {
+	hash := md5.Sum([]byte(s))
+	return hex.EncodeToString(hash[:])
+}
+
+// checkPostgres sends the startup message and answers the password, md5 or SCRAM-SHA-256 authentication
+// until the server is ready for query
+func checkPostgres(endpoint *dbEndpoint) (string, error) {
+	conn, err := dialDbEndpoint(endpoint, false)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	conn, secure, err := startPgTls(conn, endpoint)
+	if err != nil {
+		return "", err
+	}
+	var startup bytes.Buffer
+	startup.Write([]byte{0, 0, 0, 0})
+	binary.BigEndian.PutUint32(startup.Bytes(), pgProtocolVersion)
+	for _, p := range [][2]string{{"user", endpoint.userName}, {"database", endpoint.dbName}, {"application_name", dbCheckApplication}} {
+		startup.WriteString(p[0] + "\x00" + p[1] + "\x00")
+	}
+	startup.WriteByte(0)
+	if err = writePgMessage(conn, 0, startup.Bytes()); err != nil {
+		return "", err
+	}
+	reader := bufio.NewReader(conn)
+	var scram *scramClient
+	version := ""
+	for {
+		kind, data, err := readPgMessage(reader)
+		if err != nil {
+			return "", err
+		}
+		switch kind {
+		case 'E':
+			return "", readPgError(data)
+		case 'S':
+			if p := bytes.Split(data, []byte{0}); len(p) >= 2 && string(p[0]) == "server_version" {
+				version = string(p[1])
+			}
+		case 'Z':
+			writePgMessage(conn, 'X', nil)
+			if secure {
+				return "PostgreSQL " + version + " over TLS", nil
+			}
+			return "PostgreSQL " + version, nil
+		case 'R':
+			if len(data) < 4 {
+				return "", errors.New("incorrect authentication request")
+			}
+			switch code := binary.BigEndian.Uint32(data); code {
+			case 0:
+			case 3:
+				if !secure && !tlsOptions.insecure {
+					return "", errors.New("the server asks the password in clear text without TLS, --insecure allows it")
+				}
+				err = writePgMessage(conn, 'p', []byte(endpoint.password+"\x00"))
+			case 5:
+				if len(data) < 8 {
+					return "", errors.New("incorrect md5 salt")
+				}
+				hash := "md5" + md5Hex(md5Hex(endpoint.password+endpoint.userName)+string(data[4:8]))
+				err = writePgMessage(conn, 'p', []byte(hash+"\x00"))
+			case 10:
+				if !bytes.Contains(data[4:], []byte("SCRAM-SHA-256\x00")) {
+					return "", errors.New("no supported SASL mechanism in " + strings.Replace(string(data[4:]), "\x00", " ", -1))
+				}
+				// the user of the startup message is used, so SCRAM has an empty name
+				scram = newScramClient(sha256.New, "", endpoint.password)
+				first := scram.clientFirst()
+				message := []byte("SCRAM-SHA-256\x00\x00\x00\x00\x00" + first)
+				binary.BigEndian.PutUint32(message[len("SCRAM-SHA-256\x00"):], uint32(len(first)))
+				err = writePgMessage(conn, 'p', message)
+			case 11:
+				if scram == nil {
+					return "", errors.New("unexpected SASL continue")
+				}
+				final, e := scram.clientFinal(string(data[4:]))
+				if e != nil {
+					return "", e
+				}
+				err = writePgMessage(conn, 'p', []byte(final))
+			case 12:
+				if scram == nil {
+					return "", errors.New("unexpected SASL final")
+				}
+				err = scram.verifyServerFinal(string(data[4:]))
+			default:
+				return "", fmt.Errorf("unsupported authentication %d", code)
+			}
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+}
+
+func writeRedisCommand(w io.Writer, args ...string) error {
+	var buf bytes.Buffer
+	buf.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		buf.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// readRedisReply reads the simple reply, the bulk string is read whole
+func readRedisReply(r *bufio.Reader) (string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", errors.New("empty redis reply")
+	}
+	switch line[0] {
+	case '-':
+		return "", errors.New(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return "", err
+		}
+		data := make([]byte, n+2)
+		if _, err = io.ReadFull(r, data); err != nil {
+			return "", err
+		}
+		return string(data[:n]), nil
+	}
+	return line[1:], nil
+}
+
+// checkRedis authenticates by AUTH with the user if it is given (ACL of redis 6) and pings
+func checkRedis(endpoint *dbEndpoint) (string, error) {
+	conn, err := dialDbEndpoint(endpoint, endpoint.scheme == "rediss" || endpoint.requiresTls())
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	commands := make([][]string, 0, 3)
+	if endpoint.userName != "" {
+		commands = append(commands, []string{"AUTH", endpoint.userName, endpoint.password})
+	} else if endpoint.password != "" {
+		commands = append(commands, []string{"AUTH", endpoint.password})
+	}
+	if db := endpoint.redisDatabase(); db != "" {
+		commands = append(commands, []string{"SELECT", db})
+	}
+	commands = append(commands, []string{"PING"})
+	reply := ""
+	for _, command := range commands {
+		if err = writeRedisCommand(conn, command...); err != nil {
+			return "", err
+		}
+		if reply, err = readRedisReply(reader); err != nil {
+			return "", fmt.Errorf("%s: %v", command[0], err)
+		}
+	}
+	if reply != "PONG" {
+		return "", errors.New("unexpected PING reply " + reply)
+	}
+	return "Redis PONG", nil
+}
+
+func writeCqlFrame(w io.Writer, opcode byte, body []byte) error {
+	frame := []byte{cqlProtocolVersion, 0, 0, 0, opcode, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(frame[5:], uint32(len(body)))
+	_, err := w.Write(append(frame, body...))
+	return err
+}
+
+func readCqlFrame(r io.Reader) (byte, []byte, error) {
+	header := make([]byte, 9)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header[5:])
+	if size > 1<<24 {
+		return 0, nil, fmt.Errorf("incorrect frame length %d", size)
+	}
+	body := make([]byte, size)
+	_, err := io.ReadFull(r, body)
+	return header[4], body, err
+}
+
+func readCqlString(body []byte) string {
+	if len(body) < 2 {
+		return ""
+	}
+	n := int(binary.BigEndian.Uint16(body))
+	if len(body) < 2+n {
+		return string(body[2:])
+	}
+	return string(body[2 : 2+n])
+}
+
+func appendCqlString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+// checkCassandra starts the native protocol v4 session and answers the PasswordAuthenticator by SASL PLAIN
+func checkCassandra(endpoint *dbEndpoint) (string, error) {
+	conn, err := dialDbEndpoint(endpoint, endpoint.requiresTls())
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	startup := appendCqlString(appendCqlString([]byte{0, 1}, "CQL_VERSION"), "3.0.0")
+	if err = writeCqlFrame(conn, 0x01, startup); err != nil {
+		return "", err
+	}
+	for {
+		opcode, body, err := readCqlFrame(conn)
+		if err != nil {
+			return "", err
+		}
+		switch opcode {
+		case 0x00:
+			if len(body) < 4 {
+				return "", errors.New("cassandra error")
+			}
+			return "", fmt.Errorf("cassandra error %#x: %s", binary.BigEndian.Uint32(body), readCqlString(body[4:]))
+		case 0x02:
+			return "Cassandra without authentication", nil
+		case 0x03:
+			token := "\x00" + endpoint.userName + "\x00" + endpoint.password
+			response := make([]byte, 4, 4+len(token))
+			binary.BigEndian.PutUint32(response, uint32(len(token)))
+			if err = writeCqlFrame(conn, 0x0f, append(response, token...)); err != nil {
+				return "", err
+			}
+		case 0x10:
+			return "Cassandra authenticated", nil
+		default:
+			return "", fmt.Errorf("unexpected cassandra opcode %#x", opcode)
+		}
+	}
+}
+
+func appendClickHouseString(b []byte, s string) []byte {
+	b = appendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+func appendUvarint(b []byte, n uint64) []byte {
+	buf := make([]byte, binary.MaxVarintLen64)
+	return append(b, buf[:binary.PutUvarint(buf, n)]...)
+}
+
+func readClickHouseString(r *bufio.Reader) (string, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return "", err
+	}
+	if n > 1<<20 {
+		return "", fmt.Errorf("incorrect string length %d", n)
+	}
+	data := make([]byte, n)
+	_, err = io.ReadFull(r, data)
+	return string(data), err
+}
+
+// checkClickHouseNative sends the hello of the native protocol, the server answers hello or the exception
+func checkClickHouseNative(endpoint *dbEndpoint) (string, error) {
+	conn, err := dialDbEndpoint(endpoint, endpoint.port == clickHouseSecurePort || endpoint.requiresTls())
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	hello := appendUvarint(nil, clickHouseHelloPacket)
+	hello = appendClickHouseString(hello, dbCheckApplication)
+	hello = appendUvarint(appendUvarint(appendUvarint(hello, 1), 0), clickHouseRevision)
+	hello = appendClickHouseString(hello, endpoint.dbName)
+	hello = appendClickHouseString(hello, endpoint.userName)
+	hello = appendClickHouseString(hello, endpoint.password)
+	if _, err = conn.Write(hello); err != nil {
+		return "", err
+	}
+	reader := bufio.NewReader(conn)
+	packet, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return "", err
+	}
+	switch packet {
+	case clickHouseHelloPacket:
+		name, err := readClickHouseString(reader)
+		if err != nil {
+			return "", err
+		}
+		major, _ := binary.ReadUvarint(reader)
+		minor, _ := binary.ReadUvarint(reader)
+		return fmt.Sprintf("%s %d.%d", name, major, minor), nil
+	case clickHouseErrorPacket:
+		code := make([]byte, 4)
+		if _, err = io.ReadFull(reader, code); err != nil {
+			return "", err
+		}
+		readClickHouseString(reader)
+		message, _ := readClickHouseString(reader)
+		return "", fmt.Errorf("clickhouse error %d: %s", binary.LittleEndian.Uint32(code), message)
+	}
+	return "", fmt.Errorf("unexpected clickhouse packet %d", packet)
+}
+
+// readDbHttp performs GET with the basic authorization of the endpoint or with the given headers
+func readDbHttp(u string, endpoint *dbEndpoint, headers map[string]string) ([]byte, error) {
+	request, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	if headers == nil {
+		request.SetBasicAuth(endpoint.userName, endpoint.password)
+	}
+	for k, v := range headers {
+		request.Header.Set(k, v)
+	}
+	client, err := createNetClient(tlsOptions)
+	if err != nil {
+		return nil, err
+	}
+	client.Timeout = dbCheckTimeout
+	response, err := client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(response.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%d %s", response.StatusCode, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+// checkClickHouse uses the HTTP interface for the ports 8123 and 8443 or the http url, otherwise the native protocol
+func checkClickHouse(endpoint *dbEndpoint) (string, error) {
+	if endpoint.scheme != "http" && endpoint.scheme != "https" && endpoint.port != 8123 && endpoint.port != 8443 {
+		return checkClickHouseNative(endpoint)
+	}
+	u := endpoint.httpUrl(false)
+	query := u.Query()
+	query.Set("query", "SELECT version()")
+	if endpoint.dbName != "" {
+		query.Set("database", endpoint.dbName)
+	}
+	u.RawQuery = query.Encode()
+	data, err := readDbHttp(u.String(), endpoint, map[string]string{"X-ClickHouse-User": endpoint.userName, "X-ClickHouse-Key": endpoint.password})
+	if err != nil {
+		return "", err
+	}
+	return "ClickHouse " + strings.TrimSpace(string(data)), nil
+}
+
+func checkOpenSearch(endpoint *dbEndpoint) (string, error) {
+	data, err := readDbHttp(endpoint.httpUrl(false).String(), endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	info := &struct {
+		ClusterName string `json:"cluster_name"`
+		Version     struct {
+			Distribution string `json:"distribution"`
+			Number       string `json:"number"`
+		} `json:"version"`
+	}{}
+	if err = json.Unmarshal(data, info); err != nil {
+		return "", fmt.Errorf("unexpected answer: %v", err)
+	}
+	distribution := info.Version.Distribution
+	if distribution == "" {
+		distribution = dbTypeOpenSearch
+	}
+	return fmt.Sprintf("%s %s of cluster %s", distribution, info.Version.Number, info.ClusterName), nil
+}
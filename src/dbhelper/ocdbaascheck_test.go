@@ -0,0 +1,471 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Dobryvechir/dvserver/src/dvoc"
+)
+
+const (
+	testDbUser     = "app"
+	testDbPassword = "s3cr3t,=pass"
+	testScramSalt  = "c2FsdHNhbHRzYWx0"
+)
+
+// startTestDbServer serves every connection by the handler until the test ends, it returns the port
+func startTestDbServer(t *testing.T, handler func(conn net.Conn)) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handler(conn)
+			}()
+		}
+	}()
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func createTestDbEndpoint(database string, port int, password string) *dbEndpoint {
+	return &dbEndpoint{database: database, host: "127.0.0.1", port: port, dbName: "db1", userName: testDbUser, password: password}
+}
+
+// startTestScram is the server side of SCRAM, it returns the server first message and the check of the client final
+// message, which gives the server final message
+func startTestScram(newHash func() hash.Hash, clientFirst string, password string) (string, func(string) (string, bool)) {
+	bare := strings.TrimPrefix(clientFirst, "n,,")
+	serverFirst := "r=" + parseScramAttributes(bare)['r'] + "server,s=" + testScramSalt + ",i=4096"
+	return serverFirst, func(clientFinal string) (string, bool) {
+		p := strings.Index(clientFinal, ",p=")
+		if p < 0 {
+			return "e=invalid-encoding", false
+		}
+		salt, _ := base64.StdEncoding.DecodeString(testScramSalt)
+		scram := &scramClient{newHash: newHash}
+		salted := pbkdf2(newHash, []byte(password), salt, 4096)
+		h := newHash()
+		h.Write(scram.hmac(salted, "Client Key"))
+		storedKey := h.Sum(nil)
+		authMessage := bare + "," + serverFirst + "," + clientFinal[:p]
+		clientSignature := scram.hmac(storedKey, authMessage)
+		proof, _ := base64.StdEncoding.DecodeString(clientFinal[p+3:])
+		if len(proof) != len(clientSignature) {
+			return "e=invalid-proof", false
+		}
+		for i := range proof {
+			proof[i] ^= clientSignature[i]
+		}
+		h = newHash()
+		h.Write(proof)
+		if !bytes.Equal(h.Sum(nil), storedKey) {
+			return "e=invalid-proof", false
+		}
+		return "v=" + base64.StdEncoding.EncodeToString(scram.hmac(scram.hmac(salted, "Server Key"), authMessage)), true
+	}
+}
+
+func useTestTlsOptions(t *testing.T, options *netTlsOptions) {
+	saved := tlsOptions
+	tlsOptions = options
+	t.Cleanup(func() { tlsOptions = saved })
+}
+
+func readTestPgStartup(conn net.Conn) ([]byte, error) {
+	size := make([]byte, 4)
+	if _, err := io.ReadFull(conn, size); err != nil {
+		return nil, err
+	}
+	startup := make([]byte, binary.BigEndian.Uint32(size)-4)
+	_, err := io.ReadFull(conn, startup)
+	return startup, err
+}
+
+// servePostgres authenticates the user by the clear text password, md5 or SCRAM-SHA-256 as pg_hba.conf says,
+// SSLRequest is accepted if the TLS configuration is given
+func servePostgres(method string, config *tls.Config) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		startup, err := readTestPgStartup(conn)
+		if err != nil {
+			return
+		}
+		if binary.BigEndian.Uint32(startup) == pgSslRequestCode {
+			if config == nil {
+				conn.Write([]byte("N"))
+			} else {
+				conn.Write([]byte("S"))
+				conn = tls.Server(conn, config)
+			}
+			if startup, err = readTestPgStartup(conn); err != nil {
+				return
+			}
+		}
+		params := bytes.Split(startup[4:], []byte{0})
+		user := ""
+		for i := 0; i+1 < len(params); i += 2 {
+			if string(params[i]) == "user" {
+				user = string(params[i+1])
+			}
+		}
+		authenticate := func(code uint32, data string) {
+			message := make([]byte, 4)
+			binary.BigEndian.PutUint32(message, code)
+			writePgMessage(conn, 'R', append(message, data...))
+		}
+		fail := func() {
+			writePgMessage(conn, 'E', []byte("SFATAL\x00C28P01\x00Mpassword authentication failed for user \""+user+"\"\x00\x00"))
+		}
+		reader := bufio.NewReader(conn)
+		if method == "password" {
+			authenticate(3, "")
+			_, data, err := readPgMessage(reader)
+			if err != nil || string(data) != testDbPassword+"\x00" {
+				fail()
+				return
+			}
+		} else if method == "md5" {
+			authenticate(5, "salt")
+			_, data, err := readPgMessage(reader)
+			if err != nil || string(data) != "md5"+md5Hex(md5Hex(testDbPassword+user)+"salt")+"\x00" {
+				fail()
+				return
+			}
+		} else {
+			authenticate(10, "SCRAM-SHA-256\x00\x00")
+			_, data, err := readPgMessage(reader)
+			if err != nil || !bytes.HasPrefix(data, []byte("SCRAM-SHA-256\x00")) {
+				fail()
+				return
+			}
+			serverFirst, check := startTestScram(sha256.New, string(data[len("SCRAM-SHA-256\x00")+4:]), testDbPassword)
+			authenticate(11, serverFirst)
+			if _, data, err = readPgMessage(reader); err != nil {
+				return
+			}
+			serverFinal, ok := check(string(data))
+			if !ok {
+				fail()
+				return
+			}
+			authenticate(12, serverFinal)
+		}
+		authenticate(0, "")
+		writePgMessage(conn, 'S', []byte("server_version\x0015.4\x00"))
+		writePgMessage(conn, 'Z', []byte("I"))
+		readPgMessage(reader)
+	}
+}
+
+func TestCheckPostgres(t *testing.T) {
+	for _, method := range []string{"md5", "scram"} {
+		port := startTestDbServer(t, servePostgres(method, nil))
+		info, err := checkDbEndpoint(createTestDbEndpoint("postgresql", port, testDbPassword))
+		if err != nil || info != "PostgreSQL 15.4" {
+			t.Errorf("%s: %s %v", method, info, err)
+		}
+		if _, err = checkDbEndpoint(createTestDbEndpoint("postgresql", port, "wrong")); err == nil || !strings.Contains(err.Error(), "28P01") {
+			t.Errorf("%s: the wrong password is reported as %v", method, err)
+		}
+	}
+}
+
+// serveRedis accepts AUTH of the user (ACL) or of the password only, SELECT and PING
+func serveRedis(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	authenticated := false
+	for {
+		var n int
+		if _, err := fmt.Fscanf(reader, "*%d\r\n", &n); err != nil {
+			return
+		}
+		args := make([]string, n)
+		for i := range args {
+			var size int
+			if _, err := fmt.Fscanf(reader, "$%d\r\n", &size); err != nil {
+				return
+			}
+			data := make([]byte, size+2)
+			if _, err := io.ReadFull(reader, data); err != nil {
+				return
+			}
+			args[i] = string(data[:size])
+		}
+		reply := "+OK\r\n"
+		switch {
+		case args[0] == "AUTH" && n == 3 && args[1] == testDbUser && args[2] == testDbPassword,
+			args[0] == "AUTH" && n == 2 && args[1] == testDbPassword:
+			authenticated = true
+		case args[0] == "AUTH":
+			reply = "-WRONGPASS invalid username-password pair or user is disabled.\r\n"
+		case !authenticated:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case args[0] == "SELECT" && args[1] != "3":
+			reply = "-ERR DB index is out of range\r\n"
+		case args[0] == "PING":
+			reply = "+PONG\r\n"
+		}
+		conn.Write([]byte(reply))
+	}
+}
+
+func TestCheckRedis(t *testing.T) {
+	port := startTestDbServer(t, serveRedis)
+	endpoint := createTestDbEndpoint(dbTypeRedis, port, testDbPassword)
+	endpoint.dbName = "3"
+	if info, err := checkDbEndpoint(endpoint); err != nil || info != "Redis PONG" {
+		t.Errorf("ACL user: %s %v", info, err)
+	}
+	endpoint.userName = ""
+	if info, err := checkDbEndpoint(endpoint); err != nil || info != "Redis PONG" {
+		t.Errorf("password only: %s %v", info, err)
+	}
+	endpoint.dbName = "20"
+	if _, err := checkDbEndpoint(endpoint); err == nil || !strings.HasPrefix(err.Error(), "SELECT") {
+		t.Errorf("the wrong database is reported as %v", err)
+	}
+	endpoint.password = "wrong"
+	if _, err := checkDbEndpoint(endpoint); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("the wrong password is reported as %v", err)
+	}
+}
+
+func writeTestMongoReply(conn net.Conn, reply []bsonElement) {
+	doc, _ := encodeBsonDocument(reply)
+	// the mechanisms are the bson array, encodeBsonDocument writes the embedded document of the same layout
+	if p := bytes.Index(doc, []byte("\x03saslSupportedMechs\x00")); p >= 0 {
+		doc[p] = 0x04
+	}
+	message := appendBsonInt32(nil, int32(21+len(doc)))
+	message = appendBsonInt32(message, 1)
+	message = appendBsonInt32(message, 1)
+	message = appendBsonInt32(message, mongoOpMsg)
+	message = appendBsonInt32(message, 0)
+	conn.Write(append(append(message, 0), doc...))
+}
+
+// serveMongo knows the user with the mechanisms, the servers before 4.4.2 answer only isMaster
+func serveMongo(mechanisms []string, legacy bool, used *string) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		var check func(string) (string, bool)
+		authenticated := false
+		for {
+			header := make([]byte, 16)
+			if _, err := io.ReadFull(conn, header); err != nil {
+				return
+			}
+			body := make([]byte, binary.LittleEndian.Uint32(header)-16)
+			if _, err := io.ReadFull(conn, body); err != nil {
+				return
+			}
+			doc, err := decodeBsonDocument(body[5:])
+			if err != nil {
+				return
+			}
+			failed := []bsonElement{{"ok", 0.0}, {"errmsg", "Authentication failed."}, {"code", 18}}
+			var reply []bsonElement
+			switch {
+			case doc["hello"] != nil && legacy:
+				reply = []bsonElement{{"ok", 0.0}, {"errmsg", "no such command: 'hello'"}, {"code", 59}}
+			case doc["hello"] != nil || doc["isMaster"] != nil:
+				mechs := make([]bsonElement, len(mechanisms))
+				for i, m := range mechanisms {
+					mechs[i] = bsonElement{fmt.Sprint(i), m}
+				}
+				reply = []bsonElement{{"ismaster", true}, {"saslSupportedMechs", mechs}, {"ok", 1.0}}
+			case doc["saslStart"] != nil:
+				*used, _ = doc["mechanism"].(string)
+				payload, _ := doc["payload"].([]byte)
+				var serverFirst string
+				if *used == mongoScramSha256 {
+					serverFirst, check = startTestScram(sha256.New, string(payload), testDbPassword)
+				} else {
+					serverFirst, check = startTestScram(sha1.New, string(payload), md5Hex(testDbUser+":mongo:"+testDbPassword))
+				}
+				reply = []bsonElement{{"conversationId", 1}, {"done", false}, {"payload", []byte(serverFirst)}, {"ok", 1.0}}
+			case doc["saslContinue"] != nil && check != nil:
+				payload, _ := doc["payload"].([]byte)
+				serverFinal, ok := check(string(payload))
+				reply = failed
+				if ok {
+					authenticated = true
+					reply = []bsonElement{{"conversationId", 1}, {"done", true}, {"payload", []byte(serverFinal)}, {"ok", 1.0}}
+				}
+			case doc["buildInfo"] != nil && authenticated:
+				reply = []bsonElement{{"version", "6.0.14"}, {"ok", 1.0}}
+			default:
+				reply = []bsonElement{{"ok", 0.0}, {"errmsg", "command requires authentication"}, {"code", 13}}
+			}
+			writeTestMongoReply(conn, reply)
+		}
+	}
+}
+
+func TestCheckMongo(t *testing.T) {
+	for _, test := range []struct {
+		mechanisms []string
+		legacy     bool
+		expected   string
+	}{
+		{[]string{mongoScramSha1, mongoScramSha256}, false, mongoScramSha256},
+		{[]string{mongoScramSha1}, false, mongoScramSha1},
+		{[]string{mongoScramSha1, mongoScramSha256}, true, mongoScramSha256},
+	} {
+		used := ""
+		port := startTestDbServer(t, serveMongo(test.mechanisms, test.legacy, &used))
+		info, err := checkDbEndpoint(createTestDbEndpoint("mongodb", port, testDbPassword))
+		if err != nil || info != "MongoDB 6.0.14" || used != test.expected {
+			t.Errorf("%v: %s %v by %s instead of %s", test.mechanisms, info, err, used, test.expected)
+		}
+		if _, err = checkDbEndpoint(createTestDbEndpoint("mongodb", port, "wrong")); err == nil || !strings.Contains(err.Error(), "Authentication failed") {
+			t.Errorf("%v: the wrong password is reported as %v", test.mechanisms, err)
+		}
+	}
+}
+
+// serveCassandra asks the PasswordAuthenticator and checks the SASL PLAIN token
+func serveCassandra(conn net.Conn) {
+	if opcode, _, err := readCqlFrame(conn); err != nil || opcode != 0x01 {
+		return
+	}
+	writeCqlFrame(conn, 0x03, appendCqlString(nil, "org.apache.cassandra.auth.PasswordAuthenticator"))
+	opcode, body, err := readCqlFrame(conn)
+	if err != nil || opcode != 0x0f || len(body) < 4 {
+		return
+	}
+	if string(body[4:]) != "\x00"+testDbUser+"\x00"+testDbPassword {
+		writeCqlFrame(conn, 0x00, appendCqlString([]byte{0, 0, 1, 0}, "Provided username "+testDbUser+" and/or password are incorrect"))
+		return
+	}
+	writeCqlFrame(conn, 0x10, []byte{0xff, 0xff, 0xff, 0xff})
+}
+
+func TestCheckCassandra(t *testing.T) {
+	port := startTestDbServer(t, serveCassandra)
+	if info, err := checkDbEndpoint(createTestDbEndpoint(dbTypeCassandra, port, testDbPassword)); err != nil || info != "Cassandra authenticated" {
+		t.Errorf("%s %v", info, err)
+	}
+	if _, err := checkDbEndpoint(createTestDbEndpoint(dbTypeCassandra, port, "wrong")); err == nil || !strings.Contains(err.Error(), "0x100") {
+		t.Errorf("the wrong password is reported as %v", err)
+	}
+}
+
+func createTestTlsConfig(t *testing.T) (*tls.Config, *testCertificates) {
+	certs := createTestCertificates(t)
+	return &tls.Config{Certificates: []tls.Certificate{certs.server}}, certs
+}
+
+func TestCheckPostgresTls(t *testing.T) {
+	config, certs := createTestTlsConfig(t)
+	port := startTestDbServer(t, servePostgres("scram", config))
+	endpoint := createTestDbEndpoint("postgresql", port, testDbPassword)
+	endpoint.sslMode = "require"
+	useTestTlsOptions(t, &netTlsOptions{})
+	if _, err := checkDbEndpoint(endpoint); err == nil || !strings.HasPrefix(err.Error(), "TLS") {
+		t.Errorf("the untrusted certificate is reported as %v", err)
+	}
+	useTestTlsOptions(t, &netTlsOptions{caFile: certs.caFile})
+	if info, err := checkDbEndpoint(endpoint); err != nil || info != "PostgreSQL 15.4 over TLS" {
+		t.Errorf("--cacert: %s %v", info, err)
+	}
+	useTestTlsOptions(t, &netTlsOptions{insecure: true})
+	if info, err := checkDbEndpoint(endpoint); err != nil || info != "PostgreSQL 15.4 over TLS" {
+		t.Errorf("--insecure: %s %v", info, err)
+	}
+
+	endpoint.port = startTestDbServer(t, servePostgres("scram", nil))
+	if _, err := checkDbEndpoint(endpoint); err == nil || !strings.Contains(err.Error(), "does not support SSL") {
+		t.Errorf("sslmode=require without TLS at the server is reported as %v", err)
+	}
+	endpoint.sslMode = "prefer"
+	if info, err := checkDbEndpoint(endpoint); err != nil || info != "PostgreSQL 15.4" {
+		t.Errorf("sslmode=prefer without TLS at the server: %s %v", info, err)
+	}
+}
+
+func TestCheckPostgresClearTextPassword(t *testing.T) {
+	config, certs := createTestTlsConfig(t)
+	endpoint := createTestDbEndpoint("postgresql", startTestDbServer(t, servePostgres("password", config)), testDbPassword)
+	useTestTlsOptions(t, &netTlsOptions{caFile: certs.caFile})
+	if _, err := checkDbEndpoint(endpoint); err == nil || !strings.Contains(err.Error(), "clear text") {
+		t.Errorf("the clear text password without TLS is reported as %v", err)
+	}
+	endpoint.sslMode = "verify-full"
+	if info, err := checkDbEndpoint(endpoint); err != nil || info != "PostgreSQL 15.4 over TLS" {
+		t.Errorf("the clear text password over TLS: %s %v", info, err)
+	}
+}
+
+func TestCheckMongoTls(t *testing.T) {
+	config, certs := createTestTlsConfig(t)
+	used := ""
+	serve := serveMongo([]string{mongoScramSha256}, false, &used)
+	port := startTestDbServer(t, func(conn net.Conn) { serve(tls.Server(conn, config)) })
+	info := &dvoc.ConnectionPropertiesInfo{Url: fmt.Sprintf("mongodb://127.0.0.1:%d/db1?tls=true", port), UserName: testDbUser, Password: testDbPassword}
+	endpoint := createDbEndpoint(info, "mongodb", "app")
+	useTestTlsOptions(t, &netTlsOptions{})
+	if _, err := checkDbEndpoint(endpoint); err == nil || !strings.HasPrefix(err.Error(), "TLS") {
+		t.Errorf("the untrusted certificate is reported as %v", err)
+	}
+	useTestTlsOptions(t, &netTlsOptions{caFile: certs.caFile})
+	if version, err := checkDbEndpoint(endpoint); err != nil || version != "MongoDB 6.0.14" {
+		t.Errorf("--cacert: %s %v", version, err)
+	}
+}
+
+func TestCheckOpenSearchVerifiesServer(t *testing.T) {
+	certs := createTestCertificates(t)
+	server := startTestTlsServer(certs, false, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, _ := r.BasicAuth(); user != testDbUser || password != testDbPassword {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"cluster_name":"logs","version":{"distribution":"opensearch","number":"2.11.0"}}`))
+	}))
+	defer server.Close()
+	endpoint := createTestDbEndpoint(dbTypeOpenSearch, server.Listener.Addr().(*net.TCPAddr).Port, testDbPassword)
+	useTestTlsOptions(t, &netTlsOptions{})
+	if _, err := checkDbEndpoint(endpoint); err == nil {
+		t.Error("the untrusted certificate is accepted")
+	}
+	useTestTlsOptions(t, &netTlsOptions{caFile: certs.caFile})
+	if info, err := checkDbEndpoint(endpoint); err != nil || info != "opensearch 2.11.0 of cluster logs" {
+		t.Errorf("--cacert: %s %v", info, err)
+	}
+}
+
+func TestCreateDbEndpointSslMode(t *testing.T) {
+	for u, expected := range map[string]string{
+		"jdbc:postgresql://pg:5432/db1?sslmode=verify-full": "verify-full",
+		"jdbc:postgresql://pg:5432/db1?ssl=true":            dbSslRequire,
+		"postgresql://pg:5432/db1?sslmode=Disable":          dbSslDisable,
+		"mongodb://mongo:27017/db1?authSource=db1&tls=true": dbSslRequire,
+		"mongodb://mongo:27017/db1":                         "",
+	} {
+		endpoint := createDbEndpoint(&dvoc.ConnectionPropertiesInfo{Url: u}, "postgresql", "app")
+		if endpoint.sslMode != expected {
+			t.Errorf("%s: sslmode %s instead of %s", u, endpoint.sslMode, expected)
+		}
+	}
+}
@@ -0,0 +1,458 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/Dobryvechir/dvserver/src/dvoc"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+const (
+	dbFormatEnv     = "env"
+	dbFormatJdbc    = "jdbc"
+	dbFormatLibpq   = "libpq"
+	dbFormatMongo   = "mongo"
+	dbFormatSpring  = "spring"
+	dbFormatDbeaver = "dbeaver"
+	dbFormatPgpass  = "pgpass"
+	dbFormatUri     = "uri"
+)
+
+const (
+	dbTypeCassandra  = "cassandra"
+	dbTypeRedis      = "redis"
+	dbTypeClickHouse = "clickhouse"
+	dbTypeOpenSearch = "opensearch"
+)
+
+// dbType is the database type of DBaaS with the short names accepted in the command line
+type dbType struct {
+	name    string
+	aliases []string
+	port    int
+}
+
+var dbTypes = []*dbType{
+	{dvoc.OcPostgreSql, []string{"p", "pg", "postgres"}, 5432},
+	{dvoc.OcMongoDb, []string{"m", "mongo"}, 27017},
+	{dbTypeCassandra, []string{"c", "cql"}, 9042},
+	{dbTypeRedis, []string{"r"}, 6379},
+	{dbTypeClickHouse, []string{"ch", "k"}, 8123},
+	{dbTypeOpenSearch, []string{"o", "os", "elasticsearch"}, 9200},
+}
+
+// findDbType takes the name, the alias or the beginning of the name
+func findDbType(s string) *dbType {
+	s = strings.ToLower(s)
+	for _, t := range dbTypes {
+		if t.name == s {
+			return t
+		}
+		for _, alias := range t.aliases {
+			if alias == s {
+				return t
+			}
+		}
+	}
+	for _, t := range dbTypes {
+		if len(s) > 1 && strings.HasPrefix(t.name, s) {
+			return t
+		}
+	}
+	return nil
+}
+
+func listDbTypes() string {
+	list := make([]string, len(dbTypes))
+	for i, t := range dbTypes {
+		list[i] = t.aliases[0] + " = " + t.name
+	}
+	return strings.Join(list, ", ")
+}
+
+var ocDbaaSFormatHelp = "formats (--format=<format>):\n" +
+	"  env      HOST, PORT, URL, DB, USERNAME and PASSWORD (default)\n" +
+	"  jdbc     JDBC URL with the user and the password (PostgreSQL and ClickHouse)\n" +
+	"  libpq    postgresql:// URI for psql and libpq\n" +
+	"  mongo    mongodb:// URI for mongosh and the drivers\n" +
+	"  spring   spring.datasource.*, spring.data.mongodb.*, spring.cassandra.*, spring.data.redis.* or opensearch.*\n" +
+	"  dbeaver  data-sources.json of DBeaver with the connection\n" +
+	"  pgpass   line of .pgpass\n" +
+	"  uri      URI of the database: postgresql://, mongodb://, redis://, clickhouse:// or https:// for OpenSearch"
+
+// dbEndpoint is the connection of DBaaS, the host, the port and the database are taken from the url if they are absent;
+// sslMode is sslmode of the url or require for tls=true and ssl=true
+type dbEndpoint struct {
+	database     string
+	microService string
+	host         string
+	port         int
+	dbName       string
+	userName     string
+	password     string
+	url          string
+	scheme       string
+	sslMode      string
+}
+
+type dbFormatter func(endpoint *dbEndpoint) (string, error)
+
+var dbFormatters = map[string]dbFormatter{
+	dbFormatEnv:     formatDbEnv,
+	dbFormatJdbc:    formatDbJdbc,
+	dbFormatLibpq:   formatDbLibpq,
+	dbFormatMongo:   formatDbMongo,
+	dbFormatSpring:  formatDbSpring,
+	dbFormatDbeaver: formatDbDbeaver,
+	dbFormatPgpass:  formatDbPgpass,
+	dbFormatUri:     formatDbUri,
+}
+
+func createDbEndpoint(info *dvoc.ConnectionPropertiesInfo, database string, microService string) *dbEndpoint {
+	endpoint := &dbEndpoint{
+		database:     database,
+		microService: microService,
+		host:         info.Host,
+		port:         info.Port,
+		dbName:       info.DbName,
+		userName:     info.UserName,
+		password:     info.Password,
+		url:          info.Url,
+	}
+	if endpoint.url != "" {
+		if u, err := url.Parse(strings.TrimPrefix(endpoint.url, "jdbc:")); err == nil {
+			endpoint.scheme = strings.ToLower(u.Scheme)
+			if endpoint.host == "" {
+				endpoint.host = u.Hostname()
+			}
+			if endpoint.port == 0 {
+				endpoint.port, _ = strconv.Atoi(u.Port())
+			}
+			if endpoint.dbName == "" {
+				endpoint.dbName = strings.TrimPrefix(u.Path, "/")
+			}
+			query := u.Query()
+			endpoint.sslMode = strings.ToLower(query.Get("sslmode"))
+			if strings.EqualFold(query.Get("tls"), "true") || strings.EqualFold(query.Get("ssl"), "true") {
+				endpoint.sslMode = dbSslRequire
+			}
+		}
+	}
+	if t := findDbType(database); endpoint.port == 0 && t != nil {
+		endpoint.port = t.port
+	}
+	return endpoint
+}
+
+func (endpoint *dbEndpoint) hostPort() string {
+	return net.JoinHostPort(endpoint.host, strconv.Itoa(endpoint.port))
+}
+
+// uri escapes the user, the password and the database as url.URL does for userinfo and path
+func (endpoint *dbEndpoint) uri(scheme string, query url.Values) string {
+	u := &url.URL{
+		Scheme: scheme,
+		User:   url.UserPassword(endpoint.userName, endpoint.password),
+		Host:   endpoint.hostPort(),
+		Path:   "/" + endpoint.dbName,
+	}
+	if query != nil {
+		u.RawQuery = query.Encode()
+	}
+	return u.String()
+}
+
+// tlsQuery carries sslMode over to the drivers: sslmode of PostgreSQL, ssl=true of ClickHouse JDBC and tls=true of MongoDB
+func (endpoint *dbEndpoint) tlsQuery() url.Values {
+	query := url.Values{}
+	switch endpoint.database {
+	case dvoc.OcPostgreSql:
+		if endpoint.sslMode != "" {
+			query.Set("sslmode", endpoint.sslMode)
+		}
+	case dbTypeClickHouse:
+		if endpoint.requiresTls() {
+			query.Set("ssl", "true")
+		}
+	case dvoc.OcMongoDb:
+		if endpoint.requiresTls() {
+			query.Set("tls", "true")
+		}
+	}
+	return query
+}
+
+func (endpoint *dbEndpoint) requireDatabase(format string, databases ...string) error {
+	for _, database := range databases {
+		if endpoint.database == database {
+			return nil
+		}
+	}
+	return fmt.Errorf("format %s is not supported for %s", format, endpoint.database)
+}
+
+func formatDbEnv(endpoint *dbEndpoint) (string, error) {
+	return fmt.Sprintf("HOST=%s\nPORT=%d\nURL=%s\nDB=%s\nUSERNAME=%s\nPASSWORD=%s\n",
+		endpoint.host, endpoint.port, endpoint.url, endpoint.dbName, endpoint.userName, endpoint.password), nil
+}
+
+func jdbcUrl(endpoint *dbEndpoint, query url.Values) string {
+	u := &url.URL{Scheme: endpoint.database, Host: endpoint.hostPort(), Path: "/" + endpoint.dbName, RawQuery: query.Encode()}
+	return "jdbc:" + u.String()
+}
+
+// httpUrl is the URL of ClickHouse or OpenSearch, OpenSearch is reached by https unless DBaaS gives http
+func (endpoint *dbEndpoint) httpUrl(withUser bool) *url.URL {
+	scheme := "https"
+	if endpoint.scheme == "http" || endpoint.database == dbTypeClickHouse && endpoint.scheme != "https" && endpoint.port != 8443 {
+		scheme = "http"
+	}
+	u := &url.URL{Scheme: scheme, Host: endpoint.hostPort(), Path: "/"}
+	if withUser {
+		u.User = url.UserPassword(endpoint.userName, endpoint.password)
+	}
+	return u
+}
+
+// redisDatabase is the index of the redis database, the other names are not used by redis
+func (endpoint *dbEndpoint) redisDatabase() string {
+	if _, err := strconv.Atoi(endpoint.dbName); err == nil {
+		return endpoint.dbName
+	}
+	return ""
+}
+
+func formatDbJdbc(endpoint *dbEndpoint) (string, error) {
+	if err := endpoint.requireDatabase(dbFormatJdbc, dvoc.OcPostgreSql, dbTypeClickHouse); err != nil {
+		return "", err
+	}
+	query := endpoint.tlsQuery()
+	query.Set("user", endpoint.userName)
+	query.Set("password", endpoint.password)
+	return jdbcUrl(endpoint, query) + "\n", nil
+}
+
+func formatDbLibpq(endpoint *dbEndpoint) (string, error) {
+	if err := endpoint.requireDatabase(dbFormatLibpq, dvoc.OcPostgreSql); err != nil {
+		return "", err
+	}
+	return endpoint.uri(dvoc.OcPostgreSql, endpoint.tlsQuery()) + "\n", nil
+}
+
+func mongoUri(endpoint *dbEndpoint) string {
+	query := endpoint.tlsQuery()
+	query.Set("authSource", endpoint.dbName)
+	return endpoint.uri("mongodb", query)
+}
+
+func formatDbMongo(endpoint *dbEndpoint) (string, error) {
+	if err := endpoint.requireDatabase(dbFormatMongo, dvoc.OcMongoDb); err != nil {
+		return "", err
+	}
+	return mongoUri(endpoint) + "\n", nil
+}
+
+// escapeSpringProperty escapes the value of the java properties file, ':', '=' and '#' are kept as they are
+// literal after the separator
+func escapeSpringProperty(s string) string {
+	var buf bytes.Buffer
+	for i, c := range s {
+		switch {
+		case c == '\\':
+			buf.WriteString("\\\\")
+		case c == ' ' && i == 0:
+			buf.WriteString("\\ ")
+		case c == '\n':
+			buf.WriteString("\\n")
+		case c == '\r':
+			buf.WriteString("\\r")
+		case c == '\t':
+			buf.WriteString("\\t")
+		case c < 0x20 || c > 0x7e:
+			// the properties are read as ISO-8859-1, so the other letters are written as UTF-16 escapes
+			for _, r := range utf16.Encode([]rune{c}) {
+				fmt.Fprintf(&buf, "\\u%04x", r)
+			}
+		default:
+			buf.WriteRune(c)
+		}
+	}
+	return buf.String()
+}
+
+func formatDbUri(endpoint *dbEndpoint) (string, error) {
+	switch endpoint.database {
+	case dvoc.OcPostgreSql:
+		return endpoint.uri(dvoc.OcPostgreSql, endpoint.tlsQuery()) + "\n", nil
+	case dvoc.OcMongoDb:
+		return mongoUri(endpoint) + "\n", nil
+	case dbTypeRedis:
+		scheme := "redis"
+		if endpoint.scheme == "rediss" || endpoint.requiresTls() {
+			scheme = "rediss"
+		}
+		u := &url.URL{Scheme: scheme, User: url.UserPassword(endpoint.userName, endpoint.password), Host: endpoint.hostPort()}
+		if db := endpoint.redisDatabase(); db != "" {
+			u.Path = "/" + db
+		}
+		return u.String() + "\n", nil
+	case dbTypeClickHouse:
+		// clickhouse-go takes secure=true for TLS
+		var query url.Values
+		if endpoint.requiresTls() {
+			query = url.Values{"secure": {"true"}}
+		}
+		return endpoint.uri(dbTypeClickHouse, query) + "\n", nil
+	case dbTypeOpenSearch:
+		return endpoint.httpUrl(true).String() + "\n", nil
+	}
+	return "", fmt.Errorf("format %s is not supported for %s", dbFormatUri, endpoint.database)
+}
+
+func formatDbSpring(endpoint *dbEndpoint) (string, error) {
+	var props [][2]string
+	switch endpoint.database {
+	case dvoc.OcPostgreSql:
+		props = [][2]string{
+			{"spring.datasource.url", jdbcUrl(endpoint, endpoint.tlsQuery())},
+			{"spring.datasource.username", endpoint.userName},
+			{"spring.datasource.password", endpoint.password},
+			{"spring.datasource.driver-class-name", "org.postgresql.Driver"},
+		}
+	case dvoc.OcMongoDb:
+		props = [][2]string{
+			{"spring.data.mongodb.uri", mongoUri(endpoint)},
+			{"spring.data.mongodb.database", endpoint.dbName},
+		}
+	case dbTypeClickHouse:
+		props = [][2]string{
+			{"spring.datasource.url", jdbcUrl(endpoint, endpoint.tlsQuery())},
+			{"spring.datasource.username", endpoint.userName},
+			{"spring.datasource.password", endpoint.password},
+			{"spring.datasource.driver-class-name", "com.clickhouse.jdbc.ClickHouseDriver"},
+		}
+	case dbTypeCassandra:
+		props = [][2]string{
+			{"spring.cassandra.contact-points", endpoint.hostPort()},
+			{"spring.cassandra.keyspace-name", endpoint.dbName},
+			{"spring.cassandra.username", endpoint.userName},
+			{"spring.cassandra.password", endpoint.password},
+		}
+		if endpoint.requiresTls() {
+			props = append(props, [2]string{"spring.cassandra.ssl.enabled", "true"})
+		}
+	case dbTypeRedis:
+		props = [][2]string{
+			{"spring.data.redis.host", endpoint.host},
+			{"spring.data.redis.port", strconv.Itoa(endpoint.port)},
+			{"spring.data.redis.username", endpoint.userName},
+			{"spring.data.redis.password", endpoint.password},
+		}
+		if db := endpoint.redisDatabase(); db != "" {
+			props = append(props, [2]string{"spring.data.redis.database", db})
+		}
+		if endpoint.scheme == "rediss" || endpoint.requiresTls() {
+			props = append(props, [2]string{"spring.data.redis.ssl.enabled", "true"})
+		}
+	case dbTypeOpenSearch:
+		props = [][2]string{
+			{"opensearch.uris", endpoint.httpUrl(false).String()},
+			{"opensearch.username", endpoint.userName},
+			{"opensearch.password", endpoint.password},
+		}
+	default:
+		return "", fmt.Errorf("format %s is not supported for %s", dbFormatSpring, endpoint.database)
+	}
+	var buf bytes.Buffer
+	for _, p := range props {
+		buf.WriteString(p[0] + "=" + escapeSpringProperty(p[1]) + "\n")
+	}
+	return buf.String(), nil
+}
+
+// formatDbDbeaver creates data-sources.json, DBeaver keeps the user and the password if save-password is set
+func formatDbDbeaver(endpoint *dbEndpoint) (string, error) {
+	if err := endpoint.requireDatabase(dbFormatDbeaver, dvoc.OcPostgreSql); err != nil {
+		return "", err
+	}
+	id := "postgres-jdbc-" + strings.ToLower(strings.Map(func(c rune) rune {
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' {
+			return c
+		}
+		return '-'
+	}, endpoint.microService+"-"+endpoint.dbName))
+	name := endpoint.dbName
+	if endpoint.microService != "" {
+		name = endpoint.microService + " (" + endpoint.dbName + ")"
+	}
+	connection := map[string]interface{}{
+		"provider":      "postgresql",
+		"driver":        "postgres-jdbc",
+		"name":          name,
+		"save-password": true,
+		"configuration": map[string]interface{}{
+			"host":       endpoint.host,
+			"port":       strconv.Itoa(endpoint.port),
+			"database":   endpoint.dbName,
+			"url":        jdbcUrl(endpoint, endpoint.tlsQuery()),
+			"user":       endpoint.userName,
+			"password":   endpoint.password,
+			"type":       "dev",
+			"auth-model": "native",
+		},
+	}
+	sources := map[string]interface{}{
+		"folders":     map[string]interface{}{},
+		"connections": map[string]interface{}{id: connection},
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "\t")
+	if err := encoder.Encode(sources); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// escapePgpass escapes ':' and '\' as libpq expects in .pgpass
+func escapePgpass(s string) string {
+	return strings.NewReplacer("\\", "\\\\", ":", "\\:").Replace(s)
+}
+
+func formatDbPgpass(endpoint *dbEndpoint) (string, error) {
+	if err := endpoint.requireDatabase(dbFormatPgpass, dvoc.OcPostgreSql); err != nil {
+		return "", err
+	}
+	fields := []string{endpoint.host, strconv.Itoa(endpoint.port), endpoint.dbName, endpoint.userName, endpoint.password}
+	for i, field := range fields {
+		fields[i] = escapePgpass(field)
+	}
+	return strings.Join(fields, ":") + "\n", nil
+}
+
+func listDbFormats() string {
+	formats := make([]string, 0, len(dbFormatters))
+	for format := range dbFormatters {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	return strings.Join(formats, ", ")
+}
+
+func formatDbEndpoint(endpoint *dbEndpoint, format string) (string, error) {
+	formatter, ok := dbFormatters[format]
+	if !ok {
+		return "", errors.New("unknown format " + format + ", the formats are " + listDbFormats())
+	}
+	return formatter(endpoint)
+}
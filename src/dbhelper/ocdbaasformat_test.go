@@ -0,0 +1,183 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"encoding/json"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/Dobryvechir/dvserver/src/dvoc"
+)
+
+// testDbSpecialPassword has every character which must be escaped in the urls
+const testDbSpecialPassword = "p@ss:w/rd?#%+ &x"
+
+func createTestFormatEndpoint(database string, u string) *dbEndpoint {
+	info := &dvoc.ConnectionPropertiesInfo{Host: "db.local", Port: 6000, DbName: "orders", UserName: "app", Password: testDbSpecialPassword, Url: u}
+	return createDbEndpoint(info, database, "order-service")
+}
+
+func formatTestEndpoint(t *testing.T, endpoint *dbEndpoint, format string) string {
+	s, err := formatDbEndpoint(endpoint, format)
+	if err != nil {
+		t.Fatalf("%s of %s: %v", format, endpoint.database, err)
+	}
+	return strings.TrimSuffix(s, "\n")
+}
+
+// parseTestUrl parses the url and checks the host, the port and the database
+func parseTestUrl(t *testing.T, s string, scheme string) *url.URL {
+	u, err := url.Parse(strings.TrimPrefix(s, "jdbc:"))
+	if err != nil {
+		t.Fatalf("%s: %v", s, err)
+	}
+	if u.Scheme != scheme || u.Host != "db.local:6000" || u.Path != "/orders" {
+		t.Errorf("%s is parsed as %s://%s%s", s, u.Scheme, u.Host, u.Path)
+	}
+	return u
+}
+
+// checkTestUrlUser checks the user and the password of the userinfo
+func checkTestUrlUser(t *testing.T, u *url.URL) {
+	if password, _ := u.User.Password(); u.User.Username() != "app" || password != testDbSpecialPassword {
+		t.Errorf("%s: the user is %s and the password is %q", u, u.User.Username(), password)
+	}
+}
+
+// readTestProperties reads the properties written by formatDbSpring without the escapes
+func readTestProperties(s string) map[string]string {
+	props := make(map[string]string)
+	for _, line := range strings.Split(s, "\n") {
+		if p := strings.Index(line, "="); p > 0 {
+			props[line[:p]] = line[p+1:]
+		}
+	}
+	return props
+}
+
+func TestFormatDbEnvAndPgpass(t *testing.T) {
+	endpoint := createTestFormatEndpoint(dvoc.OcPostgreSql, "")
+	if env := formatTestEndpoint(t, endpoint, dbFormatEnv); !strings.Contains(env, "\nPASSWORD="+testDbSpecialPassword) {
+		t.Errorf("env %q", env)
+	}
+	if pgpass := formatTestEndpoint(t, endpoint, dbFormatPgpass); pgpass != `db.local:6000:orders:app:p@ss\:w/rd?#%+ &x` {
+		t.Errorf("pgpass %q", pgpass)
+	}
+}
+
+func TestFormatDbPostgres(t *testing.T) {
+	for u, sslMode := range map[string]string{
+		"jdbc:postgresql://pg:5432/orders?sslmode=verify-full": "verify-full",
+		"postgresql://pg:5432/orders?ssl=true":                 dbSslRequire,
+		"postgresql://pg:5432/orders":                          "",
+	} {
+		endpoint := createTestFormatEndpoint(dvoc.OcPostgreSql, u)
+
+		jdbc := parseTestUrl(t, formatTestEndpoint(t, endpoint, dbFormatJdbc), dvoc.OcPostgreSql)
+		query := jdbc.Query()
+		if query.Get("user") != "app" || query.Get("password") != testDbSpecialPassword || query.Get("sslmode") != sslMode {
+			t.Errorf("%s: jdbc %s", u, jdbc)
+		}
+
+		for _, format := range []string{dbFormatLibpq, dbFormatUri} {
+			libpq := parseTestUrl(t, formatTestEndpoint(t, endpoint, format), dvoc.OcPostgreSql)
+			checkTestUrlUser(t, libpq)
+			if libpq.Query().Get("sslmode") != sslMode {
+				t.Errorf("%s: %s %s has no sslmode %s", u, format, libpq, sslMode)
+			}
+		}
+
+		props := readTestProperties(formatTestEndpoint(t, endpoint, dbFormatSpring))
+		spring := parseTestUrl(t, props["spring.datasource.url"], dvoc.OcPostgreSql)
+		if spring.Query().Get("sslmode") != sslMode || props["spring.datasource.password"] != testDbSpecialPassword {
+			t.Errorf("%s: spring %v", u, props)
+		}
+
+		sources := struct {
+			Connections map[string]struct {
+				Configuration map[string]string `json:"configuration"`
+			} `json:"connections"`
+		}{}
+		if err := json.Unmarshal([]byte(formatTestEndpoint(t, endpoint, dbFormatDbeaver)), &sources); err != nil {
+			t.Fatal(err)
+		}
+		connection, ok := sources.Connections["postgres-jdbc-order-service-orders"]
+		if !ok || connection.Configuration["password"] != testDbSpecialPassword {
+			t.Fatalf("%s: dbeaver %+v", u, sources)
+		}
+		if dbeaver := parseTestUrl(t, connection.Configuration["url"], dvoc.OcPostgreSql); dbeaver.Query().Get("sslmode") != sslMode {
+			t.Errorf("%s: dbeaver url %s", u, dbeaver)
+		}
+	}
+}
+
+func TestFormatDbMongo(t *testing.T) {
+	for u, tls := range map[string]string{
+		"mongodb://mongo:27017/orders?authSource=orders&tls=true": "true",
+		"mongodb://mongo:27017/orders":                            "",
+	} {
+		endpoint := createTestFormatEndpoint(dvoc.OcMongoDb, u)
+		props := readTestProperties(formatTestEndpoint(t, endpoint, dbFormatSpring))
+		for _, s := range []string{formatTestEndpoint(t, endpoint, dbFormatMongo), formatTestEndpoint(t, endpoint, dbFormatUri), props["spring.data.mongodb.uri"]} {
+			mongo := parseTestUrl(t, s, "mongodb")
+			checkTestUrlUser(t, mongo)
+			if query := mongo.Query(); query.Get("tls") != tls || query.Get("authSource") != "orders" {
+				t.Errorf("%s: %s", u, mongo)
+			}
+		}
+	}
+}
+
+func TestFormatDbClickHouse(t *testing.T) {
+	endpoint := createTestFormatEndpoint(dbTypeClickHouse, "jdbc:clickhouse://ch:8443/orders?ssl=true")
+	jdbc := parseTestUrl(t, formatTestEndpoint(t, endpoint, dbFormatJdbc), dbTypeClickHouse)
+	if query := jdbc.Query(); query.Get("ssl") != "true" || query.Get("password") != testDbSpecialPassword {
+		t.Errorf("jdbc %s", jdbc)
+	}
+	uri := parseTestUrl(t, formatTestEndpoint(t, endpoint, dbFormatUri), dbTypeClickHouse)
+	checkTestUrlUser(t, uri)
+	if uri.Query().Get("secure") != "true" {
+		t.Errorf("uri %s", uri)
+	}
+	props := readTestProperties(formatTestEndpoint(t, endpoint, dbFormatSpring))
+	if spring := parseTestUrl(t, props["spring.datasource.url"], dbTypeClickHouse); spring.Query().Get("ssl") != "true" {
+		t.Errorf("spring %v", props)
+	}
+
+	endpoint = createTestFormatEndpoint(dbTypeClickHouse, "")
+	if jdbc = parseTestUrl(t, formatTestEndpoint(t, endpoint, dbFormatJdbc), dbTypeClickHouse); jdbc.Query().Get("ssl") != "" {
+		t.Errorf("jdbc without tls %s", jdbc)
+	}
+}
+
+func TestFormatDbRedisAndOpenSearch(t *testing.T) {
+	endpoint := createTestFormatEndpoint(dbTypeRedis, "rediss://redis:6380/0")
+	endpoint.dbName = "0"
+	redis, err := url.Parse(formatTestEndpoint(t, endpoint, dbFormatUri))
+	if err != nil || redis.Scheme != "rediss" || redis.Path != "/0" {
+		t.Fatalf("redis %s: %v", redis, err)
+	}
+	checkTestUrlUser(t, redis)
+	if props := readTestProperties(formatTestEndpoint(t, endpoint, dbFormatSpring)); props["spring.data.redis.password"] != testDbSpecialPassword ||
+		props["spring.data.redis.ssl.enabled"] != "true" {
+		t.Errorf("spring %v", props)
+	}
+
+	endpoint = createTestFormatEndpoint(dbTypeOpenSearch, "")
+	search, err := url.Parse(formatTestEndpoint(t, endpoint, dbFormatUri))
+	if err != nil || search.Scheme != "https" || search.Host != "db.local:6000" {
+		t.Fatalf("opensearch %s: %v", search, err)
+	}
+	checkTestUrlUser(t, search)
+}
+
+func TestFormatDbUnsupported(t *testing.T) {
+	for format, database := range map[string]string{dbFormatJdbc: dvoc.OcMongoDb, dbFormatLibpq: dbTypeRedis, dbFormatMongo: dvoc.OcPostgreSql,
+		dbFormatDbeaver: dbTypeCassandra, dbFormatPgpass: dbTypeClickHouse, dbFormatUri: dbTypeCassandra, "xml": dvoc.OcPostgreSql} {
+		if s, err := formatDbEndpoint(createTestFormatEndpoint(database, ""), format); err == nil {
+			t.Errorf("%s of %s is %q", format, database, s)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+)
+
+const (
+	mongoOpMsg        = 2013
+	mongoMaxMessage   = 48 << 20
+	mongoScramSha1    = "SCRAM-SHA-1"
+	mongoScramSha256  = "SCRAM-SHA-256"
+	mongoAdminDb      = "admin"
+	mongoMaxSaslSteps = 4
+)
+
+// bsonElement keeps the order of the command fields, mongo takes the command name from the first one
+type bsonElement struct {
+	name  string
+	value interface{}
+}
+
+func appendBsonInt32(b []byte, n int32) []byte {
+	return append(b, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+}
+
+func encodeBsonDocument(elements []bsonElement) ([]byte, error) {
+	b := []byte{0, 0, 0, 0}
+	for _, e := range elements {
+		var kind byte
+		var data []byte
+		switch v := e.value.(type) {
+		case float64:
+			kind = 0x01
+			data = make([]byte, 8)
+			binary.LittleEndian.PutUint64(data, math.Float64bits(v))
+		case string:
+			kind = 0x02
+			data = append(appendBsonInt32(nil, int32(len(v)+1)), v...)
+			data = append(data, 0)
+		case []bsonElement:
+			kind = 0x03
+			doc, err := encodeBsonDocument(v)
+			if err != nil {
+				return nil, err
+			}
+			data = doc
+		case []byte:
+			kind = 0x05
+			data = append(append(appendBsonInt32(nil, int32(len(v))), 0), v...)
+		case bool:
+			kind = 0x08
+			data = []byte{0}
+			if v {
+				data[0] = 1
+			}
+		case int32:
+			kind = 0x10
+			data = appendBsonInt32(nil, v)
+		case int:
+			kind = 0x10
+			data = appendBsonInt32(nil, int32(v))
+		default:
+			return nil, fmt.Errorf("unsupported bson value %T of %s", v, e.name)
+		}
+		b = append(b, kind)
+		b = append(b, e.name...)
+		b = append(b, 0)
+		b = append(b, data...)
+	}
+	b = append(b, 0)
+	binary.LittleEndian.PutUint32(b, uint32(len(b)))
+	return b, nil
+}
+
+func readBsonCString(data []byte) (string, []byte, error) {
+	p := bytes.IndexByte(data, 0)
+	if p < 0 {
+		return "", nil, errors.New("unterminated bson name")
+	}
+	return string(data[:p]), data[p+1:], nil
+}
+
+// decodeBsonDocument decodes the reply of mongo, the arrays are decoded as []interface{}
+func decodeBsonDocument(data []byte) (map[string]interface{}, error) {
+	if len(data) < 5 || int(binary.LittleEndian.Uint32(data)) != len(data) {
+		return nil, errors.New("incorrect bson document length")
+	}
+	doc := make(map[string]interface{})
+	data = data[4 : len(data)-1]
+	for len(data) > 0 {
+		kind := data[0]
+		name, rest, err := readBsonCString(data[1:])
+		if err != nil {
+			return nil, err
+		}
+		size := 0
+		var value interface{}
+		switch kind {
+		case 0x01, 0x09, 0x11, 0x12:
+			size = 8
+		case 0x07:
+			size = 12
+		case 0x13:
+			size = 16
+		case 0x08:
+			size = 1
+		case 0x0a:
+		case 0x10:
+			size = 4
+		case 0x02, 0x0d, 0x0e:
+			if len(rest) < 4 {
+				return nil, errors.New("truncated bson string")
+			}
+			size = 4 + int(binary.LittleEndian.Uint32(rest))
+		case 0x03, 0x04:
+			if len(rest) < 4 {
+				return nil, errors.New("truncated bson document")
+			}
+			size = int(binary.LittleEndian.Uint32(rest))
+		case 0x05:
+			if len(rest) < 4 {
+				return nil, errors.New("truncated bson binary")
+			}
+			size = 5 + int(binary.LittleEndian.Uint32(rest))
+		default:
+			return nil, fmt.Errorf("unsupported bson type %#x of %s", kind, name)
+		}
+		if size < 0 || size > len(rest) {
+			return nil, errors.New("truncated bson value of " + name)
+		}
+		field := rest[:size]
+		switch kind {
+		case 0x01:
+			value = math.Float64frombits(binary.LittleEndian.Uint64(field))
+		case 0x02, 0x0d, 0x0e:
+			value = string(bytes.TrimRight(field[4:], "\x00"))
+		case 0x03, 0x04:
+			sub, err := decodeBsonDocument(field)
+			if err != nil {
+				return nil, err
+			}
+			value = sub
+			if kind == 0x04 {
+				list := make([]interface{}, len(sub))
+				for i := range list {
+					list[i] = sub[fmt.Sprint(i)]
+				}
+				value = list
+			}
+		case 0x05:
+			value = field[5:]
+		case 0x08:
+			value = field[0] != 0
+		case 0x10:
+			value = int32(binary.LittleEndian.Uint32(field))
+		case 0x12:
+			value = int64(binary.LittleEndian.Uint64(field))
+		}
+		doc[name] = value
+		data = rest[size:]
+	}
+	return doc, nil
+}
+
+type mongoConnection struct {
+	conn      net.Conn
+	requestId int32
+}
+
+// command sends OP_MSG with the single body section and returns the reply, ok: 0 is returned as the error
+func (c *mongoConnection) command(elements []bsonElement) (map[string]interface{}, error) {
+	doc, err := encodeBsonDocument(elements)
+	if err != nil {
+		return nil, err
+	}
+	c.requestId++
+	message := appendBsonInt32(nil, int32(16+4+1+len(doc)))
+	message = appendBsonInt32(message, c.requestId)
+	message = appendBsonInt32(message, 0)
+	message = appendBsonInt32(message, mongoOpMsg)
+	message = appendBsonInt32(message, 0)
+	message = append(append(message, 0), doc...)
+	if _, err = c.conn.Write(message); err != nil {
+		return nil, err
+	}
+	header := make([]byte, 16)
+	if _, err = io.ReadFull(c.conn, header); err != nil {
+		return nil, err
+	}
+	size := int(binary.LittleEndian.Uint32(header))
+	if size < 21 || size > mongoMaxMessage || binary.LittleEndian.Uint32(header[12:]) != mongoOpMsg {
+		return nil, errors.New("unexpected mongo reply")
+	}
+	body := make([]byte, size-16)
+	if _, err = io.ReadFull(c.conn, body); err != nil {
+		return nil, err
+	}
+	if body[4] != 0 {
+		return nil, errors.New("unexpected mongo reply section")
+	}
+	reply, err := decodeBsonDocument(body[5:])
+	if err != nil {
+		return nil, err
+	}
+	if !isMongoOk(reply) {
+		return reply, fmt.Errorf("%v (code %v)", reply["errmsg"], reply["code"])
+	}
+	return reply, nil
+}
+
+func isMongoOk(reply map[string]interface{}) bool {
+	switch v := reply["ok"].(type) {
+	case float64:
+		return v == 1
+	case int32:
+		return v == 1
+	case bool:
+		return v
+	}
+	return false
+}
+
+// authenticate performs SCRAM-SHA-256 if the user has it, otherwise SCRAM-SHA-1 with the mongo password digest
+func (c *mongoConnection) authenticate(authSource string, user string, password string, mechanisms []interface{}) error {
+	mechanism := mongoScramSha1
+	for _, m := range mechanisms {
+		if m == mongoScramSha256 {
+			mechanism = mongoScramSha256
+		}
+	}
+	scram := newScramClient(sha256.New, user, password)
+	if mechanism == mongoScramSha1 {
+		scram = newScramClient(sha1.New, user, md5Hex(user+":mongo:"+password))
+	}
+	reply, err := c.command([]bsonElement{
+		{"saslStart", 1},
+		{"mechanism", mechanism},
+		{"payload", []byte(scram.clientFirst())},
+		{"autoAuthorize", 1},
+		{"options", []bsonElement{{"skipEmptyExchange", true}}},
+		{"$db", authSource},
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %v", mechanism, err)
+	}
+	payload, _ := reply["payload"].([]byte)
+	final, err := scram.clientFinal(string(payload))
+	if err != nil {
+		return err
+	}
+	verified := false
+	for step := 0; step < mongoMaxSaslSteps; step++ {
+		if reply, err = c.command([]bsonElement{
+			{"saslContinue", 1},
+			{"conversationId", reply["conversationId"]},
+			{"payload", []byte(final)},
+			{"$db", authSource},
+		}); err != nil {
+			return fmt.Errorf("%s: %v", mechanism, err)
+		}
+		if !verified {
+			payload, _ = reply["payload"].([]byte)
+			if err = scram.verifyServerFinal(string(payload)); err != nil {
+				return err
+			}
+			verified = true
+		}
+		if done, _ := reply["done"].(bool); done {
+			return nil
+		}
+		final = ""
+	}
+	return errors.New("SASL conversation is not finished")
+}
+
+// checkMongo says hello with the supported mechanisms of the user, authenticates and asks the server version
+func checkMongo(endpoint *dbEndpoint) (string, error) {
+	conn, err := dialDbEndpoint(endpoint, endpoint.requiresTls())
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	c := &mongoConnection{conn: conn}
+	authSource := endpoint.dbName
+	if authSource == "" {
+		authSource = mongoAdminDb
+	}
+	hello := []bsonElement{
+		{"hello", 1},
+		{"client", []bsonElement{{"application", []bsonElement{{"name", dbCheckApplication}}}}},
+		{"saslSupportedMechs", authSource + "." + endpoint.userName},
+		{"$db", mongoAdminDb},
+	}
+	reply, err := c.command(hello)
+	if err != nil {
+		// the servers before 4.4.2 know only isMaster
+		hello[0] = bsonElement{"isMaster", 1}
+		if reply, err = c.command(hello); err != nil {
+			return "", err
+		}
+	}
+	if endpoint.userName != "" {
+		mechanisms, _ := reply["saslSupportedMechs"].([]interface{})
+		if err = c.authenticate(authSource, endpoint.userName, endpoint.password, mechanisms); err != nil {
+			return "", err
+		}
+	}
+	info, err := c.command([]bsonElement{{"buildInfo", 1}, {"$db", authSource}})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("MongoDB %v", info["version"]), nil
+}
@@ -0,0 +1,118 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// scramClient is the client side of SCRAM (RFC 5802, RFC 7677) without channel binding
+type scramClient struct {
+	newHash         func() hash.Hash
+	user            string
+	password        string
+	nonce           string
+	clientFirstBare string
+	serverSignature []byte
+}
+
+func newScramClient(newHash func() hash.Hash, user string, password string) *scramClient {
+	b := make([]byte, 18)
+	rand.Read(b)
+	return &scramClient{newHash: newHash, user: user, password: password, nonce: base64.StdEncoding.EncodeToString(b)}
+}
+
+// pbkdf2 is PBKDF2 (RFC 8018) with HMAC of the hash, the key has the size of the hash
+func pbkdf2(newHash func() hash.Hash, password []byte, salt []byte, iterations int) []byte {
+	mac := hmac.New(newHash, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	result := make([]byte, len(u))
+	copy(result, u)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
+
+func (c *scramClient) hmac(key []byte, data string) []byte {
+	mac := hmac.New(c.newHash, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func (c *scramClient) clientFirst() string {
+	name := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(c.user)
+	c.clientFirstBare = "n=" + name + ",r=" + c.nonce
+	return "n,," + c.clientFirstBare
+}
+
+func parseScramAttributes(message string) map[byte]string {
+	attributes := make(map[byte]string)
+	for _, field := range strings.Split(message, ",") {
+		if len(field) >= 2 && field[1] == '=' {
+			attributes[field[0]] = field[2:]
+		}
+	}
+	return attributes
+}
+
+// clientFinal checks the server nonce and returns the proof of the password
+func (c *scramClient) clientFinal(serverFirst string) (string, error) {
+	attributes := parseScramAttributes(serverFirst)
+	if e, ok := attributes['e']; ok {
+		return "", errors.New("SCRAM error " + e)
+	}
+	nonce := attributes['r']
+	if !strings.HasPrefix(nonce, c.nonce) || len(nonce) == len(c.nonce) {
+		return "", errors.New("SCRAM server nonce is not valid")
+	}
+	salt, err := base64.StdEncoding.DecodeString(attributes['s'])
+	if err != nil {
+		return "", errors.New("SCRAM salt is not valid")
+	}
+	iterations, err := strconv.Atoi(attributes['i'])
+	if err != nil || iterations <= 0 {
+		return "", errors.New("SCRAM iteration count is not valid")
+	}
+	salted := pbkdf2(c.newHash, []byte(c.password), salt, iterations)
+	clientKey := c.hmac(salted, "Client Key")
+	h := c.newHash()
+	h.Write(clientKey)
+	storedKey := h.Sum(nil)
+	withoutProof := "c=biws,r=" + nonce
+	authMessage := c.clientFirstBare + "," + serverFirst + "," + withoutProof
+	clientSignature := c.hmac(storedKey, authMessage)
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+	c.serverSignature = c.hmac(c.hmac(salted, "Server Key"), authMessage)
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+// verifyServerFinal makes sure the server knows the password too
+func (c *scramClient) verifyServerFinal(serverFinal string) error {
+	attributes := parseScramAttributes(serverFinal)
+	if e, ok := attributes['e']; ok {
+		return errors.New("SCRAM error " + e)
+	}
+	signature, err := base64.StdEncoding.DecodeString(attributes['v'])
+	if err != nil || subtle.ConstantTimeCompare(signature, c.serverSignature) != 1 {
+		return errors.New("SCRAM server signature is not valid")
+	}
+	return nil
+}
@@ -3,18 +3,225 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 )
 
+// the exit codes are for the scripts which wait for the pods
+const (
+	waitExitMet     = 0
+	waitExitTimeout = 1
+	waitExitUsage   = 2
+)
+
+const (
+	waitDefaultSeconds     = 5
+	waitDefaultTimeout     = 300 * time.Second
+	waitDefaultInterval    = time.Second
+	waitDefaultMaxInterval = 30 * time.Second
+	waitDefaultBackoff     = 1.5
+	waitDefaultStatus      = "2xx"
+)
+
+var helpSleep = "Copyright by Danyil Dobryvechir 2019\n" +
+	"sleep [<time>]                      sleep for the time, such as 5, 0.5 or 500ms (default 5 seconds)\n" +
+	"sleep [options] <condition> ...     wait until all the conditions are met\n" +
+	"conditions:\n" +
+	"  tcp:<host>:<port>     the port accepts connections\n" +
+	"  http(s)://<url>       GET of the url returns the expected status and body\n" +
+	"  file:<path>           the file exists and contains the expected text\n" +
+	"  cmd:<command>         the command exits with 0, it is run by sh -c (cmd /C on Windows)\n" +
+	"options:\n" +
+	"  --timeout=<time>      time to give up, 0 to wait forever (default 300s), every check takes up to 10s and stops\n" +
+	"                        at the timeout, the killed command stops with its children\n" +
+	"  --interval=<time>     pause after the first failed check (default 1s)\n" +
+	"  --backoff=<factor>    the pause is multiplied by the factor after every failed check (default 1.5)\n" +
+	"  --max-interval=<time> the longest pause (default 30s)\n" +
+	"  --status=<codes>      comma-separated HTTP statuses, x matches any digit (default 2xx)\n" +
+	"  --body=<text>         the HTTP body must contain the text\n" +
+	"  --contains=<text>     the file must contain the text\n" +
+	"  --any                 wait until any of the conditions is met\n" +
+	"  --quiet               print nothing but the errors\n" +
+	"  --cert=<file>         client certificate (PEM) for mutual TLS\n" +
+	"  --key=<file>          private key (PEM) of the client certificate (default - the --cert file)\n" +
+	"  --cacert=<file>       CA bundle (PEM) to verify the servers in addition to the system ones\n" +
+	"  --proxy=<url>         HTTP(S) proxy (default - HTTPS_PROXY/HTTP_PROXY environment)\n" +
+	"  --no-proxy=<list>     hosts, domains (.example.com), CIDRs or * to reach without proxy\n" +
+	"                        (default - NO_PROXY environment)\n" +
+	"  --insecure            skip the verification of the server certificates\n" +
+	"the time is in seconds or with the unit like 500ms, 2m, 1h30m\n" +
+	"exit codes: 0 - the conditions are met, 1 - timeout, 2 - incorrect command line"
+
+type waitOptions struct {
+	timeout     time.Duration
+	interval    time.Duration
+	maxInterval time.Duration
+	backoff     float64
+	status      string
+	body        string
+	contains    string
+	any         bool
+	quiet       bool
+	tls         *netTlsOptions
+}
+
+func parseWaitDuration(s string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil && seconds >= 0 {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, errors.New("incorrect time " + s)
+	}
+	return d, nil
+}
+
+// readWaitOptions takes the options anywhere in the command line, --status, --body and --contains apply to all conditions
+func readWaitOptions(args []string) (*waitOptions, []string, error) {
+	options := &waitOptions{
+		timeout:     waitDefaultTimeout,
+		interval:    waitDefaultInterval,
+		maxInterval: waitDefaultMaxInterval,
+		backoff:     waitDefaultBackoff,
+		status:      waitDefaultStatus,
+		tls:         &netTlsOptions{},
+	}
+	rest := make([]string, 0, len(args))
+	var err error
+	for _, arg := range args {
+		switch {
+		case readNetTlsOption(options.tls, arg):
+		case strings.HasPrefix(arg, "--timeout="):
+			options.timeout, err = parseWaitDuration(arg[len("--timeout="):])
+		case strings.HasPrefix(arg, "--interval="):
+			options.interval, err = parseWaitDuration(arg[len("--interval="):])
+		case strings.HasPrefix(arg, "--max-interval="):
+			options.maxInterval, err = parseWaitDuration(arg[len("--max-interval="):])
+		case strings.HasPrefix(arg, "--backoff="):
+			options.backoff, err = strconv.ParseFloat(arg[len("--backoff="):], 64)
+			if err != nil || options.backoff < 1 {
+				err = errors.New("the backoff must be a number not less than 1 instead of " + arg[len("--backoff="):])
+			}
+		case strings.HasPrefix(arg, "--status="):
+			options.status = arg[len("--status="):]
+		case strings.HasPrefix(arg, "--body="):
+			options.body = arg[len("--body="):]
+		case strings.HasPrefix(arg, "--contains="):
+			options.contains = arg[len("--contains="):]
+		case arg == "--any":
+			options.any = true
+		case arg == "--quiet":
+			options.quiet = true
+		case strings.HasPrefix(arg, "--"):
+			err = errors.New("unknown option " + arg)
+		default:
+			rest = append(rest, arg)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if options.interval <= 0 {
+		return nil, nil, errors.New("the interval must be positive")
+	}
+	if options.maxInterval < options.interval {
+		options.maxInterval = options.interval
+	}
+	return options, rest, nil
+}
+
+// waitForConditions checks the unmet conditions until all (or any) are met or the timeout expires
+func waitForConditions(conditions []*waitCondition, options *waitOptions) int {
+	start := time.Now()
+	var deadline time.Time
+	if options.timeout > 0 {
+		deadline = start.Add(options.timeout)
+	}
+	lastErrors := make(map[*waitCondition]string)
+	pending := conditions
+	interval := options.interval
+	for attempt := 1; ; attempt++ {
+		unmet := make([]*waitCondition, 0, len(pending))
+		for _, condition := range pending {
+			err := checkWaitCondition(condition, deadline)
+			if err == nil {
+				if !options.quiet {
+					fmt.Printf("%s is ready after %s\n", condition.description, time.Since(start).Round(time.Millisecond))
+				}
+				if options.any {
+					return waitExitMet
+				}
+				continue
+			}
+			if !options.quiet && lastErrors[condition] != err.Error() {
+				fmt.Printf("Waiting for %s: %v\n", condition.description, err)
+			}
+			lastErrors[condition] = err.Error()
+			unmet = append(unmet, condition)
+		}
+		if len(unmet) == 0 {
+			return waitExitMet
+		}
+		pending = unmet
+		pause := interval
+		if !deadline.IsZero() {
+			left := time.Until(deadline)
+			if left <= 0 {
+				for _, condition := range pending {
+					fmt.Printf("Timeout %s after %d attempts waiting for %s: %s\n", options.timeout, attempt, condition.description, lastErrors[condition])
+				}
+				return waitExitTimeout
+			}
+			if pause > left {
+				pause = left
+			}
+		}
+		time.Sleep(pause)
+		interval = nextWaitInterval(interval, options)
+	}
+}
+
+// nextWaitInterval multiplies the pause by the backoff up to the longest pause
+func nextWaitInterval(interval time.Duration, options *waitOptions) time.Duration {
+	interval = time.Duration(float64(interval) * options.backoff)
+	if interval > options.maxInterval {
+		interval = options.maxInterval
+	}
+	return interval
+}
+
 func main() {
-	args := os.Args
-	timeSec := 5
-	if len(args) > 1 {
-		timeSec, _ = strconv.Atoi(os.Args[1])
+	options, args, err := readWaitOptions(os.Args[1:])
+	if err != nil {
+		fmt.Println(helpSleep)
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(waitExitUsage)
+	}
+	if len(args) <= 1 {
+		duration := waitDefaultSeconds * time.Second
+		if len(args) == 1 {
+			duration, err = parseWaitDuration(args[0])
+		}
+		// the single argument which is not a time is the condition
+		if err == nil {
+			if !options.quiet {
+				fmt.Printf("Waiting for %s\n", duration)
+			}
+			time.Sleep(duration)
+			return
+		}
+	}
+	conditions := make([]*waitCondition, len(args))
+	for i, arg := range args {
+		if conditions[i], err = createWaitCondition(arg, options); err != nil {
+			fmt.Println(helpSleep)
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(waitExitUsage)
+		}
 	}
-	fmt.Printf("Waiting for %ds\n", timeSec)
-	time.Sleep(time.Duration(timeSec) * time.Second)
+	os.Exit(waitForConditions(conditions, options))
 }
@@ -0,0 +1,26 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// createShellCommand runs the command by sh in its own process group, so that killCommandTree stops
+// the pipelines and the background children too
+func createShellCommand(target string) *exec.Cmd {
+	command := exec.Command("sh", "-c", target)
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	return command
+}
+
+// killCommandTree kills the process group of sh
+func killCommandTree(command *exec.Cmd) {
+	if err := syscall.Kill(-command.Process.Pid, syscall.SIGKILL); err != nil {
+		command.Process.Kill()
+	}
+}
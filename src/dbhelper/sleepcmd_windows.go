@@ -0,0 +1,23 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os/exec"
+	"strconv"
+)
+
+// createShellCommand runs the command by cmd, Windows has no process groups, so the tree is killed by taskkill
+func createShellCommand(target string) *exec.Cmd {
+	return exec.Command("cmd", "/C", target)
+}
+
+// killCommandTree kills the process tree of cmd
+func killCommandTree(command *exec.Cmd) {
+	if err := exec.Command("taskkill", "/T", "/F", "/PID", strconv.Itoa(command.Process.Pid)).Run(); err != nil {
+		command.Process.Kill()
+	}
+}
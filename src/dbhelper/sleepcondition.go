@@ -0,0 +1,230 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	waitAttemptTimeout    = 10 * time.Second
+	waitMinAttemptTimeout = time.Second
+	waitMaxBodySize       = 1 << 20
+	waitMaxErrorText      = 200
+)
+
+// waitCondition is checked again and again until check returns nil
+type waitCondition struct {
+	description string
+	check       func(ctx context.Context) error
+}
+
+type waitConditionFactory func(target string, options *waitOptions) (*waitCondition, error)
+
+var waitConditionFactories = map[string]waitConditionFactory{
+	"tcp":   createTcpCondition,
+	"http":  createHttpCondition,
+	"https": createHttpCondition,
+	"file":  createFileCondition,
+	"cmd":   createCmdCondition,
+}
+
+func createWaitCondition(arg string, options *waitOptions) (*waitCondition, error) {
+	p := strings.Index(arg, ":")
+	if p <= 0 {
+		return nil, errors.New("unknown condition " + arg)
+	}
+	kind := strings.ToLower(arg[:p])
+	factory, ok := waitConditionFactories[kind]
+	if !ok {
+		return nil, errors.New("unknown condition " + arg)
+	}
+	target := arg[p+1:]
+	if kind == "http" || kind == "https" {
+		target = arg
+	}
+	if target == "" {
+		return nil, errors.New("empty condition " + arg)
+	}
+	return factory(target, options)
+}
+
+func createTcpCondition(target string, options *waitOptions) (*waitCondition, error) {
+	if _, port, err := net.SplitHostPort(target); err != nil || port == "" {
+		return nil, errors.New("tcp:<host>:<port> is expected instead of tcp:" + target)
+	}
+	return &waitCondition{
+		description: "port " + target,
+		check: func(ctx context.Context) error {
+			dialer := &net.Dialer{}
+			conn, err := dialer.DialContext(ctx, "tcp", target)
+			if err != nil {
+				return err
+			}
+			return conn.Close()
+		},
+	}, nil
+}
+
+// matchHttpStatus accepts the exact codes and the masks like 2xx
+func matchHttpStatus(statuses []string, code int) bool {
+	s := strconv.Itoa(code)
+	for _, status := range statuses {
+		status = strings.ToLower(strings.TrimSpace(status))
+		if len(status) != len(s) {
+			continue
+		}
+		matched := true
+		for i := range s {
+			if status[i] != 'x' && status[i] != s[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func shortenWaitText(s string) string {
+	s = strings.Join(strings.Fields(s), " ")
+	if len(s) > waitMaxErrorText {
+		s = s[:waitMaxErrorText] + "..."
+	}
+	return s
+}
+
+func createHttpCondition(target string, options *waitOptions) (*waitCondition, error) {
+	client, err := createNetClient(options.tls)
+	if err != nil {
+		return nil, err
+	}
+	statuses := strings.Split(options.status, ",")
+	description := target + " returns " + options.status
+	if options.body != "" {
+		description += " with " + options.body
+	}
+	return &waitCondition{
+		description: description,
+		check: func(ctx context.Context) error {
+			request, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+			if err != nil {
+				return err
+			}
+			response, err := client.Do(request)
+			if err != nil {
+				return err
+			}
+			defer response.Body.Close()
+			data, err := ioutil.ReadAll(io.LimitReader(response.Body, waitMaxBodySize))
+			if err != nil {
+				return err
+			}
+			if !matchHttpStatus(statuses, response.StatusCode) {
+				return fmt.Errorf("status %d %s", response.StatusCode, shortenWaitText(string(data)))
+			}
+			if options.body != "" && !strings.Contains(string(data), options.body) {
+				return fmt.Errorf("status %d without %s in the body", response.StatusCode, options.body)
+			}
+			return nil
+		},
+	}, nil
+}
+
+func createFileCondition(target string, options *waitOptions) (*waitCondition, error) {
+	description := "file " + target
+	if options.contains != "" {
+		description += " with " + options.contains
+	}
+	contains := options.contains
+	return &waitCondition{
+		description: description,
+		check: func(ctx context.Context) error {
+			if contains == "" {
+				_, err := os.Stat(target)
+				return err
+			}
+			data, err := ioutil.ReadFile(target)
+			if err != nil {
+				return err
+			}
+			if !strings.Contains(string(data), contains) {
+				return errors.New("the file has no " + contains)
+			}
+			return nil
+		},
+	}, nil
+}
+
+func readCmdOutput(output *os.File) string {
+	data, _ := ioutil.ReadAll(io.LimitReader(io.NewSectionReader(output, 0, waitMaxBodySize), waitMaxBodySize))
+	return shortenWaitText(string(data))
+}
+
+// createCmdCondition runs the command by the shell, so the pipes and the quotes work as in the scripts;
+// the output goes to a file, because the children left after the kill would keep a pipe open and block Wait
+func createCmdCondition(target string, options *waitOptions) (*waitCondition, error) {
+	return &waitCondition{
+		description: "command " + target,
+		check: func(ctx context.Context) error {
+			output, err := ioutil.TempFile("", "sleepcmd")
+			if err != nil {
+				return err
+			}
+			defer os.Remove(output.Name())
+			defer output.Close()
+			command := createShellCommand(target)
+			command.Stdout = output
+			command.Stderr = output
+			start := time.Now()
+			if err = command.Start(); err != nil {
+				return err
+			}
+			done := make(chan error, 1)
+			go func() { done <- command.Wait() }()
+			select {
+			case err = <-done:
+			case <-ctx.Done():
+				killCommandTree(command)
+				<-done
+				err = fmt.Errorf("killed after %s", time.Since(start).Round(time.Millisecond))
+			}
+			if err != nil {
+				if text := readCmdOutput(output); text != "" {
+					return fmt.Errorf("%v: %s", err, text)
+				}
+				return err
+			}
+			return nil
+		},
+	}, nil
+}
+
+// checkWaitCondition limits every attempt by waitAttemptTimeout and by the time left to the deadline, but gives it
+// at least waitMinAttemptTimeout, so the last attempt after the timeout still reports the real reason
+func checkWaitCondition(condition *waitCondition, deadline time.Time) error {
+	timeout := waitAttemptTimeout
+	if !deadline.IsZero() {
+		if left := time.Until(deadline); left < timeout {
+			timeout = left
+		}
+		if timeout < waitMinAttemptTimeout {
+			timeout = waitMinAttemptTimeout
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return condition.check(ctx)
+}
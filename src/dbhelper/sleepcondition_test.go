@@ -0,0 +1,244 @@
+// Copyright by Danyil Dobryvechir 2019 (dobrivecher@yahoo.com, ddobryvechir@gmail.com)
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readTestWaitOptions(t *testing.T, args ...string) *waitOptions {
+	options, _, err := readWaitOptions(append(args, "--quiet"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return options
+}
+
+func checkTestCondition(t *testing.T, arg string, options *waitOptions) error {
+	condition, err := createWaitCondition(arg, options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return checkWaitCondition(condition, time.Time{})
+}
+
+// createCountedCondition fails until the check is called the given number of times, 0 never succeeds
+func createCountedCondition(name string, succeedAt int, times *[]time.Time) *waitCondition {
+	attempts := 0
+	return &waitCondition{
+		description: name,
+		check: func(ctx context.Context) error {
+			attempts++
+			if times != nil {
+				*times = append(*times, time.Now())
+			}
+			if succeedAt > 0 && attempts >= succeedAt {
+				return nil
+			}
+			return fmt.Errorf("attempt %d", attempts)
+		},
+	}
+}
+
+func TestParseWaitDuration(t *testing.T) {
+	for s, expected := range map[string]time.Duration{
+		"0.5":   500 * time.Millisecond,
+		"500ms": 500 * time.Millisecond,
+		"2":     2 * time.Second,
+		"1h30m": 90 * time.Minute,
+	} {
+		if d, err := parseWaitDuration(s); err != nil || d != expected {
+			t.Errorf("%s: %s %v instead of %s", s, d, err, expected)
+		}
+	}
+	for _, s := range []string{"x", "-1", "-2s", "tcp:localhost:80"} {
+		if d, err := parseWaitDuration(s); err == nil {
+			t.Errorf("%s is taken as %s", s, d)
+		}
+	}
+}
+
+func TestCmdConditionOutput(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the commands are for sh")
+	}
+	options, _, _ := readWaitOptions(nil)
+	condition, err := createWaitCondition("cmd:echo not ready >&2; exit 3", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = checkWaitCondition(condition, time.Time{}); err == nil || !strings.Contains(err.Error(), "not ready") {
+		t.Errorf("the failure is reported as %v", err)
+	}
+	condition, _ = createWaitCondition("cmd:true", options)
+	if err = checkWaitCondition(condition, time.Time{}); err != nil {
+		t.Error(err)
+	}
+}
+
+// the children of sh keep the output pipe open, the timeout must not wait for them
+func TestCmdConditionTimeoutKillsChildren(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the commands are for sh")
+	}
+	options, _, err := readWaitOptions([]string{"--timeout=1", "--interval=100ms", "--quiet"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	condition, err := createWaitCondition("cmd:sleep 25 | cat; exit 1", options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if code := waitForConditions([]*waitCondition{condition}, options); code != waitExitTimeout {
+		t.Errorf("exit code %d instead of %d", code, waitExitTimeout)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("the timeout of 1s took %s", elapsed)
+	}
+}
+
+func TestTcpCondition(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	options := readTestWaitOptions(t)
+	if err = checkTestCondition(t, "tcp:"+address, options); err != nil {
+		t.Errorf("the listening port is not ready: %v", err)
+	}
+	listener.Close()
+	if err = checkTestCondition(t, "tcp:"+address, options); err == nil {
+		t.Error("the closed port is ready")
+	}
+	for _, arg := range []string{"tcp:localhost", "tcp:", "udp:localhost:53"} {
+		if _, err = createWaitCondition(arg, options); err == nil {
+			t.Errorf("%s is accepted", arg)
+		}
+	}
+}
+
+func TestHttpConditionStatusAndBody(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/ready":
+			w.WriteHeader(http.StatusNoContent)
+		case "/health":
+			w.Write([]byte(`{"status":"UP"}`))
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("starting\n  the context"))
+		}
+	}))
+	defer server.Close()
+	for _, test := range []struct {
+		path    string
+		args    []string
+		failure string
+	}{
+		{"/ready", nil, ""},
+		{"/starting", nil, "status 503 starting the context"},
+		{"/starting", []string{"--status=200,5x3"}, ""},
+		{"/ready", []string{"--status=200, 3xx"}, "status 204"},
+		{"/health", []string{"--body=\"UP\""}, ""},
+		{"/health", []string{"--body=DOWN"}, "status 200 without DOWN in the body"},
+		{"/starting", []string{"--status=503", "--body=UP"}, "without UP"},
+	} {
+		err := checkTestCondition(t, server.URL+test.path, readTestWaitOptions(t, test.args...))
+		if test.failure == "" && err != nil || test.failure != "" && (err == nil || !strings.Contains(err.Error(), test.failure)) {
+			t.Errorf("%s %v: %v instead of %q", test.path, test.args, err, test.failure)
+		}
+	}
+	for status, expected := range map[string]bool{"2xx": true, "20x,404": true, "200": false, "xx1": true, "2x": false, "3xx, 201": true} {
+		if matchHttpStatus(strings.Split(status, ","), 201) != expected {
+			t.Errorf("%s matches 201: %v", status, !expected)
+		}
+	}
+}
+
+func TestFileConditionContains(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "started.log")
+	exists := readTestWaitOptions(t)
+	contains := readTestWaitOptions(t, "--contains=Started Application")
+	if err := checkTestCondition(t, "file:"+fileName, exists); !os.IsNotExist(err) {
+		t.Errorf("the absent file gives %v", err)
+	}
+	if err := ioutil.WriteFile(fileName, []byte("Starting Application\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkTestCondition(t, "file:"+fileName, exists); err != nil {
+		t.Errorf("the file is not ready: %v", err)
+	}
+	if err := checkTestCondition(t, "file:"+fileName, contains); err == nil || !strings.Contains(err.Error(), "has no Started Application") {
+		t.Errorf("the file without the text gives %v", err)
+	}
+	if err := ioutil.WriteFile(fileName, []byte("Starting Application\nStarted Application in 3.2 seconds\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkTestCondition(t, "file:"+fileName, contains); err != nil {
+		t.Errorf("the file with the text is not ready: %v", err)
+	}
+}
+
+func TestWaitForAnyCondition(t *testing.T) {
+	options := readTestWaitOptions(t, "--timeout=2", "--interval=10ms", "--any")
+	never := createCountedCondition("never", 0, nil)
+	third := createCountedCondition("third", 3, nil)
+	if code := waitForConditions([]*waitCondition{never, third}, options); code != waitExitMet {
+		t.Errorf("--any gives exit code %d instead of %d", code, waitExitMet)
+	}
+
+	options = readTestWaitOptions(t, "--timeout=200ms", "--interval=10ms")
+	never = createCountedCondition("never", 0, nil)
+	third = createCountedCondition("third", 3, nil)
+	if code := waitForConditions([]*waitCondition{never, third}, options); code != waitExitTimeout {
+		t.Errorf("all conditions give exit code %d instead of %d", code, waitExitTimeout)
+	}
+	third = createCountedCondition("third", 3, nil)
+	if code := waitForConditions([]*waitCondition{createCountedCondition("second", 2, nil), third}, options); code != waitExitMet {
+		t.Errorf("the met conditions give exit code %d instead of %d", code, waitExitMet)
+	}
+}
+
+func TestWaitBackoffInterval(t *testing.T) {
+	options := readTestWaitOptions(t, "--interval=20ms", "--backoff=2", "--max-interval=80ms")
+	interval := options.interval
+	for _, expected := range []time.Duration{40 * time.Millisecond, 80 * time.Millisecond, 80 * time.Millisecond} {
+		if interval = nextWaitInterval(interval, options); interval != expected {
+			t.Errorf("the interval is %s instead of %s", interval, expected)
+		}
+	}
+	if options = readTestWaitOptions(t, "--interval=2s", "--max-interval=1s"); options.maxInterval != options.interval {
+		t.Errorf("the longest pause %s is less than the interval %s", options.maxInterval, options.interval)
+	}
+	if _, _, err := readWaitOptions([]string{"--backoff=0.5"}); err == nil {
+		t.Error("the backoff less than 1 is accepted")
+	}
+
+	// the pauses between the checks are not shorter than 20ms, 40ms, 80ms and 80ms
+	var times []time.Time
+	options = readTestWaitOptions(t, "--timeout=10", "--interval=20ms", "--backoff=2", "--max-interval=80ms")
+	if code := waitForConditions([]*waitCondition{createCountedCondition("fifth", 5, &times)}, options); code != waitExitMet || len(times) != 5 {
+		t.Fatalf("exit code %d after %d checks", code, len(times))
+	}
+	for i, expected := range []time.Duration{20, 40, 80, 80} {
+		if pause := times[i+1].Sub(times[i]); pause < expected*time.Millisecond {
+			t.Errorf("the pause %d is %s instead of %dms", i+1, pause, expected)
+		}
+	}
+	if total := times[4].Sub(times[0]); total >= 2*time.Second {
+		t.Errorf("the pauses took %s", total)
+	}
+}
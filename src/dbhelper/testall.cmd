@@ -0,0 +1,10 @@
+go test m2mtoken.go m2mtokencache.go m2mtokeninspect.go dvnettls.go dvnettls_test.go m2mtoken_test.go m2mtokencache_test.go
+go test dvnetwork.go dvnetassert.go dvnetreport.go dvnetextract.go dvnetload.go dvnetcurl.go dvnetbody.go dvnettls.go dvnettls_test.go dvnetload_test.go dvnetcurl_test.go
+go test dvreaddcparams.go dvreaddcenv.go dvreaddcworkload.go dvreaddchelm.go dvreaddcoffline.go dvreaddcdrift.go dvreaddcparams_test.go
+go test dvsecret.go dvsecretexport.go dvsecretrestore.go dvsecretcrypt.go dvsecretcrypt_test.go dvsecretexport_test.go dvsecretrestore_test.go
+go test gitinfo.go gitinforead.go gitinfostamp.go gitinfoartifact.go gitinfoartifact_test.go gitinfo_test.go gitinfostamp_test.go gitinforead_test.go
+go test m2mcredentials.go m2mcredentials_test.go
+go test ocdbaas.go ocdbaasformat.go ocdbaascheck.go ocdbaasscram.go ocdbaasmongo.go dvnettls.go dvnettls_test.go ocdbaascheck_test.go ocdbaasformat_test.go
+go test sleep.go sleepcondition.go sleepcmd_windows.go dvnettls.go sleepcondition_test.go
+go test dvenvironment.go dvsecretcrypt.go dvsecretcrypt_test.go dvenvironment_test.go
+go test dvoidc.go dvoidctoken.go dvoidcserver.go dvoidcserver_test.go